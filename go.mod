@@ -8,6 +8,8 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/jdeng/goheif v0.0.0-20200323230657-a0d6a8b3e68f
 	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	go.mongodb.org/mongo-driver v1.7.4
 	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
@@ -0,0 +1,123 @@
+package imageServer
+
+import (
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// Conversion requests refer to assets by name, so names are kept simple
+var assetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Reads an uploaded asset from the form. The form's "name" value is the name
+// that conversion requests use and fileField is the name of the file. The
+// file's content is checked with validate before anything is saved.
+func (ic *ImageController) addUploadedAsset(ctx *gin.Context, kind dbController.AssetKind, fileField string, validate func([]byte) error) (string, error) {
+	name := ctx.PostForm("name")
+
+	if !assetNamePattern.MatchString(name) {
+		return "", dbController.NewInvalidInputError("invalid " + string(kind) + " name")
+	}
+
+	file, fileHeader, fileErr := ctx.Request.FormFile(fileField)
+
+	if fileErr != nil {
+		return "", dbController.NewInvalidInputError("missing " + string(kind) + " file")
+	}
+	defer file.Close()
+
+	fileBytes, fileBytesErr := ioutil.ReadAll(file)
+	if fileBytesErr != nil {
+		return "", fileBytesErr
+	}
+
+	if err := validate(fileBytes); err != nil {
+		return "", err
+	}
+
+	doc := dbController.AddAssetDocument{
+		Kind:      kind,
+		Name:      name,
+		Filename:  fileHeader.Filename,
+		Sha256:    imageHandler.HashBytes(fileBytes),
+		FileSize:  len(fileBytes),
+		AuthorId:  ctx.GetString("userId"),
+		DateAdded: time.Now(),
+	}
+
+	return ic.addAsset(doc, fileBytes)
+}
+
+// Writes the asset's file, unless a file with the same content is already
+// stored, then saves the asset to the database. The file is removed again if
+// this request wrote it and the database write fails.
+func (ic *ImageController) addAsset(doc dbController.AddAssetDocument, fileBytes []byte) (string, error) {
+	storageName := dbController.AssetDocument{Kind: doc.Kind, Sha256: doc.Sha256}.GetStorageName()
+
+	// The file stays locked until the asset is saved, like the files of images
+	unlock := ic.blobLocks.Lock(storageName)
+	defer unlock()
+
+	written := false
+	_, statErr := ic.FileStore.Stat(storageName)
+
+	if _, notFound := statErr.(imageHandler.FileNotFoundError); notFound {
+		if err := ic.FileStore.Put(storageName, fileBytes); err != nil {
+			return "", err
+		}
+
+		written = true
+	} else if statErr != nil {
+		return "", statErr
+	}
+
+	id, err := (*ic.DBController).AddAsset(doc)
+
+	if err != nil {
+		if written {
+			ic.FileStore.Delete(storageName)
+		}
+
+		return "", err
+	}
+
+	ic.restoreMissingFiles([]string{storageName}, func(string) ([]byte, error) {
+		return fileBytes, nil
+	})
+
+	return id, nil
+}
+
+// Removes the asset from the database before deleting its file, like image
+// files. The files of images that used the asset keep it, but transforming
+// such an image makes its files again without the asset. TransformImage logs
+// the assets that were left out.
+func (ic *ImageController) deleteAsset(delDoc dbController.DeleteAssetDocument) error {
+	asset, err := (*ic.DBController).DeleteAsset(delDoc)
+
+	if err != nil {
+		return err
+	}
+
+	return ic.deleteStoredFile(asset.Sha256, asset.GetStorageName())
+}
+
+// Returns the file of the asset that a conversion request refers to by name
+func (ic *ImageController) getAssetFile(kind dbController.AssetKind, name string) ([]byte, error) {
+	asset, err := (*ic.DBController).GetAssetByName(kind, name)
+
+	if err != nil {
+		if _, noResults := err.(dbController.NoResultsError); noResults {
+			return nil, imageHandler.NewMissingAssetError("unknown " + string(kind) + ": " + name)
+		}
+
+		return nil, err
+	}
+
+	return ic.FileStore.Get(asset.GetStorageName())
+}
@@ -0,0 +1,84 @@
+package imageServer
+
+import (
+	"sort"
+	"sync"
+)
+
+// Serializes the writes and deletes of content-addressed files. Stored files
+// are shared by every image file and asset with the same digest, so checking
+// whether a file is referenced, then writing or deleting it, must not overlap
+// with another request doing the same for that file. The locks only cover
+// this process. Instances that share a file store rely on deletes checking
+// for references again after the file is removed, and on saves writing files
+// that went missing, see removeUnreferencedFile and restoreMissingFiles.
+type blobLocks struct {
+	mutex sync.Mutex
+	locks map[string]*blobLock
+}
+
+type blobLock struct {
+	mutex sync.Mutex
+	users int
+}
+
+func makeBlobLocks() *blobLocks {
+	return &blobLocks{
+		locks: make(map[string]*blobLock),
+	}
+}
+
+// Locks every named file and returns a function that unlocks them. The names
+// are locked in order, so two requests that share files can't deadlock.
+func (bl *blobLocks) Lock(names ...string) func() {
+	sorted := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			sorted = append(sorted, name)
+		}
+	}
+
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		bl.acquire(name).mutex.Lock()
+	}
+
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			bl.release(sorted[i])
+		}
+	}
+}
+
+// Returns the lock for the name. Locks are removed once nobody uses them.
+func (bl *blobLocks) acquire(name string) *blobLock {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	lock, ok := bl.locks[name]
+	if !ok {
+		lock = &blobLock{}
+		bl.locks[name] = lock
+	}
+
+	lock.users++
+
+	return lock
+}
+
+func (bl *blobLocks) release(name string) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	lock := bl.locks[name]
+	lock.mutex.Unlock()
+
+	lock.users--
+	if lock.users == 0 {
+		delete(bl.locks, name)
+	}
+}
@@ -0,0 +1,48 @@
+package imageServer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlobLocksRepeatedNames(t *testing.T) {
+	bl := makeBlobLocks()
+
+	unlock := bl.Lock("b", "a", "b")
+	unlock()
+
+	if len(bl.locks) != 0 {
+		t.Fatalf("len(locks) = '%v', Should be '0'", len(bl.locks))
+	}
+}
+
+func TestBlobLocksBlockSharedNames(t *testing.T) {
+	bl := makeBlobLocks()
+	unlock := bl.Lock("a", "b")
+
+	locked := make(chan bool)
+	go func() {
+		bl.Lock("c")()
+		locked <- true
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("a name that isn't locked should not block")
+	}
+
+	go func() {
+		bl.Lock("b", "c")()
+		locked <- true
+	}()
+
+	select {
+	case <-locked:
+		t.Fatalf("a locked name should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+}
@@ -0,0 +1,192 @@
+package imageServer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/mongoDbController"
+)
+
+// RunCommand runs a maintenance command instead of starting the server. args
+// are the command line arguments after the program name, e.g. "migrate".
+func RunCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no command provided")
+	}
+
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "check-consistency":
+		return runCheckConsistencyCommand(args[1:])
+	case "reshard":
+		return runReshardCommand(args[1:])
+	case "backfill-placeholders":
+		return runBackfillPlaceholdersCommand(args[1:])
+	default:
+		return errors.New("unknown command: " + args[0])
+	}
+}
+
+// Applies pending MongoDB migrations. With -status, only the database's and
+// the binary's schema versions are printed.
+func runMigrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := flags.Bool("status", false, "print the schema versions without migrating")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dbType := os.Getenv(constants.DB_TYPE)
+	if dbType != "" && dbType != "mongodb" {
+		return errors.New("migrations are only used with MongoDB. The " + dbType + " database is updated at startup")
+	}
+
+	mdbc, err := mongoDbController.MakeMongoDbController(constants.IMAGE_DB_NAME)
+	if err != nil {
+		return err
+	}
+
+	version, err := mdbc.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Database schema version: %v\n", version)
+	fmt.Printf("Latest schema version: %v\n", mongoDbController.LatestSchemaVersion())
+
+	if *status {
+		return nil
+	}
+
+	applied, err := mdbc.RunMigrations()
+
+	for _, v := range applied {
+		fmt.Printf("Applied migration %v\n", v)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("No migrations to apply")
+	}
+
+	fmt.Println("Validators synced with the current schemas")
+
+	return nil
+}
+
+// Compares the file store with the database and prints the results. Orphaned
+// files are quarantined or deleted with -action.
+func runCheckConsistencyCommand(args []string) error {
+	flags := flag.NewFlagSet("check-consistency", flag.ContinueOnError)
+	action := flags.String("action", "report", "what to do with orphaned files: report, quarantine or delete")
+	minAge := flags.Duration("min-age", DEFAULT_ORPHAN_MIN_AGE, "only quarantine or delete orphans older than this")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	orphanAction, err := ParseOrphanAction(*action)
+	if err != nil {
+		return err
+	}
+
+	if *minAge < 0 {
+		return errors.New("min-age must not be negative")
+	}
+
+	dbc, err := makeAndInitDatabase()
+	if err != nil {
+		return err
+	}
+
+	fileStore, err := makeFileStore(dbc)
+	if err != nil {
+		return err
+	}
+
+	ic := InitController(&dbc, fileStore)
+
+	report, err := ic.CheckConsistency(ConsistencyOptions{
+		Action: orphanAction,
+		MinAge: *minAge,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	report.Print()
+
+	return nil
+}
+
+// Moves the files of the local file store into the sub folders for the
+// current IMAGE_SUB_PATH_LENGTH. The server can keep running while this runs.
+func runReshardCommand(args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ContinueOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fileStore := os.Getenv(constants.FILE_STORE)
+	if fileStore != "" && fileStore != "local" {
+		return errors.New("resharding is only used with the local file store")
+	}
+
+	store, err := imageHandler.MakeLocalFileStore()
+	if err != nil {
+		return err
+	}
+
+	if !store.NeedsReshard() {
+		fmt.Println("Files are already saved with the current sub path length")
+		return nil
+	}
+
+	fmt.Printf("Moving files from sub path length %v to %v\n", store.PreviousSubPathLength, store.SubPathLength)
+
+	moved, err := store.Reshard()
+
+	fmt.Printf("Moved %v files\n", moved)
+
+	return err
+}
+
+// Adds the BlurHash and LQIP placeholders to images that were uploaded before
+// placeholders existed. Images that already have them are skipped, so the
+// command can run again after errors.
+func runBackfillPlaceholdersCommand(args []string) error {
+	flags := flag.NewFlagSet("backfill-placeholders", flag.ContinueOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dbc, err := makeAndInitDatabase()
+	if err != nil {
+		return err
+	}
+
+	fileStore, err := makeFileStore(dbc)
+	if err != nil {
+		return err
+	}
+
+	ic := InitController(&dbc, fileStore)
+
+	report, err := ic.BackfillPlaceholders()
+
+	report.Print()
+
+	return err
+}
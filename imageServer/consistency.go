@@ -0,0 +1,317 @@
+package imageServer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// Orphans are quarantined by renaming them with this prefix. Quarantined files
+// are ignored by later checks and can be restored by removing the prefix.
+const QUARANTINE_PREFIX = "quarantine-"
+
+// Files are written before their image files are saved to the database, so a
+// file that was just written looks like an orphan. We only quarantine or
+// delete orphans that are older than this.
+const DEFAULT_ORPHAN_MIN_AGE = time.Hour
+
+// What the consistency check does with orphaned files
+type OrphanAction int
+
+const (
+	ReportOrphans OrphanAction = iota
+	QuarantineOrphans
+	DeleteOrphans
+)
+
+func ParseOrphanAction(action string) (OrphanAction, error) {
+	switch strings.ToLower(action) {
+	case "", "report":
+		return ReportOrphans, nil
+	case "quarantine":
+		return QuarantineOrphans, nil
+	case "delete":
+		return DeleteOrphans, nil
+	default:
+		return ReportOrphans, dbController.NewInvalidInputError("invalid orphan action: " + action)
+	}
+}
+
+type ConsistencyOptions struct {
+	Action OrphanAction
+	MinAge time.Duration
+}
+
+// An image file whose stored file doesn't have the size saved in the database
+type SizeMismatch struct {
+	ImageFile  dbController.ImageFileDocument
+	StoredSize int64
+}
+
+// The result of comparing the file store with the image files in the database.
+// Orphans are stored files that no image file refers to. Missing are image
+// files whose stored file doesn't exist. Quarantined and Deleted are the
+// orphans that were acted on. Errors holds problems with individual orphans,
+// which don't stop the check.
+type ConsistencyReport struct {
+	FilesScanned      int
+	ImageFilesScanned int
+	Orphans           []imageHandler.FileInfo
+	Missing           []dbController.ImageFileDocument
+	SizeMismatches    []SizeMismatch
+	Quarantined       []string
+	Deleted           []string
+	Errors            []string
+}
+
+func (cr ConsistencyReport) GetMap() map[string]interface{} {
+	orphans := make([]map[string]interface{}, 0)
+	for _, orphan := range cr.Orphans {
+		orphans = append(orphans, map[string]interface{}{
+			"filename": orphan.Filename,
+			"size":     orphan.Size,
+			"modTime":  orphan.ModTime,
+		})
+	}
+
+	missing := make([]map[string]interface{}, 0)
+	for _, imgFile := range cr.Missing {
+		missing = append(missing, map[string]interface{}{
+			"id":          imgFile.Id,
+			"imageId":     imgFile.ImageId,
+			"filename":    imgFile.Filename,
+			"storageName": imgFile.GetStorageName(),
+		})
+	}
+
+	mismatches := make([]map[string]interface{}, 0)
+	for _, mismatch := range cr.SizeMismatches {
+		mismatches = append(mismatches, map[string]interface{}{
+			"id":          mismatch.ImageFile.Id,
+			"filename":    mismatch.ImageFile.Filename,
+			"storageName": mismatch.ImageFile.GetStorageName(),
+			"fileSize":    mismatch.ImageFile.FileSize,
+			"storedSize":  mismatch.StoredSize,
+		})
+	}
+
+	return map[string]interface{}{
+		"filesScanned":      cr.FilesScanned,
+		"imageFilesScanned": cr.ImageFilesScanned,
+		"orphans":           orphans,
+		"missing":           missing,
+		"sizeMismatches":    mismatches,
+		"quarantined":       cr.Quarantined,
+		"deleted":           cr.Deleted,
+		"errors":            cr.Errors,
+	}
+}
+
+// Compares the files in the file store with the image files in the database.
+// The file store must implement WalkableFileStore.
+func (ic *ImageController) CheckConsistency(opts ConsistencyOptions) (ConsistencyReport, error) {
+	report := ConsistencyReport{
+		Orphans:        make([]imageHandler.FileInfo, 0),
+		Missing:        make([]dbController.ImageFileDocument, 0),
+		SizeMismatches: make([]SizeMismatch, 0),
+		Quarantined:    make([]string, 0),
+		Deleted:        make([]string, 0),
+		Errors:         make([]string, 0),
+	}
+
+	walkable, ok := ic.FileStore.(imageHandler.WalkableFileStore)
+
+	if !ok {
+		return report, errors.New("the file store can't list its files")
+	}
+
+	// We list the files before the image files. A file that is written in
+	// between then only looks like an orphan, which MinAge guards against.
+	stored := make(map[string]imageHandler.FileInfo)
+
+	err := walkable.Walk(func(info imageHandler.FileInfo) error {
+		if !strings.HasPrefix(info.Filename, QUARANTINE_PREFIX) {
+			stored[info.Filename] = info
+		}
+		return nil
+	})
+
+	if err != nil {
+		return report, err
+	}
+
+	imgFiles, err := (*ic.DBController).GetAllImageFiles()
+
+	if err != nil {
+		return report, err
+	}
+
+	assets, err := (*ic.DBController).GetAssets("")
+
+	if err != nil {
+		return report, err
+	}
+
+	sources, err := (*ic.DBController).GetImageSources()
+
+	if err != nil {
+		return report, err
+	}
+
+	report.FilesScanned = len(stored)
+	report.ImageFilesScanned = len(imgFiles)
+
+	// Asset and source files are stored next to image files, so they aren't
+	// orphans
+	referenced := make(map[string]bool)
+	for _, asset := range assets {
+		referenced[asset.GetStorageName()] = true
+	}
+
+	for _, source := range sources {
+		referenced[source.GetStorageName()] = true
+	}
+
+	for _, imgFile := range imgFiles {
+		storageName := imgFile.GetStorageName()
+		referenced[storageName] = true
+
+		info, ok := stored[storageName]
+
+		if !ok {
+			report.Missing = append(report.Missing, imgFile)
+		} else if info.Size != int64(imgFile.FileSize) {
+			report.SizeMismatches = append(report.SizeMismatches, SizeMismatch{imgFile, info.Size})
+		}
+	}
+
+	for filename, info := range stored {
+		if !referenced[filename] {
+			report.Orphans = append(report.Orphans, info)
+		}
+	}
+
+	if opts.Action == ReportOrphans {
+		return report, nil
+	}
+
+	for _, orphan := range report.Orphans {
+		// Files with an unknown modification time are treated as old enough
+		if !orphan.ModTime.IsZero() && time.Since(orphan.ModTime) < opts.MinAge {
+			continue
+		}
+
+		if err := ic.handleOrphan(orphan.Filename, opts.Action); err != nil {
+			report.Errors = append(report.Errors, orphan.Filename+": "+err.Error())
+			continue
+		}
+
+		if opts.Action == QuarantineOrphans {
+			report.Quarantined = append(report.Quarantined, orphan.Filename)
+		} else {
+			report.Deleted = append(report.Deleted, orphan.Filename)
+		}
+	}
+
+	return report, nil
+}
+
+// Quarantines or deletes an orphan. An image file may have been saved since we
+// listed the image files, so we check for a reference again first. The file is
+// locked like it is when an image file is saved or deleted, and it's put back
+// if another instance saves a reference to it meanwhile.
+func (ic *ImageController) handleOrphan(filename string, action OrphanAction) error {
+	unlock := ic.blobLocks.Lock(filename)
+	defer unlock()
+
+	isReferenced := func() (bool, error) { return ic.fileIsReferenced(filename) }
+
+	removed, err := ic.removeUnreferencedFile(filename, isReferenced, action == QuarantineOrphans)
+
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return errors.New("file is referenced by an image file")
+	}
+
+	return nil
+}
+
+// Content-addressed files are referenced by digest, all other files by
+// filename. Assets are always content-addressed.
+func (ic *ImageController) fileIsReferenced(filename string) (bool, error) {
+	sha256 := strings.TrimSuffix(filename, path.Ext(filename))
+
+	if isSha256(sha256) {
+		count, err := ic.countSha256References(sha256)
+		return count > 0, err
+	}
+
+	_, err := (*ic.DBController).GetImageByName(filename)
+
+	if err == nil {
+		return true, nil
+	}
+
+	if _, noResults := err.(dbController.NoResultsError); noResults {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func isSha256(value string) bool {
+	if len(value) != 64 {
+		return false
+	}
+
+	for _, c := range value {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Prints a summary of the report, used by the check-consistency command
+func (cr ConsistencyReport) Print() {
+	fmt.Printf("Files scanned: %v\n", cr.FilesScanned)
+	fmt.Printf("Image files scanned: %v\n", cr.ImageFilesScanned)
+
+	for _, orphan := range cr.Orphans {
+		fmt.Printf("Orphan: %v (%v bytes)\n", orphan.Filename, orphan.Size)
+	}
+
+	for _, imgFile := range cr.Missing {
+		fmt.Printf("Missing: %v (image file %v, stored as %v)\n", imgFile.Filename, imgFile.Id, imgFile.GetStorageName())
+	}
+
+	for _, mismatch := range cr.SizeMismatches {
+		fmt.Printf(
+			"Size mismatch: %v is %v bytes, should be %v bytes\n",
+			mismatch.ImageFile.GetStorageName(),
+			mismatch.StoredSize,
+			mismatch.ImageFile.FileSize,
+		)
+	}
+
+	for _, name := range cr.Quarantined {
+		fmt.Printf("Quarantined: %v\n", name)
+	}
+
+	for _, name := range cr.Deleted {
+		fmt.Printf("Deleted: %v\n", name)
+	}
+
+	for _, msg := range cr.Errors {
+		fmt.Printf("Error: %v\n", msg)
+	}
+}
@@ -0,0 +1,184 @@
+package imageServer
+
+import (
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/memoryDbController"
+)
+
+// Makes a controller with one image with three files. The thumb file is
+// correct, the web file is missing and the large file has the wrong size. The
+// store also holds an orphaned file.
+func makeConsistencyTestController(t *testing.T) ImageController {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := imageHandler.MakeMemoryFileStore()
+
+	ic := InitController(&dbc, store)
+
+	thumb := []byte("thumb")
+	large := []byte("large")
+
+	formats := []imageHandler.ImageSizeFormat{
+		{FormatName: "thumb", Filename: "abc@thumb.jpg", FileSize: len(thumb), ImageType: imageHandler.Jpeg, Sha256: imageHandler.HashBytes(thumb)},
+		{FormatName: "web", Filename: "abc@web.jpg", FileSize: 3, ImageType: imageHandler.Jpeg},
+		{FormatName: "large", Filename: "abc@large.jpg", FileSize: 100, ImageType: imageHandler.Jpeg},
+	}
+
+	store.Put(formats[0].GetStorageName(), thumb)
+	store.Put(formats[2].GetStorageName(), large)
+	store.Put("orphan.jpg", []byte("orphan"))
+
+	_, err := dbc.AddImageData(dbController.AddImageDocument{
+		Title:       "test",
+		Filename:    "test.jpg",
+		IdName:      "abc",
+		SizeFormats: formats,
+		DateAdded:   time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	return ic
+}
+
+func TestCheckConsistencyReport(t *testing.T) {
+	ic := makeConsistencyTestController(t)
+
+	report, err := ic.CheckConsistency(ConsistencyOptions{Action: ReportOrphans})
+
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error '%v'", err)
+	}
+
+	if report.FilesScanned != 3 || report.ImageFilesScanned != 3 {
+		t.Fatalf("scanned = '%v, %v', Should be '3, 3'", report.FilesScanned, report.ImageFilesScanned)
+	}
+
+	if len(report.Orphans) != 1 || report.Orphans[0].Filename != "orphan.jpg" {
+		t.Fatalf("report.Orphans = '%v', Should be 'orphan.jpg'", report.Orphans)
+	}
+
+	if len(report.Missing) != 1 || report.Missing[0].Filename != "abc@web.jpg" {
+		t.Fatalf("report.Missing = '%v', Should be 'abc@web.jpg'", report.Missing)
+	}
+
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0].StoredSize != 5 {
+		t.Fatalf("report.SizeMismatches = '%v', Should be 'abc@large.jpg'", report.SizeMismatches)
+	}
+
+	if _, err := ic.FileStore.Stat("orphan.jpg"); err != nil {
+		t.Fatalf("orphans should only be reported")
+	}
+}
+
+func TestCheckConsistencyQuarantine(t *testing.T) {
+	ic := makeConsistencyTestController(t)
+
+	report, err := ic.CheckConsistency(ConsistencyOptions{Action: QuarantineOrphans})
+
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error '%v'", err)
+	}
+
+	if len(report.Quarantined) != 1 {
+		t.Fatalf("len(report.Quarantined) = '%v', Should be '1'", len(report.Quarantined))
+	}
+
+	if _, err := ic.FileStore.Stat(QUARANTINE_PREFIX + "orphan.jpg"); err != nil {
+		t.Fatalf("orphan.jpg should be quarantined")
+	}
+
+	// Quarantined files are not reported again
+	report, _ = ic.CheckConsistency(ConsistencyOptions{Action: ReportOrphans})
+
+	if len(report.Orphans) != 0 {
+		t.Fatalf("len(report.Orphans) = '%v', Should be '0'", len(report.Orphans))
+	}
+}
+
+func TestCheckConsistencyDelete(t *testing.T) {
+	ic := makeConsistencyTestController(t)
+
+	// The orphan was just written, so it's too new to delete
+	report, _ := ic.CheckConsistency(ConsistencyOptions{Action: DeleteOrphans, MinAge: time.Hour})
+
+	if len(report.Deleted) != 0 {
+		t.Fatalf("len(report.Deleted) = '%v', Should be '0'", len(report.Deleted))
+	}
+
+	report, _ = ic.CheckConsistency(ConsistencyOptions{Action: DeleteOrphans})
+
+	if len(report.Deleted) != 1 {
+		t.Fatalf("len(report.Deleted) = '%v', Should be '1'", len(report.Deleted))
+	}
+
+	if _, err := ic.FileStore.Stat("orphan.jpg"); err == nil {
+		t.Fatalf("orphan.jpg should be deleted")
+	}
+}
+
+func TestParseOrphanAction(t *testing.T) {
+	action, err := ParseOrphanAction("Quarantine")
+
+	if err != nil || action != QuarantineOrphans {
+		t.Fatalf("action = '%v', Should be '%v'", action, QuarantineOrphans)
+	}
+
+	if _, err := ParseOrphanAction("archive"); err == nil {
+		t.Fatalf("ParseOrphanAction should return an error for an unknown action")
+	}
+}
+
+func TestCheckConsistencyKeepsAssetFiles(t *testing.T) {
+	ic := makeConsistencyTestController(t)
+
+	_, err := ic.addAsset(dbController.AddAssetDocument{
+		Kind:   dbController.WatermarkAsset,
+		Name:   "logo",
+		Sha256: imageHandler.HashBytes([]byte("logo")),
+	}, []byte("logo"))
+
+	if err != nil {
+		t.Fatalf("addAsset returned error '%v'", err)
+	}
+
+	report, err := ic.CheckConsistency(ConsistencyOptions{Action: DeleteOrphans})
+
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error '%v'", err)
+	}
+
+	if len(report.Orphans) != 1 || report.Orphans[0].Filename != "orphan.jpg" {
+		t.Fatalf("orphans = '%v', Should only be 'orphan.jpg'", report.Orphans)
+	}
+}
+
+func TestCheckConsistencyKeepsSourceFiles(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	ic := InitController(&dbc, imageHandler.MakeMemoryFileStore())
+
+	id, formats := addPngImage(t, ic)
+
+	if err := ic.TransformImage(TransformImageBody{Id: id, Rotate: 90}); err != nil {
+		t.Fatalf("TransformImage returned error '%v'", err)
+	}
+
+	report, err := ic.CheckConsistency(ConsistencyOptions{Action: DeleteOrphans})
+
+	if err != nil {
+		t.Fatalf("CheckConsistency returned error '%v'", err)
+	}
+
+	if len(report.Orphans) != 0 {
+		t.Fatalf("orphans = '%v', Should be empty", report.Orphans)
+	}
+
+	if _, err := ic.FileStore.Stat(formats[0].GetStorageName()); err != nil {
+		t.Fatalf("the source '%v' should be kept", formats[0].GetStorageName())
+	}
+}
@@ -4,11 +4,29 @@ const GOOGLE_APPLICATION_CREDENTIALS = "GOOGLE_APPLICATION_CREDENTIALS"
 const FIREBASE_AUTH_EMULATOR_HOST = "FIREBASE_AUTH_EMULATOR_HOST"
 
 const IMAGE_DB_NAME = "imageDb"
+const DB_TYPE = "DB_TYPE"
+const SQL_DSN = "SQL_DSN"
 const GIN_MODE = "GIN_MODE"
 
 const MONGO_DB_URL = "MONGO_DB_URL"
 const MONGO_DB_USERNAME = "MONGO_DB_USERNAME"
 const MONGO_DB_PASSWORD = "MONGO_DB_PASSWORD"
+const MONGO_DB_URI = "MONGO_DB_URI"
+const MONGO_DB_HOST = "MONGO_DB_HOST"
+const MONGO_DB_PORT = "MONGO_DB_PORT"
+const MONGO_DB_AUTH_SOURCE = "MONGO_DB_AUTH_SOURCE"
+const MONGO_DB_AUTH_MECHANISM = "MONGO_DB_AUTH_MECHANISM"
+const MONGO_DB_REPLICA_SET = "MONGO_DB_REPLICA_SET"
+const MONGO_DB_TLS = "MONGO_DB_TLS"
+const MONGO_DB_TLS_CA_FILE = "MONGO_DB_TLS_CA_FILE"
+const MONGO_DB_TLS_CERT_KEY_FILE = "MONGO_DB_TLS_CERT_KEY_FILE"
+const MONGO_DB_TLS_INSECURE = "MONGO_DB_TLS_INSECURE"
+const MONGO_DB_CONNECT_TIMEOUT = "MONGO_DB_CONNECT_TIMEOUT"
+const MONGO_DB_OPERATION_TIMEOUT = "MONGO_DB_OPERATION_TIMEOUT"
+const MONGO_DB_MAX_POOL_SIZE = "MONGO_DB_MAX_POOL_SIZE"
+const MONGO_DB_MIN_POOL_SIZE = "MONGO_DB_MIN_POOL_SIZE"
+const MONGO_DB_MAX_CONN_IDLE_TIME = "MONGO_DB_MAX_CONN_IDLE_TIME"
+const MONGO_DB_AUTO_MIGRATE = "MONGO_DB_AUTO_MIGRATE"
 
 const USER_ADMIN = "admin"
 const USER_EDITOR = "editor"
@@ -19,10 +37,40 @@ const FILE_LOGGING_PATH = "FILE_LOGGING_PATH"
 const DB_LOGGING = "DB_LOGGING"
 const CONSOLE_LOGGING = "CONSOLE_LOGGING"
 
+const FILE_STORE = "FILE_STORE"
 const IMAGE_PATH = "IMAGE_PATH"
+
+const S3_BUCKET = "S3_BUCKET"
+const S3_PREFIX = "S3_PREFIX"
+const S3_ENDPOINT = "S3_ENDPOINT"
+const S3_REGION = "S3_REGION"
+const S3_ACCESS_KEY_ID = "S3_ACCESS_KEY_ID"
+const S3_SECRET_ACCESS_KEY = "S3_SECRET_ACCESS_KEY"
+const S3_USE_PATH_STYLE = "S3_USE_PATH_STYLE"
+const S3_SERVE_MODE = "S3_SERVE_MODE"
+const S3_PRESIGN_EXPIRY = "S3_PRESIGN_EXPIRY"
+
 const JPEG_QUALITY = "JPEG_QUALITY"
+const JPEG_MIN_QUALITY = "JPEG_MIN_QUALITY"
+const JPEG_MAX_QUALITY = "JPEG_MAX_QUALITY"
+const JPEG_SUBSAMPLING = "JPEG_SUBSAMPLING"
+const WEBP_QUALITY = "WEBP_QUALITY"
+const WEBP_MIN_QUALITY = "WEBP_MIN_QUALITY"
+const WEBP_MAX_QUALITY = "WEBP_MAX_QUALITY"
+const PNG_COMPRESSION = "PNG_COMPRESSION"
+const GIF_COLORS = "GIF_COLORS"
+const GIF_MIN_COLORS = "GIF_MIN_COLORS"
+const GIF_MAX_COLORS = "GIF_MAX_COLORS"
+const GIF_DITHER = "GIF_DITHER"
+const TIFF_COMPRESSION = "TIFF_COMPRESSION"
 const IMAGE_SUB_PATH_LENGTH = "IMAGE_SUB_PATH_LENGTH"
 const THUMBNAIL_SIZE = "THUMBNAIL_SIZE"
+const MAX_OUTPUT_DIMENSION = "MAX_OUTPUT_DIMENSION"
+const MAX_ANIMATION_PIXELS = "MAX_ANIMATION_PIXELS"
+const PUBLIC_METADATA_POLICY = "PUBLIC_METADATA_POLICY"
+const PUBLIC_METADATA_ALLOWLIST = "PUBLIC_METADATA_ALLOWLIST"
+const WATERMARK_PATH = "WATERMARK_PATH"
+const WATERMARK_SUFFIXES = "WATERMARK_SUFFIXES"
 
 const AUTH_TESTING_MODE = "AUTH_TESTING_MODE"
 const DEBUG_MODE = "DEBUG_MODE"
@@ -1,6 +1,7 @@
 package dbController
 
 import (
+	"methompson.com/image-microservice/imageServer/imageHandler"
 	"methompson.com/image-microservice/imageServer/logging"
 )
 
@@ -16,12 +17,54 @@ type DatabaseController interface {
 
 	ImageHasFiles(id string) (bool, error)
 
+	// Returns the number of image files whose content has the digest. The file
+	// stored under the digest can be deleted once no image files refer to it.
+	CountImageFilesWithSha256(sha256 string) (int, error)
+
+	// Returns every image file, including private files. Used to compare the
+	// database with the file store.
+	GetAllImageFiles() ([]ImageFileDocument, error)
+
+	// Returns the number of images whose source file has the digest. Sources
+	// are stored next to image files, like assets.
+	CountImageSourcesWithSha256(sha256 string) (int, error)
+
+	// Returns the sources of every transformed image. Used to compare the
+	// database with the file store.
+	GetImageSources() ([]imageHandler.ImageSource, error)
+
 	EditImageData(doc EditImageDocument) error
 	EditImageFileData(doc EditImageFileDocument) (EditImageFileResult, error)
 
+	// Updates the size, digest and encoding of an image's existing files. Every
+	// size format has to match one of the image's files. Returns a ConflictError
+	// if a file's digest isn't the one in PreviousSha256.
+	ReplaceImageFiles(doc ReplaceImageFilesDocument) error
+
+	// Sets the BlurHash and LQIP of an image. Used to add placeholders to images
+	// that were uploaded before placeholders existed.
+	SetImagePlaceholders(doc ImagePlaceholdersDocument) error
+
 	DeleteImage(doc DeleteImageDocument) error
 	DeleteImageFile(doc DeleteImageFileDocument) (ImageFileDocument, error)
 
+	// Assets are uploaded files that conversion operations use, like watermarks.
+	// Names are unique for each kind of asset. GetAssets returns the assets of
+	// every kind when kind is empty.
+	AddAsset(doc AddAssetDocument) (id string, err error)
+	GetAssets(kind AssetKind) ([]AssetDocument, error)
+	GetAssetByName(kind AssetKind, name string) (AssetDocument, error)
+	DeleteAsset(doc DeleteAssetDocument) (AssetDocument, error)
+
+	// Returns the number of assets whose file has the digest. Asset files are
+	// stored next to image files, so both counts have to be zero before the
+	// stored file is deleted.
+	CountAssetsWithSha256(sha256 string) (int, error)
+
+	// Returns the user with the UID. Users are used to get the author's name for
+	// images.
+	GetUserByUID(uid string) (UserDataDocument, error)
+
 	AddRequestLog(log logging.RequestLogData) error
 	AddInfoLog(log logging.InfoLogData) error
 }
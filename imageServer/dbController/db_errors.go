@@ -19,6 +19,13 @@ type DuplicateEntryError struct{ ErrMsg string }
 func (err DuplicateEntryError) Error() string { return err.ErrMsg }
 func NewDuplicateEntryError(msg string) error { return DuplicateEntryError{msg} }
 
+// Used to communicate that the data changed since it was read, so the change
+// that was based on it can't be saved
+type ConflictError struct{ ErrMsg string }
+
+func (err ConflictError) Error() string { return err.ErrMsg }
+func NewConflictError(msg string) error { return ConflictError{msg} }
+
 // Used to communicate that the value provided cannot be parsed or used
 type InvalidInputError struct{ ErrMsg string }
 
@@ -1,6 +1,7 @@
 package dbController
 
 import (
+	"context"
 	"strings"
 	"time"
 
@@ -23,14 +24,23 @@ type UserDataDocument struct {
 // SizeFormats represents the actual image files and metadata about each image, such as size and resolution
 // AuthorId is the id of the uploader of the image
 // DateAdded is the date when the image was uploaded
+// OriginalSha256 is the SHA-256 digest of the uploaded file
+// BlurHash and Lqip are placeholders that clients show while the image files load
+// Palette holds the dominant colors of the image, with the largest share first
+// OnTransaction is an optional function that runs inside of the transaction that saves the image, after the documents have been written. Returning an error aborts the transaction
 type AddImageDocument struct {
-	Title       string
-	Filename    string
-	IdName      string
-	Tags        []string
-	SizeFormats []imageHandler.ImageSizeFormat
-	AuthorId    string
-	DateAdded   time.Time
+	Title          string
+	Filename       string
+	IdName         string
+	Tags           []string
+	SizeFormats    []imageHandler.ImageSizeFormat
+	AuthorId       string
+	DateAdded      time.Time
+	OriginalSha256 string
+	BlurHash       string
+	Lqip           string
+	Palette        []imageHandler.PaletteColor
+	OnTransaction  func(ctx context.Context) error
 }
 
 // An image file result for when a user is accessing JUST an image file
@@ -44,6 +54,17 @@ type ImageFileDocument struct {
 	FileSize    int
 	Private     bool
 	ImageType   imageHandler.ImageType
+	Sha256      string
+	Crop        *imageHandler.CropRect
+	Encoding    *imageHandler.EncoderSettings
+	Capped      bool
+	Request     *imageHandler.ConversionRequest
+}
+
+// Returns the name of the file in the file store. Files are stored under their
+// SHA-256 digest, so several image files can share one stored file.
+func (ifd ImageFileDocument) GetStorageName() string {
+	return imageHandler.GetStorageName(ifd.Filename, ifd.Sha256, ifd.ImageType)
 }
 
 func (ifd ImageFileDocument) GetMimeType() string {
@@ -60,6 +81,8 @@ func (ifd ImageFileDocument) GetMimeType() string {
 		mimeType = "image/bmp"
 	case imageHandler.Tiff:
 		mimeType = "image/tiff"
+	case imageHandler.Webp:
+		mimeType = "image/webp"
 	default:
 		mimeType = "application/octet-stream"
 	}
@@ -78,19 +101,38 @@ func (ifd ImageFileDocument) GetMap() map[string]interface{} {
 	m["imageSize"] = ifd.ImageSize.GetMap()
 	m["imageType"] = ifd.GetMimeType()
 
+	if ifd.Crop != nil {
+		m["crop"] = ifd.Crop.GetMap()
+	}
+
+	if ifd.Encoding != nil {
+		m["encoding"] = ifd.Encoding.GetMap()
+	}
+
+	if ifd.Capped {
+		m["capped"] = ifd.Capped
+	}
+
 	return m
 }
 
+// Source is the file that the image files are made from after the image is
+// transformed. Images that were never transformed have none.
 type ImageDocument struct {
-	Id         string
-	Title      string
-	Filename   string
-	IdName     string
-	Tags       []string
-	ImageFiles []ImageFileDocument
-	Author     string
-	AuthorId   string
-	DateAdded  time.Time
+	Id             string
+	Title          string
+	Filename       string
+	IdName         string
+	Tags           []string
+	ImageFiles     []ImageFileDocument
+	Author         string
+	AuthorId       string
+	DateAdded      time.Time
+	OriginalSha256 string
+	BlurHash       string
+	Lqip           string
+	Palette        []imageHandler.PaletteColor
+	Source         *imageHandler.ImageSource
 }
 
 func (bd *ImageDocument) GetMap() map[string]interface{} {
@@ -104,6 +146,24 @@ func (bd *ImageDocument) GetMap() map[string]interface{} {
 	m["authorId"] = bd.AuthorId
 	m["dateAdded"] = bd.DateAdded.Unix()
 
+	// Images that were uploaded before placeholders existed may not have them
+	if len(bd.BlurHash) > 0 {
+		m["blurHash"] = bd.BlurHash
+	}
+
+	if len(bd.Lqip) > 0 {
+		m["lqip"] = bd.Lqip
+	}
+
+	if len(bd.Palette) > 0 {
+		palette := make([]map[string]interface{}, 0, len(bd.Palette))
+		for _, pc := range bd.Palette {
+			palette = append(palette, pc.GetMap())
+		}
+
+		m["palette"] = palette
+	}
+
 	if bd.Tags != nil {
 		m["tags"] = bd.Tags
 	} else {
@@ -141,6 +201,30 @@ func (eifd *EditImageFileDocument) ChangesExist() bool {
 	return eifd.ChangePrivate || eifd.ChangeObfuscate
 }
 
+// Replaces the content of an image's files after the image is edited. Each
+// size format updates the image file of the image with the same filename. The
+// image and image file ids don't change. The image's placeholders are replaced
+// too, unless BlurHash is empty. OnTransaction works like it does for
+// AddImageDocument. PreviousSha256 maps filenames to the digests the files had
+// when they were read. A file with another digest was changed in the meantime
+// and nothing is replaced. The image's source is replaced unless Source is nil.
+type ReplaceImageFilesDocument struct {
+	ImageId        string
+	SizeFormats    []imageHandler.ImageSizeFormat
+	PreviousSha256 map[string]string
+	Source         *imageHandler.ImageSource
+	BlurHash       string
+	Lqip           string
+	OnTransaction  func(ctx context.Context) error
+}
+
+// Sets the placeholders of an existing image
+type ImagePlaceholdersDocument struct {
+	Id       string
+	BlurHash string
+	Lqip     string
+}
+
 type EditImageFileResult struct {
 	OldName string
 	NewName string
@@ -168,6 +252,24 @@ type SortImageFilter struct {
 	Sortby      SortType
 	SearchBy    string
 	ShowPrivate bool
+	Color       *ColorFilter
+}
+
+// Matches images with a palette color within Distance of Color. Distance is
+// the CIE76 color difference.
+type ColorFilter struct {
+	Color    imageHandler.LabColor
+	Distance float64
+}
+
+func (cf ColorFilter) Matches(palette []imageHandler.PaletteColor) bool {
+	for _, pc := range palette {
+		if pc.Lab().Distance(cf.Color) <= cf.Distance {
+			return true
+		}
+	}
+
+	return false
 }
 
 func MakeSortImageFilter(sortByStr string) SortImageFilter {
@@ -189,3 +291,76 @@ func MakeSortImageFilter(sortByStr string) SortImageFilter {
 		SearchBy: "",
 	}
 }
+
+// The kinds of files that can be uploaded as assets
+type AssetKind string
+
+const (
+	WatermarkAsset AssetKind = "watermark"
+	FontAsset      AssetKind = "font"
+)
+
+// Returns the extension of the kind's stored files
+func (kind AssetKind) GetExtension() string {
+	switch kind {
+	case WatermarkAsset:
+		return "png"
+	case FontAsset:
+		return "ttf"
+	default:
+		return ""
+	}
+}
+
+// A struct representing a new asset
+// Kind is the kind of asset, e.g. a watermark
+// Name is the user provided name that conversion requests use to refer to the asset
+// Filename is the original file name of the file when uploaded
+// Sha256 is the SHA-256 digest of the file. The file is stored under this digest, like image files
+// FileSize is the size of the file in bytes
+// AuthorId is the id of the uploader of the asset
+// DateAdded is the date when the asset was uploaded
+type AddAssetDocument struct {
+	Kind      AssetKind
+	Name      string
+	Filename  string
+	Sha256    string
+	FileSize  int
+	AuthorId  string
+	DateAdded time.Time
+}
+
+type AssetDocument struct {
+	Id        string
+	Kind      AssetKind
+	Name      string
+	Filename  string
+	Sha256    string
+	FileSize  int
+	AuthorId  string
+	DateAdded time.Time
+}
+
+// Returns the name of the file in the file store. Assets are stored under their
+// SHA-256 digest, like image files.
+func (ad AssetDocument) GetStorageName() string {
+	return ad.Sha256 + "." + ad.Kind.GetExtension()
+}
+
+func (ad AssetDocument) GetMap() map[string]interface{} {
+	m := make(map[string]interface{})
+
+	m["id"] = ad.Id
+	m["kind"] = string(ad.Kind)
+	m["name"] = ad.Name
+	m["filename"] = ad.Filename
+	m["fileSize"] = ad.FileSize
+	m["authorId"] = ad.AuthorId
+	m["dateAdded"] = ad.DateAdded.Unix()
+
+	return m
+}
+
+type DeleteAssetDocument struct {
+	Id string
+}
@@ -105,3 +105,36 @@ func TestImageLocGetMap(t *testing.T) {
 	}
 
 }
+
+func TestImageDocumentGetMapPlaceholders(t *testing.T) {
+	imgDoc := ImageDocument{Id: "123", DateAdded: time.Now()}
+
+	if _, ok := imgDoc.GetMap()["blurHash"]; ok {
+		t.Fatalf("blurHash should be left out when the image has no placeholders")
+	}
+
+	imgDoc.BlurHash = "LEHV6nWB2yk8pyo0adR*.7kCMdnj"
+	imgDoc.Lqip = "data:image/jpeg;base64,abc"
+
+	m := imgDoc.GetMap()
+
+	if m["blurHash"] != imgDoc.BlurHash || m["lqip"] != imgDoc.Lqip {
+		t.Fatalf("m = '%v', Should have the placeholders", m)
+	}
+}
+
+func TestImageDocumentGetMapPalette(t *testing.T) {
+	imgDoc := ImageDocument{Id: "123", DateAdded: time.Now()}
+
+	if _, ok := imgDoc.GetMap()["palette"]; ok {
+		t.Fatalf("palette should be left out when the image has no palette")
+	}
+
+	imgDoc.Palette = []imageHandler.PaletteColor{{Color: "#1a2b3c", Percentage: 72.5}}
+
+	palette, ok := imgDoc.GetMap()["palette"].([]map[string]interface{})
+
+	if !ok || len(palette) != 1 || palette[0]["color"] != "#1a2b3c" || palette[0]["percentage"] != 72.5 {
+		t.Fatalf("palette = '%v', Should be '%v'", palette, imgDoc.Palette)
+	}
+}
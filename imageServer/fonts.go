@@ -0,0 +1,37 @@
+package imageServer
+
+import (
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/font/opentype"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+// Saves an uploaded font for text overlays. The form's "name" value is the name
+// that conversion requests use and the "font" file must be a TrueType or
+// OpenType font.
+func (ic *ImageController) AddFont(ctx *gin.Context) (string, error) {
+	return ic.addUploadedAsset(ctx, dbController.FontAsset, "font", func(fileBytes []byte) error {
+		if _, err := opentype.Parse(fileBytes); err != nil {
+			return dbController.NewInvalidInputError("fonts must be TrueType or OpenType files")
+		}
+
+		return nil
+	})
+}
+
+func (ic *ImageController) GetFonts() ([]dbController.AssetDocument, error) {
+	return (*ic.DBController).GetAssets(dbController.FontAsset)
+}
+
+// Images that already have text in the font keep it until they are
+// transformed, see deleteAsset
+func (ic *ImageController) DeleteFont(delDoc dbController.DeleteAssetDocument) error {
+	return ic.deleteAsset(delDoc)
+}
+
+// Implements imageHandler.FontSource for the fonts that text overlays refer to
+// by name
+func (ic *ImageController) GetFontFile(name string) ([]byte, error) {
+	return ic.getAssetFile(dbController.FontAsset, name)
+}
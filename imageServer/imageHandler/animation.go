@@ -0,0 +1,314 @@
+package imageHandler
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// The frames of an animated GIF. Each frame is composited over the frames
+// before it, following their disposal methods, so that every frame is a full
+// image that conversion operations can resize like a still image.
+type animation struct {
+	Frames    []*image.Image
+	Palettes  []color.Palette
+	Delays    []int
+	LoopCount int
+}
+
+// The largest frame count times canvas area of an animated GIF when
+// MAX_ANIMATION_PIXELS isn't set. Every frame is decoded into a full canvas,
+// so this caps the memory a small, highly compressed GIF file can use.
+const defaultMaxAnimationPixels = 100000000
+
+// Decodes every frame of a GIF file. Returns nil if the GIF only has one
+// frame. Returns an error before decoding any frame if the frame count times
+// the canvas area is larger than getMaxAnimationPixels.
+func decodeAnimation(data []byte) (*animation, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	frameCount, err := countGifFrames(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(frameCount)*uint64(config.Width)*uint64(config.Height) > getMaxAnimationPixels() {
+		return nil, errors.New("the animation has too many frames for its size")
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+
+	canvasBounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		canvasBounds = canvasBounds.Union(image.Rect(0, 0, frame.Bounds().Max.X, frame.Bounds().Max.Y))
+	}
+
+	anim := animation{
+		Frames:    make([]*image.Image, 0, len(g.Image)),
+		Palettes:  make([]color.Palette, 0, len(g.Image)),
+		Delays:    make([]int, 0, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	canvas := image.NewRGBA(canvasBounds)
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = copyRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		var full image.Image = copyRGBA(canvas)
+
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+
+		anim.Frames = append(anim.Frames, &full)
+		anim.Palettes = append(anim.Palettes, frame.Palette)
+		anim.Delays = append(anim.Delays, delay)
+
+		// The frame's area is cleared to transparent, which is what browsers do
+		// instead of using the background color
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return &anim, nil
+}
+
+// Counts the image descriptors of a GIF file by skipping over its blocks
+// without decompressing them.
+func countGifFrames(data []byte) (int, error) {
+	invalid := errors.New("gif: invalid file structure")
+
+	// Header and logical screen descriptor
+	pos := 13
+	if len(data) < pos {
+		return 0, invalid
+	}
+
+	if data[10]&0x80 != 0 {
+		pos += 3 << ((data[10] & 0x07) + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += size + 1
+			if size == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// Extension introducer and label
+			pos += 2
+			if !skipSubBlocks() {
+				return 0, invalid
+			}
+		case 0x2C:
+			// Image descriptor, local color table and LZW minimum code size
+			if pos+10 > len(data) {
+				return 0, invalid
+			}
+
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos++
+
+			if !skipSubBlocks() {
+				return 0, invalid
+			}
+			frames++
+		case 0x3B:
+			return frames, nil
+		default:
+			return 0, invalid
+		}
+	}
+
+	return 0, invalid
+}
+
+// Returns the frame at index. The last frame is returned if the animation has
+// fewer frames.
+func (anim *animation) frame(index int) *image.Image {
+	if index >= len(anim.Frames) {
+		index = len(anim.Frames) - 1
+	}
+
+	return anim.Frames[index]
+}
+
+// Transforms every frame and encodes the frames as an animated GIF. The frames
+// keep their delays. Every encoded frame covers the whole image, so each one
+// clears the frame before it. See framePalette for the frames' palettes.
+func (anim *animation) encode(transform func(*image.Image) *image.Image, settings EncoderSettings) ([]byte, ImageSize, error) {
+	output := gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(anim.Frames)),
+		Delay:     make([]int, 0, len(anim.Frames)),
+		Disposal:  make([]byte, 0, len(anim.Frames)),
+		LoopCount: anim.LoopCount,
+	}
+
+	var size ImageSize
+
+	for i, frame := range anim.Frames {
+		transformed := transform(frame)
+		bounds := (*transformed).Bounds()
+
+		if i == 0 {
+			size = GetImageSize(transformed)
+			output.Config = image.Config{Width: bounds.Dx(), Height: bounds.Dy()}
+		}
+
+		palette := framePalette(anim.Palettes[i], *transformed, settings.Colors)
+
+		paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+		settings.getGifDrawer().Draw(paletted, paletted.Bounds(), *transformed, bounds.Min)
+
+		output.Image = append(output.Image, paletted)
+		output.Delay = append(output.Delay, anim.Delays[i])
+		output.Disposal = append(output.Disposal, gif.DisposalBackground)
+	}
+
+	buffer := new(bytes.Buffer)
+
+	if err := gif.EncodeAll(buffer, &output); err != nil {
+		return nil, ImageSize{}, err
+	}
+
+	return buffer.Bytes(), size, nil
+}
+
+// Returns the palette for a transformed frame. The source frame's palette is
+// kept if it has every color of the frame and no more colors than the settings
+// allow, e.g. when the frame was only rotated. Filters, watermarks, text
+// overlays and resampling give frames new colors, so those frames get a
+// palette made from their own pixels: their exact colors if there are few
+// enough, otherwise a median cut palette. The median cut palette starts with
+// the source colors that are still in the frame, so flat areas that were only
+// resized keep their exact color.
+func framePalette(source color.Palette, img image.Image, maxColors int) color.Palette {
+	if maxColors <= 0 || maxColors > 256 {
+		maxColors = 256
+	}
+
+	sourceIndexes := make(map[[4]uint32]int, len(source))
+	for i, c := range source {
+		sourceIndexes[colorKey(c)] = i
+	}
+
+	inFrame := make([]bool, len(source))
+	onlySource := true
+
+	seen := make(map[[4]uint32]bool)
+	exact := make(color.Palette, 0, maxColors)
+	tooMany := false
+
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			key := colorKey(c)
+
+			if i, ok := sourceIndexes[key]; ok {
+				inFrame[i] = true
+			} else {
+				onlySource = false
+			}
+
+			if tooMany || seen[key] {
+				continue
+			}
+
+			if len(exact) == maxColors {
+				tooMany = true
+				continue
+			}
+
+			seen[key] = true
+
+			if key[3] == 0 {
+				exact = append(exact, color.RGBA{})
+			} else {
+				exact = append(exact, c)
+			}
+		}
+	}
+
+	if onlySource && len(source) <= maxColors {
+		return source
+	}
+
+	if !tooMany {
+		return exact
+	}
+
+	// At most half of the palette is kept for source colors, so the median cut
+	// has room for the new colors
+	palette := make(color.Palette, 0, maxColors)
+	for i, c := range source {
+		if inFrame[i] && len(palette) < maxColors/2 {
+			palette = append(palette, c)
+		}
+	}
+
+	return medianCutQuantizer{}.Quantize(palette, img)
+}
+
+func colorKey(c color.Color) [4]uint32 {
+	r, g, b, a := c.RGBA()
+
+	if a == 0 {
+		return [4]uint32{}
+	}
+
+	return [4]uint32{r, g, b, a}
+}
+
+func copyRGBA(img *image.RGBA) *image.RGBA {
+	result := image.NewRGBA(img.Bounds())
+	copy(result.Pix, img.Pix)
+
+	return result
+}
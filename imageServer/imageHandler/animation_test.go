@@ -0,0 +1,268 @@
+package imageHandler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+var testGifPalette = color.Palette{
+	color.RGBA{},
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{0, 255, 0, 255},
+	color.RGBA{0, 0, 255, 255},
+}
+
+func makeTestFrame(rect image.Rectangle, index uint8) *image.Paletted {
+	frame := image.NewPaletted(rect, testGifPalette)
+
+	for i := range frame.Pix {
+		frame.Pix[i] = index
+	}
+
+	return frame
+}
+
+// Makes a 40 x 20 GIF with a red first frame, a green square that's kept with
+// DisposalNone and a blue square that's drawn over the first two frames
+func makeTestAnimatedGif(t *testing.T) []byte {
+	g := gif.GIF{
+		Image: []*image.Paletted{
+			makeTestFrame(image.Rect(0, 0, 40, 20), 1),
+			makeTestFrame(image.Rect(0, 0, 10, 10), 2),
+			makeTestFrame(image.Rect(30, 10, 40, 20), 3),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalPrevious},
+		LoopCount: 0,
+		Config:    image.Config{Width: 40, Height: 20, ColorModel: testGifPalette},
+	}
+
+	buffer := new(bytes.Buffer)
+
+	if err := gif.EncodeAll(buffer, &g); err != nil {
+		t.Fatalf("gif.EncodeAll returned error '%v'", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func isGreen(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r == 0 && g == 0xffff && b == 0
+}
+
+func isBlue(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r == 0 && g == 0 && b == 0xffff
+}
+
+func TestDecodeAnimation(t *testing.T) {
+	anim, err := decodeAnimation(makeTestAnimatedGif(t))
+
+	if err != nil {
+		t.Fatalf("decodeAnimation returned error '%v'", err)
+	}
+
+	if len(anim.Frames) != 3 {
+		t.Fatalf("len(anim.Frames) = '%v', Should be '3'", len(anim.Frames))
+	}
+
+	last := *anim.Frames[2]
+
+	if last.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Fatalf("bounds = '%v', Should cover the whole animation", last.Bounds())
+	}
+
+	// The last frame is drawn over the frames before it
+	if !isGreen(last.At(5, 5)) || !isBlue(last.At(35, 15)) || !isRed(last.At(20, 5)) {
+		t.Fatalf("the last frame should be composited over the earlier frames")
+	}
+
+	if anim.Delays[1] != 20 {
+		t.Fatalf("anim.Delays[1] = '%v', Should be '20'", anim.Delays[1])
+	}
+
+	if *anim.frame(10) != last {
+		t.Fatalf("frame should return the last frame for an index past the end")
+	}
+
+	still, err := decodeAnimation(encodeTestGif(t, makeTestFrame(image.Rect(0, 0, 4, 4), 1)))
+	if err != nil || still != nil {
+		t.Fatalf("decodeAnimation should return nil for a GIF with one frame")
+	}
+}
+
+func TestDecodeAnimationTooManyPixels(t *testing.T) {
+	// 3 frames of 40 x 20
+	t.Setenv(constants.MAX_ANIMATION_PIXELS, "2399")
+
+	if _, err := decodeAnimation(makeTestAnimatedGif(t)); err == nil {
+		t.Fatalf("decodeAnimation should return an error for an animation over the limit")
+	}
+
+	t.Setenv(constants.MAX_ANIMATION_PIXELS, "2400")
+
+	if _, err := decodeAnimation(makeTestAnimatedGif(t)); err != nil {
+		t.Fatalf("decodeAnimation returned error '%v'", err)
+	}
+}
+
+func TestCountGifFrames(t *testing.T) {
+	// The second frame has its own palette, which is stored as a local color
+	// table
+	localFrame := image.NewPaletted(image.Rect(0, 0, 5, 5), color.Palette{color.Black, color.White})
+	g := gif.GIF{
+		Image: []*image.Paletted{
+			makeTestFrame(image.Rect(0, 0, 10, 10), 1),
+			localFrame,
+			makeTestFrame(image.Rect(0, 0, 10, 10), 2),
+		},
+		Delay:  []int{10, 10, 10},
+		Config: image.Config{Width: 10, Height: 10, ColorModel: testGifPalette},
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := gif.EncodeAll(buffer, &g); err != nil {
+		t.Fatalf("gif.EncodeAll returned error '%v'", err)
+	}
+
+	count, err := countGifFrames(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("countGifFrames returned error '%v'", err)
+	}
+
+	if count != 3 {
+		t.Fatalf("count = '%v', Should be '3'", count)
+	}
+
+	if _, err := countGifFrames(buffer.Bytes()[:20]); err == nil {
+		t.Fatalf("countGifFrames should return an error for a truncated file")
+	}
+}
+
+func encodeTestGif(t *testing.T, img image.Image) []byte {
+	buffer := new(bytes.Buffer)
+
+	if err := gif.Encode(buffer, img, nil); err != nil {
+		t.Fatalf("gif.Encode returned error '%v'", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestEncodeAnimatedGif(t *testing.T) {
+	dat, err := makeImageDataFromBytes(makeTestAnimatedGif(t))
+
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 20})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	output, err := gif.DecodeAll(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("gif.DecodeAll returned error '%v'", err)
+	}
+
+	if len(output.Image) != 3 {
+		t.Fatalf("len(output.Image) = '%v', Should be '3'", len(output.Image))
+	}
+
+	if output.Config.Width != 20 || output.Config.Height != 10 || encoded.ImageSize.Width != 20 {
+		t.Fatalf("the animation should be scaled to 20 x 10 pixels")
+	}
+
+	if output.Delay[2] != 30 {
+		t.Fatalf("output.Delay[2] = '%v', Should be '30'", output.Delay[2])
+	}
+
+	// Resampling can change the colors slightly
+	if !isNear(output.Image[2].At(17, 7), color.RGBA{0, 0, 255, 255}) || !isNear(output.Image[2].At(2, 2), color.RGBA{0, 255, 0, 255}) {
+		t.Fatalf("every frame should be scaled with the frames before it")
+	}
+}
+
+func isNear(c color.Color, expected color.RGBA) bool {
+	got := color.RGBAModel.Convert(c).(color.RGBA)
+
+	near := func(a, b uint8) bool {
+		return int(a)-int(b) < 8 && int(b)-int(a) < 8
+	}
+
+	return near(got.R, expected.R) && near(got.G, expected.G) && near(got.B, expected.B)
+}
+
+// Filters change the colors of every frame, so the frames can't use the
+// palettes of the source frames
+func TestEncodeAnimatedGifWithFilter(t *testing.T) {
+	dat, _ := makeImageDataFromBytes(makeTestAnimatedGif(t))
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 40, Filters: []ImageFilter{{Type: Invert}}})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	output, err := gif.DecodeAll(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("gif.DecodeAll returned error '%v'", err)
+	}
+
+	// Red becomes cyan, green magenta and blue yellow
+	expected := []struct {
+		frame int
+		point image.Point
+		color color.RGBA
+	}{
+		{0, image.Pt(20, 10), color.RGBA{0, 255, 255, 255}},
+		{1, image.Pt(5, 5), color.RGBA{255, 0, 255, 255}},
+		{2, image.Pt(35, 15), color.RGBA{255, 255, 0, 255}},
+	}
+
+	for _, test := range expected {
+		if c := output.Image[test.frame].At(test.point.X, test.point.Y); !isNear(c, test.color) {
+			t.Fatalf("frame %v color = '%v', Should be '%v'", test.frame, c, test.color)
+		}
+	}
+}
+
+func TestEncodeAnimatedGifPoster(t *testing.T) {
+	dat, _ := makeImageDataFromBytes(makeTestAnimatedGif(t))
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Thumbnail, Poster: true, PosterFrame: 2})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	output, err := gif.DecodeAll(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("gif.DecodeAll returned error '%v'", err)
+	}
+
+	if len(output.Image) != 1 {
+		t.Fatalf("len(output.Image) = '%v', Should be '1'", len(output.Image))
+	}
+
+	// Other formats use the poster frame
+	encoded, err = dat.EncodeImage(ConversionOp{ResizeOp: Crop, Width: 10, Height: 10, Gravity: SouthEast, CompressTo: Png, PosterFrame: 2})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("png.Decode returned error '%v'", err)
+	}
+
+	if !isBlue(img.At(5, 5)) {
+		t.Fatalf("color = '%v', Should be the blue square of the poster frame", img.At(5, 5))
+	}
+}
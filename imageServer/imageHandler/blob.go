@@ -0,0 +1,30 @@
+package imageHandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Returns the hex encoded SHA-256 digest of data
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Image files are stored content-addressed. The name in the file store is the
+// SHA-256 digest of the file's bytes plus the extension, so identical files
+// are only kept once no matter how many image files refer to them. The image
+// file's filename is only used to find the image file in the database.
+func MakeBlobName(sha256 string, iType ImageType) string {
+	return sha256 + "." + GetExtensionFromImageType(iType)
+}
+
+// Returns the name of the file in the file store. Image files saved before
+// content-addressing have no digest and are stored under their filename.
+func GetStorageName(filename, sha256 string, iType ImageType) string {
+	if len(sha256) == 0 {
+		return filename
+	}
+
+	return MakeBlobName(sha256, iType)
+}
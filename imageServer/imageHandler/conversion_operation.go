@@ -2,7 +2,12 @@ package imageHandler
 
 import (
 	"errors"
+	"fmt"
+	"image"
+	"math"
 	"strings"
+
+	"github.com/nfnt/resize"
 )
 
 type ConversionRequest struct {
@@ -13,8 +18,43 @@ type ConversionRequest struct {
 	// png
 	// bmp
 	// tiff
+	// webp
 	CompressTo string `json:"compressTo"`
 
+	// The encoder quality, from 1 to 100. What it means depends on the format:
+	// jpeg : The JPEG quality. JPEG_QUALITY is used if it's not set, and the quality
+	//        is limited to JPEG_MIN_QUALITY and JPEG_MAX_QUALITY
+	// webp : The quality of lossy files. WEBP_QUALITY is used if it's not set, and
+	//        the quality is limited to WEBP_MIN_QUALITY and WEBP_MAX_QUALITY. Lossless
+	//        files ignore it
+	// Other formats ignore Quality.
+	Quality int `json:"quality"`
+
+	// Whether the file is compressed losslessly. What it means depends on the format:
+	// webp : Makes a lossless WebP file instead of a lossy one
+	// Other formats ignore Lossless. JPEG files are always lossy and PNG, GIF, BMP
+	// and TIFF files are always lossless.
+	Lossless bool `json:"lossless"`
+
+	// The chroma subsampling of JPEG files: 4:2:0, 4:2:2 or 4:4:4. The
+	// JPEG_SUBSAMPLING environment variable is used if it's not set.
+	Subsampling string `json:"subsampling"`
+
+	// The compression of PNG files: none, fast, standard or best. The
+	// PNG_COMPRESSION environment variable is used if it's not set.
+	PngCompression string `json:"pngCompression"`
+
+	// The palette size of GIF files, from 2 to 256, and whether GIF files are
+	// dithered. The GIF_COLORS and GIF_DITHER environment variables are used if
+	// they're not set. The palette size is limited to the configured minimum and
+	// maximum.
+	Colors int   `json:"colors"`
+	Dither *bool `json:"dither"`
+
+	// The compression of TIFF files: none or deflate. The TIFF_COMPRESSION
+	// environment variable is used if it's not set.
+	TiffCompression string `json:"tiffCompression"`
+
 	// A string representation of this file's purpose or size. e.g. "web" or
 	// "x-large". If Obfuscate is set to false, this value will be added to
 	// the end of the filename.
@@ -24,6 +64,25 @@ type ConversionRequest struct {
 	// value only dictates one side.
 	LongestSide uint `json:"longestSide"`
 
+	// Target dimensions for the fit, fill, cover, crop and smartcrop resize operations
+	Width  uint `json:"width"`
+	Height uint `json:"height"`
+
+	// The part of the image that's kept by the cover and crop resize operations.
+	// The following are valid Gravity values:
+	// center (default), north, northeast, east, southeast, south, southwest, west, northwest
+	Gravity string `json:"gravity"`
+
+	// The resampling filter that's used to scale the image. The following are valid
+	// Filter values:
+	// nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3 (default)
+	Filter string `json:"filter"`
+
+	// Whether the image is kept at its original size when the resize operation would
+	// enlarge it. The output is scaled down to the largest size that doesn't enlarge
+	// the image instead, keeping the operation's aspect ratio.
+	WithoutEnlargement bool `json:"withoutEnlargement"`
+
 	// Whether to keep all filenames the same or randomize the names
 	Obfuscate bool `json:"obfuscate"`
 
@@ -33,10 +92,62 @@ type ConversionRequest struct {
 	// thumbnail    : Resize the image down to a small size, dictated by the THUMBNAIL_SIZE environment variable or 128px by default
 	// scale        : Scales the image, setting the longest side to the LongestSide value. This operation maintains the image's aspect ratio
 	// scalebywidth : Scales the image so that the width is set to LongestSide. This operation maintains the image's aspect ratio
+	// fit          : Scales the image to fit inside Width x Height. This operation maintains the image's aspect ratio
+	// fill         : Scales the image to exactly Width x Height, stretching it if the aspect ratios differ
+	// cover        : Scales the image to cover Width x Height and crops the rest, keeping the part at Gravity
+	// crop         : Crops Width x Height of the image at Gravity without scaling it
+	// smartcrop    : Crops the most interesting part of the image with the aspect ratio of Width x Height, then
+	//                scales it to Width x Height
 	ResizeOp string `json:"resizeOp"`
 
 	// Indicates whether this image should be available publicly or privately.
 	Private bool `json:"private"`
+
+	// What happens to the original image's EXIF data in this file. The following
+	// are valid Metadata values:
+	// keep      : Keeps all of the EXIF data
+	// strip     : Removes all of the EXIF data
+	// strip-gps : Keeps the EXIF data, except for the GPS location
+	// allowlist : Only keeps the tags named in MetadataTags, e.g. "Make" or "DateTimeOriginal"
+	// Private files keep the EXIF data by default. Public files use the
+	// PUBLIC_METADATA_POLICY environment variable, or strip-gps if it's not set.
+	Metadata string `json:"metadata"`
+
+	// The EXIF tags that the allowlist metadata policy keeps
+	MetadataTags []string `json:"metadataTags"`
+
+	// The clockwise rotation of this file in degrees. Multiples of 90 degrees are
+	// exact. Other angles enlarge the image to fit the rotated image and fill the
+	// corners with Background, a hex color that's white by default. The original
+	// can't be rotated.
+	Rotate     float64 `json:"rotate"`
+	Background string  `json:"background"`
+
+	// Mirrors this file after it's rotated. The following are valid Flip values:
+	// horizontal, vertical, both. The original can't be flipped.
+	Flip string `json:"flip"`
+
+	// Filters that are applied to this file in order after it's resized, e.g.
+	// grayscale or blur. Filters are applied before the watermark and text
+	// overlays. The original can't be filtered.
+	Filters []FilterRequest `json:"filters"`
+
+	// A watermark that's composited over this file. The original can't be
+	// watermarked.
+	Watermark *WatermarkRequest `json:"watermark"`
+
+	// Text that's drawn over this file, e.g. a copyright line or a caption. The
+	// overlays are drawn in order, after the watermark. The original can't have
+	// text overlays.
+	TextOverlays []TextOverlayRequest `json:"textOverlays"`
+
+	// The frame of an animated GIF that's used for still files, starting from 0.
+	// The last frame is used if the GIF has fewer frames.
+	PosterFrame int `json:"posterFrame"`
+
+	// Whether the GIF file of an animated GIF only has the poster frame. GIF files
+	// keep the animation otherwise. Other formats always have the poster frame.
+	Poster bool `json:"poster"`
 }
 
 type ImageType int8
@@ -48,6 +159,7 @@ const (
 	Gif
 	Bmp
 	Tiff
+	Webp
 )
 
 type ResizeOp int8
@@ -57,8 +169,161 @@ const (
 	Thumbnail
 	Scale
 	ScaleByWidth
+	Fit
+	Fill
+	Cover
+	Crop
+	SmartCrop
+)
+
+// Which part of an image is kept when it's cropped
+type Gravity int8
+
+const (
+	Center Gravity = iota
+	North
+	NorthEast
+	East
+	SouthEast
+	South
+	SouthWest
+	West
+	NorthWest
+)
+
+func parseGravity(gravity string) (Gravity, error) {
+	switch strings.ToLower(gravity) {
+	case "", "center":
+		return Center, nil
+	case "north":
+		return North, nil
+	case "northeast":
+		return NorthEast, nil
+	case "east":
+		return East, nil
+	case "southeast":
+		return SouthEast, nil
+	case "south":
+		return South, nil
+	case "southwest":
+		return SouthWest, nil
+	case "west":
+		return West, nil
+	case "northwest":
+		return NorthWest, nil
+	default:
+		return Center, errors.New("invalid gravity")
+	}
+}
+
+// Returns where the gravity is on each axis, from 0 (left or top) to 1 (right
+// or bottom)
+func (g Gravity) anchor() (float64, float64) {
+	switch g {
+	case North:
+		return 0.5, 0
+	case NorthEast:
+		return 1, 0
+	case East:
+		return 1, 0.5
+	case SouthEast:
+		return 1, 1
+	case South:
+		return 0.5, 1
+	case SouthWest:
+		return 0, 1
+	case West:
+		return 0, 0.5
+	case NorthWest:
+		return 0, 0
+	default:
+		return 0.5, 0.5
+	}
+}
+
+// The interpolation that's used when an image is scaled
+type ResampleFilter int8
+
+const (
+	Lanczos3Filter ResampleFilter = iota
+	Lanczos2Filter
+	MitchellFilter
+	BicubicFilter
+	BilinearFilter
+	NearestFilter
 )
 
+func parseResampleFilter(filter string) (ResampleFilter, error) {
+	switch strings.ToLower(filter) {
+	case "", "lanczos3":
+		return Lanczos3Filter, nil
+	case "lanczos2":
+		return Lanczos2Filter, nil
+	case "mitchell":
+		return MitchellFilter, nil
+	case "bicubic":
+		return BicubicFilter, nil
+	case "bilinear":
+		return BilinearFilter, nil
+	case "nearest":
+		return NearestFilter, nil
+	default:
+		return Lanczos3Filter, errors.New("invalid resampling filter")
+	}
+}
+
+func (f ResampleFilter) interpolation() resize.InterpolationFunction {
+	switch f {
+	case Lanczos2Filter:
+		return resize.Lanczos2
+	case MitchellFilter:
+		return resize.MitchellNetravali
+	case BicubicFilter:
+		return resize.Bicubic
+	case BilinearFilter:
+		return resize.Bilinear
+	case NearestFilter:
+		return resize.NearestNeighbor
+	default:
+		return resize.Lanczos3
+	}
+}
+
+// What happens to an image's EXIF data when it's written. DefaultMetadata
+// keeps the data in private files and uses the configured policy for public
+// files.
+type MetadataPolicy int8
+
+const (
+	DefaultMetadata MetadataPolicy = iota
+	KeepMetadata
+	StripMetadata
+	StripGPSMetadata
+	AllowlistMetadata
+)
+
+func parseMetadataPolicy(policy string) (MetadataPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		return DefaultMetadata, nil
+	case "keep":
+		return KeepMetadata, nil
+	case "strip":
+		return StripMetadata, nil
+	case "strip-gps":
+		return StripGPSMetadata, nil
+	case "allowlist":
+		return AllowlistMetadata, nil
+	default:
+		return DefaultMetadata, errors.New("invalid metadata policy")
+	}
+}
+
+// Returns true for the resize operations that use Width and Height
+func (op ResizeOp) hasTargetSize() bool {
+	return op == Fit || op == Fill || op == Cover || op == Crop || op == SmartCrop
+}
+
 // The ConversionOp is a blueprint for an image conversion operation.
 // We use the original source image and perform operations on that.
 // The ConversionOp also defines a format to encode to, in case the user wants to have
@@ -80,13 +345,140 @@ type ConversionOp struct {
 	// Resize operation chosen for this conversion operation.
 	ResizeOp ResizeOp
 
+	// Target dimensions for the Fit, Fill, Cover, Crop and SmartCrop resize operations
+	Width  uint
+	Height uint
+
+	// The part of the image that's kept by the Cover and Crop resize operations
+	Gravity Gravity
+
+	// The resampling filter that's used to scale the image
+	Filter ResampleFilter
+
+	// Whether the output is limited to the size of the source image
+	WithoutEnlargement bool
+
 	// This option will randomize the file name.
 	Obfuscate bool
 
 	// Indicates whether this image should be available publicly or privately
 	Private bool
+
+	// The JPEG quality, or the quality of lossy WebP files. Other formats ignore
+	// it. Zero uses the format's default quality.
+	Quality int
+
+	// Whether WebP files are compressed losslessly. Other formats ignore it.
+	Lossless bool
+
+	// The chroma subsampling of JPEG files
+	Subsampling ChromaSubsampling
+
+	// The compression of PNG files
+	PngCompression PngCompression
+
+	// The palette size of GIF files and whether they're dithered. Zero and nil
+	// use the defaults.
+	Colors int
+	Dither *bool
+
+	// The compression of TIFF files
+	TiffCompression TiffCompression
+
+	// What happens to the original image's EXIF data in this file
+	Metadata MetadataPolicy
+
+	// The EXIF tags that the AllowlistMetadata policy keeps
+	MetadataTags []string
+
+	// The rotation and flip that are applied before the image is resized
+	Transform Transform
+
+	// The filters that are applied to this file, in order
+	Filters []ImageFilter
+
+	// The watermark that's composited over this file, if any
+	Watermark *Watermark
+
+	// The text that's drawn over this file, in order
+	TextOverlays []TextOverlay
+
+	// The frame of an animated GIF that's used for still files
+	PosterFrame int
+
+	// Whether a GIF file of an animated GIF is a still of the poster frame
+	Poster bool
+
+	// The request that the operation was made from, or nil for the default
+	// operations. It's stored with the file, so that the file can be made again.
+	Request *ConversionRequest
+}
+
+// Resolves DefaultMetadata to the policy that's used for this operation and
+// returns the tags that the policy keeps
+func (op ConversionOp) getMetadataPolicy() (MetadataPolicy, []string) {
+	if op.Metadata != DefaultMetadata {
+		return op.Metadata, op.MetadataTags
+	}
+
+	if op.Private {
+		return KeepMetadata, nil
+	}
+
+	return getPublicMetadataPolicy()
+}
+
+// Limits the output size of an operation that doesn't enlarge images to the
+// size of the source image. Returns the limited operation and true if the
+// operation would have enlarged the image. Thumbnails and crops never enlarge
+// images.
+func (op ConversionOp) limitToSource(bounds image.Rectangle) (ConversionOp, bool) {
+	if !op.WithoutEnlargement {
+		return op, false
+	}
+
+	width := uint(bounds.Dx())
+	height := uint(bounds.Dy())
+
+	switch op.ResizeOp {
+	case Scale:
+		longestSide := width
+		if height > width {
+			longestSide = height
+		}
+
+		if op.LongestSide > longestSide {
+			op.LongestSide = longestSide
+			return op, true
+		}
+	case ScaleByWidth:
+		if op.LongestSide > width {
+			op.LongestSide = width
+			return op, true
+		}
+	case Fit:
+		// Fit only enlarges the image when both sides are smaller than the box
+		if op.Width > width && op.Height > height {
+			op.Width = width
+			op.Height = height
+			return op, true
+		}
+	case Fill, Cover, SmartCrop:
+		if op.Width > width || op.Height > height {
+			scale := math.Min(float64(width)/float64(op.Width), float64(height)/float64(op.Height))
+			op.Width = uint(math.Max(math.Round(float64(op.Width)*scale), 1))
+			op.Height = uint(math.Max(math.Round(float64(op.Height)*scale), 1))
+			return op, true
+		}
+	}
+
+	return op, false
 }
 
+// The largest width, height or longest side of a conversion request when
+// MAX_OUTPUT_DIMENSION isn't set
+const defaultMaxOutputDimension = 10000
+
 // Takes a ConversionRequest struct and returns a ConversionRequest We return an
 // error if the user does not explicitly define a resize operation
 func makeOpFromRequest(req ConversionRequest) (ConversionOp, error) {
@@ -102,6 +494,16 @@ func makeOpFromRequest(req ConversionRequest) (ConversionOp, error) {
 		resizeOp = ScaleByWidth
 	case "original":
 		resizeOp = Original
+	case "fit":
+		resizeOp = Fit
+	case "fill":
+		resizeOp = Fill
+	case "cover":
+		resizeOp = Cover
+	case "crop":
+		resizeOp = Crop
+	case "smartcrop":
+		resizeOp = SmartCrop
 	default:
 		return ConversionOp{}, errors.New("invalid resize operation")
 	}
@@ -119,6 +521,8 @@ func makeOpFromRequest(req ConversionRequest) (ConversionOp, error) {
 			encodeTo = Bmp
 		case "tiff":
 			encodeTo = Tiff
+		case "webp":
+			encodeTo = Webp
 		default:
 			encodeTo = Same
 		}
@@ -132,17 +536,152 @@ func makeOpFromRequest(req ConversionRequest) (ConversionOp, error) {
 
 	// We return an error if the user does not set the value greater than zero
 	// and has an Original or Thumbnail resize operation
-	if req.LongestSide == 0 && resizeOp != Original && resizeOp != Thumbnail {
+	if req.LongestSide == 0 && resizeOp != Original && resizeOp != Thumbnail && !resizeOp.hasTargetSize() {
 		return ConversionOp{}, errors.New("invalid longest side value or operation")
 	}
 
+	// The operations with a target size need both dimensions
+	if resizeOp.hasTargetSize() && (req.Width == 0 || req.Height == 0) {
+		return ConversionOp{}, errors.New("invalid width or height value for operation")
+	}
+
+	// Large outputs are refused before the resize allocates them
+	maxDimension := getMaxOutputDimension()
+	if req.LongestSide > maxDimension || req.Width > maxDimension || req.Height > maxDimension {
+		return ConversionOp{}, fmt.Errorf("width, height and longest side must be at most %v", maxDimension)
+	}
+
+	gravity, gravityErr := parseGravity(req.Gravity)
+	if gravityErr != nil {
+		return ConversionOp{}, gravityErr
+	}
+
+	filter, filterErr := parseResampleFilter(req.Filter)
+	if filterErr != nil {
+		return ConversionOp{}, filterErr
+	}
+
+	if req.Quality < 0 || req.Quality > 100 {
+		return ConversionOp{}, errors.New("invalid quality value")
+	}
+
+	subsampling, subsamplingErr := parseChromaSubsampling(req.Subsampling)
+	if subsamplingErr != nil {
+		return ConversionOp{}, subsamplingErr
+	}
+
+	pngCompression, pngErr := parsePngCompression(req.PngCompression)
+	if pngErr != nil {
+		return ConversionOp{}, pngErr
+	}
+
+	tiffCompression, tiffErr := parseTiffCompression(req.TiffCompression)
+	if tiffErr != nil {
+		return ConversionOp{}, tiffErr
+	}
+
+	if req.Colors != 0 && (req.Colors < 2 || req.Colors > 256) {
+		return ConversionOp{}, errors.New("invalid colors value")
+	}
+
+	metadata, metadataErr := parseMetadataPolicy(req.Metadata)
+	if metadataErr != nil {
+		return ConversionOp{}, metadataErr
+	}
+
+	for _, name := range req.MetadataTags {
+		if _, ok := getExifTagKey(name); !ok {
+			return ConversionOp{}, errors.New("invalid metadata tag: " + name)
+		}
+	}
+
+	if metadata == AllowlistMetadata && len(req.MetadataTags) == 0 {
+		return ConversionOp{}, errors.New("the allowlist metadata policy requires metadata tags")
+	}
+
+	if req.PosterFrame < 0 {
+		return ConversionOp{}, errors.New("invalid poster frame")
+	}
+
+	transform, transformErr := MakeTransform(req.Rotate, req.Flip, req.Background)
+	if transformErr != nil {
+		return ConversionOp{}, transformErr
+	}
+
+	if !transform.IsIdentity() && resizeOp == Original {
+		return ConversionOp{}, errors.New("the original image can't be rotated or flipped")
+	}
+
+	if len(req.Filters) > 0 && resizeOp == Original {
+		return ConversionOp{}, errors.New("the original image can't be filtered")
+	}
+
+	filters := make([]ImageFilter, 0, len(req.Filters))
+	for _, filterReq := range req.Filters {
+		filter, filterErr := makeImageFilterFromRequest(filterReq)
+		if filterErr != nil {
+			return ConversionOp{}, filterErr
+		}
+
+		filters = append(filters, filter)
+	}
+
+	var watermark *Watermark
+	if req.Watermark != nil {
+		if resizeOp == Original {
+			return ConversionOp{}, errors.New("the original image can't be watermarked")
+		}
+
+		w, watermarkErr := makeWatermarkFromRequest(*req.Watermark)
+		if watermarkErr != nil {
+			return ConversionOp{}, watermarkErr
+		}
+
+		watermark = &w
+	}
+
+	if len(req.TextOverlays) > 0 && resizeOp == Original {
+		return ConversionOp{}, errors.New("the original image can't have text overlays")
+	}
+
+	textOverlays := make([]TextOverlay, 0, len(req.TextOverlays))
+	for _, textReq := range req.TextOverlays {
+		overlay, overlayErr := makeTextOverlayFromRequest(textReq)
+		if overlayErr != nil {
+			return ConversionOp{}, overlayErr
+		}
+
+		textOverlays = append(textOverlays, overlay)
+	}
+
 	return ConversionOp{
-		Suffix:      suffix,
-		CompressTo:  encodeTo,
-		LongestSide: req.LongestSide,
-		ResizeOp:    resizeOp,
-		Obfuscate:   req.Obfuscate,
-		Private:     req.Private,
+		Suffix:             suffix,
+		CompressTo:         encodeTo,
+		LongestSide:        req.LongestSide,
+		ResizeOp:           resizeOp,
+		Width:              req.Width,
+		Height:             req.Height,
+		Gravity:            gravity,
+		Filter:             filter,
+		WithoutEnlargement: req.WithoutEnlargement,
+		Obfuscate:          req.Obfuscate,
+		Private:            req.Private,
+		Quality:            req.Quality,
+		Lossless:           req.Lossless,
+		Subsampling:        subsampling,
+		PngCompression:     pngCompression,
+		Colors:             req.Colors,
+		Dither:             req.Dither,
+		TiffCompression:    tiffCompression,
+		Metadata:           metadata,
+		MetadataTags:       req.MetadataTags,
+		Transform:          transform,
+		Filters:            filters,
+		Watermark:          watermark,
+		TextOverlays:       textOverlays,
+		PosterFrame:        req.PosterFrame,
+		Poster:             req.Poster,
+		Request:            &req,
 	}, nil
 }
 
@@ -0,0 +1,299 @@
+package imageHandler
+
+import (
+	"errors"
+	"image/draw"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/tiff"
+
+	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/jpegEncoder"
+)
+
+// The chroma subsampling of JPEG files. DefaultSubsampling uses the configured
+// subsampling.
+type ChromaSubsampling int8
+
+const (
+	DefaultSubsampling ChromaSubsampling = iota
+	Subsampling420
+	Subsampling422
+	Subsampling444
+)
+
+func parseChromaSubsampling(subsampling string) (ChromaSubsampling, error) {
+	switch strings.ReplaceAll(subsampling, ":", "") {
+	case "":
+		return DefaultSubsampling, nil
+	case "420":
+		return Subsampling420, nil
+	case "422":
+		return Subsampling422, nil
+	case "444":
+		return Subsampling444, nil
+	default:
+		return DefaultSubsampling, errors.New("invalid chroma subsampling")
+	}
+}
+
+func (s ChromaSubsampling) String() string {
+	switch s {
+	case Subsampling422:
+		return "4:2:2"
+	case Subsampling444:
+		return "4:4:4"
+	default:
+		return "4:2:0"
+	}
+}
+
+func (s ChromaSubsampling) encoderSubsampling() jpegEncoder.Subsampling {
+	switch s {
+	case Subsampling422:
+		return jpegEncoder.Subsampling422
+	case Subsampling444:
+		return jpegEncoder.Subsampling444
+	default:
+		return jpegEncoder.Subsampling420
+	}
+}
+
+// The zlib compression level of PNG files. DefaultPngCompression uses the
+// configured level.
+type PngCompression int8
+
+const (
+	DefaultPngCompression PngCompression = iota
+	NoPngCompression
+	FastPngCompression
+	StandardPngCompression
+	BestPngCompression
+)
+
+func parsePngCompression(compression string) (PngCompression, error) {
+	switch strings.ToLower(compression) {
+	case "":
+		return DefaultPngCompression, nil
+	case "none":
+		return NoPngCompression, nil
+	case "fast":
+		return FastPngCompression, nil
+	case "standard":
+		return StandardPngCompression, nil
+	case "best":
+		return BestPngCompression, nil
+	default:
+		return DefaultPngCompression, errors.New("invalid PNG compression")
+	}
+}
+
+func (c PngCompression) String() string {
+	switch c {
+	case NoPngCompression:
+		return "none"
+	case FastPngCompression:
+		return "fast"
+	case StandardPngCompression:
+		return "standard"
+	default:
+		return "best"
+	}
+}
+
+func (c PngCompression) encoderLevel() png.CompressionLevel {
+	switch c {
+	case NoPngCompression:
+		return png.NoCompression
+	case FastPngCompression:
+		return png.BestSpeed
+	case StandardPngCompression:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
+// The compression of TIFF files. DefaultTiffCompression uses the configured
+// compression.
+type TiffCompression int8
+
+const (
+	DefaultTiffCompression TiffCompression = iota
+	NoTiffCompression
+	DeflateTiffCompression
+)
+
+func parseTiffCompression(compression string) (TiffCompression, error) {
+	switch strings.ToLower(compression) {
+	case "":
+		return DefaultTiffCompression, nil
+	case "none":
+		return NoTiffCompression, nil
+	case "deflate":
+		return DeflateTiffCompression, nil
+	default:
+		return DefaultTiffCompression, errors.New("invalid TIFF compression")
+	}
+}
+
+func (c TiffCompression) String() string {
+	if c == NoTiffCompression {
+		return "none"
+	}
+
+	return "deflate"
+}
+
+func (c TiffCompression) encoderCompression() tiff.CompressionType {
+	if c == NoTiffCompression {
+		return tiff.Uncompressed
+	}
+
+	return tiff.Deflate
+}
+
+// The settings that a file was encoded with, after the configured defaults and
+// bounds were applied. Only the settings of the file's format are set.
+type EncoderSettings struct {
+	// The JPEG quality of JPEG files and the quality of lossy WebP files. Lossless
+	// WebP files and other formats don't have a quality.
+	Quality int `json:"quality,omitempty"`
+
+	// Whether a WebP file is lossless. Only set for WebP files.
+	Lossless bool `json:"lossless,omitempty"`
+
+	// The chroma subsampling of JPEG files
+	Subsampling string `json:"subsampling,omitempty"`
+
+	// The compression of PNG and TIFF files
+	Compression string `json:"compression,omitempty"`
+
+	// The size of the palette of GIF files and whether they're dithered
+	Colors int  `json:"colors,omitempty"`
+	Dither bool `json:"dither,omitempty"`
+}
+
+func (es EncoderSettings) GetMap() map[string]interface{} {
+	m := make(map[string]interface{})
+
+	if es.Quality > 0 {
+		m["quality"] = es.Quality
+	}
+
+	if es.Lossless {
+		m["lossless"] = es.Lossless
+	}
+
+	if len(es.Subsampling) > 0 {
+		m["subsampling"] = es.Subsampling
+	}
+
+	if len(es.Compression) > 0 {
+		m["compression"] = es.Compression
+	}
+
+	if es.Colors > 0 {
+		m["colors"] = es.Colors
+		m["dither"] = es.Dither
+	}
+
+	return m
+}
+
+func (es EncoderSettings) getGifDrawer() draw.Drawer {
+	if es.Dither {
+		return draw.FloydSteinberg
+	}
+
+	return draw.Src
+}
+
+// Returns the settings that the operation's file is encoded with in the
+// format. Settings that the operation doesn't set use the configured defaults
+// and every setting is limited to the configured bounds.
+func (op ConversionOp) getEncoderSettings(imgType ImageType) EncoderSettings {
+	switch imgType {
+	case Jpeg:
+		subsampling := op.Subsampling
+		if subsampling == DefaultSubsampling {
+			subsampling, _ = parseChromaSubsampling(os.Getenv(constants.JPEG_SUBSAMPLING))
+		}
+
+		return EncoderSettings{
+			Quality:     getBoundedSetting(op.Quality, getJpegQuality(), constants.JPEG_MIN_QUALITY, constants.JPEG_MAX_QUALITY, 1, 100),
+			Subsampling: subsampling.String(),
+		}
+	case Webp:
+		if op.Lossless {
+			return EncoderSettings{Lossless: true}
+		}
+
+		return EncoderSettings{
+			Quality: getBoundedSetting(op.Quality, getWebpQuality(), constants.WEBP_MIN_QUALITY, constants.WEBP_MAX_QUALITY, 1, 100),
+		}
+	case Png:
+		compression := op.PngCompression
+		if compression == DefaultPngCompression {
+			compression, _ = parsePngCompression(os.Getenv(constants.PNG_COMPRESSION))
+		}
+
+		return EncoderSettings{Compression: compression.String()}
+	case Gif:
+		dither := true
+		if op.Dither != nil {
+			dither = *op.Dither
+		} else if val, err := strconv.ParseBool(os.Getenv(constants.GIF_DITHER)); err == nil {
+			dither = val
+		}
+
+		return EncoderSettings{
+			Colors: getBoundedSetting(op.Colors, getGifColors(), constants.GIF_MIN_COLORS, constants.GIF_MAX_COLORS, 2, 256),
+			Dither: dither,
+		}
+	case Tiff:
+		compression := op.TiffCompression
+		if compression == DefaultTiffCompression {
+			compression, _ = parseTiffCompression(os.Getenv(constants.TIFF_COMPRESSION))
+		}
+
+		return EncoderSettings{Compression: compression.String()}
+	default:
+		return EncoderSettings{}
+	}
+}
+
+// Returns value, or defaultValue if value isn't set, limited to the bounds in
+// the minName and maxName env variables. The bounds themselves are limited to
+// lowest and highest.
+func getBoundedSetting(value, defaultValue int, minName, maxName string, lowest, highest int) int {
+	min := getIntEnv(minName, lowest, lowest, highest)
+	max := getIntEnv(maxName, highest, min, highest)
+
+	if value == 0 {
+		value = defaultValue
+	}
+
+	if value < min {
+		return min
+	} else if value > max {
+		return max
+	}
+
+	return value
+}
+
+// Gets an integer from the env. Returns defaultValue if the value doesn't
+// exist or isn't between lowest and highest.
+func getIntEnv(name string, defaultValue, lowest, highest int) int {
+	val, err := strconv.Atoi(os.Getenv(name))
+
+	if err != nil || val < lowest || val > highest {
+		return defaultValue
+	}
+
+	return val
+}
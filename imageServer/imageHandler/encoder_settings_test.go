@@ -0,0 +1,191 @@
+package imageHandler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+func TestGetEncoderSettings(t *testing.T) {
+	t.Setenv(constants.JPEG_QUALITY, "")
+	t.Setenv(constants.JPEG_SUBSAMPLING, "")
+	t.Setenv(constants.JPEG_MIN_QUALITY, "")
+	t.Setenv(constants.JPEG_MAX_QUALITY, "")
+	t.Setenv(constants.PNG_COMPRESSION, "")
+	t.Setenv(constants.GIF_COLORS, "")
+	t.Setenv(constants.GIF_DITHER, "")
+	t.Setenv(constants.TIFF_COMPRESSION, "")
+
+	settings := (ConversionOp{}).getEncoderSettings(Jpeg)
+	if settings != (EncoderSettings{Quality: 75, Subsampling: "4:2:0"}) {
+		t.Fatalf("settings = '%v', Should be the JPEG defaults", settings)
+	}
+
+	if settings := (ConversionOp{}).getEncoderSettings(Png); settings.Compression != "best" {
+		t.Fatalf("settings.Compression = '%v', Should be 'best'", settings.Compression)
+	}
+
+	if settings := (ConversionOp{}).getEncoderSettings(Gif); settings != (EncoderSettings{Colors: 256, Dither: true}) {
+		t.Fatalf("settings = '%v', Should be the GIF defaults", settings)
+	}
+
+	if settings := (ConversionOp{}).getEncoderSettings(Tiff); settings.Compression != "deflate" {
+		t.Fatalf("settings.Compression = '%v', Should be 'deflate'", settings.Compression)
+	}
+
+	if settings := (ConversionOp{}).getEncoderSettings(Bmp); makeSettingsRecord(settings) != nil {
+		t.Fatalf("settings = '%v', BMP files shouldn't have settings", settings)
+	}
+
+	t.Setenv(constants.JPEG_SUBSAMPLING, "4:4:4")
+	t.Setenv(constants.JPEG_MIN_QUALITY, "40")
+	t.Setenv(constants.JPEG_MAX_QUALITY, "90")
+	t.Setenv(constants.GIF_COLORS, "64")
+	t.Setenv(constants.GIF_DITHER, "false")
+
+	if settings := (ConversionOp{Quality: 95}).getEncoderSettings(Jpeg); settings.Quality != 90 || settings.Subsampling != "4:4:4" {
+		t.Fatalf("settings = '%v', Should be limited to quality '90' with '4:4:4'", settings)
+	}
+
+	if settings := (ConversionOp{Quality: 10, Subsampling: Subsampling422}).getEncoderSettings(Jpeg); settings.Quality != 40 || settings.Subsampling != "4:2:2" {
+		t.Fatalf("settings = '%v', Should be limited to quality '40' with '4:2:2'", settings)
+	}
+
+	dither := true
+	if settings := (ConversionOp{}).getEncoderSettings(Gif); settings != (EncoderSettings{Colors: 64}) {
+		t.Fatalf("settings = '%v', Should use the configured GIF settings", settings)
+	}
+
+	if settings := (ConversionOp{Colors: 16, Dither: &dither}).getEncoderSettings(Gif); settings != (EncoderSettings{Colors: 16, Dither: true}) {
+		t.Fatalf("settings = '%v', Should use the operation's GIF settings", settings)
+	}
+
+	// Bounds outside of the valid range are ignored
+	t.Setenv(constants.JPEG_MIN_QUALITY, "0")
+	t.Setenv(constants.JPEG_MAX_QUALITY, "20")
+	if settings := (ConversionOp{Quality: 10}).getEncoderSettings(Jpeg); settings.Quality != 10 {
+		t.Fatalf("settings.Quality = '%v', Should be '10'", settings.Quality)
+	}
+
+	if settings := (ConversionOp{Quality: 30, Lossless: true}).getEncoderSettings(Webp); settings != (EncoderSettings{Lossless: true}) {
+		t.Fatalf("settings = '%v', Lossless WebP files shouldn't have a quality", settings)
+	}
+}
+
+func TestMakeOpFromRequestEncoderSettings(t *testing.T) {
+	op, err := makeOpFromRequest(ConversionRequest{
+		ResizeOp:        "scale",
+		LongestSide:     100,
+		Subsampling:     "4:2:2",
+		PngCompression:  "fast",
+		Colors:          32,
+		TiffCompression: "none",
+	})
+
+	if err != nil {
+		t.Fatalf("makeOpFromRequest returned error '%v'", err)
+	}
+
+	if op.Subsampling != Subsampling422 || op.PngCompression != FastPngCompression || op.Colors != 32 || op.TiffCompression != NoTiffCompression {
+		t.Fatalf("op = '%v', Should have the requested encoder settings", op)
+	}
+
+	invalid := []ConversionRequest{
+		{ResizeOp: "scale", LongestSide: 100, Subsampling: "4:1:1"},
+		{ResizeOp: "scale", LongestSide: 100, PngCompression: "max"},
+		{ResizeOp: "scale", LongestSide: 100, Colors: 1},
+		{ResizeOp: "scale", LongestSide: 100, Colors: 300},
+		{ResizeOp: "scale", LongestSide: 100, TiffCompression: "lzw"},
+	}
+
+	for _, req := range invalid {
+		if _, err := makeOpFromRequest(req); err == nil {
+			t.Fatalf("makeOpFromRequest should return an error for '%v'", req)
+		}
+	}
+}
+
+func makeGradientImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+
+	return img
+}
+
+func TestEncodeImageSettings(t *testing.T) {
+	t.Setenv(constants.JPEG_QUALITY, "")
+	t.Setenv(constants.JPEG_MIN_QUALITY, "")
+	t.Setenv(constants.JPEG_MAX_QUALITY, "")
+
+	var img image.Image = makeGradientImage(64, 48)
+	dat := makeImageDataFromImage(&img, Jpeg, exifData{})
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 64, Subsampling: Subsampling444, Quality: 90})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	if encoded.Settings == nil || *encoded.Settings != (EncoderSettings{Quality: 90, Subsampling: "4:4:4"}) {
+		t.Fatalf("encoded.Settings = '%v', Should be '{90 4:4:4}'", encoded.Settings)
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("jpeg.Decode returned error '%v'", err)
+	}
+
+	if ratio := decoded.(*image.YCbCr).SubsampleRatio; ratio != image.YCbCrSubsampleRatio444 {
+		t.Fatalf("SubsampleRatio = '%v', Should be '%v'", ratio, image.YCbCrSubsampleRatio444)
+	}
+
+	encoded, err = dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 64, CompressTo: Gif, Colors: 8})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	g, err := gif.Decode(bytes.NewReader(encoded.Bytes))
+	if err != nil {
+		t.Fatalf("gif.Decode returned error '%v'", err)
+	}
+
+	if palette := g.(*image.Paletted).Palette; len(palette) > 8 {
+		t.Fatalf("len(palette) = '%v', Should be at most '8'", len(palette))
+	}
+}
+
+func TestMedianCutQuantizer(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		c := color.RGBA{255, 0, 0, 255}
+		if i%2 == 0 {
+			c = color.RGBA{0, 0, 255, 255}
+		}
+		img.SetRGBA(i%4, i/4, c)
+	}
+	img.SetRGBA(0, 0, color.RGBA{})
+
+	palette := medianCutQuantizer{}.Quantize(make(color.Palette, 0, 16), img)
+
+	// The transparent color and one color for each of the two opaque colors
+	if len(palette) != 3 {
+		t.Fatalf("len(palette) = '%v', Should be '3'", len(palette))
+	}
+
+	if _, _, _, a := palette[0].RGBA(); a != 0 {
+		t.Fatalf("palette[0] = '%v', Should be transparent", palette[0])
+	}
+
+	if !isBlue(palette[1]) && !isBlue(palette[2]) {
+		t.Fatalf("palette = '%v', Should have blue", palette)
+	}
+}
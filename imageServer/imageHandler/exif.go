@@ -1,30 +1,37 @@
 package imageHandler
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 )
 
+// The EXIF orientation of an image. The value describes how the stored pixels
+// have to be transformed to display the image upright.
 type Orientation uint8
 
 const (
-	Horizontal Orientation = 1
-	Rotate180  Orientation = 3
-	RotateCW   Orientation = 6
-	RotateCCW  Orientation = 8
+	Horizontal                Orientation = 1
+	MirrorHorizontal          Orientation = 2
+	Rotate180                 Orientation = 3
+	MirrorVertical            Orientation = 4
+	MirrorHorizontalRotateCCW Orientation = 5
+	RotateCW                  Orientation = 6
+	MirrorHorizontalRotateCW  Orientation = 7
+	RotateCCW                 Orientation = 8
 )
 
-func getOrientation(value byte) Orientation {
-	switch value {
-	case 3:
-		return Rotate180
-	case 6:
-		return RotateCW
-	case 8:
-		return RotateCCW
-	default:
+func getOrientation(value uint16) Orientation {
+	if value < uint16(Horizontal) || value > uint16(RotateCCW) {
 		return Horizontal
 	}
+
+	return Orientation(value)
+}
+
+// Returns true if the orientation swaps the width and height of the image
+func (o Orientation) swapsDimensions() bool {
+	return o >= MirrorHorizontalRotateCCW
 }
 
 /****************************************************************************************
@@ -39,6 +46,9 @@ type exifData struct {
 
 func (exif *exifData) hasData() bool { return (exif.ExifData != nil && len(exif.ExifData) > 0) }
 
+// The most data that fits in an APP1 segment after its 2 length bytes
+const maxExifSegmentLength = 0xffff - 2
+
 // Generates APP1 Marker bytes and File sizes.
 func (exif *exifData) makeSizeData() []byte {
 	markerlen := 2 + len(exif.ExifData)
@@ -62,36 +72,72 @@ func (exif *exifData) makeFileData() []byte {
 	return data
 }
 
-// This function reviews the exif binary data, looks for a specific byte order
-// extracts the information after the metadata and compares it to the spec to
-// determine if the image is rotated.
-// Typical IFD ordering for an EXIF tag:
-// TTTT | ffff | NNNNNNNN | DDDDDDDD
-// TTTT (2 bytes) is the tag
-// ffff (2 bytes) is the format
-// NNNNNNNN (4 bytes) is the number of components
-// DDDDDDDD (4 bytes) contains a data value or offset data value
-//Example:  01 12 00 03 00 00 00 01 00 06
-// 01 12 is the tag (orientation)
-// 00 03 is the format (Unsigned short, 2 bytes)
-// 00 00 00 01 is the amount of compeonts (1)
-// 00 06 is the actual value. In this case, 6 or rotate Clockwise
-// Returns an orientation enum
-func (exif *exifData) isImageRotated() Orientation {
-	bytesLength := len(exif.ExifData)
-	for i := 0; i < bytesLength-1; i++ {
-		byte1 := exif.ExifData[i]
-		byte2 := exif.ExifData[i+1]
-
-		// We check that byte1 & byte2 == 0x0112 and that there are 16 more
-		// bytes after 0x0112
-		if byte1 == 0x01 && byte2 == 0x12 && bytesLength-i > 8 {
-			orientationByte := exif.ExifData[i+9]
-			return getOrientation(orientationByte)
+// Parses the EXIF data. Returns an error if there's no data.
+func (exif *exifData) parse() (*exifTags, error) {
+	if !exif.hasData() {
+		return nil, NewExifError("no exif data")
+	}
+
+	return parseExif(exif.ExifData)
+}
+
+// Returns the orientation from the EXIF data. Images without an orientation
+// are Horizontal.
+func (exif *exifData) getImageOrientation() Orientation {
+	tags, err := exif.parse()
+	if err != nil {
+		return Horizontal
+	}
+
+	return tags.Orientation()
+}
+
+// Returns new EXIF data with the orientation set. The data is serialized
+// again, which leaves out the thumbnail in IFD1. EXIF data is made if there's
+// none.
+func (exif *exifData) withOrientation(orientation Orientation) exifData {
+	tags, err := exif.parse()
+	if err != nil {
+		tags = &exifTags{
+			order: binary.BigEndian,
+			IFD0:  &exifIFD{SubIFDs: make(map[uint16]*exifIFD)},
 		}
 	}
 
-	return Horizontal
+	tags.SetOrientation(orientation)
+
+	return exifData{ExifData: tags.Bytes()}
+}
+
+// Returns the EXIF data that a file with the metadata policy keeps. names are
+// the tags that the AllowlistMetadata policy keeps. Data that can't be parsed
+// can't be filtered, so it's removed by every policy except KeepMetadata.
+func (exif *exifData) withPolicy(policy MetadataPolicy, names []string) exifData {
+	if policy == KeepMetadata || policy == DefaultMetadata || !exif.hasData() {
+		return *exif
+	}
+
+	if policy == StripMetadata {
+		return exifData{}
+	}
+
+	tags, err := exif.parse()
+	if err != nil {
+		return exifData{}
+	}
+
+	switch policy {
+	case StripGPSMetadata:
+		tags.RemoveGPS()
+	case AllowlistMetadata:
+		tags.KeepOnly(names)
+	}
+
+	if tags.IFD0.isEmpty() {
+		return exifData{}
+	}
+
+	return exifData{ExifData: tags.Bytes()}
 }
 
 // Skip Writer for exif writing
@@ -142,7 +188,8 @@ func newWriterExif(writer io.Writer, exif exifData) (io.Writer, error) {
 		return nil, err
 	}
 
-	if exif.hasData() {
+	// The segment length is 2 bytes, so larger EXIF data can't be written
+	if exif.hasData() && len(exif.ExifData) <= maxExifSegmentLength {
 		exifData := exif.makeFileData()
 
 		if _, err := writer.Write(exifData); err != nil {
@@ -153,51 +200,87 @@ func newWriterExif(writer io.Writer, exif exifData) (io.Writer, error) {
 	return writerSkipper, nil
 }
 
-// TODO find jpeg begining bytes or EXIF end bytes
-// FF C0 or something like that
+// Finds the EXIF data in a jpeg file.
 func extractJpegExif(imageBytes []byte) exifData {
-	bytesLength := len(imageBytes)
-	if bytesLength < 2 {
+	start, end := findJpegExifSegment(imageBytes)
+	if start < 0 {
 		return exifData{}
 	}
 
-	// Check for jpeg magic bytes
-	if imageBytes[0] != 0xff || imageBytes[1] != 0xd8 {
-		return exifData{}
+	// We skip the marker and the length bytes
+	return exifData{
+		ExifData: imageBytes[start+4 : end],
+	}
+}
+
+// Replaces the EXIF data in a jpeg file, or removes it if exif has no data.
+// The image data isn't changed. Files without EXIF data are returned as-is.
+func replaceJpegExif(imageBytes []byte, exif exifData) []byte {
+	start, end := findJpegExifSegment(imageBytes)
+	if start < 0 {
+		return imageBytes
 	}
 
-	length := -1
-	start := -1
+	result := make([]byte, 0, len(imageBytes))
+	result = append(result, imageBytes[:start]...)
 
-	// Iterate through the file to find the exif bytes
-	for i := 0; i < bytesLength-1; i++ {
-		byte1 := imageBytes[i]
-		byte2 := imageBytes[i+1]
+	if exif.hasData() && len(exif.ExifData) <= maxExifSegmentLength {
+		result = append(result, exif.makeFileData()...)
+	}
 
-		if byte1 == 0xff && byte2 == 0xe1 {
+	return append(result, imageBytes[end:]...)
+}
 
-			lengthSlice := imageBytes[i+2 : i+4]
-			length = int(binary.BigEndian.Uint16(lengthSlice))
+// Finds the APP1 segment with the EXIF data in a jpeg file. The EXIF data
+// starts with "Exif\0\0". Other APP1 segments, like XMP, are skipped. We stop
+// looking at the start of the image data. Returns where the segment's marker
+// starts and where the segment ends, or -1 if there's no EXIF data.
+func findJpegExifSegment(imageBytes []byte) (int, int) {
+	bytesLength := len(imageBytes)
 
-			start = i + 2
-			break
-		}
+	// Check for jpeg magic bytes
+	if bytesLength < 2 || imageBytes[0] != 0xff || imageBytes[1] != 0xd8 {
+		return -1, -1
 	}
 
-	if length == -1 {
-		return exifData{}
-	}
+	for i := 2; i+4 <= bytesLength; {
+		if imageBytes[i] != 0xff {
+			return -1, -1
+		}
 
-	end := start + length
+		marker := imageBytes[i+1]
 
-	if len(imageBytes) < end {
-		return exifData{}
-	}
+		// Markers can be padded with any number of 0xff bytes
+		if marker == 0xff {
+			i++
+			continue
+		}
 
-	// We have to add 2 to go past the length bytes
-	exif := imageBytes[start+2 : end]
+		// Restart markers and TEM have no length
+		if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			i += 2
+			continue
+		}
 
-	return exifData{
-		ExifData: exif,
+		// Start of scan or end of image
+		if marker == 0xda || marker == 0xd9 {
+			return -1, -1
+		}
+
+		// The length includes the 2 length bytes
+		length := int(binary.BigEndian.Uint16(imageBytes[i+2 : i+4]))
+		end := i + 2 + length
+
+		if length < 2 || end > bytesLength {
+			return -1, -1
+		}
+
+		if marker == 0xe1 && bytes.HasPrefix(imageBytes[i+4:end], []byte(exifIdentifier)) {
+			return i, end
+		}
+
+		i = end
 	}
+
+	return -1, -1
 }
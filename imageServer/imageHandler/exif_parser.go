@@ -0,0 +1,750 @@
+package imageHandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EXIF data is a TIFF file after the "Exif\0\0" identifier. The TIFF header
+// starts with the byte order, II for little endian (Intel) and MM for big
+// endian (Motorola), then the number 42 and the offset of IFD0. An IFD is a
+// count of entries, the entries, then the offset of the next IFD. The Exif and
+// GPS IFDs are pointed to by tags in IFD0, and the Interoperability IFD by a
+// tag in the Exif IFD. Offsets are from the start of the TIFF header.
+// Typical IFD ordering for an EXIF tag:
+// TTTT | ffff | NNNNNNNN | DDDDDDDD
+// TTTT (2 bytes) is the tag
+// ffff (2 bytes) is the format
+// NNNNNNNN (4 bytes) is the number of components
+// DDDDDDDD (4 bytes) contains a data value or offset data value
+//Example:  01 12 00 03 00 00 00 01 00 06
+// 01 12 is the tag (orientation)
+// 00 03 is the format (Unsigned short, 2 bytes)
+// 00 00 00 01 is the amount of compeonts (1)
+// 00 06 is the actual value. In this case, 6 or rotate Clockwise
+// Values that don't fit in 4 bytes are stored elsewhere and DDDDDDDD is their
+// offset.
+
+const exifIdentifier = "Exif\x00\x00"
+
+// Tags in IFD0
+const (
+	exifTagMake        uint16 = 0x010f
+	exifTagModel       uint16 = 0x0110
+	exifTagOrientation uint16 = 0x0112
+	exifTagExifIFD     uint16 = 0x8769
+	exifTagGPSIFD      uint16 = 0x8825
+)
+
+// Tags in the Exif IFD
+const (
+	exifTagExposureTime       uint16 = 0x829a
+	exifTagFNumber            uint16 = 0x829d
+	exifTagISO                uint16 = 0x8827
+	exifTagDateTimeOriginal   uint16 = 0x9003
+	exifTagOffsetTimeOriginal uint16 = 0x9011
+	exifTagFocalLength        uint16 = 0x920a
+	exifTagInteropIFD         uint16 = 0xa005
+)
+
+// Tags in the GPS IFD
+const (
+	gpsTagLatitudeRef  uint16 = 0x0001
+	gpsTagLatitude     uint16 = 0x0002
+	gpsTagLongitudeRef uint16 = 0x0003
+	gpsTagLongitude    uint16 = 0x0004
+	gpsTagAltitudeRef  uint16 = 0x0005
+	gpsTagAltitude     uint16 = 0x0006
+)
+
+// The tags that point to sub IFDs in each IFD. IFD0 is 0.
+var exifSubIFDTags = map[uint16][]uint16{
+	0:              {exifTagExifIFD, exifTagGPSIFD},
+	exifTagExifIFD: {exifTagInteropIFD},
+}
+
+// Identifies a tag by the IFD that it's in and its ID. ifd is the tag that
+// points to the IFD, or 0 for IFD0.
+type exifTagKey struct {
+	ifd uint16
+	id  uint16
+}
+
+// The tags that can be named in a metadata allowlist
+var exifTagNames = map[string]exifTagKey{
+	"imagedescription": {0, 0x010e},
+	"make":             {0, exifTagMake},
+	"model":            {0, exifTagModel},
+	"orientation":      {0, exifTagOrientation},
+	"xresolution":      {0, 0x011a},
+	"yresolution":      {0, 0x011b},
+	"resolutionunit":   {0, 0x0128},
+	"software":         {0, 0x0131},
+	"datetime":         {0, 0x0132},
+	"artist":           {0, 0x013b},
+	"copyright":        {0, 0x8298},
+
+	"exposuretime":          {exifTagExifIFD, exifTagExposureTime},
+	"fnumber":               {exifTagExifIFD, exifTagFNumber},
+	"exposureprogram":       {exifTagExifIFD, 0x8822},
+	"isospeedratings":       {exifTagExifIFD, exifTagISO},
+	"iso":                   {exifTagExifIFD, exifTagISO},
+	"exifversion":           {exifTagExifIFD, 0x9000},
+	"datetimeoriginal":      {exifTagExifIFD, exifTagDateTimeOriginal},
+	"datetimedigitized":     {exifTagExifIFD, 0x9004},
+	"offsettime":            {exifTagExifIFD, 0x9010},
+	"offsettimeoriginal":    {exifTagExifIFD, exifTagOffsetTimeOriginal},
+	"offsettimedigitized":   {exifTagExifIFD, 0x9012},
+	"shutterspeedvalue":     {exifTagExifIFD, 0x9201},
+	"aperturevalue":         {exifTagExifIFD, 0x9202},
+	"exposurebiasvalue":     {exifTagExifIFD, 0x9204},
+	"maxaperturevalue":      {exifTagExifIFD, 0x9205},
+	"meteringmode":          {exifTagExifIFD, 0x9207},
+	"flash":                 {exifTagExifIFD, 0x9209},
+	"focallength":           {exifTagExifIFD, exifTagFocalLength},
+	"makernote":             {exifTagExifIFD, 0x927c},
+	"usercomment":           {exifTagExifIFD, 0x9286},
+	"colorspace":            {exifTagExifIFD, 0xa001},
+	"exposuremode":          {exifTagExifIFD, 0xa402},
+	"whitebalance":          {exifTagExifIFD, 0xa403},
+	"focallengthin35mmfilm": {exifTagExifIFD, 0xa405},
+	"scenecapturetype":      {exifTagExifIFD, 0xa406},
+	"cameraownername":       {exifTagExifIFD, 0xa430},
+	"bodyserialnumber":      {exifTagExifIFD, 0xa431},
+	"lensmake":              {exifTagExifIFD, 0xa433},
+	"lensmodel":             {exifTagExifIFD, 0xa434},
+	"lensserialnumber":      {exifTagExifIFD, 0xa435},
+
+	"gpslatituderef":  {exifTagGPSIFD, gpsTagLatitudeRef},
+	"gpslatitude":     {exifTagGPSIFD, gpsTagLatitude},
+	"gpslongituderef": {exifTagGPSIFD, gpsTagLongitudeRef},
+	"gpslongitude":    {exifTagGPSIFD, gpsTagLongitude},
+	"gpsaltituderef":  {exifTagGPSIFD, gpsTagAltitudeRef},
+	"gpsaltitude":     {exifTagGPSIFD, gpsTagAltitude},
+	"gpstimestamp":    {exifTagGPSIFD, 0x0007},
+	"gpsdatestamp":    {exifTagGPSIFD, 0x001d},
+}
+
+// Returns the tag with the name, ignoring case
+func getExifTagKey(name string) (exifTagKey, bool) {
+	key, ok := exifTagNames[strings.ToLower(name)]
+	return key, ok
+}
+
+// IFDs can't have more entries than this. It stops corrupt data from making
+// us allocate a lot of memory.
+const maxExifEntries = 1000
+
+type exifFormat uint16
+
+const (
+	exifFormatByte exifFormat = iota + 1
+	exifFormatASCII
+	exifFormatShort
+	exifFormatLong
+	exifFormatRational
+	exifFormatSByte
+	exifFormatUndefined
+	exifFormatSShort
+	exifFormatSLong
+	exifFormatSRational
+	exifFormatFloat
+	exifFormatDouble
+	exifFormatIFDOffset
+)
+
+// Returns the size of one component of the format, or 0 for unknown formats
+func (f exifFormat) size() int {
+	switch f {
+	case exifFormatByte, exifFormatASCII, exifFormatSByte, exifFormatUndefined:
+		return 1
+	case exifFormatShort, exifFormatSShort:
+		return 2
+	case exifFormatLong, exifFormatSLong, exifFormatFloat, exifFormatIFDOffset:
+		return 4
+	case exifFormatRational, exifFormatSRational, exifFormatDouble:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// A single tag. Value is in the byte order of the EXIF data that it came
+// from.
+type exifTag struct {
+	ID     uint16
+	Format exifFormat
+	Count  uint32
+	Value  []byte
+}
+
+// An IFD's tags and the IFDs that its tags point to. The tags that point to
+// sub IFDs aren't in Tags, they're written with the sub IFDs.
+type exifIFD struct {
+	Tags    []exifTag
+	SubIFDs map[uint16]*exifIFD
+}
+
+func (ifd *exifIFD) get(id uint16) (exifTag, bool) {
+	for _, tag := range ifd.Tags {
+		if tag.ID == id {
+			return tag, true
+		}
+	}
+
+	return exifTag{}, false
+}
+
+// Replaces the tag with the same ID, or adds the tag
+func (ifd *exifIFD) set(tag exifTag) {
+	for i := range ifd.Tags {
+		if ifd.Tags[i].ID == tag.ID {
+			ifd.Tags[i] = tag
+			return
+		}
+	}
+
+	ifd.Tags = append(ifd.Tags, tag)
+}
+
+func (ifd *exifIFD) remove(id uint16) {
+	tags := make([]exifTag, 0, len(ifd.Tags))
+	for _, tag := range ifd.Tags {
+		if tag.ID != id {
+			tags = append(tags, tag)
+		}
+	}
+
+	ifd.Tags = tags
+}
+
+func (ifd *exifIFD) isEmpty() bool {
+	for _, sub := range ifd.SubIFDs {
+		if !sub.isEmpty() {
+			return false
+		}
+	}
+
+	return len(ifd.Tags) == 0
+}
+
+// The parsed tags of EXIF data. IFD1, which holds a thumbnail of the original
+// image, isn't kept, since the thumbnail doesn't match converted images.
+type exifTags struct {
+	order binary.ByteOrder
+	IFD0  *exifIFD
+}
+
+// Parses EXIF data, with or without the "Exif\0\0" identifier. Tags with
+// values outside of the data and sub IFDs that can't be read are skipped, so
+// that one bad tag doesn't lose the rest.
+func parseExif(data []byte) (*exifTags, error) {
+	tiff := bytes.TrimPrefix(data, []byte(exifIdentifier))
+
+	if len(tiff) < 8 {
+		return nil, NewExifError("exif data is too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, NewExifError("invalid exif byte order")
+	}
+
+	if order.Uint16(tiff[2:4]) != 42 {
+		return nil, NewExifError("invalid tiff header")
+	}
+
+	parser := exifParser{
+		tiff:    tiff,
+		order:   order,
+		visited: make(map[uint32]bool),
+	}
+
+	ifd0, err := parser.parseIFD(order.Uint32(tiff[4:8]), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exifTags{order: order, IFD0: ifd0}, nil
+}
+
+type exifParser struct {
+	tiff  []byte
+	order binary.ByteOrder
+
+	// IFDs that were already parsed, so that IFDs pointing at each other
+	// don't loop forever
+	visited map[uint32]bool
+}
+
+// Parses the IFD at offset. pointerTag is the tag that pointed to the IFD.
+func (p *exifParser) parseIFD(offset uint32, pointerTag uint16) (*exifIFD, error) {
+	if p.visited[offset] {
+		return nil, NewExifError("exif IFDs form a loop")
+	}
+	p.visited[offset] = true
+
+	start := int64(offset)
+	if start+2 > int64(len(p.tiff)) {
+		return nil, NewExifError("exif IFD is outside of the data")
+	}
+
+	entries := int(p.order.Uint16(p.tiff[start : start+2]))
+	if entries > maxExifEntries || start+2+int64(entries)*12 > int64(len(p.tiff)) {
+		return nil, NewExifError("exif IFD is too long")
+	}
+
+	ifd := &exifIFD{
+		Tags:    make([]exifTag, 0, entries),
+		SubIFDs: make(map[uint16]*exifIFD),
+	}
+
+	for i := 0; i < entries; i++ {
+		entry := p.tiff[start+2+int64(i)*12 : start+2+int64(i+1)*12]
+
+		tag, ok := p.parseTag(entry)
+		if !ok {
+			continue
+		}
+
+		if isSubIFDTag(pointerTag, tag.ID) {
+			if tag.Count != 1 || tag.Format.size() != 4 {
+				continue
+			}
+
+			sub, err := p.parseIFD(p.order.Uint32(tag.Value), tag.ID)
+			if err == nil {
+				ifd.SubIFDs[tag.ID] = sub
+			}
+
+			continue
+		}
+
+		ifd.Tags = append(ifd.Tags, tag)
+	}
+
+	return ifd, nil
+}
+
+// Parses a 12 byte IFD entry. Returns false if the entry can't be read.
+func (p *exifParser) parseTag(entry []byte) (exifTag, bool) {
+	tag := exifTag{
+		ID:     p.order.Uint16(entry[0:2]),
+		Format: exifFormat(p.order.Uint16(entry[2:4])),
+		Count:  p.order.Uint32(entry[4:8]),
+	}
+
+	size := int64(tag.Format.size()) * int64(tag.Count)
+	if size == 0 {
+		return exifTag{}, false
+	}
+
+	var value []byte
+	if size <= 4 {
+		value = entry[8 : 8+size]
+	} else {
+		offset := int64(p.order.Uint32(entry[8:12]))
+		if offset+size > int64(len(p.tiff)) {
+			return exifTag{}, false
+		}
+		value = p.tiff[offset : offset+size]
+	}
+
+	// The value is copied so that changing it doesn't change the original data
+	tag.Value = append([]byte{}, value...)
+
+	return tag, true
+}
+
+func isSubIFDTag(pointerTag, id uint16) bool {
+	for _, subTag := range exifSubIFDTags[pointerTag] {
+		if subTag == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+/****************************************************************************************
+ * Typed tags
+*****************************************************************************************/
+
+// An unsigned rational value, like an exposure time of 1/250
+type exifRational struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+func (r exifRational) Float() float64 {
+	if r.Denominator == 0 {
+		return 0
+	}
+
+	return float64(r.Numerator) / float64(r.Denominator)
+}
+
+// A position from the GPS IFD. Latitude is negative in the southern hemisphere
+// and Longitude is negative in the western hemisphere. Altitude is in meters
+// and is only set if HasAltitude is true.
+type exifGPS struct {
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	HasAltitude bool
+}
+
+// Returns the sub IFD that pointerTag points to in IFD0, or nil
+func (e *exifTags) subIFD(pointerTag uint16) *exifIFD {
+	return e.IFD0.SubIFDs[pointerTag]
+}
+
+// Reads the component at index of a BYTE, SHORT or LONG tag
+func (e *exifTags) uintValue(tag exifTag, index int) (uint32, bool) {
+	if index < 0 || uint32(index) >= tag.Count {
+		return 0, false
+	}
+
+	switch tag.Format {
+	case exifFormatByte:
+		return uint32(tag.Value[index]), true
+	case exifFormatShort:
+		return uint32(e.order.Uint16(tag.Value[index*2:])), true
+	case exifFormatLong:
+		return e.order.Uint32(tag.Value[index*4:]), true
+	default:
+		return 0, false
+	}
+}
+
+// Reads the component at index of a RATIONAL tag
+func (e *exifTags) rationalValue(tag exifTag, index int) (exifRational, bool) {
+	if tag.Format != exifFormatRational || index < 0 || uint32(index) >= tag.Count {
+		return exifRational{}, false
+	}
+
+	return exifRational{
+		Numerator:   e.order.Uint32(tag.Value[index*8:]),
+		Denominator: e.order.Uint32(tag.Value[index*8+4:]),
+	}, true
+}
+
+// Reads an ASCII tag. Values end at the first NUL and are trimmed of spaces,
+// which some cameras pad values with.
+func (e *exifTags) stringValue(tag exifTag) string {
+	if tag.Format != exifFormatASCII {
+		return ""
+	}
+
+	value := tag.Value
+	if end := bytes.IndexByte(value, 0); end >= 0 {
+		value = value[:end]
+	}
+
+	return strings.TrimSpace(string(value))
+}
+
+func (e *exifTags) getString(ifd *exifIFD, id uint16) string {
+	if ifd == nil {
+		return ""
+	}
+
+	tag, ok := ifd.get(id)
+	if !ok {
+		return ""
+	}
+
+	return e.stringValue(tag)
+}
+
+func (e *exifTags) getRational(ifd *exifIFD, id uint16) (exifRational, bool) {
+	if ifd == nil {
+		return exifRational{}, false
+	}
+
+	tag, ok := ifd.get(id)
+	if !ok {
+		return exifRational{}, false
+	}
+
+	return e.rationalValue(tag, 0)
+}
+
+// Returns the orientation from IFD0, or Horizontal if there isn't one
+func (e *exifTags) Orientation() Orientation {
+	tag, ok := e.IFD0.get(exifTagOrientation)
+	if !ok {
+		return Horizontal
+	}
+
+	value, ok := e.uintValue(tag, 0)
+	if !ok || value > math.MaxUint16 {
+		return Horizontal
+	}
+
+	return getOrientation(uint16(value))
+}
+
+func (e *exifTags) SetOrientation(orientation Orientation) {
+	value := make([]byte, 2)
+	e.order.PutUint16(value, uint16(orientation))
+
+	e.IFD0.set(exifTag{
+		ID:     exifTagOrientation,
+		Format: exifFormatShort,
+		Count:  1,
+		Value:  value,
+	})
+}
+
+func (e *exifTags) Make() string {
+	return e.getString(e.IFD0, exifTagMake)
+}
+
+func (e *exifTags) Model() string {
+	return e.getString(e.IFD0, exifTagModel)
+}
+
+// Returns when the photo was taken. EXIF dates have no time zone, so the date
+// is in UTC unless the Exif IFD has the offset of the original time.
+func (e *exifTags) DateTimeOriginal() (time.Time, bool) {
+	exifIFD := e.subIFD(exifTagExifIFD)
+
+	value := e.getString(exifIFD, exifTagDateTimeOriginal)
+	if len(value) == 0 {
+		return time.Time{}, false
+	}
+
+	if offset := e.getString(exifIFD, exifTagOffsetTimeOriginal); len(offset) > 0 {
+		if date, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return date, true
+		}
+	}
+
+	date, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return date, true
+}
+
+// Returns the exposure time in seconds as a fraction, e.g. 1/250
+func (e *exifTags) ExposureTime() (exifRational, bool) {
+	return e.getRational(e.subIFD(exifTagExifIFD), exifTagExposureTime)
+}
+
+func (e *exifTags) FNumber() (float64, bool) {
+	value, ok := e.getRational(e.subIFD(exifTagExifIFD), exifTagFNumber)
+	return value.Float(), ok
+}
+
+// Returns the focal length in millimeters
+func (e *exifTags) FocalLength() (float64, bool) {
+	value, ok := e.getRational(e.subIFD(exifTagExifIFD), exifTagFocalLength)
+	return value.Float(), ok
+}
+
+func (e *exifTags) ISO() (uint32, bool) {
+	exifIFD := e.subIFD(exifTagExifIFD)
+	if exifIFD == nil {
+		return 0, false
+	}
+
+	tag, ok := exifIFD.get(exifTagISO)
+	if !ok {
+		return 0, false
+	}
+
+	return e.uintValue(tag, 0)
+}
+
+// Returns the position from the GPS IFD. Returns false if there's no latitude
+// and longitude.
+func (e *exifTags) GPS() (exifGPS, bool) {
+	gpsIFD := e.subIFD(exifTagGPSIFD)
+	if gpsIFD == nil {
+		return exifGPS{}, false
+	}
+
+	latitude, latOk := e.gpsCoordinate(gpsIFD, gpsTagLatitude, gpsTagLatitudeRef, "S")
+	longitude, lonOk := e.gpsCoordinate(gpsIFD, gpsTagLongitude, gpsTagLongitudeRef, "W")
+
+	if !latOk || !lonOk {
+		return exifGPS{}, false
+	}
+
+	gps := exifGPS{Latitude: latitude, Longitude: longitude}
+
+	if altitude, ok := e.getRational(gpsIFD, gpsTagAltitude); ok {
+		gps.Altitude = altitude.Float()
+		gps.HasAltitude = true
+
+		// An altitude reference of 1 is below sea level
+		if ref, ok := gpsIFD.get(gpsTagAltitudeRef); ok {
+			if value, ok := e.uintValue(ref, 0); ok && value == 1 {
+				gps.Altitude = -gps.Altitude
+			}
+		}
+	}
+
+	return gps, true
+}
+
+// Coordinates are stored as degrees, minutes and seconds, with a reference
+// tag for the hemisphere
+func (e *exifTags) gpsCoordinate(gpsIFD *exifIFD, id, refId uint16, negativeRef string) (float64, bool) {
+	tag, ok := gpsIFD.get(id)
+	if !ok || tag.Count < 3 {
+		return 0, false
+	}
+
+	var coordinate float64
+	for i, divisor := range []float64{1, 60, 3600} {
+		value, ok := e.rationalValue(tag, i)
+		if !ok {
+			return 0, false
+		}
+		coordinate += value.Float() / divisor
+	}
+
+	if strings.EqualFold(e.getString(gpsIFD, refId), negativeRef) {
+		coordinate = -coordinate
+	}
+
+	return coordinate, true
+}
+
+func (e *exifTags) RemoveGPS() {
+	delete(e.IFD0.SubIFDs, exifTagGPSIFD)
+}
+
+// Removes every tag that isn't named in names. Unknown names are ignored. The
+// Interoperability IFD is removed, since it can't be named.
+func (e *exifTags) KeepOnly(names []string) {
+	keep := make(map[exifTagKey]bool)
+	for _, name := range names {
+		if key, ok := getExifTagKey(name); ok {
+			keep[key] = true
+		}
+	}
+
+	keepTags := func(ifd *exifIFD, pointerTag uint16) {
+		tags := make([]exifTag, 0, len(ifd.Tags))
+		for _, tag := range ifd.Tags {
+			if keep[exifTagKey{pointerTag, tag.ID}] {
+				tags = append(tags, tag)
+			}
+		}
+		ifd.Tags = tags
+	}
+
+	keepTags(e.IFD0, 0)
+
+	for pointerTag, sub := range e.IFD0.SubIFDs {
+		keepTags(sub, pointerTag)
+		sub.SubIFDs = make(map[uint16]*exifIFD)
+	}
+}
+
+/****************************************************************************************
+ * Serializing
+*****************************************************************************************/
+
+// Serializes the tags as EXIF data with the "Exif\0\0" identifier, which can
+// be written with newWriterExif. Tags are written in order of their IDs, so
+// the same tags always make the same bytes.
+func (e *exifTags) Bytes() []byte {
+	writer := exifWriter{order: e.order}
+
+	if e.order == binary.LittleEndian {
+		writer.buf = append(writer.buf, 'I', 'I')
+	} else {
+		writer.buf = append(writer.buf, 'M', 'M')
+	}
+
+	writer.buf = append(writer.buf, 0, 0, 0, 0, 0, 0)
+	e.order.PutUint16(writer.buf[2:4], 42)
+
+	ifd0Offset := writer.writeIFD(e.IFD0)
+	e.order.PutUint32(writer.buf[4:8], ifd0Offset)
+
+	return append([]byte(exifIdentifier), writer.buf...)
+}
+
+type exifWriter struct {
+	order binary.ByteOrder
+	buf   []byte
+}
+
+// Values and IFDs start on even offsets
+func (w *exifWriter) align() {
+	if len(w.buf)%2 == 1 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// Writes an IFD, its values and its sub IFDs to the end of the buffer and
+// returns the IFD's offset
+func (w *exifWriter) writeIFD(ifd *exifIFD) uint32 {
+	entries := make([]exifTag, 0, len(ifd.Tags)+len(ifd.SubIFDs))
+	entries = append(entries, ifd.Tags...)
+
+	for id, sub := range ifd.SubIFDs {
+		if !sub.isEmpty() {
+			entries = append(entries, exifTag{ID: id, Format: exifFormatLong, Count: 1, Value: make([]byte, 4)})
+		}
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].ID < entries[b].ID
+	})
+
+	w.align()
+	start := len(w.buf)
+
+	// The entry count, the entries and the offset of the next IFD, which is
+	// always 0
+	w.buf = append(w.buf, make([]byte, 2+len(entries)*12+4)...)
+	w.order.PutUint16(w.buf[start:], uint16(len(entries)))
+
+	for i, tag := range entries {
+		entry := start + 2 + i*12
+
+		w.order.PutUint16(w.buf[entry:], tag.ID)
+		w.order.PutUint16(w.buf[entry+2:], uint16(tag.Format))
+		w.order.PutUint32(w.buf[entry+4:], tag.Count)
+
+		if len(tag.Value) <= 4 {
+			copy(w.buf[entry+8:entry+12], tag.Value)
+			continue
+		}
+
+		w.align()
+		w.order.PutUint32(w.buf[entry+8:], uint32(len(w.buf)))
+		w.buf = append(w.buf, tag.Value...)
+	}
+
+	// Sub IFDs are written after this IFD's values, then their offsets are
+	// filled in
+	for i, tag := range entries {
+		sub, ok := ifd.SubIFDs[tag.ID]
+		if !ok || sub.isEmpty() {
+			continue
+		}
+
+		offset := w.writeIFD(sub)
+		w.order.PutUint32(w.buf[start+2+i*12+8:], offset)
+	}
+
+	return uint32(start)
+}
@@ -0,0 +1,476 @@
+package imageHandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+// Makes EXIF data with an IFD that only has the orientation tag
+func makeOrientationExif(order binary.ByteOrder, orientation Orientation) []byte {
+	data := []byte("Exif\x00\x00")
+
+	if order == binary.LittleEndian {
+		data = append(data, 'I', 'I')
+	} else {
+		data = append(data, 'M', 'M')
+	}
+
+	short := func(value uint16) {
+		b := make([]byte, 2)
+		order.PutUint16(b, value)
+		data = append(data, b...)
+	}
+	long := func(value uint32) {
+		b := make([]byte, 4)
+		order.PutUint32(b, value)
+		data = append(data, b...)
+	}
+
+	short(42)
+	long(8)
+
+	// One entry: the orientation as a single short
+	short(1)
+	short(0x0112)
+	short(3)
+	long(1)
+	short(uint16(orientation))
+	short(0)
+
+	// No next IFD
+	long(0)
+
+	return data
+}
+
+func TestGetImageOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := Horizontal; o <= RotateCCW; o++ {
+			exif := exifData{ExifData: makeOrientationExif(order, o)}
+
+			if result := exif.getImageOrientation(); result != o {
+				t.Fatalf("orientation = '%v', Should be '%v'", result, o)
+			}
+
+			reset := exif.withOrientation(Horizontal)
+			if result := reset.getImageOrientation(); result != Horizontal {
+				t.Fatalf("reset orientation = '%v', Should be '%v'", result, Horizontal)
+			}
+
+			// The original data is left alone
+			if result := exif.getImageOrientation(); result != o {
+				t.Fatalf("orientation after reset = '%v', Should be '%v'", result, o)
+			}
+		}
+	}
+
+	empty := exifData{}
+	if result := empty.getImageOrientation(); result != Horizontal {
+		t.Fatalf("orientation = '%v', Should be '%v'", result, Horizontal)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 3x2 image where each pixel has a different red value
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			src.Set(x, y, color.RGBA{uint8(y*3 + x), 0, 0, 255})
+		}
+	}
+
+	// The source pixel that ends up in the top left and top right corners
+	tests := []struct {
+		orientation Orientation
+		size        ImageSize
+		topLeft     image.Point
+		topRight    image.Point
+	}{
+		{Horizontal, ImageSize{3, 2}, image.Pt(0, 0), image.Pt(2, 0)},
+		{MirrorHorizontal, ImageSize{3, 2}, image.Pt(2, 0), image.Pt(0, 0)},
+		{Rotate180, ImageSize{3, 2}, image.Pt(2, 1), image.Pt(0, 1)},
+		{MirrorVertical, ImageSize{3, 2}, image.Pt(0, 1), image.Pt(2, 1)},
+		{MirrorHorizontalRotateCCW, ImageSize{2, 3}, image.Pt(0, 0), image.Pt(0, 1)},
+		{RotateCW, ImageSize{2, 3}, image.Pt(0, 1), image.Pt(0, 0)},
+		{MirrorHorizontalRotateCW, ImageSize{2, 3}, image.Pt(2, 1), image.Pt(2, 0)},
+		{RotateCCW, ImageSize{2, 3}, image.Pt(2, 0), image.Pt(2, 1)},
+	}
+
+	for _, test := range tests {
+		result := orientImage(src, test.orientation)
+
+		size := GetImageSize(&result)
+		if size != test.size {
+			t.Fatalf("%v: size = '%v', Should be '%v'", test.orientation, size, test.size)
+		}
+
+		if result.At(0, 0) != src.At(test.topLeft.X, test.topLeft.Y) {
+			t.Fatalf("%v: top left = '%v', Should be '%v'", test.orientation, result.At(0, 0), src.At(test.topLeft.X, test.topLeft.Y))
+		}
+
+		if result.At(size.Width-1, 0) != src.At(test.topRight.X, test.topRight.Y) {
+			t.Fatalf("%v: top right = '%v', Should be '%v'", test.orientation, result.At(size.Width-1, 0), src.At(test.topRight.X, test.topRight.Y))
+		}
+	}
+}
+
+func TestMakeImageDataAppliesOrientation(t *testing.T) {
+	// A 64x32 jpeg that's displayed rotated clockwise
+	src := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	buffer := new(bytes.Buffer)
+	writer, _ := newWriterExif(buffer, exifData{ExifData: makeOrientationExif(binary.LittleEndian, RotateCW)})
+
+	if err := jpeg.Encode(writer, src, nil); err != nil {
+		t.Fatalf("jpeg.Encode returned error '%v'", err)
+	}
+
+	dat, err := makeImageDataFromBytes(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	size := GetImageSize(dat.ImageData)
+	if size != (ImageSize{32, 64}) {
+		t.Fatalf("size = '%v', Should be '%v'", size, ImageSize{32, 64})
+	}
+
+	if orientation := dat.ExifData.getImageOrientation(); orientation != Horizontal {
+		t.Fatalf("orientation = '%v', Should be '%v'", orientation, Horizontal)
+	}
+
+	// The original file still has its orientation
+	original := extractJpegExif(dat.OriginalData)
+	if orientation := original.getImageOrientation(); orientation != RotateCW {
+		t.Fatalf("original orientation = '%v', Should be '%v'", orientation, RotateCW)
+	}
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 32, CompressTo: Png})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	if encoded.ImageSize != (ImageSize{16, 32}) {
+		t.Fatalf("encoded size = '%v', Should be '%v'", encoded.ImageSize, ImageSize{16, 32})
+	}
+}
+
+func makeAsciiTag(id uint16, value string) exifTag {
+	return exifTag{ID: id, Format: exifFormatASCII, Count: uint32(len(value) + 1), Value: append([]byte(value), 0)}
+}
+
+func makeShortTag(order binary.ByteOrder, id uint16, value uint16) exifTag {
+	data := make([]byte, 2)
+	order.PutUint16(data, value)
+
+	return exifTag{ID: id, Format: exifFormatShort, Count: 1, Value: data}
+}
+
+func makeRationalTag(order binary.ByteOrder, id uint16, values ...uint32) exifTag {
+	data := make([]byte, len(values)*4)
+	for i, value := range values {
+		order.PutUint32(data[i*4:], value)
+	}
+
+	return exifTag{ID: id, Format: exifFormatRational, Count: uint32(len(values) / 2), Value: data}
+}
+
+// Makes tags in IFD0, the Exif IFD and the GPS IFD
+func makeTestExifTags(order binary.ByteOrder) *exifTags {
+	return &exifTags{
+		order: order,
+		IFD0: &exifIFD{
+			Tags: []exifTag{
+				makeAsciiTag(exifTagMake, "Camera Maker  "),
+				makeAsciiTag(exifTagModel, "Model 7"),
+				makeShortTag(order, exifTagOrientation, uint16(RotateCCW)),
+			},
+			SubIFDs: map[uint16]*exifIFD{
+				exifTagExifIFD: {
+					Tags: []exifTag{
+						makeAsciiTag(exifTagDateTimeOriginal, "2021:06:05 14:30:00"),
+						makeAsciiTag(exifTagOffsetTimeOriginal, "+02:00"),
+						makeRationalTag(order, exifTagExposureTime, 1, 250),
+						makeRationalTag(order, exifTagFNumber, 28, 10),
+						makeShortTag(order, exifTagISO, 400),
+					},
+				},
+				exifTagGPSIFD: {
+					Tags: []exifTag{
+						makeAsciiTag(gpsTagLatitudeRef, "S"),
+						makeRationalTag(order, gpsTagLatitude, 33, 1, 52, 1, 12, 1),
+						makeAsciiTag(gpsTagLongitudeRef, "E"),
+						makeRationalTag(order, gpsTagLongitude, 151, 1, 12, 1, 36, 1),
+						makeRationalTag(order, gpsTagAltitude, 58, 1),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestParseExif(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := makeTestExifTags(order).Bytes()
+
+		tags, err := parseExif(data)
+		if err != nil {
+			t.Fatalf("parseExif returned error '%v'", err)
+		}
+
+		if tags.Make() != "Camera Maker" || tags.Model() != "Model 7" {
+			t.Fatalf("make and model = '%v %v', Should be 'Camera Maker Model 7'", tags.Make(), tags.Model())
+		}
+
+		if tags.Orientation() != RotateCCW {
+			t.Fatalf("orientation = '%v', Should be '%v'", tags.Orientation(), RotateCCW)
+		}
+
+		date, ok := tags.DateTimeOriginal()
+		expectedDate := time.Date(2021, 6, 5, 12, 30, 0, 0, time.UTC)
+		if !ok || !date.Equal(expectedDate) {
+			t.Fatalf("date = '%v', Should be '%v'", date, expectedDate)
+		}
+
+		exposure, ok := tags.ExposureTime()
+		if !ok || exposure != (exifRational{1, 250}) {
+			t.Fatalf("exposure = '%v', Should be '1/250'", exposure)
+		}
+
+		if fNumber, ok := tags.FNumber(); !ok || fNumber != 2.8 {
+			t.Fatalf("fNumber = '%v', Should be '2.8'", fNumber)
+		}
+
+		if iso, ok := tags.ISO(); !ok || iso != 400 {
+			t.Fatalf("iso = '%v', Should be '400'", iso)
+		}
+
+		gps, ok := tags.GPS()
+		if !ok || math.Abs(gps.Latitude+33.87) > 0.0001 || math.Abs(gps.Longitude-151.21) > 0.0001 || gps.Altitude != 58 {
+			t.Fatalf("gps = '%v', Should be '{-33.87 151.21 58 true}'", gps)
+		}
+
+		// Serializing the parsed tags makes the same bytes
+		if !bytes.Equal(tags.Bytes(), data) {
+			t.Fatalf("serialized tags don't match the original data")
+		}
+
+		tags.RemoveGPS()
+		tags.SetOrientation(Horizontal)
+
+		modified, err := parseExif(tags.Bytes())
+		if err != nil {
+			t.Fatalf("parseExif returned error '%v'", err)
+		}
+
+		if _, ok := modified.GPS(); ok {
+			t.Fatalf("gps should have been removed")
+		}
+		if modified.Orientation() != Horizontal {
+			t.Fatalf("orientation = '%v', Should be '%v'", modified.Orientation(), Horizontal)
+		}
+		if _, ok := modified.DateTimeOriginal(); !ok {
+			t.Fatalf("DateTimeOriginal should have been kept")
+		}
+	}
+}
+
+func TestParseExifInvalidData(t *testing.T) {
+	data := makeTestExifTags(binary.BigEndian).Bytes()
+
+	// Truncated data and corrupt bytes shouldn't panic
+	for i := 0; i < len(data); i++ {
+		parseExif(data[:i])
+
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0xff
+		if tags, err := parseExif(corrupt); err == nil {
+			tags.Orientation()
+			tags.DateTimeOriginal()
+			tags.GPS()
+		}
+	}
+
+	// IFD0 pointing at itself as the Exif IFD
+	looped := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01\x87\x69\x00\x04\x00\x00\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00")
+
+	tags, err := parseExif(looped)
+	if err != nil {
+		t.Fatalf("parseExif returned error '%v'", err)
+	}
+	if tags.subIFD(exifTagExifIFD) != nil {
+		t.Fatalf("an IFD that points to itself should be skipped")
+	}
+
+	if _, err := parseExif([]byte("Exif\x00\x00XX\x00\x2a\x00\x00\x00\x08")); err == nil {
+		t.Fatalf("an invalid byte order should return an error")
+	}
+}
+
+func TestExtractJpegExif(t *testing.T) {
+	exif := makeOrientationExif(binary.BigEndian, Rotate180)
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")
+
+	segment := func(marker byte, data []byte) []byte {
+		return append([]byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)}, data...)
+	}
+
+	file := []byte{0xff, 0xd8}
+	file = append(file, segment(0xe0, []byte("JFIF\x00"))...)
+	file = append(file, segment(0xe1, xmp)...)
+	file = append(file, segment(0xe1, exif)...)
+	file = append(file, 0xff, 0xda)
+
+	result := extractJpegExif(file)
+	if !bytes.Equal(result.ExifData, exif) {
+		t.Fatalf("ExifData = '%v', Should be '%v'", result.ExifData, exif)
+	}
+
+	// Without the Exif segment, the XMP segment isn't returned
+	withoutExif := []byte{0xff, 0xd8}
+	withoutExif = append(withoutExif, segment(0xe1, xmp)...)
+	withoutExif = append(withoutExif, 0xff, 0xda)
+
+	if result := extractJpegExif(withoutExif); result.hasData() {
+		t.Fatalf("XMP data should not be returned as EXIF data")
+	}
+}
+
+func TestExifWithPolicy(t *testing.T) {
+	exif := exifData{ExifData: makeTestExifTags(binary.BigEndian).Bytes()}
+
+	if kept := exif.withPolicy(KeepMetadata, nil); !bytes.Equal(kept.ExifData, exif.ExifData) {
+		t.Fatalf("keep should not change the exif data")
+	}
+
+	if stripped := exif.withPolicy(StripMetadata, nil); stripped.hasData() {
+		t.Fatalf("strip should remove the exif data")
+	}
+
+	withoutGPS := exif.withPolicy(StripGPSMetadata, nil)
+	tags, err := withoutGPS.parse()
+	if err != nil {
+		t.Fatalf("parse returned error '%v'", err)
+	}
+	if _, ok := tags.GPS(); ok {
+		t.Fatalf("strip-gps should remove the gps location")
+	}
+	if tags.Make() != "Camera Maker" {
+		t.Fatalf("Make = '%v', Should be 'Camera Maker'", tags.Make())
+	}
+
+	allowed := exif.withPolicy(AllowlistMetadata, []string{"Make", "datetimeoriginal"})
+	tags, err = allowed.parse()
+	if err != nil {
+		t.Fatalf("parse returned error '%v'", err)
+	}
+	if tags.Make() != "Camera Maker" || tags.Model() != "" {
+		t.Fatalf("make and model = '%v' '%v', Should be 'Camera Maker' ''", tags.Make(), tags.Model())
+	}
+	if _, ok := tags.DateTimeOriginal(); !ok {
+		t.Fatalf("DateTimeOriginal should have been kept")
+	}
+	if _, ok := tags.ISO(); ok {
+		t.Fatalf("ISO should have been removed")
+	}
+	if _, ok := tags.GPS(); ok {
+		t.Fatalf("the gps location should have been removed")
+	}
+}
+
+func TestGetMetadataPolicy(t *testing.T) {
+	t.Setenv(constants.PUBLIC_METADATA_POLICY, "")
+
+	if policy, _ := (ConversionOp{Private: true}).getMetadataPolicy(); policy != KeepMetadata {
+		t.Fatalf("policy = '%v', Should be '%v'", policy, KeepMetadata)
+	}
+
+	if policy, _ := (ConversionOp{}).getMetadataPolicy(); policy != StripGPSMetadata {
+		t.Fatalf("policy = '%v', Should be '%v'", policy, StripGPSMetadata)
+	}
+
+	t.Setenv(constants.PUBLIC_METADATA_POLICY, "allowlist")
+	t.Setenv(constants.PUBLIC_METADATA_ALLOWLIST, "Make, Model")
+
+	policy, names := (ConversionOp{}).getMetadataPolicy()
+	if policy != AllowlistMetadata || len(names) != 2 || names[1] != "Model" {
+		t.Fatalf("policy = '%v' '%v', Should be '%v' '[Make Model]'", policy, names, AllowlistMetadata)
+	}
+
+	if policy, _ := (ConversionOp{Metadata: StripMetadata}).getMetadataPolicy(); policy != StripMetadata {
+		t.Fatalf("policy = '%v', Should be '%v'", policy, StripMetadata)
+	}
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "original", Metadata: "allowlist"}); err == nil {
+		t.Fatalf("allowlist without tags should return an error")
+	}
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "original", Metadata: "allowlist", MetadataTags: []string{"Serial"}}); err == nil {
+		t.Fatalf("an unknown tag should return an error")
+	}
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "original", Metadata: "some"}); err == nil {
+		t.Fatalf("an invalid policy should return an error")
+	}
+}
+
+func TestOriginalMetadataPolicy(t *testing.T) {
+	t.Setenv(constants.PUBLIC_METADATA_POLICY, "strip")
+
+	tags := makeTestExifTags(binary.LittleEndian)
+
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	buffer := new(bytes.Buffer)
+	writer, _ := newWriterExif(buffer, exifData{ExifData: tags.Bytes()})
+
+	if err := jpeg.Encode(writer, src, nil); err != nil {
+		t.Fatalf("jpeg.Encode returned error '%v'", err)
+	}
+
+	dat, err := makeImageDataFromBytes(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Original})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	// The original pixels aren't rotated, so only the orientation is kept
+	original := extractJpegExif(encoded.Bytes)
+	originalTags, err := original.parse()
+	if err != nil {
+		t.Fatalf("parse returned error '%v'", err)
+	}
+	if originalTags.Orientation() != RotateCCW || originalTags.Make() != "" {
+		t.Fatalf("original tags = '%v' '%v', Should be '%v' ''", originalTags.Orientation(), originalTags.Make(), RotateCCW)
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(encoded.Bytes)); err != nil {
+		t.Fatalf("jpeg.Decode returned error '%v'", err)
+	}
+
+	private, _ := dat.EncodeImage(ConversionOp{ResizeOp: Original, Private: true})
+	if !bytes.Equal(private.Bytes, buffer.Bytes()) {
+		t.Fatalf("private originals should keep their exif data")
+	}
+
+	scaled, _ := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 8, CompressTo: Jpeg, Metadata: StripGPSMetadata})
+	scaledExif := extractJpegExif(scaled.Bytes)
+	scaledTags, err := scaledExif.parse()
+	if err != nil {
+		t.Fatalf("parse returned error '%v'", err)
+	}
+	if _, ok := scaledTags.GPS(); ok || scaledTags.Make() != "Camera Maker" || scaledTags.Orientation() != Horizontal {
+		t.Fatalf("scaled tags should keep the make and a horizontal orientation without the gps location")
+	}
+}
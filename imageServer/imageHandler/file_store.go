@@ -0,0 +1,70 @@
+package imageHandler
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Information about a single stored file. Filename is the name the file was
+// stored under, Size is the length of the file in bytes and ModTime is the last
+// time the file was written, if the storage backend tracks that information.
+type FileInfo struct {
+	Filename string
+	Size     int64
+	ModTime  time.Time
+}
+
+// FileStore is the storage backend for image file bytes. Files are addressed
+// only by their filename. Each implementation decides where and how the bytes
+// are actually kept, e.g. the local file system for LocalFileStore. All methods
+// return a FileNotFoundError when the requested file does not exist.
+type FileStore interface {
+	// Writes data to the file, replacing any file that already exists with that name
+	Put(filename string, data []byte) error
+
+	// Reads the full contents of the file
+	Get(filename string) ([]byte, error)
+
+	// Gets information about the file without reading its contents
+	Stat(filename string) (FileInfo, error)
+
+	// Removes the file from the store
+	Delete(filename string) error
+
+	// Renames a file from oldFilename to newFilename
+	Move(oldFilename, newFilename string) error
+
+	// Opens the file for reading. The caller is responsible for closing the
+	// returned ReadCloser. If the ReadCloser also implements io.Seeker, callers
+	// may use it to serve ranged requests.
+	Stream(filename string) (io.ReadCloser, FileInfo, error)
+}
+
+// Stores that can let clients download files directly, e.g. with a presigned
+// URL, implement URLFileStore in addition to FileStore.
+type URLFileStore interface {
+	FileStore
+
+	// Returns a URL that clients can use to download the file directly. An
+	// empty string means that the file should be streamed instead.
+	FileURL(filename string) (string, error)
+}
+
+// Stores that can list their contents implement WalkableFileStore. Walk calls
+// fn once for every stored file, in no particular order, and stops at the
+// first error that fn returns.
+type WalkableFileStore interface {
+	FileStore
+
+	Walk(fn func(info FileInfo) error) error
+}
+
+// Stores that can take part in a database transaction implement
+// ContextFileStore. WithContext returns a FileStore that runs all of its
+// operations with ctx, e.g. a session context with an active transaction.
+type ContextFileStore interface {
+	FileStore
+
+	WithContext(ctx context.Context) FileStore
+}
@@ -0,0 +1,170 @@
+package imageHandler
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Runs the same series of operations against any FileStore implementation
+func testFileStore(t *testing.T, store FileStore) {
+	data := []byte("test image data")
+
+	if err := store.Put("abcdef.jpg", data); err != nil {
+		t.Fatalf("Put returned error '%v'", err)
+	}
+
+	got, err := store.Get("abcdef.jpg")
+	if err != nil {
+		t.Fatalf("Get returned error '%v'", err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("Get = '%v', Should be '%v'", string(got), string(data))
+	}
+
+	info, err := store.Stat("abcdef.jpg")
+	if err != nil {
+		t.Fatalf("Stat returned error '%v'", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Fatalf("info.Size = '%v', Should be '%v'", info.Size, len(data))
+	}
+
+	if err := store.Move("abcdef.jpg", "zyxwvu.jpg"); err != nil {
+		t.Fatalf("Move returned error '%v'", err)
+	}
+
+	if _, err := store.Stat("abcdef.jpg"); err == nil {
+		t.Fatalf("Stat of the old name should return an error after Move")
+	} else if _, ok := err.(FileNotFoundError); !ok {
+		t.Fatalf("err is '%T', Should be 'FileNotFoundError'", err)
+	}
+
+	reader, info, err := store.Stream("zyxwvu.jpg")
+	if err != nil {
+		t.Fatalf("Stream returned error '%v'", err)
+	}
+	streamed, _ := ioutil.ReadAll(reader)
+	reader.Close()
+
+	if string(streamed) != string(data) {
+		t.Fatalf("streamed = '%v', Should be '%v'", string(streamed), string(data))
+	}
+	if info.Filename != "zyxwvu.jpg" {
+		t.Fatalf("info.Filename = '%v', Should be 'zyxwvu.jpg'", info.Filename)
+	}
+
+	if err := store.Delete("zyxwvu.jpg"); err != nil {
+		t.Fatalf("Delete returned error '%v'", err)
+	}
+
+	if _, err := store.Get("zyxwvu.jpg"); err == nil {
+		t.Fatalf("Get should return an error after Delete")
+	}
+}
+
+// Checks that Walk reports every stored file by its filename
+func testWalkFileStore(t *testing.T, store WalkableFileStore) {
+	store.Put("abcdef.jpg", []byte("abc"))
+	store.Put("ghijkl.jpg", []byte("ghijkl"))
+
+	walked := make(map[string]int64)
+	err := store.Walk(func(info FileInfo) error {
+		walked[info.Filename] = info.Size
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Walk returned error '%v'", err)
+	}
+	if len(walked) != 2 {
+		t.Fatalf("len(walked) = '%v', Should be '2'", len(walked))
+	}
+	if walked["abcdef.jpg"] != 3 || walked["ghijkl.jpg"] != 6 {
+		t.Fatalf("walked = '%v', Should have the size of each file", walked)
+	}
+}
+
+func TestLocalFileStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "image-store")
+	if err != nil {
+		t.Fatalf("Error making temp dir")
+	}
+	defer os.RemoveAll(root)
+
+	store := &LocalFileStore{RootPath: root, SubPathLength: 2}
+
+	testFileStore(t, store)
+
+	store.Put("abcdef.jpg", []byte("data"))
+
+	if _, err := os.Stat(root + "/ab/abcdef.jpg"); err != nil {
+		t.Fatalf("file should be saved in the 'ab' sub folder")
+	}
+
+	os.WriteFile(root+"/ab/.DS_Store", []byte("hidden"), 0644)
+	store.Delete("abcdef.jpg")
+
+	testWalkFileStore(t, store)
+}
+
+func TestMemoryFileStore(t *testing.T) {
+	testFileStore(t, MakeMemoryFileStore())
+	testWalkFileStore(t, MakeMemoryFileStore())
+}
+
+// A file store whose Put fails for one filename
+type failingPutFileStore struct {
+	*MemoryFileStore
+	failOn string
+}
+
+func (s failingPutFileStore) Put(filename string, data []byte) error {
+	if filename == s.failOn {
+		return errors.New("put failed")
+	}
+
+	return s.MemoryFileStore.Put(filename, data)
+}
+
+func TestCopyFiles(t *testing.T) {
+	from := MakeMemoryFileStore()
+	to := MakeMemoryFileStore()
+
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		from.Put(name, []byte(name))
+	}
+	to.Put("b.jpg", []byte("b.jpg"))
+
+	data := ImageConversionResult{NewFiles: []string{"a.jpg", "b.jpg", "c.jpg"}}
+
+	copied, err := CopyFiles(data, from, failingPutFileStore{to, "c.jpg"})
+
+	if err == nil {
+		t.Fatalf("CopyFiles should return the error of Put")
+	}
+
+	// Files that existed in the final store aren't copied
+	if len(copied) != 1 || copied[0] != "a.jpg" {
+		t.Fatalf("copied = '%v', Should be '[a.jpg]'", copied)
+	}
+
+	if err := RollBackWrites(copied, to); err != nil {
+		t.Fatalf("RollBackWrites returned error '%v'", err)
+	}
+
+	if _, err := to.Stat("a.jpg"); err == nil {
+		t.Fatalf("a.jpg should be rolled back")
+	}
+
+	if _, err := to.Stat("b.jpg"); err != nil {
+		t.Fatalf("b.jpg existed before the copy and should be kept")
+	}
+
+	copied, err = CopyFiles(data, from, to)
+
+	if err != nil || len(copied) != 2 {
+		t.Fatalf("copied = '%v' err = '%v', Should be '[a.jpg c.jpg]'", copied, err)
+	}
+}
@@ -0,0 +1,346 @@
+package imageHandler
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// The largest blur and sharpen sigma. The kernel grows with the sigma, so this
+// limits the work that one filter can ask for.
+const maxFilterSigma = 50
+
+type FilterRequest struct {
+	// The kind of filter. The following are valid Type values:
+	// grayscale  : Removes the color of the image
+	// sepia      : Tones the image brown. Amount is the strength from 0 to 100, 100 by default
+	// blur       : Gaussian blur. Sigma is the standard deviation in pixels
+	// sharpen    : Unsharp mask. Sigma is the radius of the blur that's subtracted, 1 by default.
+	//              Amount is the strength in percent, 100 by default. Differences smaller
+	//              than Threshold, from 0 to 255, aren't sharpened
+	// brightness : Amount is from -100 (black) to 100 (white)
+	// contrast   : Amount is from -100 (gray) to 100
+	// gamma      : Amount is the gamma, greater than 0. Values above 1 brighten the image
+	// saturation : Amount is from -100 (grayscale) to 100 (double the saturation)
+	// invert     : Inverts the colors of the image
+	Type      string  `json:"type"`
+	Sigma     float64 `json:"sigma"`
+	Amount    float64 `json:"amount"`
+	Threshold float64 `json:"threshold"`
+}
+
+type FilterType int8
+
+const (
+	Grayscale FilterType = iota
+	Sepia
+	Blur
+	Sharpen
+	Brightness
+	Contrast
+	Gamma
+	Saturation
+	Invert
+)
+
+// A filter step of a conversion operation. The filters are applied in order
+// after the image is resized.
+type ImageFilter struct {
+	Type      FilterType
+	Sigma     float64
+	Amount    float64
+	Threshold float64
+}
+
+func parseFilterType(filterType string) (FilterType, error) {
+	switch strings.ToLower(filterType) {
+	case "grayscale", "greyscale":
+		return Grayscale, nil
+	case "sepia":
+		return Sepia, nil
+	case "blur":
+		return Blur, nil
+	case "sharpen":
+		return Sharpen, nil
+	case "brightness":
+		return Brightness, nil
+	case "contrast":
+		return Contrast, nil
+	case "gamma":
+		return Gamma, nil
+	case "saturation":
+		return Saturation, nil
+	case "invert":
+		return Invert, nil
+	default:
+		return Grayscale, errors.New("invalid filter type")
+	}
+}
+
+func makeImageFilterFromRequest(req FilterRequest) (ImageFilter, error) {
+	filterType, typeErr := parseFilterType(req.Type)
+	if typeErr != nil {
+		return ImageFilter{}, typeErr
+	}
+
+	filter := ImageFilter{
+		Type:      filterType,
+		Sigma:     req.Sigma,
+		Amount:    req.Amount,
+		Threshold: req.Threshold,
+	}
+
+	if req.Sigma < 0 || req.Sigma > maxFilterSigma {
+		return ImageFilter{}, errors.New("invalid filter sigma")
+	}
+
+	switch filterType {
+	case Sepia:
+		if req.Amount < 0 || req.Amount > 100 {
+			return ImageFilter{}, errors.New("invalid sepia amount")
+		}
+
+		if req.Amount == 0 {
+			filter.Amount = 100
+		}
+	case Blur:
+		if req.Sigma == 0 {
+			return ImageFilter{}, errors.New("the blur filter requires a sigma")
+		}
+	case Sharpen:
+		if req.Amount < 0 || req.Threshold < 0 || req.Threshold > 255 {
+			return ImageFilter{}, errors.New("invalid sharpen amount or threshold")
+		}
+
+		if req.Sigma == 0 {
+			filter.Sigma = 1
+		}
+
+		if req.Amount == 0 {
+			filter.Amount = 100
+		}
+	case Brightness, Contrast, Saturation:
+		if req.Amount < -100 || req.Amount > 100 {
+			return ImageFilter{}, errors.New("invalid filter amount")
+		}
+	case Gamma:
+		if req.Amount <= 0 {
+			return ImageFilter{}, errors.New("the gamma filter requires an amount greater than 0")
+		}
+	}
+
+	return filter, nil
+}
+
+// Applies the filters to the image in order
+func applyFilters(img *image.Image, filters []ImageFilter) *image.Image {
+	if len(filters) == 0 {
+		return img
+	}
+
+	bounds := (*img).Bounds()
+	output := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(output, output.Bounds(), *img, bounds.Min, draw.Src)
+
+	for _, filter := range filters {
+		switch filter.Type {
+		case Blur:
+			output = toNRGBA(gaussianBlur(toRGBA(output), filter.Sigma))
+		case Sharpen:
+			output = unsharpMask(output, filter)
+		default:
+			output.Pix = mapColors(output.Pix, filter)
+		}
+	}
+
+	var result image.Image = output
+
+	return &result
+}
+
+// Changes the color of each pixel. pix holds non-premultiplied RGBA values.
+func mapColors(pix []uint8, filter ImageFilter) []uint8 {
+	lookup := makeLookupTable(filter)
+
+	for i := 0; i < len(pix); i += 4 {
+		r, g, b := float64(pix[i]), float64(pix[i+1]), float64(pix[i+2])
+
+		switch filter.Type {
+		case Grayscale:
+			l := luma(r, g, b)
+			r, g, b = l, l, l
+		case Sepia:
+			sr := 0.393*r + 0.769*g + 0.189*b
+			sg := 0.349*r + 0.686*g + 0.168*b
+			sb := 0.272*r + 0.534*g + 0.131*b
+
+			strength := filter.Amount / 100
+			r = r + (sr-r)*strength
+			g = g + (sg-g)*strength
+			b = b + (sb-b)*strength
+		case Saturation:
+			l := luma(r, g, b)
+			scale := 1 + filter.Amount/100
+
+			r = l + (r-l)*scale
+			g = l + (g-l)*scale
+			b = l + (b-l)*scale
+		default:
+			r, g, b = float64(lookup[pix[i]]), float64(lookup[pix[i+1]]), float64(lookup[pix[i+2]])
+		}
+
+		pix[i] = clampUint8(r)
+		pix[i+1] = clampUint8(g)
+		pix[i+2] = clampUint8(b)
+	}
+
+	return pix
+}
+
+// Returns the value of each channel value after the brightness, contrast,
+// gamma and invert filters. Other filters keep the value.
+func makeLookupTable(filter ImageFilter) [256]uint8 {
+	var lookup [256]uint8
+
+	for i := range lookup {
+		v := float64(i)
+
+		switch filter.Type {
+		case Brightness:
+			v += filter.Amount / 100 * 255
+		case Contrast:
+			// -100 maps every value to gray. 100 is a contrast of 255 / 1.
+			factor := (100 + filter.Amount) / 100
+			if filter.Amount > 0 {
+				factor = 100 / math.Max(100-filter.Amount, 100.0/255)
+			}
+
+			v = (v-127.5)*factor + 127.5
+		case Gamma:
+			v = 255 * math.Pow(v/255, 1/filter.Amount)
+		case Invert:
+			v = 255 - v
+		}
+
+		lookup[i] = clampUint8(v)
+	}
+
+	return lookup
+}
+
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	} else if v >= 255 {
+		return 255
+	}
+
+	return uint8(math.Round(v))
+}
+
+// Returns a normalized Gaussian kernel with a radius of three sigma
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-(x * x) / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	return kernel
+}
+
+// Blurs an image horizontally, then vertically. The image is premultiplied, so
+// transparent pixels don't bleed their color into their neighbors. Pixels past
+// the edges repeat the edge pixels.
+func gaussianBlur(img *image.RGBA, sigma float64) *image.RGBA {
+	kernel := gaussianKernel(sigma)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	horizontal := image.NewRGBA(img.Bounds())
+	blurPass(img.Pix, horizontal.Pix, width, height, kernel, 4, img.Stride)
+
+	vertical := image.NewRGBA(img.Bounds())
+	blurPass(horizontal.Pix, vertical.Pix, height, width, kernel, img.Stride, 4)
+
+	return vertical
+}
+
+// Convolves each line of src with the kernel. step is the distance between the
+// pixels of a line and lineStep is the distance between lines.
+func blurPass(src, dst []uint8, length, lines int, kernel []float64, step, lineStep int) {
+	radius := len(kernel) / 2
+
+	for line := 0; line < lines; line++ {
+		start := line * lineStep
+
+		for i := 0; i < length; i++ {
+			var sums [4]float64
+
+			for k, weight := range kernel {
+				j := i + k - radius
+				if j < 0 {
+					j = 0
+				} else if j >= length {
+					j = length - 1
+				}
+
+				offset := start + j*step
+				for c := 0; c < 4; c++ {
+					sums[c] += float64(src[offset+c]) * weight
+				}
+			}
+
+			offset := start + i*step
+			for c := 0; c < 4; c++ {
+				dst[offset+c] = clampUint8(sums[c])
+			}
+		}
+	}
+}
+
+// Sharpens an image by adding the difference between the image and a blurred
+// copy of it. Alpha isn't sharpened.
+func unsharpMask(img *image.NRGBA, filter ImageFilter) *image.NRGBA {
+	blurred := toNRGBA(gaussianBlur(toRGBA(img), filter.Sigma))
+	amount := filter.Amount / 100
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			diff := float64(img.Pix[i+c]) - float64(blurred.Pix[i+c])
+
+			if math.Abs(diff) >= filter.Threshold {
+				img.Pix[i+c] = clampUint8(float64(img.Pix[i+c]) + diff*amount)
+			}
+		}
+	}
+
+	return img
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	result := image.NewRGBA(img.Bounds())
+	draw.Draw(result, result.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return result
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	result := image.NewNRGBA(img.Bounds())
+	draw.Draw(result, result.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return result
+}
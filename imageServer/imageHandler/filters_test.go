@@ -0,0 +1,141 @@
+package imageHandler
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func getNRGBA(img *image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert((*img).At(x, y)).(color.NRGBA)
+}
+
+func TestApplyColorFilters(t *testing.T) {
+	orange := color.RGBA{200, 100, 50, 255}
+
+	tests := []struct {
+		filter   ImageFilter
+		expected color.NRGBA
+	}{
+		{ImageFilter{Type: Grayscale}, color.NRGBA{124, 124, 124, 255}},
+		{ImageFilter{Type: Invert}, color.NRGBA{55, 155, 205, 255}},
+		{ImageFilter{Type: Brightness, Amount: 20}, color.NRGBA{251, 151, 101, 255}},
+		{ImageFilter{Type: Brightness, Amount: -100}, color.NRGBA{0, 0, 0, 255}},
+		{ImageFilter{Type: Contrast, Amount: -100}, color.NRGBA{128, 128, 128, 255}},
+		{ImageFilter{Type: Saturation, Amount: -100}, color.NRGBA{124, 124, 124, 255}},
+		{ImageFilter{Type: Gamma, Amount: 1}, color.NRGBA{200, 100, 50, 255}},
+		{ImageFilter{Type: Sepia, Amount: 100}, color.NRGBA{165, 147, 114, 255}},
+	}
+
+	for _, test := range tests {
+		output := applyFilters(makeSolidImage(4, 4, orange), []ImageFilter{test.filter})
+
+		if c := getNRGBA(output, 2, 2); c != test.expected {
+			t.Fatalf("color = '%v', Should be '%v' for '%v'", c, test.expected, test.filter)
+		}
+	}
+
+	// Gamma above 1 brightens the image
+	output := applyFilters(makeSolidImage(4, 4, orange), []ImageFilter{{Type: Gamma, Amount: 2}})
+	if c := getNRGBA(output, 2, 2); c.G <= 100 {
+		t.Fatalf("c.G = '%v', Should be greater than '100'", c.G)
+	}
+
+	// Transparent pixels keep their alpha
+	output = applyFilters(makeSolidImage(4, 4, color.RGBA{}), []ImageFilter{{Type: Invert}})
+	if c := getNRGBA(output, 2, 2); c.A != 0 {
+		t.Fatalf("c.A = '%v', Should be '0'", c.A)
+	}
+}
+
+// Makes an image with a black left half and a white right half
+func makeEdgeImage() *image.Image {
+	img := makeSolidImage(20, 10, color.RGBA{0, 0, 0, 255})
+	rgba := (*img).(*image.RGBA)
+
+	for y := 0; y < 10; y++ {
+		for x := 10; x < 20; x++ {
+			rgba.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+		}
+	}
+
+	return img
+}
+
+func TestApplyBlurAndSharpen(t *testing.T) {
+	blurred := applyFilters(makeEdgeImage(), []ImageFilter{{Type: Blur, Sigma: 2}})
+
+	if c := getNRGBA(blurred, 9, 5); c.R == 0 || c.R == 255 {
+		t.Fatalf("c.R = '%v', the edge should be blurred", c.R)
+	}
+
+	if c := getNRGBA(blurred, 0, 5); c.R != 0 {
+		t.Fatalf("c.R = '%v', Should be '0' far from the edge", c.R)
+	}
+
+	// Sharpening a blurred edge makes it steeper
+	sharpened := applyFilters(blurred, []ImageFilter{{Type: Sharpen, Sigma: 2, Amount: 200}})
+
+	if before, after := getNRGBA(blurred, 8, 5).R, getNRGBA(sharpened, 8, 5).R; after >= before {
+		t.Fatalf("after = '%v', Should be darker than '%v'", after, before)
+	}
+
+	// Differences below the threshold aren't sharpened
+	unchanged := applyFilters(blurred, []ImageFilter{{Type: Sharpen, Sigma: 2, Amount: 200, Threshold: 255}})
+	if before, after := getNRGBA(blurred, 8, 5).R, getNRGBA(unchanged, 8, 5).R; after != before {
+		t.Fatalf("after = '%v', Should be '%v'", after, before)
+	}
+}
+
+func TestMakeOpFromRequestFilters(t *testing.T) {
+	op, err := makeOpFromRequest(ConversionRequest{
+		ResizeOp:    "scale",
+		LongestSide: 100,
+		Filters: []FilterRequest{
+			{Type: "grayscale"},
+			{Type: "sharpen"},
+			{Type: "blur", Sigma: 1.5},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("makeOpFromRequest returned error '%v'", err)
+	}
+
+	if len(op.Filters) != 3 || op.Filters[1] != (ImageFilter{Type: Sharpen, Sigma: 1, Amount: 100}) {
+		t.Fatalf("op.Filters = '%v', Should have the default sharpen settings", op.Filters)
+	}
+
+	invalid := []ConversionRequest{
+		{ResizeOp: "original", Filters: []FilterRequest{{Type: "grayscale"}}},
+		{ResizeOp: "thumbnail", Filters: []FilterRequest{{Type: "emboss"}}},
+		{ResizeOp: "thumbnail", Filters: []FilterRequest{{Type: "blur"}}},
+		{ResizeOp: "thumbnail", Filters: []FilterRequest{{Type: "blur", Sigma: 500}}},
+		{ResizeOp: "thumbnail", Filters: []FilterRequest{{Type: "gamma"}}},
+		{ResizeOp: "thumbnail", Filters: []FilterRequest{{Type: "contrast", Amount: 150}}},
+	}
+
+	for _, req := range invalid {
+		if _, err := makeOpFromRequest(req); err == nil {
+			t.Fatalf("makeOpFromRequest should return an error for '%v'", req)
+		}
+	}
+}
+
+func TestEncodeImageAppliesFilters(t *testing.T) {
+	dat := imageData{ImageData: makeSolidImage(8, 8, color.RGBA{200, 100, 50, 255}), OriginalImageType: Png}
+
+	encoded, err := dat.EncodeImage(ConversionOp{ResizeOp: Scale, LongestSide: 4, Filters: []ImageFilter{{Type: Invert}}})
+	if err != nil {
+		t.Fatalf("EncodeImage returned error '%v'", err)
+	}
+
+	output, err := makeImageDataFromBytes(encoded.Bytes)
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	if c := getNRGBA(output.ImageData, 2, 2); c != (color.NRGBA{55, 155, 205, 255}) {
+		t.Fatalf("color = '%v', Should be the inverted color", c)
+	}
+}
@@ -30,18 +30,21 @@ func GetImageRootPath() string {
 // * return the path to that folder
 // X is defined by an environment variable, but defaults to 2
 func GetImagePath(filename string) string {
+	return makeImagePath(GetImageRootPath(), filename, getSubPathLength())
+}
+
+// Builds the folder path for filename inside of rootPath, using the first
+// subPathLength characters of the filename as the sub folder.
+func makeImagePath(rootPath, filename string, subPathLength int) string {
 	var subfolder string
 
-	subPathLength := getSubPathLength()
 	if len(filename) <= subPathLength {
 		subfolder = filename
 	} else {
 		subfolder = filename[:subPathLength]
 	}
 
-	folderPath := path.Join(GetImageRootPath(), subfolder)
-
-	return folderPath
+	return path.Join(rootPath, subfolder)
 }
 
 func getSubPathLength() int {
@@ -5,9 +5,6 @@ import (
 	"errors"
 	"io/ioutil"
 
-	"os"
-	"path"
-
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jdeng/goheif"
@@ -15,8 +12,10 @@ import (
 
 // Starting point for receiving a new image from the user. The gin context and ConversionRequests
 // are passed to this function to process the data, determine the image type and perform all
-// conversion requests.
-func ProcessImageFile(ctx *gin.Context, conversionRequests []ConversionRequest) (ImageConversionResult, error) {
+// conversion requests. All resulting files are written to fileStore. Watermarks and fonts that
+// the requests refer to by name are loaded from assets. The template variables of text overlays
+// are filled in with templateValues.
+func ProcessImageFile(ctx *gin.Context, conversionRequests []ConversionRequest, fileStore FileStore, assets AssetSource, templateValues TemplateValues) (ImageConversionResult, error) {
 	ops := makeNewOpArray()
 	for _, req := range conversionRequests {
 		op, opErr := makeOpFromRequest(req)
@@ -26,6 +25,16 @@ func ProcessImageFile(ctx *gin.Context, conversionRequests []ConversionRequest)
 		}
 	}
 
+	ops, watermarkErr := loadWatermarks(ops, assets)
+	if watermarkErr != nil {
+		return ImageConversionResult{}, watermarkErr
+	}
+
+	ops, textErr := loadTextOverlays(ops, assets, templateValues)
+	if textErr != nil {
+		return ImageConversionResult{}, textErr
+	}
+
 	file, fileHeader, fileErr := ctx.Request.FormFile("image")
 
 	if fileErr != nil {
@@ -41,17 +50,29 @@ func ProcessImageFile(ctx *gin.Context, conversionRequests []ConversionRequest)
 
 	originalFilename := fileHeader.Filename
 
+	var result ImageConversionResult
+	var err error
+
 	if contentType == "image/heic" {
-		return processNewHeifImage(fileBytes, originalFilename, ops)
+		result, err = processNewHeifImage(fileBytes, originalFilename, ops, fileStore)
 	} else if contentType == "image/jpeg" ||
 		contentType == "image/png" ||
 		contentType == "image/gif" ||
 		contentType == "image/bmp" ||
-		contentType == "image/tiff" {
-		return processNewImage(fileBytes, originalFilename, ops)
+		contentType == "image/tiff" ||
+		contentType == "image/webp" {
+		result, err = processNewImage(fileBytes, originalFilename, ops, fileStore)
+	} else {
+		return ImageConversionResult{}, errors.New("invalid image format")
 	}
 
-	return ImageConversionResult{}, errors.New("invalid image format")
+	if err != nil {
+		return result, err
+	}
+
+	result.OriginalSha256 = HashBytes(fileBytes)
+
+	return result, nil
 }
 
 // Returns a string to be used as a file name. Currently just uses UUID
@@ -59,13 +80,12 @@ func MakeRandomName() string {
 	return uuid.New().String()
 }
 
-// Attempts to roll back any writes that already occrred in the case of an error
-func RollBackWrites(data ImageConversionResult) error {
-	for _, f := range data.SizeFormats {
-		folderPath := GetImagePath(f.Filename)
-		filePath := path.Join(folderPath, f.Filename)
-
-		delErr := DeleteFile(filePath)
+// Attempts to roll back any writes that already occrred in the case of an error.
+// names are the storage names of the files that were written, so files that
+// existed before the conversion are kept.
+func RollBackWrites(names []string, fileStore FileStore) error {
+	for _, name := range names {
+		delErr := fileStore.Delete(name)
 
 		if delErr != nil {
 			return delErr
@@ -75,13 +95,39 @@ func RollBackWrites(data ImageConversionResult) error {
 	return nil
 }
 
-// Simple file deletion function.
-func DeleteFile(filePath string) error {
-	return os.Remove(filePath)
-}
+// Copies every file written by the conversion from one store to another. This
+// is used to move files that were staged in memory into their final store.
+// Files that already exist in the final store have the same content, so they
+// are skipped. Returns the storage names of the files that were copied, even
+// if an error stopped the copy part way.
+func CopyFiles(data ImageConversionResult, from FileStore, to FileStore) ([]string, error) {
+	copied := make([]string, 0, len(data.NewFiles))
+
+	for _, name := range data.NewFiles {
+		_, statErr := to.Stat(name)
+
+		if statErr == nil {
+			continue
+		} else if _, notFound := statErr.(FileNotFoundError); !notFound {
+			return copied, statErr
+		}
 
-func MoveFile(oldFilePath string, newFilePath string) error {
-	return os.Rename(oldFilePath, newFilePath)
+		fileBytes, getErr := from.Get(name)
+
+		if getErr != nil {
+			return copied, getErr
+		}
+
+		putErr := to.Put(name, fileBytes)
+
+		if putErr != nil {
+			return copied, putErr
+		}
+
+		copied = append(copied, name)
+	}
+
+	return copied, nil
 }
 
 // The save functions need to do a few things:
@@ -94,7 +140,7 @@ func MoveFile(oldFilePath string, newFilePath string) error {
 // * Get an *image.Image struct
 // * Get the exif
 // Then we pass the above two points to the encode Jpeg function.
-func processNewHeifImage(imageBytes []byte, originalFilename string, conversionOps []ConversionOp) (ImageConversionResult, error) {
+func processNewHeifImage(imageBytes []byte, originalFilename string, conversionOps []ConversionOp, fileStore FileStore) (ImageConversionResult, error) {
 	reader := bytes.NewReader(imageBytes)
 	exif, err := goheif.ExtractExif(reader)
 	if err != nil {
@@ -110,24 +156,24 @@ func processNewHeifImage(imageBytes []byte, originalFilename string, conversionO
 
 	imgDat := makeImageDataFromImage(&image, Jpeg, exifData{ExifData: exif})
 
-	return convertAndWriteImage(imgDat, originalFilename, conversionOps)
+	return convertAndWriteImage(imgDat, originalFilename, conversionOps, fileStore)
 }
 
 // Takes an image file and processes the file based on environment or user parameters.
 // imageBytes represents a file send to the function. The function confirms the jpeg
 // data, parses the file, performs scale operations and save the data to the file system.
-func processNewImage(imageBytes []byte, originalFilename string, conversionOps []ConversionOp) (ImageConversionResult, error) {
+func processNewImage(imageBytes []byte, originalFilename string, conversionOps []ConversionOp, fileStore FileStore) (ImageConversionResult, error) {
 	imgDat, imageErr := makeImageDataFromBytes(imageBytes)
 
 	if imageErr != nil {
 		return ImageConversionResult{}, imageErr
 	}
 
-	return convertAndWriteImage(imgDat, originalFilename, conversionOps)
+	return convertAndWriteImage(imgDat, originalFilename, conversionOps, fileStore)
 }
 
-func convertAndWriteImage(imgDat imageData, originalFilename string, conversionOps []ConversionOp) (ImageConversionResult, error) {
-	iw := MakeImageWriter(originalFilename, imgDat)
+func convertAndWriteImage(imgDat imageData, originalFilename string, conversionOps []ConversionOp, fileStore FileStore) (ImageConversionResult, error) {
+	iw := MakeImageWriter(originalFilename, imgDat, fileStore)
 	// iw.AddNewOp(makeOriginalOp())
 
 	// The length of conversionOps will be 1 if the only valid operation is a thumbnail
@@ -141,11 +187,20 @@ func convertAndWriteImage(imgDat imageData, originalFilename string, conversionO
 		iw.AddNewOp(op)
 	}
 
+	placeholders, placeholderErr := makePlaceholders(imgDat.ImageData)
+
+	if placeholderErr != nil {
+		return ImageConversionResult{}, placeholderErr
+	}
+
 	output, writeErr := iw.Commit()
 
 	if writeErr != nil {
 		return ImageConversionResult{}, writeErr
 	}
 
+	output.Placeholders = placeholders
+	output.Palette = extractPalette(imgDat.ImageData)
+
 	return output, nil
 }
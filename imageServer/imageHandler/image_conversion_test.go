@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"encoding/base64"
 	"image"
+	"image/color"
+	"image/draw"
 	"testing"
 
 	"github.com/nfnt/resize"
+
+	"methompson.com/image-microservice/imageServer/constants"
 )
 
 func TestCalculateShorterDimension(t *testing.T) {
@@ -48,7 +52,7 @@ func TestScaleImage(t *testing.T) {
 
 	_1024x768 := resize.Resize(1024, 768, oneBeOneImage, resize.Lanczos3)
 
-	_640x480 := scaleImage(&_1024x768, 640)
+	_640x480 := scaleImage(&_1024x768, 640, Lanczos3Filter)
 
 	width := (*_640x480).Bounds().Max.X
 	height := (*_640x480).Bounds().Max.Y
@@ -62,7 +66,7 @@ func TestScaleImage(t *testing.T) {
 
 	_768x1024 := resize.Resize(768, 1024, oneBeOneImage, resize.Lanczos3)
 
-	_480x640 := scaleImage(&_768x1024, 640)
+	_480x640 := scaleImage(&_768x1024, 640, Lanczos3Filter)
 
 	width = (*_480x640).Bounds().Max.X
 	height = (*_480x640).Bounds().Max.Y
@@ -74,3 +78,202 @@ func TestScaleImage(t *testing.T) {
 		t.Fatalf("height is '%v'. Should be '640", height)
 	}
 }
+
+func TestResizeImageToBox(t *testing.T) {
+	// A 400x200 image with a red left half and a blue right half
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(src, image.Rect(0, 0, 200, 200), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(200, 0, 400, 200), &image.Uniform{color.RGBA{0, 0, 255, 255}}, image.Point{}, draw.Src)
+
+	var img image.Image = src
+	dat := imageData{ImageData: &img}
+
+	tests := []struct {
+		resizeOp ResizeOp
+		width    uint
+		height   uint
+		expected ImageSize
+	}{
+		{Fit, 100, 100, ImageSize{100, 50}},
+		{Fill, 100, 100, ImageSize{100, 100}},
+		{Cover, 100, 100, ImageSize{100, 100}},
+		{Crop, 100, 100, ImageSize{100, 100}},
+		{Crop, 500, 100, ImageSize{400, 100}},
+	}
+
+	for _, test := range tests {
+		img, _ := dat.ResizeImageToBox(test.resizeOp, test.width, test.height, Center)
+		size := GetImageSize(img)
+
+		if size != test.expected {
+			t.Fatalf("size = '%v', Should be '%v'", size, test.expected)
+		}
+	}
+
+	west, westCrop := dat.ResizeImageToBox(Crop, 100, 100, West)
+	r, _, b, _ := (*west).At(99, 50).RGBA()
+	if r == 0 || b != 0 {
+		t.Fatalf("west crop should be red")
+	}
+	if *westCrop != (CropRect{0, 50, 100, 100}) {
+		t.Fatalf("westCrop = '%v', Should be '%v'", *westCrop, CropRect{0, 50, 100, 100})
+	}
+
+	east, eastCrop := dat.ResizeImageToBox(Cover, 100, 100, East)
+	r, _, b, _ = (*east).At(90, 50).RGBA()
+	if r != 0 || b == 0 {
+		t.Fatalf("east cover should be blue")
+	}
+	if *eastCrop != (CropRect{200, 0, 200, 200}) {
+		t.Fatalf("eastCrop = '%v', Should be '%v'", *eastCrop, CropRect{200, 0, 200, 200})
+	}
+}
+
+func TestWithoutEnlargement(t *testing.T) {
+	var img image.Image = image.NewRGBA(image.Rect(0, 0, 400, 200))
+	dat := imageData{ImageData: &img, OriginalImageType: Png}
+
+	tests := []struct {
+		op       ConversionOp
+		expected ImageSize
+		capped   bool
+	}{
+		{ConversionOp{ResizeOp: Scale, LongestSide: 2000}, ImageSize{2000, 1000}, false},
+		{ConversionOp{ResizeOp: Scale, LongestSide: 2000, WithoutEnlargement: true}, ImageSize{400, 200}, true},
+		{ConversionOp{ResizeOp: Scale, LongestSide: 200, WithoutEnlargement: true}, ImageSize{200, 100}, false},
+		{ConversionOp{ResizeOp: ScaleByWidth, LongestSide: 800, WithoutEnlargement: true}, ImageSize{400, 200}, true},
+		{ConversionOp{ResizeOp: Fit, Width: 800, Height: 800, WithoutEnlargement: true}, ImageSize{400, 200}, true},
+		{ConversionOp{ResizeOp: Fit, Width: 800, Height: 100, WithoutEnlargement: true}, ImageSize{200, 100}, false},
+		{ConversionOp{ResizeOp: Cover, Width: 600, Height: 300, WithoutEnlargement: true}, ImageSize{400, 200}, true},
+		{ConversionOp{ResizeOp: Fill, Width: 100, Height: 400, WithoutEnlargement: true}, ImageSize{50, 200}, true},
+		{ConversionOp{ResizeOp: Crop, Width: 800, Height: 800, WithoutEnlargement: true}, ImageSize{400, 200}, false},
+	}
+
+	for _, test := range tests {
+		encoded, err := dat.EncodeImage(test.op)
+
+		if err != nil {
+			t.Fatalf("EncodeImage returned error '%v'", err)
+		}
+
+		if encoded.ImageSize != test.expected || encoded.Capped != test.capped {
+			t.Fatalf("size = '%v' capped = '%v', Should be '%v' '%v' for '%v'", encoded.ImageSize, encoded.Capped, test.expected, test.capped, test.op)
+		}
+	}
+}
+
+func TestResampleFilter(t *testing.T) {
+	// A 2x1 image with a black and a white pixel
+	src := image.NewGray(image.Rect(0, 0, 2, 1))
+	src.Pix[1] = 255
+
+	var img image.Image = src
+
+	nearest := *fillImage(&img, 4, 1, NearestFilter)
+	if r, _, _, _ := nearest.At(1, 0).RGBA(); r != 0 {
+		t.Fatalf("nearest = '%v', Should be black without interpolation", r)
+	}
+
+	bilinear := *fillImage(&img, 4, 1, BilinearFilter)
+	if r, _, _, _ := bilinear.At(1, 0).RGBA(); r == 0 || r == 0xffff {
+		t.Fatalf("bilinear = '%v', Should be interpolated", r)
+	}
+
+	op, err := makeOpFromRequest(ConversionRequest{ResizeOp: "scale", LongestSide: 100, Filter: "Mitchell", WithoutEnlargement: true})
+	if err != nil || op.Filter != MitchellFilter || !op.WithoutEnlargement {
+		t.Fatalf("op = '%v', Should use the Mitchell filter without enlargement", op)
+	}
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "scale", LongestSide: 100, Filter: "box"}); err == nil {
+		t.Fatalf("an invalid filter should return an error")
+	}
+}
+
+func TestMakeOpFromRequestTargetSize(t *testing.T) {
+	op, err := makeOpFromRequest(ConversionRequest{ResizeOp: "cover", Width: 1200, Height: 630, Gravity: "NorthEast"})
+
+	if err != nil {
+		t.Fatalf("err = '%v', Should be nil", err)
+	}
+	if op.ResizeOp != Cover || op.Width != 1200 || op.Height != 630 || op.Gravity != NorthEast {
+		t.Fatalf("op = '%v', Should be a 1200x630 northeast cover op", op)
+	}
+
+	_, err = makeOpFromRequest(ConversionRequest{ResizeOp: "fit", Width: 100})
+	if err == nil {
+		t.Fatalf("fit without a height should return an error")
+	}
+
+	_, err = makeOpFromRequest(ConversionRequest{ResizeOp: "crop", Width: 100, Height: 100, Gravity: "up"})
+	if err == nil {
+		t.Fatalf("invalid gravity should return an error")
+	}
+}
+
+func TestMakeOpFromRequestMaxDimension(t *testing.T) {
+	t.Setenv(constants.MAX_OUTPUT_DIMENSION, "2000")
+
+	tests := []ConversionRequest{
+		{ResizeOp: "fill", Width: 100000, Height: 100000},
+		{ResizeOp: "fit", Width: 100, Height: 2001},
+		{ResizeOp: "scale", LongestSide: 2001},
+	}
+
+	for _, req := range tests {
+		if _, err := makeOpFromRequest(req); err == nil {
+			t.Fatalf("'%v' should return an error", req)
+		}
+	}
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "fill", Width: 2000, Height: 2000}); err != nil {
+		t.Fatalf("err = '%v', Should be nil at the maximum dimension", err)
+	}
+
+	// The default maximum is used without the environment variable
+	t.Setenv(constants.MAX_OUTPUT_DIMENSION, "")
+
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "scale", LongestSide: defaultMaxOutputDimension + 1}); err == nil {
+		t.Fatalf("a longest side over the default maximum should return an error")
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// A flat gray 600x300 image with a colorful, detailed 100x100 patch near the
+	// right edge
+	src := image.NewRGBA(image.Rect(0, 0, 600, 300))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.RGBA{128, 128, 128, 255}}, image.Point{}, draw.Src)
+
+	for y := 150; y < 250; y++ {
+		for x := 450; x < 550; x++ {
+			c := color.RGBA{220, 40, 40, 255}
+			if (x/5+y/5)%2 == 0 {
+				c = color.RGBA{40, 40, 220, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+
+	var img image.Image = src
+	dat := imageData{ImageData: &img}
+
+	output, crop := dat.ResizeImageToBox(SmartCrop, 150, 150, Center)
+
+	size := GetImageSize(output)
+	if size != (ImageSize{150, 150}) {
+		t.Fatalf("size = '%v', Should be '%v'", size, ImageSize{150, 150})
+	}
+
+	if crop == nil {
+		t.Fatalf("crop should not be nil")
+	}
+
+	patch := image.Rect(450, 150, 550, 250)
+	cropRect := image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height)
+
+	if !patch.In(cropRect) {
+		t.Fatalf("crop = '%v', Should contain '%v'", cropRect, patch)
+	}
+	if crop.Width != crop.Height {
+		t.Fatalf("crop = '%v', Should be square", cropRect)
+	}
+}
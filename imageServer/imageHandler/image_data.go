@@ -7,11 +7,14 @@ import (
 	"io"
 
 	gif "image/gif"
-	jpeg "image/jpeg"
+	_ "image/jpeg"
 	png "image/png"
 
 	bmp "golang.org/x/image/bmp"
 	tiff "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"methompson.com/image-microservice/imageServer/jpegEncoder"
+	"methompson.com/image-microservice/imageServer/webpEncoder"
 )
 
 // imageData is a generic image container that accepts raw image data, converts to the go
@@ -22,66 +25,201 @@ type imageData struct {
 	OriginalData      []byte
 	ImageData         *image.Image
 	ExifData          exifData
-	Orientation       Orientation
+
+	// The frames of an animated GIF. ImageData is the first frame.
+	Animation *animation
 }
 
-// Checks the EncodeTo parameter. If it's specified, it uses that image format to
-// encode the image. If it's not specified, it encodes using the OriginalImageType format.
-func (dat *imageData) EncodeImage(op ConversionOp) ([]byte, ImageSize, error) {
+// Rotates, flips and resizes the image for the operation, applies its filters
+// and draws its watermark and text overlays, then checks the EncodeTo
+// parameter. If it's specified, it uses that image format to encode the image.
+// If it's not specified, it encodes using the OriginalImageType format.
+// Animated GIFs stay animated when they're encoded as GIF files, unless the
+// operation asks for a poster frame.
+func (dat *imageData) EncodeImage(op ConversionOp) (EncodedImage, error) {
 	if op.ResizeOp == Original && dat.OriginalData != nil && len(dat.OriginalData) > 0 {
-		return dat.OriginalData, GetImageSize(dat.ImageData), nil
+		return EncodedImage{Bytes: dat.getOriginalData(op), ImageSize: GetImageSize(dat.ImageData)}, nil
+	}
+
+	settings := op.getEncoderSettings(dat.getEncodeType(op))
+
+	stillImage := op.Transform.apply(dat.getStillImage(op))
+	op, capped := op.limitToSource((*stillImage).Bounds())
+
+	if dat.Animation != nil && !op.Poster && dat.getEncodeType(op) == Gif {
+		encoded, err := dat.encodeAnimation(op, settings)
+		encoded.Capped = capped
+
+		return encoded, err
+	}
+
+	outputImage, crop := resizeForOp(stillImage, op)
+	outputImage = applyFilters(outputImage, op.Filters)
+	outputImage = drawOverlays(outputImage, op)
+
+	imgBytes, imgSize, encodeErr := dat.encodeOutputImage(outputImage, op, settings)
+
+	if encodeErr != nil {
+		return EncodedImage{}, encodeErr
 	}
 
-	var outputImage *image.Image
+	return EncodedImage{Bytes: imgBytes, ImageSize: imgSize, Crop: crop, Settings: makeSettingsRecord(settings), Capped: capped}, nil
+}
+
+// Returns nil for formats without settings, so that nothing is recorded for them
+func makeSettingsRecord(settings EncoderSettings) *EncoderSettings {
+	if settings == (EncoderSettings{}) {
+		return nil
+	}
+
+	return &settings
+}
+
+// Returns the image that's used for still files. This is the poster frame of
+// an animated GIF.
+func (dat *imageData) getStillImage(op ConversionOp) *image.Image {
+	if dat.Animation != nil {
+		return dat.Animation.frame(op.PosterFrame)
+	}
+
+	return dat.ImageData
+}
+
+// Transforms, resizes, filters and decorates every frame of an animated GIF. Smart crops use the
+// region that's picked for the first frame for every frame, so that the crop
+// doesn't move during the animation.
+func (dat *imageData) encodeAnimation(op ConversionOp, settings EncoderSettings) (EncodedImage, error) {
+	var crop *CropRect
+
+	resize := func(frame *image.Image) *image.Image {
+		img, frameCrop := resizeForOp(frame, op)
+		crop = frameCrop
 
+		return img
+	}
+
+	if op.ResizeOp == SmartCrop && op.Width > 0 && op.Height > 0 {
+		rect := smartCropWindow(*op.Transform.apply(dat.Animation.frame(0)), op.Width, op.Height)
+		crop = makeCropRect(rect)
+
+		resize = func(frame *image.Image) *image.Image {
+			return fillImage(cropToRect(frame, rect), op.Width, op.Height, op.Filter)
+		}
+	}
+
+	imgBytes, imgSize, encodeErr := dat.Animation.encode(func(frame *image.Image) *image.Image {
+		return drawOverlays(applyFilters(resize(op.Transform.apply(frame)), op.Filters), op)
+	}, settings)
+
+	if encodeErr != nil {
+		return EncodedImage{}, encodeErr
+	}
+
+	return EncodedImage{Bytes: imgBytes, ImageSize: imgSize, Crop: crop, Settings: makeSettingsRecord(settings)}, nil
+}
+
+// Resizes the image for the operation. Returns the region of the image that was
+// kept when the image is cropped.
+func resizeForOp(img *image.Image, op ConversionOp) (*image.Image, *CropRect) {
 	if op.ResizeOp == Thumbnail {
-		outputImage = dat.MakeThumbnail()
+		return makeThumbnail(img, op.Filter), nil
 	} else if op.ResizeOp == Scale && op.LongestSide > 0 {
-		outputImage = dat.ResizeImage(op.LongestSide)
+		return scaleImage(img, op.LongestSide, op.Filter), nil
 	} else if op.ResizeOp == ScaleByWidth && op.LongestSide > 0 {
-		outputImage = dat.ResizeImageByWidth(op.LongestSide)
-	} else {
-		outputImage = dat.ImageData
+		return scaleImageByX(img, op.LongestSide, op.Filter), nil
+	} else if op.ResizeOp.hasTargetSize() && op.Width > 0 && op.Height > 0 {
+		return resizeImageToBox(img, op.ResizeOp, op.Width, op.Height, op.Gravity, op.Filter)
+	}
+
+	return img, nil
+}
+
+// Draws the operation's watermark and text overlays over the resized image
+func drawOverlays(img *image.Image, op ConversionOp) *image.Image {
+	if op.Watermark != nil {
+		img = applyWatermark(img, *op.Watermark)
 	}
 
-	var encType ImageType
+	for _, overlay := range op.TextOverlays {
+		img = applyTextOverlay(img, overlay)
+	}
+
+	return img
+}
+
+// Returns the format that the operation's file is encoded in
+func (dat *imageData) getEncodeType(op ConversionOp) ImageType {
 	if op.CompressTo != Same {
-		encType = op.CompressTo
-	} else {
-		encType = dat.OriginalImageType
+		return op.CompressTo
 	}
 
-	switch encType {
+	return dat.OriginalImageType
+}
+
+func (dat *imageData) encodeOutputImage(outputImage *image.Image, op ConversionOp, settings EncoderSettings) ([]byte, ImageSize, error) {
+	switch dat.getEncodeType(op) {
 	case Jpeg:
-		return (*dat).EncodeJpegImage(outputImage)
+		return (*dat).EncodeJpegImage(outputImage, op, settings)
 	case Png:
-		return (*dat).EncodePngImage(outputImage)
+		return (*dat).EncodePngImage(outputImage, settings)
 	case Gif:
-		return (*dat).EncodeGifImage(outputImage)
+		return (*dat).EncodeGifImage(outputImage, settings)
 	case Bmp:
 		return (*dat).EncodeBmpImage(outputImage)
 	case Tiff:
-		return (*dat).EncodeTiffImage(outputImage)
+		return (*dat).EncodeTiffImage(outputImage, settings)
+	case Webp:
+		return (*dat).EncodeWebpImage(outputImage, settings)
 	default:
 		return nil, ImageSize{}, errors.New("unsupported image format")
 	}
 }
 
-// These are the functions that actually perform the encoding operations.
-func (dat *imageData) EncodeJpegImage(imgDat *image.Image) ([]byte, ImageSize, error) {
+// Returns the original file with the EXIF data that the operation's metadata
+// policy keeps. Only the EXIF data of jpeg files is changed. The pixels of the
+// original file aren't rotated, so the original keeps its orientation.
+func (dat *imageData) getOriginalData(op ConversionOp) []byte {
+	policy, names := op.getMetadataPolicy()
+
+	if policy == KeepMetadata || dat.OriginalImageType != Jpeg {
+		return dat.OriginalData
+	}
+
+	originalExif := extractJpegExif(dat.OriginalData)
+	if !originalExif.hasData() {
+		return dat.OriginalData
+	}
+
+	exif := originalExif.withPolicy(policy, names)
+
+	if orientation := originalExif.getImageOrientation(); orientation != Horizontal {
+		exif = exif.withOrientation(orientation)
+	}
+
+	return replaceJpegExif(dat.OriginalData, exif)
+}
+
+// These are the functions that actually perform the encoding operations. The
+// settings come from the operation's getEncoderSettings.
+func (dat *imageData) EncodeJpegImage(imgDat *image.Image, op ConversionOp, settings EncoderSettings) ([]byte, ImageSize, error) {
 	var writer io.Writer
 	buffer := new(bytes.Buffer)
 
+	exif := dat.ExifData.withPolicy(op.getMetadataPolicy())
+
 	// if exif data exists, we'll make an exif writer to encode the jpeg file
 	// with the exif data. Otherwise, we'll just use the buffer
-	if dat.ExifData.hasData() {
-		writer, _ = newWriterExif(buffer, dat.ExifData)
+	if exif.hasData() {
+		writer, _ = newWriterExif(buffer, exif)
 	} else {
 		writer = buffer
 	}
 
-	encodeErr := jpeg.Encode(writer, *imgDat, &jpeg.Options{
-		Quality: getJpegQuality(),
+	subsampling, _ := parseChromaSubsampling(settings.Subsampling)
+
+	encodeErr := jpegEncoder.Encode(writer, *imgDat, &jpegEncoder.Options{
+		Quality:     settings.Quality,
+		Subsampling: subsampling.encoderSubsampling(),
 	})
 
 	if encodeErr != nil {
@@ -91,9 +229,11 @@ func (dat *imageData) EncodeJpegImage(imgDat *image.Image) ([]byte, ImageSize, e
 	return buffer.Bytes(), GetImageSize(imgDat), nil
 }
 
-func (dat *imageData) EncodePngImage(imgDat *image.Image) ([]byte, ImageSize, error) {
+func (dat *imageData) EncodePngImage(imgDat *image.Image, settings EncoderSettings) ([]byte, ImageSize, error) {
+	compression, _ := parsePngCompression(settings.Compression)
+
 	enc := png.Encoder{
-		CompressionLevel: png.BestCompression,
+		CompressionLevel: compression.encoderLevel(),
 	}
 
 	buffer := new(bytes.Buffer)
@@ -107,10 +247,14 @@ func (dat *imageData) EncodePngImage(imgDat *image.Image) ([]byte, ImageSize, er
 	return buffer.Bytes(), GetImageSize(imgDat), nil
 }
 
-func (dat *imageData) EncodeGifImage(imgDat *image.Image) ([]byte, ImageSize, error) {
+func (dat *imageData) EncodeGifImage(imgDat *image.Image, settings EncoderSettings) ([]byte, ImageSize, error) {
 	buffer := new(bytes.Buffer)
 
-	encodeErr := gif.Encode(buffer, *imgDat, nil)
+	encodeErr := gif.Encode(buffer, *imgDat, &gif.Options{
+		NumColors: settings.Colors,
+		Quantizer: medianCutQuantizer{},
+		Drawer:    settings.getGifDrawer(),
+	})
 
 	if encodeErr != nil {
 		return nil, ImageSize{}, encodeErr
@@ -131,12 +275,30 @@ func (dat *imageData) EncodeBmpImage(imgDat *image.Image) ([]byte, ImageSize, er
 	return buffer.Bytes(), GetImageSize(imgDat), nil
 }
 
-func (dat *imageData) EncodeTiffImage(imgDat *image.Image) ([]byte, ImageSize, error) {
+func (dat *imageData) EncodeTiffImage(imgDat *image.Image, settings EncoderSettings) ([]byte, ImageSize, error) {
 	buffer := new(bytes.Buffer)
 
+	compression, _ := parseTiffCompression(settings.Compression)
+
 	// encodeErr := tiff.Encode(buffer, *td.ImageData, nil)
 	encodeErr := tiff.Encode(buffer, *imgDat, &tiff.Options{
-		Compression: tiff.Deflate,
+		Compression: compression.encoderCompression(),
+	})
+
+	if encodeErr != nil {
+		return nil, ImageSize{}, encodeErr
+	}
+
+	return buffer.Bytes(), GetImageSize(imgDat), nil
+}
+
+// WebP files are lossy unless the operation asks for lossless compression
+func (dat *imageData) EncodeWebpImage(imgDat *image.Image, settings EncoderSettings) ([]byte, ImageSize, error) {
+	buffer := new(bytes.Buffer)
+
+	encodeErr := webpEncoder.Encode(buffer, *imgDat, &webpEncoder.Options{
+		Lossless: settings.Lossless,
+		Quality:  settings.Quality,
 	})
 
 	if encodeErr != nil {
@@ -147,22 +309,47 @@ func (dat *imageData) EncodeTiffImage(imgDat *image.Image) ([]byte, ImageSize, e
 }
 
 func (dat *imageData) MakeThumbnail() *image.Image {
-	return makeThumbnail(dat.ImageData)
+	return makeThumbnail(dat.ImageData, Lanczos3Filter)
 }
 
 // Creates a new imageData struct from the existing struct with a different image size.
 // Also allows the user to define a new output format.
 func (dat *imageData) ResizeImage(longestSide uint) *image.Image {
-	return scaleImage(dat.ImageData, longestSide)
+	return scaleImage(dat.ImageData, longestSide, Lanczos3Filter)
 }
 
 // Creates a new imageData struct from the existing struct with a different image size.
 // Also allows the user to define a new output format.
 func (dat *imageData) ResizeImageByWidth(width uint) *image.Image {
-	rotated := dat.Orientation == RotateCCW || dat.Orientation == RotateCW
-	newImage := scaleImageByWidth(dat.ImageData, width, rotated)
+	return scaleImageByX(dat.ImageData, width, Lanczos3Filter)
+}
 
-	return newImage
+// Performs the Fit, Fill, Cover, Crop and SmartCrop resize operations. Returns
+// the region of the image that was kept when the image is cropped.
+func (dat *imageData) ResizeImageToBox(resizeOp ResizeOp, width, height uint, gravity Gravity) (*image.Image, *CropRect) {
+	return resizeImageToBox(dat.ImageData, resizeOp, width, height, gravity, Lanczos3Filter)
+}
+
+func resizeImageToBox(img *image.Image, resizeOp ResizeOp, width, height uint, gravity Gravity, filter ResampleFilter) (*image.Image, *CropRect) {
+	anchorX, anchorY := gravity.anchor()
+
+	switch resizeOp {
+	case Fit:
+		return fitImage(img, width, height, filter), nil
+	case Fill:
+		return fillImage(img, width, height, filter), nil
+	case Cover:
+		resized, rect := coverImage(img, width, height, anchorX, anchorY, filter)
+		return resized, makeCropRect(rect)
+	case Crop:
+		cropped, rect := cropImage(img, width, height, anchorX, anchorY)
+		return cropped, makeCropRect(rect)
+	case SmartCrop:
+		cropped, rect := smartCropImage(img, width, height, filter)
+		return cropped, makeCropRect(rect)
+	default:
+		return img, nil
+	}
 }
 
 func makeImageDataFromBytes(imageBytes []byte) (imageData, error) {
@@ -174,39 +361,65 @@ func makeImageDataFromBytes(imageBytes []byte) (imageData, error) {
 
 	var iType ImageType
 	var exifDat exifData
-	var orientation Orientation = Horizontal
+	var anim *animation
 	switch t {
 	case "jpeg":
 		iType = Jpeg
 		exifDat = extractJpegExif(imageBytes)
-		orientation = exifDat.isImageRotated()
 	case "png":
 		iType = Png
 	case "gif":
 		iType = Gif
+
+		var animErr error
+		anim, animErr = decodeAnimation(imageBytes)
+		if animErr != nil {
+			return imageData{}, animErr
+		}
+
+		if anim != nil {
+			originalImage = *anim.frame(0)
+		}
 	case "bmp":
 		iType = Bmp
 	case "tiff":
 		iType = Tiff
+	case "webp":
+		iType = Webp
 	default:
 		return imageData{}, errors.New("invalid image format")
 	}
 
+	orientedImage, orientedExif := applyExifOrientation(originalImage, exifDat)
+
 	return imageData{
 		OriginalImageType: iType,
 		OriginalData:      imageBytes,
-		ImageData:         &originalImage,
-		ExifData:          exifDat,
-		Orientation:       orientation,
+		ImageData:         &orientedImage,
+		ExifData:          orientedExif,
+		Animation:         anim,
 	}, nil
 }
 
 func makeImageDataFromImage(imgDat *image.Image, iType ImageType, exifDat exifData) imageData {
-	orientation := exifDat.isImageRotated()
+	orientedImage, orientedExif := applyExifOrientation(*imgDat, exifDat)
+
 	return imageData{
 		OriginalImageType: iType,
-		ImageData:         imgDat,
-		ExifData:          exifDat,
-		Orientation:       orientation,
+		ImageData:         &orientedImage,
+		ExifData:          orientedExif,
 	}
 }
+
+// Rotates and flips the pixels of an image so that it's upright without its
+// EXIF orientation. The orientation in the returned EXIF data is reset, so
+// that viewers don't transform the image a second time.
+func applyExifOrientation(img image.Image, exif exifData) (image.Image, exifData) {
+	orientation := exif.getImageOrientation()
+
+	if orientation == Horizontal {
+		return img, exif
+	}
+
+	return orientImage(img, orientation), exif.withOrientation(Horizontal)
+}
@@ -4,3 +4,22 @@ type ImageError struct{ ErrMsg string }
 
 func (err ImageError) Error() string { return err.ErrMsg }
 func NewDBError(msg string) error    { return ImageError{msg} }
+
+// Used to communicate that a file does not exist in a FileStore
+type FileNotFoundError struct{ ErrMsg string }
+
+func (err FileNotFoundError) Error() string { return err.ErrMsg }
+func NewFileNotFoundError(msg string) error { return FileNotFoundError{msg} }
+
+// Used to communicate that EXIF data can't be parsed
+type ExifError struct{ ErrMsg string }
+
+func (err ExifError) Error() string { return err.ErrMsg }
+func NewExifError(msg string) error { return ExifError{msg} }
+
+// Used to communicate that no uploaded watermark or font has the name that a
+// conversion request refers to
+type MissingAssetError struct{ ErrMsg string }
+
+func (err MissingAssetError) Error() string { return err.ErrMsg }
+func NewMissingAssetError(msg string) error { return MissingAssetError{msg} }
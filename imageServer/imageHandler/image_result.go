@@ -27,12 +27,58 @@ func GetImageSize(imgData *image.Image) ImageSize {
 	}
 }
 
+// The region of the original image that a cropped image was made from. X and Y
+// are the top left corner of the region.
+type CropRect struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+func (cr CropRect) GetMap() map[string]interface{} {
+	crop := make(map[string]interface{})
+
+	crop["x"] = cr.X
+	crop["y"] = cr.Y
+	crop["width"] = cr.Width
+	crop["height"] = cr.Height
+
+	return crop
+}
+
+func makeCropRect(rect image.Rectangle) *CropRect {
+	return &CropRect{
+		X:      rect.Min.X,
+		Y:      rect.Min.Y,
+		Width:  rect.Dx(),
+		Height: rect.Dy(),
+	}
+}
+
+// The result of encoding an image for a conversion operation. Crop is nil
+// unless the operation cropped the image. Settings is nil for files that are
+// copied from the original or have no encoder settings. Capped is true if the
+// output was limited to the size of the original image.
+type EncodedImage struct {
+	Bytes     []byte
+	ImageSize ImageSize
+	Crop      *CropRect
+	Settings  *EncoderSettings
+	Capped    bool
+}
+
 // Representation of an actual image that is saved in the file system
 // Type is a string description of the type of image. e.g. "thumbnail", "web", "original"
 // Filename is the actual file name on the filesystem. The filename is used for accessing the image using a GET command
 // ImageSize is an ImageSize struct describing the height and width of the image
 // FileSize is the size of the image file in bytes.
 // Private is a flag representing whether this image is accessible publicly or not
+// Sha256 is the hex encoded SHA-256 digest of the file. The file is stored under a name made from the digest
+// Crop is the region of the original image that was kept when the image was cropped, or nil
+// Encoding is the encoder settings that the file was written with, or nil
+// Capped is true if the operation would have enlarged the image and was limited to its size
+// Request is the conversion request that the file was made from, or nil for the default files
 type ImageSizeFormat struct {
 	FormatName string
 	Filename   string
@@ -40,6 +86,16 @@ type ImageSizeFormat struct {
 	FileSize   int
 	Private    bool
 	ImageType  ImageType
+	Sha256     string
+	Crop       *CropRect
+	Encoding   *EncoderSettings
+	Capped     bool
+	Request    *ConversionRequest
+}
+
+// Returns the name of the file in the file store
+func (isf ImageSizeFormat) GetStorageName() string {
+	return GetStorageName(isf.Filename, isf.Sha256, isf.ImageType)
 }
 
 func (isf ImageSizeFormat) GetMap() map[string]interface{} {
@@ -51,17 +107,34 @@ func (isf ImageSizeFormat) GetMap() map[string]interface{} {
 	m["formatName"] = isf.FormatName
 	m["imageSize"] = isf.ImageSize.GetMap()
 
+	if isf.Crop != nil {
+		m["crop"] = isf.Crop.GetMap()
+	}
+
+	if isf.Encoding != nil {
+		m["encoding"] = isf.Encoding.GetMap()
+	}
+
+	if isf.Capped {
+		m["capped"] = isf.Capped
+	}
+
 	return m
 }
 
-func MakeImageSizeFormat(filename string, fileSize int, imageSize ImageSize, imgOp ConversionOp, imgType ImageType) ImageSizeFormat {
+func MakeImageSizeFormat(filename string, encoded EncodedImage, imgOp ConversionOp, imgType ImageType) ImageSizeFormat {
 	return ImageSizeFormat{
 		FormatName: imgOp.Suffix,
 		Filename:   filename,
-		ImageSize:  imageSize,
-		FileSize:   fileSize,
+		ImageSize:  encoded.ImageSize,
+		FileSize:   len(encoded.Bytes),
 		Private:    imgOp.Private,
 		ImageType:  imgType,
+		Sha256:     HashBytes(encoded.Bytes),
+		Crop:       encoded.Crop,
+		Encoding:   encoded.Settings,
+		Capped:     encoded.Capped,
+		Request:    imgOp.Request,
 	}
 }
 
@@ -70,21 +143,33 @@ func MakeImageSizeFormat(filename string, fileSize int, imageSize ImageSize, img
 *****************************************************************************************/
 
 // The eventual data struct that communicates the result of having written files to the
-// filesystem. It provides information, like, name, extension and size formats
+// filesystem. It provides information, like, name, extension and size formats.
+// OriginalSha256 is the digest of the uploaded file. NewFiles holds the storage
+// names of the files that were written by this conversion. Files that already
+// existed in the file store aren't included, so rolling back only removes the
+// files that this conversion added. Placeholders and Palette are made from the
+// uploaded image. RemovedAssets describes the deleted watermarks and fonts
+// that RewriteImageFiles left out of the files.
 type ImageConversionResult struct {
 	IdName           string
 	OriginalFilename string
+	OriginalSha256   string
 	SizeFormats      []ImageSizeFormat
+	NewFiles         []string
+	Placeholders     Placeholders
+	Palette          []PaletteColor
+	RemovedAssets    []string
 }
 
 func (iod *ImageConversionResult) AddSizeFormat(sf ImageSizeFormat) {
 	iod.SizeFormats = append(iod.SizeFormats, sf)
 }
 
-func makeImageConversionResult(iw *ImageWriter, idName string, formats []ImageSizeFormat) ImageConversionResult {
+func makeImageConversionResult(iw *ImageWriter, idName string, formats []ImageSizeFormat, newFiles []string) ImageConversionResult {
 	return ImageConversionResult{
 		IdName:           idName,
 		OriginalFilename: iw.OriginalFilename,
 		SizeFormats:      formats,
+		NewFiles:         newFiles,
 	}
 }
@@ -0,0 +1,326 @@
+package imageHandler
+
+import (
+	"errors"
+	"image"
+)
+
+// The quality that a transformed JPEG original is encoded with. Originals are
+// always made from the image's source, so they are only encoded once no matter
+// how often the image is transformed.
+const rewriteOriginalQuality = 95
+
+// The file that an image's files are made from once the image is transformed.
+// Sha256 and ImageType name the stored file, which is the original from before
+// the first transform. Transform combines every transform since then, so each
+// transform starts from the untouched file instead of an original that was
+// already encoded again.
+type ImageSource struct {
+	Sha256    string
+	ImageType ImageType
+	Transform Transform
+}
+
+// Returns the name of the source file in the file store
+func (src ImageSource) GetStorageName() string {
+	return MakeBlobName(src.Sha256, src.ImageType)
+}
+
+// A stored image file that RewriteImageFiles makes again. Request is the
+// conversion request that the file was made from. Files that were made before
+// requests were stored have none.
+type StoredImageFile struct {
+	Filename   string
+	FormatName string
+	ImageType  ImageType
+	ImageSize  ImageSize
+	Private    bool
+	Crop       *CropRect
+	Encoding   *EncoderSettings
+	Request    *ConversionRequest
+}
+
+// Returns true if the file's operation can be rebuilt without a new request.
+// The original and the default thumbnail have no request, so files without a
+// stored request can only be rebuilt if they are one of them. We can't tell
+// whether older files had a watermark, text overlays or filters.
+func (file StoredImageFile) canRebuild() bool {
+	return file.Request != nil || file.FormatName == "original" || file.FormatName == "thumb"
+}
+
+// Returns the format names of the files that RewriteImageFiles can't make
+// again unless requests include an operation for them
+func GetMissingRewriteRequests(files []StoredImageFile, requests []ConversionRequest) []string {
+	requested := make(map[string]bool)
+	for _, req := range requests {
+		requested[req.Suffix] = true
+	}
+
+	missing := make([]string, 0)
+	for _, file := range files {
+		if !file.canRebuild() && !requested[file.FormatName] {
+			missing = append(missing, file.FormatName)
+		}
+	}
+
+	return missing
+}
+
+// Applies the transform to an image's source file and makes every stored file
+// of the image again from the transformed source. The transform is the
+// source's whole transform, see ImageSource. The files keep their
+// filenames, but their content and digests change. requests replace the
+// operations of the files with the same suffix. Files without a stored request
+// need one, see GetMissingRewriteRequests. Stored requests whose watermark or
+// font was deleted are made without it, see withoutMissingAssets. Returns a
+// size format for each
+// file, in order, and the placeholders of the transformed image. Files that
+// were written are rolled back on errors.
+func RewriteImageFiles(sourceBytes []byte, transform Transform, files []StoredImageFile, requests []ConversionRequest, fileStore FileStore, assets AssetSource, templateValues TemplateValues) (ImageConversionResult, error) {
+	requestsBySuffix := make(map[string]ConversionRequest)
+	for _, req := range requests {
+		requestsBySuffix[req.Suffix] = req
+	}
+
+	missingAssets := make(map[string]bool)
+	removedAssets := make([]string, 0)
+
+	ops := make([]ConversionOp, 0, len(files))
+	for _, file := range files {
+		if _, requested := requestsBySuffix[file.FormatName]; !requested && file.Request != nil {
+			req, removed := withoutMissingAssets(*file.Request, assets, missingAssets)
+
+			file.Request = &req
+			for _, asset := range removed {
+				removedAssets = append(removedAssets, asset+" of "+file.Filename)
+			}
+		}
+
+		op, opErr := makeRewriteOp(file, requestsBySuffix)
+		if opErr != nil {
+			return ImageConversionResult{}, opErr
+		}
+
+		ops = append(ops, op)
+	}
+
+	ops, watermarkErr := loadWatermarks(ops, assets)
+	if watermarkErr != nil {
+		return ImageConversionResult{}, watermarkErr
+	}
+
+	ops, textErr := loadTextOverlays(ops, assets, templateValues)
+	if textErr != nil {
+		return ImageConversionResult{}, textErr
+	}
+
+	imgDat, imageErr := makeImageDataFromBytes(sourceBytes)
+	if imageErr != nil {
+		return ImageConversionResult{}, imageErr
+	}
+
+	imgDat = imgDat.transformed(transform)
+
+	placeholders, placeholderErr := makePlaceholders(imgDat.ImageData)
+	if placeholderErr != nil {
+		return ImageConversionResult{}, placeholderErr
+	}
+
+	iw := MakeImageWriter("", imgDat, fileStore)
+
+	sizeFormats := make([]ImageSizeFormat, 0, len(files))
+	newFiles := make([]string, 0)
+	written := make(map[string]bool)
+
+	for i, op := range ops {
+		result, writeErr := iw.writeFile(op, files[i].Filename)
+
+		if writeErr != nil {
+			iw.rollback(newFiles)
+			return ImageConversionResult{}, writeErr
+		}
+
+		sizeFormats = append(sizeFormats, result.sizeFormat)
+
+		storageName := result.sizeFormat.GetStorageName()
+		if result.written && !written[storageName] {
+			written[storageName] = true
+			newFiles = append(newFiles, storageName)
+		}
+	}
+
+	return ImageConversionResult{
+		SizeFormats:   sizeFormats,
+		NewFiles:      newFiles,
+		Placeholders:  placeholders,
+		RemovedAssets: removedAssets,
+	}, nil
+}
+
+// Removes the watermark and the text overlays of a stored request whose
+// uploaded watermark or font was deleted since the file was made. Only a
+// MissingAssetError counts as deleted, other errors are returned when the
+// assets are loaded. missing remembers the assets that were already looked up.
+// Returns the request and a description of each removed asset.
+func withoutMissingAssets(req ConversionRequest, assets AssetSource, missing map[string]bool) (ConversionRequest, []string) {
+	removed := make([]string, 0)
+
+	if assets == nil {
+		return req, removed
+	}
+
+	isMissing := func(key string, load func() error) bool {
+		if result, ok := missing[key]; ok {
+			return result
+		}
+
+		_, isMissingErr := load().(MissingAssetError)
+		missing[key] = isMissingErr
+
+		return isMissingErr
+	}
+
+	if req.Watermark != nil && len(req.Watermark.Name) > 0 {
+		name := req.Watermark.Name
+		deleted := isMissing("watermark "+name, func() error {
+			_, err := assets.GetWatermarkFile(name)
+			return err
+		})
+
+		if deleted {
+			removed = append(removed, "watermark "+name)
+			req.Watermark = nil
+		}
+	}
+
+	overlays := make([]TextOverlayRequest, 0, len(req.TextOverlays))
+	for _, overlay := range req.TextOverlays {
+		name := overlay.Font
+		deleted := len(name) > 0 && isMissing("font "+name, func() error {
+			_, err := assets.GetFontFile(name)
+			return err
+		})
+
+		if deleted {
+			removed = append(removed, "font "+name)
+			continue
+		}
+
+		overlays = append(overlays, overlay)
+	}
+
+	if len(overlays) < len(req.TextOverlays) {
+		req.TextOverlays = overlays
+	}
+
+	return req, removed
+}
+
+// Rebuilds the operation of a stored file. A request for the file's suffix
+// replaces its operation. Otherwise the stored request is used with the
+// recorded encoder settings, so the file is made the same way again. The
+// original is encoded again and the default thumbnail is made again.
+func makeRewriteOp(file StoredImageFile, requests map[string]ConversionRequest) (ConversionOp, error) {
+	req, requested := requests[file.FormatName]
+
+	if !requested && file.Request != nil {
+		req = *file.Request
+	}
+
+	if requested || file.Request != nil {
+		op, opErr := makeOpFromRequest(req)
+		if opErr != nil {
+			return ConversionOp{}, opErr
+		}
+
+		op.Suffix = file.FormatName
+		op.CompressTo = file.ImageType
+		op.Private = file.Private
+
+		if !requested && file.Encoding != nil {
+			op = file.Encoding.applyTo(op)
+		}
+
+		return op, nil
+	}
+
+	if !file.canRebuild() {
+		return ConversionOp{}, errors.New("the operation of " + file.Filename + " isn't stored")
+	}
+
+	if file.ImageType == Same {
+		return ConversionOp{}, errors.New("invalid image type for " + file.Filename)
+	}
+
+	op := ConversionOp{
+		Suffix:     file.FormatName,
+		CompressTo: file.ImageType,
+		Private:    file.Private,
+	}
+
+	if file.FormatName == "original" {
+		op.ResizeOp = Original
+		op.Quality = rewriteOriginalQuality
+	} else {
+		op.ResizeOp = Thumbnail
+	}
+
+	if file.Encoding != nil {
+		op = file.Encoding.applyTo(op)
+	}
+
+	return op, nil
+}
+
+// Sets the operation's encoder options to the recorded settings
+func (es EncoderSettings) applyTo(op ConversionOp) ConversionOp {
+	if es.Quality > 0 {
+		op.Quality = es.Quality
+	}
+
+	op.Lossless = es.Lossless
+	op.Subsampling, _ = parseChromaSubsampling(es.Subsampling)
+
+	if op.CompressTo == Png {
+		op.PngCompression, _ = parsePngCompression(es.Compression)
+	} else if op.CompressTo == Tiff {
+		op.TiffCompression, _ = parseTiffCompression(es.Compression)
+	}
+
+	if es.Colors > 0 {
+		dither := es.Dither
+		op.Colors = es.Colors
+		op.Dither = &dither
+	}
+
+	return op
+}
+
+// Returns a copy of the image data with the transform applied to the image and
+// every frame of an animation. The copy has no original data, so original
+// operations encode the transformed image.
+func (dat imageData) transformed(t Transform) imageData {
+	if t.IsIdentity() {
+		return dat
+	}
+
+	result := imageData{
+		OriginalImageType: dat.OriginalImageType,
+		ImageData:         t.apply(dat.ImageData),
+		ExifData:          dat.ExifData,
+	}
+
+	if dat.Animation != nil {
+		anim := *dat.Animation
+		anim.Frames = make([]*image.Image, len(dat.Animation.Frames))
+
+		for i, frame := range dat.Animation.Frames {
+			anim.Frames[i] = t.apply(frame)
+		}
+
+		result.Animation = &anim
+		result.ImageData = anim.frame(0)
+	}
+
+	return result
+}
@@ -2,15 +2,18 @@ package imageHandler
 
 import (
 	"image"
+	"image/draw"
 	"math"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/nfnt/resize"
 	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/webpEncoder"
 )
 
-func scaleImage(img *image.Image, longestSide uint) *image.Image {
+func scaleImage(img *image.Image, longestSide uint, filter ResampleFilter) *image.Image {
 	width := float64((*img).Bounds().Max.X)
 	height := float64((*img).Bounds().Max.Y)
 
@@ -28,46 +31,190 @@ func scaleImage(img *image.Image, longestSide uint) *image.Image {
 		newWidth = newShorter
 	}
 
-	var image = resize.Resize(newWidth, newHeight, *img, resize.Lanczos3)
+	var image = resize.Resize(newWidth, newHeight, *img, filter.interpolation())
 
 	return &image
 }
 
-func scaleImageByWidth(img *image.Image, newWidth uint, rotated bool) *image.Image {
-	if rotated {
-		return scaleImageByY(img, newWidth)
-	} else {
-		return scaleImageByX(img, newWidth)
-	}
-}
-
 // Scales an image such that the Aspect ratio is (mostly) constrained. Scales the
 // X value so that it aligns with the newY value.
-func scaleImageByY(img *image.Image, newY uint) *image.Image {
+func scaleImageByY(img *image.Image, newY uint, filter ResampleFilter) *image.Image {
 	X := float64((*img).Bounds().Max.X)
 	Y := float64((*img).Bounds().Max.Y)
 
 	newX := calculateOtherSide(Y, X, float64(newY))
 
-	var image = resize.Resize(newX, newY, *img, resize.Lanczos3)
+	var image = resize.Resize(newX, newY, *img, filter.interpolation())
 
 	return &image
 }
 
 // Scales an image such that the Aspect ratio is (mostly) constrained. Scales the
 // Y value so that it aligns with the newX value.
-func scaleImageByX(img *image.Image, newX uint) *image.Image {
+func scaleImageByX(img *image.Image, newX uint, filter ResampleFilter) *image.Image {
 	X := float64((*img).Bounds().Max.X)
 	Y := float64((*img).Bounds().Max.Y)
 
 	newY := calculateOtherSide(X, Y, float64(newX))
 
-	var image = resize.Resize(newX, newY, *img, resize.Lanczos3)
+	var image = resize.Resize(newX, newY, *img, filter.interpolation())
 	// var image = resize.Resize(newY, newX, *img, resize.Lanczos3)
 
 	return &image
 }
 
+// Scales an image so that it fits inside width x height. The aspect ratio is
+// maintained, so one side may be shorter than requested.
+func fitImage(img *image.Image, width, height uint, filter ResampleFilter) *image.Image {
+	X := float64((*img).Bounds().Max.X)
+	Y := float64((*img).Bounds().Max.Y)
+
+	scale := math.Min(float64(width)/X, float64(height)/Y)
+
+	return resizeToScale(img, X, Y, scale, filter)
+}
+
+// Scales an image to exactly width x height. The image is stretched if the
+// aspect ratios are different.
+func fillImage(img *image.Image, width, height uint, filter ResampleFilter) *image.Image {
+	var image = resize.Resize(width, height, *img, filter.interpolation())
+
+	return &image
+}
+
+// Scales an image so that it covers width x height and crops the overflow.
+// anchorX and anchorY determine which part of the image is kept. Returns the
+// region of the original image that was kept.
+func coverImage(img *image.Image, width, height uint, anchorX, anchorY float64, filter ResampleFilter) (*image.Image, image.Rectangle) {
+	rect := coverWindow((*img).Bounds(), width, height, anchorX, anchorY)
+
+	return fillImage(cropToRect(img, rect), width, height, filter), rect
+}
+
+// Cuts a width x height region out of an image without scaling it. anchorX and
+// anchorY place the region, from 0 (left or top) to 1 (right or bottom). The
+// region is limited to the size of the image. Returns the region that was cut.
+func cropImage(img *image.Image, width, height uint, anchorX, anchorY float64) (*image.Image, image.Rectangle) {
+	bounds := (*img).Bounds()
+
+	cropWidth := minInt(int(width), bounds.Dx())
+	cropHeight := minInt(int(height), bounds.Dy())
+
+	rect := placeWindow(bounds, cropWidth, cropHeight, anchorX, anchorY)
+
+	return cropToRect(img, rect), rect
+}
+
+// Returns the largest region of bounds with the aspect ratio of width x height,
+// placed at anchorX and anchorY
+func coverWindow(bounds image.Rectangle, width, height uint, anchorX, anchorY float64) image.Rectangle {
+	windowWidth, windowHeight := aspectWindowSize(bounds, width, height)
+
+	return placeWindow(bounds, windowWidth, windowHeight, anchorX, anchorY)
+}
+
+// Returns the size of the largest region of bounds with the aspect ratio of
+// width x height
+func aspectWindowSize(bounds image.Rectangle, width, height uint) (int, int) {
+	X := float64(bounds.Dx())
+	Y := float64(bounds.Dy())
+	ratio := float64(width) / float64(height)
+
+	if X/Y > ratio {
+		return minInt(int(math.Max(math.Round(Y*ratio), 1)), bounds.Dx()), bounds.Dy()
+	}
+
+	return bounds.Dx(), minInt(int(math.Max(math.Round(X/ratio), 1)), bounds.Dy())
+}
+
+// Places a width x height region inside of bounds. anchorX and anchorY are
+// from 0 (left or top) to 1 (right or bottom).
+func placeWindow(bounds image.Rectangle, width, height int, anchorX, anchorY float64) image.Rectangle {
+	x := bounds.Min.X + int(math.Round(float64(bounds.Dx()-width)*anchorX))
+	y := bounds.Min.Y + int(math.Round(float64(bounds.Dy()-height)*anchorY))
+
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// Copies a region of an image into a new image so that its bounds start at 0, 0
+func cropToRect(img *image.Image, rect image.Rectangle) *image.Image {
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), *img, rect.Min, draw.Src)
+
+	var image image.Image = cropped
+
+	return &image
+}
+
+// Resizes an image with the dimensions X and Y by scale. Neither side is made
+// smaller than 1 pixel.
+func resizeToScale(img *image.Image, X, Y, scale float64, filter ResampleFilter) *image.Image {
+	newX := uint(math.Max(math.Round(X*scale), 1))
+	newY := uint(math.Max(math.Round(Y*scale), 1))
+
+	var image = resize.Resize(newX, newY, *img, filter.interpolation())
+
+	return &image
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Transforms the pixels of an image with an EXIF orientation so that the image
+// is upright. Rotations by 90 degrees swap the width and height.
+func orientImage(img image.Image, orientation Orientation) image.Image {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// We copy the image into an RGBA image first so that pixels can be moved
+	// without converting their colors
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dstWidth, dstHeight := width, height
+	if orientation.swapsDimensions() {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+
+			switch orientation {
+			case MirrorHorizontal:
+				srcX, srcY = width-1-x, y
+			case Rotate180:
+				srcX, srcY = width-1-x, height-1-y
+			case MirrorVertical:
+				srcX, srcY = x, height-1-y
+			case MirrorHorizontalRotateCCW:
+				srcX, srcY = y, x
+			case RotateCW:
+				srcX, srcY = y, height-1-x
+			case MirrorHorizontalRotateCW:
+				srcX, srcY = width-1-y, height-1-x
+			case RotateCCW:
+				srcX, srcY = width-1-y, x
+			default:
+				srcX, srcY = x, y
+			}
+
+			dstOffset := dst.PixOffset(x, y)
+			srcOffset := src.PixOffset(srcX, srcY)
+			copy(dst.Pix[dstOffset:dstOffset+4], src.Pix[srcOffset:srcOffset+4])
+		}
+	}
+
+	return dst
+}
+
 // Given two sides, side1 and side2, this function calculates new side 2 when given
 // new side 1 by finding the aspect ratio between the two sides. The end result is
 // a new side the produces the same or similar aspect ratio
@@ -93,10 +240,11 @@ func calculateShorterDimension(side1, side2, newLongSide float64) uint {
 	return calculateOtherSide(longerSide, shorterSide, newLongSide)
 }
 
-// Scales an image using the resize.Thumbnail function.
-func makeThumbnail(img *image.Image) *image.Image {
+// Scales an image using the resize.Thumbnail function. Images that are smaller
+// than the thumbnail size aren't enlarged.
+func makeThumbnail(img *image.Image, filter ResampleFilter) *image.Image {
 	dim := getThumbnailDimenions()
-	var thumb = resize.Thumbnail(dim, dim, *img, resize.Lanczos3)
+	var thumb = resize.Thumbnail(dim, dim, *img, filter.interpolation())
 	return &thumb
 }
 
@@ -113,6 +261,76 @@ func getJpegQuality() int {
 	return val
 }
 
+// Gets WebP quality as an integer. Retrieves the value from the env
+// and if it doesn't exist or the value is erroneous, returns 75 as
+// a default
+func getWebpQuality() int {
+	val, err := strconv.Atoi(os.Getenv(constants.WEBP_QUALITY))
+
+	if err != nil || val < 1 || val > 100 {
+		return webpEncoder.DEFAULT_QUALITY
+	}
+
+	return val
+}
+
+// Gets the palette size of GIF files as an integer. Retrieves the value from
+// the env and if it doesn't exist or the value is erroneous, returns 256 as a
+// default
+func getGifColors() int {
+	val, err := strconv.Atoi(os.Getenv(constants.GIF_COLORS))
+
+	if err != nil || val < 2 || val > 256 {
+		return 256
+	}
+
+	return val
+}
+
+// Gets the metadata policy for public files. Retrieves the policy from the env
+// and if it doesn't exist or the value is erroneous, returns StripGPSMetadata
+// as a default. The allowlist policy keeps the comma separated tags in
+// PUBLIC_METADATA_ALLOWLIST.
+func getPublicMetadataPolicy() (MetadataPolicy, []string) {
+	policy, err := parseMetadataPolicy(os.Getenv(constants.PUBLIC_METADATA_POLICY))
+
+	if err != nil || policy == DefaultMetadata {
+		return StripGPSMetadata, nil
+	}
+
+	if policy != AllowlistMetadata {
+		return policy, nil
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(os.Getenv(constants.PUBLIC_METADATA_ALLOWLIST), ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	return policy, names
+}
+
+// Gets the suffixes of the operations that get the configured watermark from
+// the comma separated WATERMARK_SUFFIXES env variable. Nothing is watermarked
+// automatically unless WATERMARK_PATH is set as well.
+func getWatermarkSuffixes() map[string]bool {
+	suffixes := make(map[string]bool)
+
+	if len(os.Getenv(constants.WATERMARK_PATH)) == 0 {
+		return suffixes
+	}
+
+	for _, suffix := range strings.Split(os.Getenv(constants.WATERMARK_SUFFIXES), ",") {
+		if suffix = strings.TrimSpace(suffix); len(suffix) > 0 {
+			suffixes[suffix] = true
+		}
+	}
+
+	return suffixes
+}
+
 // Gets dimensions for a thumbnail. Retrieves the value from the env
 // and if it doesn't exist or the value is erroneous, returns 128 as
 // a default
@@ -125,3 +343,29 @@ func getThumbnailDimenions() uint {
 
 	return uint(val)
 }
+
+// The largest width, height or longest side that a conversion request may ask
+// for. Retrieves the value from the env and if it doesn't exist or the value
+// is erroneous, returns defaultMaxOutputDimension.
+func getMaxOutputDimension() uint {
+	val, err := strconv.ParseUint(os.Getenv(constants.MAX_OUTPUT_DIMENSION), 10, 0)
+
+	if err != nil || val == 0 {
+		return defaultMaxOutputDimension
+	}
+
+	return uint(val)
+}
+
+// The largest frame count times canvas area of an animated GIF. Retrieves the
+// value from the env and if it doesn't exist or the value is erroneous,
+// returns defaultMaxAnimationPixels.
+func getMaxAnimationPixels() uint64 {
+	val, err := strconv.ParseUint(os.Getenv(constants.MAX_ANIMATION_PIXELS), 10, 64)
+
+	if err != nil || val == 0 {
+		return defaultMaxAnimationPixels
+	}
+
+	return val
+}
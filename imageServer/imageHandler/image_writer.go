@@ -3,18 +3,18 @@ package imageHandler
 import (
 	"errors"
 	"fmt"
-	"os"
-	"path"
 	"sync"
 )
 
 // Name is the file name of the files to be written. Extension is the file type
 // extension to be appended to the end of the file name. imagesToCommit are the
-// individual image data structs that will eventually be written.
+// individual image data structs that will eventually be written. fileStore is
+// the storage backend that the encoded files are written to.
 type ImageWriter struct {
 	OriginalFilename string
 	imageOperations  map[string]ConversionOp
 	imageData        imageData
+	fileStore        FileStore
 }
 
 func (iw *ImageWriter) makeFilenameFromOp(name string, op ConversionOp) string {
@@ -36,6 +36,13 @@ func (iw *ImageWriter) AddNewOp(op ConversionOp) {
 	iw.imageOperations[op.Suffix] = op
 }
 
+// The result of writing a single image file. Written is false when a file with
+// the same content already existed in the file store.
+type writeResult struct {
+	sizeFormat ImageSizeFormat
+	written    bool
+}
+
 // Commit takes all image sizes defined in imagesToCommit and writes them all to disk.
 // Performs all operations asynchronously, but doesn't finish until all operations are
 // finished.
@@ -47,7 +54,7 @@ func (iw *ImageWriter) Commit() (ImageConversionResult, error) {
 	// necessary information from the operations themselves.
 	totalOps := len(iw.imageOperations)
 
-	outputChannel := make(chan ImageSizeFormat, totalOps)
+	outputChannel := make(chan writeResult, totalOps)
 	errorChannel := make(chan error, totalOps)
 
 	// We use a WaitGroup to sync all operations
@@ -79,8 +86,8 @@ func (iw *ImageWriter) Commit() (ImageConversionResult, error) {
 
 			// We use the syncronous writeNewFile function to actually write the file
 			// and pass the return values to the channels.
-			sizeF, writeErr := iw.writeNewFile(op, name)
-			outputChannel <- sizeF
+			result, writeErr := iw.writeNewFile(op, name)
+			outputChannel <- result
 			errorChannel <- writeErr
 		}()
 	}
@@ -92,8 +99,13 @@ func (iw *ImageWriter) Commit() (ImageConversionResult, error) {
 	// at least one. Any write error will result in rolling back the operation
 	errs := make([]error, 0)
 
+	// Two operations can produce identical files, so we keep track of the
+	// files that we wrote by their storage name.
+	newFiles := make([]string, 0)
+	written := make(map[string]bool)
+
 	for range iw.imageOperations {
-		size := <-outputChannel
+		result := <-outputChannel
 		writeErr := <-errorChannel
 
 		// Here, we collect the errors into the array and continue the for loop.
@@ -104,25 +116,29 @@ func (iw *ImageWriter) Commit() (ImageConversionResult, error) {
 			continue
 		}
 
-		sizeFormats = append(sizeFormats, size)
+		sizeFormats = append(sizeFormats, result.sizeFormat)
+
+		storageName := result.sizeFormat.GetStorageName()
+		if result.written && !written[storageName] {
+			written[storageName] = true
+			newFiles = append(newFiles, storageName)
+		}
 	}
 
 	if len(errs) > 0 {
-		iw.rollback(sizeFormats)
+		iw.rollback(newFiles)
 		return ImageConversionResult{}, errors.New("write error. rolling back operation")
 	}
 
-	return makeImageConversionResult(iw, idName, sizeFormats), nil
+	return makeImageConversionResult(iw, idName, sizeFormats, newFiles), nil
 }
 
-// Rollback image writes
-func (iw *ImageWriter) rollback(writtenImages []ImageSizeFormat) []error {
+// Rollback image writes. Only files that were written by this writer are
+// deleted, because existing files with the same content belong to other images.
+func (iw *ImageWriter) rollback(newFiles []string) []error {
 	errs := make([]error, 0)
-	for _, imgDat := range writtenImages {
-		folderPath := GetImagePath(imgDat.Filename)
-		filePath := path.Join(folderPath, imgDat.Filename)
-
-		err := DeleteFile(filePath)
+	for _, name := range newFiles {
+		err := iw.fileStore.Delete(name)
 
 		if err != nil {
 			errs = append(errs, err)
@@ -133,30 +149,20 @@ func (iw *ImageWriter) rollback(writtenImages []ImageSizeFormat) []error {
 }
 
 // Takes an image operation and name, performs the conversion, gets image information
-// and returns the ImageSizeFormat for the converted file. Returns an error if there's
-// a problem with the write.
-func (iw *ImageWriter) writeNewFile(imgOp ConversionOp, name string) (ImageSizeFormat, error) {
-	filename := iw.makeFilenameFromOp(name, imgOp)
-
-	folderPath := GetImagePath(filename)
-
-	folderErr := CheckOrCreateImageFolder(folderPath)
-
-	if folderErr != nil {
-		return ImageSizeFormat{}, folderErr
-	}
+// and returns the ImageSizeFormat for the converted file. The file is stored under
+// its content digest. If a file with the same digest already exists, nothing is
+// written. Returns an error if there's a problem with the write.
+func (iw *ImageWriter) writeNewFile(imgOp ConversionOp, name string) (writeResult, error) {
+	return iw.writeFile(imgOp, iw.makeFilenameFromOp(name, imgOp))
+}
 
-	filePath := path.Join(folderPath, filename)
-	bytes, imgSize, encodeErr := iw.imageData.EncodeImage(imgOp)
+// Performs the conversion and writes the file for an image file with the
+// filename. Returns an error if there's a problem with the write.
+func (iw *ImageWriter) writeFile(imgOp ConversionOp, filename string) (writeResult, error) {
+	encoded, encodeErr := iw.imageData.EncodeImage(imgOp)
 
 	if encodeErr != nil {
-		return ImageSizeFormat{}, encodeErr
-	}
-
-	writeErr := os.WriteFile(filePath, bytes, 0644)
-
-	if writeErr != nil {
-		return ImageSizeFormat{}, writeErr
+		return writeResult{}, encodeErr
 	}
 
 	var imgType ImageType
@@ -166,16 +172,32 @@ func (iw *ImageWriter) writeNewFile(imgOp ConversionOp, name string) (ImageSizeF
 		imgType = imgOp.CompressTo
 	}
 
-	imgSizeF := MakeImageSizeFormat(filename, len(bytes), imgSize, imgOp, imgType)
+	imgSizeF := MakeImageSizeFormat(filename, encoded, imgOp, imgType)
+	storageName := imgSizeF.GetStorageName()
+
+	_, statErr := iw.fileStore.Stat(storageName)
+
+	if statErr == nil {
+		return writeResult{imgSizeF, false}, nil
+	} else if _, notFound := statErr.(FileNotFoundError); !notFound {
+		return writeResult{}, statErr
+	}
+
+	writeErr := iw.fileStore.Put(storageName, encoded.Bytes)
+
+	if writeErr != nil {
+		return writeResult{}, writeErr
+	}
 
-	return imgSizeF, nil
+	return writeResult{imgSizeF, true}, nil
 }
 
-func MakeImageWriter(originalFilename string, imgData imageData) ImageWriter {
+func MakeImageWriter(originalFilename string, imgData imageData, fileStore FileStore) ImageWriter {
 	return ImageWriter{
 		OriginalFilename: originalFilename,
 		imageOperations:  make(map[string]ConversionOp),
 		imageData:        imgData,
+		fileStore:        fileStore,
 	}
 }
 
@@ -202,6 +224,8 @@ func GetExtensionFromImageType(iType ImageType) string {
 		return "bmp"
 	case Tiff:
 		return "tiff"
+	case Webp:
+		return "webp"
 	default:
 		return ""
 	}
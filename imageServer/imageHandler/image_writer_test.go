@@ -0,0 +1,130 @@
+package imageHandler
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// A 1x1 PNG file in Base 64
+const oneByOnePngB64 = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+P+/HgAFhAJ/wlseKgAAAABJRU5ErkJggg=="
+
+func makeTestImageWriter(t *testing.T, store FileStore) ImageWriter {
+	pngBytes, err := base64.StdEncoding.DecodeString(oneByOnePngB64)
+
+	if err != nil {
+		t.Fatalf("Error decode base64 string")
+	}
+
+	imgData, err := makeImageDataFromBytes(pngBytes)
+
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	iw := MakeImageWriter("test.png", imgData, store)
+	iw.AddNewOp(ConversionOp{Suffix: "original", ResizeOp: Original})
+	iw.AddNewOp(ConversionOp{Suffix: "copy", ResizeOp: Original})
+
+	return iw
+}
+
+func TestCommitDeduplicatesFiles(t *testing.T) {
+	store := MakeMemoryFileStore()
+	iw := makeTestImageWriter(t, store)
+
+	result, err := iw.Commit()
+
+	if err != nil {
+		t.Fatalf("Commit returned error '%v'", err)
+	}
+
+	if len(result.SizeFormats) != 2 {
+		t.Fatalf("len(result.SizeFormats) = '%v', Should be '2'", len(result.SizeFormats))
+	}
+
+	first := result.SizeFormats[0]
+	second := result.SizeFormats[1]
+
+	if first.Filename == second.Filename {
+		t.Fatalf("filenames should be different")
+	}
+
+	if first.GetStorageName() != second.GetStorageName() {
+		t.Fatalf("storage name = '%v', Should be '%v'", second.GetStorageName(), first.GetStorageName())
+	}
+
+	if len(result.NewFiles) != 1 {
+		t.Fatalf("len(result.NewFiles) = '%v', Should be '1'", len(result.NewFiles))
+	}
+
+	// Writing the same image again writes no new files
+	iw = makeTestImageWriter(t, store)
+	result, err = iw.Commit()
+
+	if err != nil {
+		t.Fatalf("Commit returned error '%v'", err)
+	}
+
+	if len(result.NewFiles) != 0 {
+		t.Fatalf("len(result.NewFiles) = '%v', Should be '0'", len(result.NewFiles))
+	}
+}
+
+func TestGetStorageName(t *testing.T) {
+	name := GetStorageName("abc@web.jpg", "", Jpeg)
+
+	if name != "abc@web.jpg" {
+		t.Fatalf("name = '%v', Should be 'abc@web.jpg'", name)
+	}
+
+	sha := HashBytes([]byte("abc"))
+	name = GetStorageName("abc@web.jpg", sha, Jpeg)
+
+	if name != sha+".jpg" {
+		t.Fatalf("name = '%v', Should be '%v'", name, sha+".jpg")
+	}
+}
+
+func TestCommitWebp(t *testing.T) {
+	store := MakeMemoryFileStore()
+	iw := makeTestImageWriter(t, store)
+	iw.AddNewOp(ConversionOp{Suffix: "webp", ResizeOp: Scale, LongestSide: 8, CompressTo: Webp, Quality: 90})
+
+	result, err := iw.Commit()
+
+	if err != nil {
+		t.Fatalf("Commit returned error '%v'", err)
+	}
+
+	var webpFormat ImageSizeFormat
+	for _, format := range result.SizeFormats {
+		if format.FormatName == "webp" {
+			webpFormat = format
+		}
+	}
+
+	if webpFormat.ImageType != Webp || GetExtensionFromImageType(webpFormat.ImageType) != "webp" {
+		t.Fatalf("webpFormat.ImageType = '%v', Should be '%v'", webpFormat.ImageType, Webp)
+	}
+
+	fileBytes, err := store.Get(webpFormat.GetStorageName())
+
+	if err != nil {
+		t.Fatalf("store.Get returned error '%v'", err)
+	}
+
+	// WebP files can be uploaded as well
+	imgData, err := makeImageDataFromBytes(fileBytes)
+
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	if imgData.OriginalImageType != Webp {
+		t.Fatalf("imgData.OriginalImageType = '%v', Should be '%v'", imgData.OriginalImageType, Webp)
+	}
+
+	if size := GetImageSize(imgData.ImageData); size.Width != 8 || size.Height != 8 {
+		t.Fatalf("size = '%v', Should be '8x8'", size)
+	}
+}
@@ -0,0 +1,221 @@
+package imageHandler
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalFileStore keeps image files on the local file system. Files are saved
+// in sub folders of RootPath, named after the first SubPathLength characters
+// of the filename. See GetImagePath for more information about the layout.
+// PreviousSubPathLength is set while files are still saved in the folders of
+// an older SubPathLength. Lookups fall back to the older folders until Reshard
+// has moved every file. See reshard.go.
+type LocalFileStore struct {
+	RootPath              string
+	SubPathLength         int
+	PreviousSubPathLength int
+}
+
+// Makes a LocalFileStore using the IMAGE_PATH and IMAGE_SUB_PATH_LENGTH
+// environment variables and makes sure that the root folder exists.
+func MakeLocalFileStore() (*LocalFileStore, error) {
+	store := &LocalFileStore{
+		RootPath:      GetImageRootPath(),
+		SubPathLength: getSubPathLength(),
+	}
+
+	folderErr := CheckOrCreateImageFolder(store.RootPath)
+
+	if folderErr != nil {
+		return nil, folderErr
+	}
+
+	layoutErr := store.loadLayout()
+
+	if layoutErr != nil {
+		return nil, layoutErr
+	}
+
+	return store, nil
+}
+
+// Gets the full path of a file in this store
+func (lfs *LocalFileStore) FilePath(filename string) string {
+	return path.Join(lfs.folderPath(filename), filename)
+}
+
+func (lfs *LocalFileStore) folderPath(filename string) string {
+	return makeImagePath(lfs.RootPath, filename, lfs.SubPathLength)
+}
+
+func (lfs *LocalFileStore) hasPreviousLayout() bool {
+	return lfs.PreviousSubPathLength > 0 && lfs.PreviousSubPathLength != lfs.SubPathLength
+}
+
+// Gets the path that the file is actually saved at. Files that haven't been
+// moved by Reshard yet are found in the previous layout's folders.
+func (lfs *LocalFileStore) locate(filename string) string {
+	current := lfs.FilePath(filename)
+
+	if !lfs.hasPreviousLayout() {
+		return current
+	}
+
+	if _, err := os.Stat(current); err == nil {
+		return current
+	}
+
+	previous := path.Join(makeImagePath(lfs.RootPath, filename, lfs.PreviousSubPathLength), filename)
+
+	if _, err := os.Stat(previous); err == nil {
+		return previous
+	}
+
+	return current
+}
+
+// Runs op with the path of the file. Reshard may move the file after we
+// located it, so we locate the file once more if it has disappeared.
+func (lfs *LocalFileStore) withFilePath(filename string, op func(filePath string) error) error {
+	err := op(lfs.locate(filename))
+
+	if os.IsNotExist(err) && lfs.hasPreviousLayout() {
+		err = op(lfs.locate(filename))
+	}
+
+	return convertLocalFileError(filename, err)
+}
+
+func (lfs *LocalFileStore) Put(filename string, data []byte) error {
+	folderErr := CheckOrCreateImageFolder(lfs.folderPath(filename))
+
+	if folderErr != nil {
+		return folderErr
+	}
+
+	return os.WriteFile(lfs.FilePath(filename), data, 0644)
+}
+
+func (lfs *LocalFileStore) Get(filename string) ([]byte, error) {
+	var data []byte
+
+	err := lfs.withFilePath(filename, func(filePath string) (err error) {
+		data, err = os.ReadFile(filePath)
+		return
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (lfs *LocalFileStore) Stat(filename string) (FileInfo, error) {
+	var stat os.FileInfo
+
+	err := lfs.withFilePath(filename, func(filePath string) (err error) {
+		stat, err = os.Stat(filePath)
+		return
+	})
+
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		Filename: filename,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+	}, nil
+}
+
+func (lfs *LocalFileStore) Delete(filename string) error {
+	return lfs.withFilePath(filename, os.Remove)
+}
+
+// Moves the file to the folder dictated by the new name. The destination
+// folder is created if it does not exist yet.
+func (lfs *LocalFileStore) Move(oldFilename, newFilename string) error {
+	folderErr := CheckOrCreateImageFolder(lfs.folderPath(newFilename))
+
+	if folderErr != nil {
+		return folderErr
+	}
+
+	return lfs.withFilePath(oldFilename, func(filePath string) error {
+		return os.Rename(filePath, lfs.FilePath(newFilename))
+	})
+}
+
+// Opens the file for reading. The returned ReadCloser is an *os.File, which
+// also implements io.Seeker.
+func (lfs *LocalFileStore) Stream(filename string) (io.ReadCloser, FileInfo, error) {
+	var file *os.File
+
+	err := lfs.withFilePath(filename, func(filePath string) (err error) {
+		file, err = os.Open(filePath)
+		return
+	})
+
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, FileInfo{}, err
+	}
+
+	info := FileInfo{
+		Filename: filename,
+		Size:     stat.Size(),
+		ModTime:  stat.ModTime(),
+	}
+
+	return file, info, nil
+}
+
+// Walks all sub folders of RootPath. Files are reported by their filename, no
+// matter which sub folder they are in. Hidden files, e.g. .DS_Store, are
+// skipped.
+func (lfs *LocalFileStore) Walk(fn func(info FileInfo) error) error {
+	return filepath.WalkDir(lfs.RootPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		stat, err := entry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		return fn(FileInfo{
+			Filename: entry.Name(),
+			Size:     stat.Size(),
+			ModTime:  stat.ModTime(),
+		})
+	})
+}
+
+// Converts os errors indicating a missing file into a FileNotFoundError. All
+// other errors are returned as-is.
+func convertLocalFileError(filename string, err error) error {
+	if os.IsNotExist(err) {
+		return NewFileNotFoundError("file not found: " + filename)
+	}
+
+	return err
+}
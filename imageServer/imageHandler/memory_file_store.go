@@ -0,0 +1,151 @@
+package imageHandler
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryFileStore keeps image files in memory. Nothing is persisted, so this
+// store is mostly useful for tests and local development.
+type MemoryFileStore struct {
+	files map[string]memoryFile
+	mutex sync.RWMutex
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func MakeMemoryFileStore() *MemoryFileStore {
+	return &MemoryFileStore{
+		files: make(map[string]memoryFile),
+	}
+}
+
+func (mfs *MemoryFileStore) Put(filename string, data []byte) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+
+	// We copy the data so that the caller can't change the stored file
+	fileData := make([]byte, len(data))
+	copy(fileData, data)
+
+	mfs.files[filename] = memoryFile{
+		data:    fileData,
+		modTime: time.Now(),
+	}
+
+	return nil
+}
+
+func (mfs *MemoryFileStore) Get(filename string) ([]byte, error) {
+	mfs.mutex.RLock()
+	defer mfs.mutex.RUnlock()
+
+	file, ok := mfs.files[filename]
+
+	if !ok {
+		return nil, NewFileNotFoundError("file not found: " + filename)
+	}
+
+	data := make([]byte, len(file.data))
+	copy(data, file.data)
+
+	return data, nil
+}
+
+func (mfs *MemoryFileStore) Stat(filename string) (FileInfo, error) {
+	mfs.mutex.RLock()
+	defer mfs.mutex.RUnlock()
+
+	file, ok := mfs.files[filename]
+
+	if !ok {
+		return FileInfo{}, NewFileNotFoundError("file not found: " + filename)
+	}
+
+	return file.getFileInfo(filename), nil
+}
+
+func (mfs *MemoryFileStore) Delete(filename string) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+
+	if _, ok := mfs.files[filename]; !ok {
+		return NewFileNotFoundError("file not found: " + filename)
+	}
+
+	delete(mfs.files, filename)
+
+	return nil
+}
+
+func (mfs *MemoryFileStore) Move(oldFilename, newFilename string) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+
+	file, ok := mfs.files[oldFilename]
+
+	if !ok {
+		return NewFileNotFoundError("file not found: " + oldFilename)
+	}
+
+	delete(mfs.files, oldFilename)
+	mfs.files[newFilename] = file
+
+	return nil
+}
+
+// Returns a reader over the stored bytes. The returned ReadCloser also
+// implements io.Seeker.
+func (mfs *MemoryFileStore) Stream(filename string) (io.ReadCloser, FileInfo, error) {
+	mfs.mutex.RLock()
+	defer mfs.mutex.RUnlock()
+
+	file, ok := mfs.files[filename]
+
+	if !ok {
+		return nil, FileInfo{}, NewFileNotFoundError("file not found: " + filename)
+	}
+
+	return readSeekNopCloser{bytes.NewReader(file.data)}, file.getFileInfo(filename), nil
+}
+
+// Calls fn with a snapshot of the stored files, so fn may change the store
+func (mfs *MemoryFileStore) Walk(fn func(info FileInfo) error) error {
+	mfs.mutex.RLock()
+
+	infos := make([]FileInfo, 0, len(mfs.files))
+	for filename, file := range mfs.files {
+		infos = append(infos, file.getFileInfo(filename))
+	}
+
+	mfs.mutex.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (mf memoryFile) getFileInfo(filename string) FileInfo {
+	return FileInfo{
+		Filename: filename,
+		Size:     int64(len(mf.data)),
+		ModTime:  mf.modTime,
+	}
+}
+
+// io.NopCloser hides the Seek method of the reader, so we use our own
+// wrapper to keep it.
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error { return nil }
@@ -0,0 +1,205 @@
+package imageHandler
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// The number of colors in an image's palette
+const paletteSize = 5
+
+// Images are split into this many median cut boxes before similar boxes are
+// merged into the palette colors. Splitting finely first keeps a small area of
+// a striking color from being averaged into its surroundings.
+const paletteBoxes = 24
+
+// Boxes whose average colors are closer than this CIE76 distance are merged
+const paletteMergeDistance = 12
+
+// Images are scaled down to this size before their palette is extracted
+const paletteSampleSize = 128
+
+// A dominant color of an image. Color is a hex color, e.g. #1a2b3c, and
+// Percentage is the share of the image's opaque pixels, from 0 to 100, that
+// are closest to the color.
+type PaletteColor struct {
+	Color      string  `json:"color"`
+	Percentage float64 `json:"percentage"`
+}
+
+func (pc PaletteColor) GetMap() map[string]interface{} {
+	return map[string]interface{}{
+		"color":      pc.Color,
+		"percentage": pc.Percentage,
+	}
+}
+
+// Returns the color in the CIE L*a*b* color space. Invalid colors are black.
+func (pc PaletteColor) Lab() LabColor {
+	c, _ := parseColorOrDefault(pc.Color, color.NRGBA{0, 0, 0, 255})
+
+	return MakeLabColor(c)
+}
+
+// A color in the CIE L*a*b* color space with the D65 white point. Distances
+// in the space are close to the perceived differences between colors.
+type LabColor struct {
+	L float64
+	A float64
+	B float64
+}
+
+func MakeLabColor(c color.Color) LabColor {
+	nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+
+	r, g, b := srgbToLinear(nrgba.R), srgbToLinear(nrgba.G), srgbToLinear(nrgba.B)
+
+	// Linear sRGB to CIE XYZ, relative to the D65 white point
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+
+	return LabColor{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// Parses a hex color, e.g. #1a2b3c or 1a2b3c, into a Lab color
+func ParseLabColor(hex string) (LabColor, error) {
+	c, err := parseColorOrDefault(hex, color.NRGBA{})
+
+	if err != nil {
+		return LabColor{}, err
+	}
+
+	if c.A != 255 {
+		return LabColor{}, errors.New("invalid color: " + hex)
+	}
+
+	return MakeLabColor(c), nil
+}
+
+// Returns the CIE76 color difference, the Euclidean distance between the
+// colors. A difference of about 2.3 is just noticeable.
+func (lc LabColor) Distance(other LabColor) float64 {
+	dl, da, db := lc.L-other.L, lc.A-other.A, lc.B-other.B
+
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+// Returns the dominant colors of the image, with the largest share first.
+// Transparent pixels aren't counted. Images without opaque pixels have no
+// palette.
+func extractPalette(img *image.Image) []PaletteColor {
+	colors, _ := sampleColors(*shrinkImage(img, paletteSampleSize))
+
+	if len(colors) == 0 {
+		return []PaletteColor{}
+	}
+
+	total := len(colors)
+
+	boxes := []quantizeBox{{colors: colors}}
+	for len(boxes) < paletteBoxes {
+		index, channel := widestBox(boxes)
+		if index < 0 {
+			break
+		}
+
+		low, high := boxes[index].split(channel)
+		boxes[index] = low
+		boxes = append(boxes, high)
+	}
+
+	clusters := mergeBoxes(boxes)
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].count > clusters[j].count
+	})
+
+	if len(clusters) > paletteSize {
+		clusters = clusters[:paletteSize]
+	}
+
+	palette := make([]PaletteColor, 0, len(clusters))
+	for _, cluster := range clusters {
+		palette = append(palette, PaletteColor{
+			Color:      fmt.Sprintf("#%02x%02x%02x", cluster.color.R, cluster.color.G, cluster.color.B),
+			Percentage: math.Round(float64(cluster.count)/float64(total)*1000) / 10,
+		})
+	}
+
+	return palette
+}
+
+// Pixels of similar colors that are counted as one palette color
+type colorCluster struct {
+	color color.RGBA
+	lab   LabColor
+	count int
+}
+
+// Merges boxes with similar average colors, starting with the largest boxes.
+// The merged color is the average of the boxes, weighted by their pixels.
+func mergeBoxes(boxes []quantizeBox) []colorCluster {
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i].colors) > len(boxes[j].colors)
+	})
+
+	clusters := make([]colorCluster, 0)
+
+	for _, box := range boxes {
+		if len(box.colors) == 0 {
+			continue
+		}
+
+		average := box.average()
+		lab := MakeLabColor(average)
+		count := len(box.colors)
+
+		merged := false
+		for i := range clusters {
+			if clusters[i].lab.Distance(lab) >= paletteMergeDistance {
+				continue
+			}
+
+			c := &clusters[i]
+			total := c.count + count
+			c.color = color.RGBA{
+				R: uint8((int(c.color.R)*c.count + int(average.R)*count) / total),
+				G: uint8((int(c.color.G)*c.count + int(average.G)*count) / total),
+				B: uint8((int(c.color.B)*c.count + int(average.B)*count) / total),
+				A: 255,
+			}
+			c.lab = MakeLabColor(c.color)
+			c.count = total
+
+			merged = true
+			break
+		}
+
+		if !merged {
+			clusters = append(clusters, colorCluster{color: average, lab: lab, count: count})
+		}
+	}
+
+	return clusters
+}
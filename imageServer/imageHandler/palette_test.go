@@ -0,0 +1,82 @@
+package imageHandler
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestMakeLabColor(t *testing.T) {
+	tests := []struct {
+		color    color.Color
+		expected LabColor
+	}{
+		{color.White, LabColor{100, 0, 0}},
+		{color.Black, LabColor{0, 0, 0}},
+		{color.RGBA{255, 0, 0, 255}, LabColor{53.24, 80.09, 67.20}},
+		{color.RGBA{0, 0, 255, 255}, LabColor{32.30, 79.19, -107.86}},
+	}
+
+	for _, test := range tests {
+		lab := MakeLabColor(test.color)
+
+		if lab.Distance(test.expected) > 0.05 {
+			t.Fatalf("lab = '%v', Should be '%v' for '%v'", lab, test.expected, test.color)
+		}
+	}
+
+	if _, err := ParseLabColor("#ff000080"); err == nil {
+		t.Fatalf("a transparent color should return an error")
+	}
+
+	if lab, err := ParseLabColor("f00"); err != nil || lab.Distance(LabColor{53.24, 80.09, 67.20}) > 0.05 {
+		t.Fatalf("lab = '%v' err = '%v', Should be red", lab, err)
+	}
+}
+
+func TestExtractPalette(t *testing.T) {
+	// 60% red, 30% blue and 10% green, with a slightly different red
+	src := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			switch {
+			case x < 30:
+				src.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+			case x < 60:
+				src.SetRGBA(x, y, color.RGBA{250, 5, 5, 255})
+			case x < 90:
+				src.SetRGBA(x, y, color.RGBA{0, 0, 255, 255})
+			default:
+				src.SetRGBA(x, y, color.RGBA{0, 255, 0, 255})
+			}
+		}
+	}
+
+	var img image.Image = src
+	palette := extractPalette(&img)
+
+	if len(palette) != 3 {
+		t.Fatalf("palette = '%v', Should have 3 colors", palette)
+	}
+
+	expected := []float64{60, 30, 10}
+	for i, pc := range palette {
+		if math.Abs(pc.Percentage-expected[i]) > 0.5 {
+			t.Fatalf("palette = '%v', Should have the percentages '%v'", palette, expected)
+		}
+	}
+
+	if palette[1].Color != "#0000ff" || palette[2].Color != "#00ff00" {
+		t.Fatalf("palette = '%v', Should have blue and green", palette)
+	}
+
+	if palette[0].Lab().Distance(MakeLabColor(color.RGBA{255, 0, 0, 255})) > 3 {
+		t.Fatalf("palette[0] = '%v', Should be red", palette[0])
+	}
+
+	// Transparent pixels aren't counted
+	if palette := extractPalette(makeSolidImage(10, 10, color.RGBA{})); len(palette) != 0 {
+		t.Fatalf("palette = '%v', Should be empty", palette)
+	}
+}
@@ -0,0 +1,224 @@
+package imageHandler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"methompson.com/image-microservice/imageServer/jpegEncoder"
+)
+
+// The longest side of the JPEG in an LQIP
+const lqipSize = 16
+
+const lqipQuality = 60
+
+// Images are scaled down to this size before their BlurHash is computed. The
+// hash only keeps a few cosine components, so the small copy gives the same
+// result for a fraction of the work.
+const blurHashSampleSize = 64
+
+// The number of BlurHash components along the longer side of an image. The
+// shorter side gets one less.
+const blurHashComponents = 4
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Clients show placeholders while the image files load. BlurHash is a
+// BlurHash string and Lqip is a data URL of a tiny JPEG of the image.
+type Placeholders struct {
+	BlurHash string
+	Lqip     string
+}
+
+// Makes the placeholders of an uploaded file. Used for images that were
+// uploaded before placeholders existed.
+func MakePlaceholdersFromBytes(imageBytes []byte) (Placeholders, error) {
+	imgDat, imageErr := makeImageDataFromBytes(imageBytes)
+	if imageErr != nil {
+		return Placeholders{}, imageErr
+	}
+
+	return makePlaceholders(imgDat.ImageData)
+}
+
+// Makes the placeholders of an image. The image is upright, so the EXIF
+// orientation doesn't have to be applied.
+func makePlaceholders(img *image.Image) (Placeholders, error) {
+	lqip, lqipErr := makeLqip(img)
+	if lqipErr != nil {
+		return Placeholders{}, lqipErr
+	}
+
+	return Placeholders{
+		BlurHash: makeBlurHash(img),
+		Lqip:     lqip,
+	}, nil
+}
+
+// Returns a data URL of a JPEG with a longest side of lqipSize pixels. JPEG
+// has no transparency, so the image is drawn over white.
+func makeLqip(img *image.Image) (string, error) {
+	small := shrinkImage(img, lqipSize)
+	bounds := (*small).Bounds()
+
+	flattened := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), *small, bounds.Min, draw.Over)
+
+	buffer := new(bytes.Buffer)
+
+	encodeErr := jpegEncoder.Encode(buffer, flattened, &jpegEncoder.Options{Quality: lqipQuality})
+	if encodeErr != nil {
+		return "", encodeErr
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// Scales the image down so that its longest side is at most longestSide.
+// Smaller images are returned as they are.
+func shrinkImage(img *image.Image, longestSide uint) *image.Image {
+	size := GetImageSize(img)
+
+	if size.Width <= int(longestSide) && size.Height <= int(longestSide) {
+		return img
+	}
+
+	return scaleImage(img, longestSide, BilinearFilter)
+}
+
+// Encodes the image as a BlurHash. Landscape images get more horizontal
+// components and portrait images more vertical components.
+// https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func makeBlurHash(img *image.Image) string {
+	small := toNRGBA(*shrinkImage(img, blurHashSampleSize))
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+
+	xComponents, yComponents := blurHashComponents, blurHashComponents-1
+	if height > width {
+		xComponents, yComponents = yComponents, xComponents
+	}
+
+	// The linear values of each pixel. Transparent pixels are drawn over white,
+	// like they are in the LQIP.
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := small.NRGBAAt(x, y)
+			alpha := float64(c.A) / 255
+
+			linear[y*width+x] = [3]float64{
+				srgbToLinear(c.R)*alpha + 1 - alpha,
+				srgbToLinear(c.G)*alpha + 1 - alpha,
+				srgbToLinear(c.B)*alpha + 1 - alpha,
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			factors = append(factors, blurHashFactor(linear, width, height, i, j))
+		}
+	}
+
+	hash := encodeBase83((xComponents-1)+(yComponents-1)*9, 1)
+
+	// The AC components are quantized relative to the largest of them
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		largest := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				largest = math.Max(largest, math.Abs(v))
+			}
+		}
+
+		quantizedMaximum := int(math.Max(0, math.Min(82, math.Floor(largest*166-0.5))))
+		maximumValue = float64(quantizedMaximum+1) / 166
+		hash += encodeBase83(quantizedMaximum, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	dc := factors[0]
+	hash += encodeBase83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4)
+
+	for _, factor := range factors[1:] {
+		var quantized [3]int
+		for c, v := range factor {
+			quantized[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+
+		hash += encodeBase83(quantized[0]*19*19+quantized[1]*19+quantized[2], 2)
+	}
+
+	return hash
+}
+
+// Returns the average color of the image weighted by the cosine basis of the
+// component
+func blurHashFactor(linear [][3]float64, width, height, i, j int) [3]float64 {
+	var sums [3]float64
+
+	for y := 0; y < height; y++ {
+		yBasis := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+
+		for x := 0; x < width; x++ {
+			basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * yBasis
+
+			for c := 0; c < 3; c++ {
+				sums[c] += basis * linear[y*width+x][c]
+			}
+		}
+	}
+
+	normalization := 2.0
+	if i == 0 && j == 0 {
+		normalization = 1
+	}
+
+	scale := normalization / float64(width*height)
+
+	return [3]float64{sums[0] * scale, sums[1] * scale, sums[2] * scale}
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+// Encodes the value with length base 83 digits
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+
+	for i := length - 1; i >= 0; i-- {
+		result[i] = base83Characters[value%83]
+		value /= 83
+	}
+
+	return string(result)
+}
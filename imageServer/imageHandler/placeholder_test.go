@@ -0,0 +1,81 @@
+package imageHandler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func decodeBase83(str string) int {
+	value := 0
+	for i := 0; i < len(str); i++ {
+		value = value*83 + strings.IndexByte(base83Characters, str[i])
+	}
+
+	return value
+}
+
+func TestMakeBlurHash(t *testing.T) {
+	hash := makeBlurHash(makeSolidImage(200, 100, color.RGBA{255, 0, 0, 255}))
+
+	// A size flag, the maximum AC value, 4 characters for the DC component and
+	// 2 characters for each of the 11 AC components
+	if len(hash) != 28 {
+		t.Fatalf("len(hash) = '%v', Should be '28'", len(hash))
+	}
+
+	// 4x3 components
+	if hash[0] != 'L' {
+		t.Fatalf("hash[0] = '%v', Should be 'L'", string(hash[0]))
+	}
+
+	if dc := decodeBase83(hash[2:6]); dc != 0xff0000 {
+		t.Fatalf("dc = '%x', Should be 'ff0000'", dc)
+	}
+
+	// Portrait images get 3x4 components
+	if hash := makeBlurHash(makeSolidImage(100, 200, color.RGBA{255, 0, 0, 255})); hash[0] != 'T' {
+		t.Fatalf("hash[0] = '%v', Should be 'T'", string(hash[0]))
+	}
+
+	// Images with detail have larger AC components
+	edgeHash := makeBlurHash(makeEdgeImage())
+	if decodeBase83(edgeHash[1:2]) <= decodeBase83(hash[1:2]) {
+		t.Fatalf("edgeHash = '%v', Should have a larger maximum AC value than '%v'", edgeHash, hash)
+	}
+}
+
+func TestMakeLqip(t *testing.T) {
+	lqip, err := makeLqip(makeSolidImage(400, 200, color.RGBA{0, 0, 0, 0}))
+
+	if err != nil {
+		t.Fatalf("makeLqip returned error '%v'", err)
+	}
+
+	prefix := "data:image/jpeg;base64,"
+	if !strings.HasPrefix(lqip, prefix) {
+		t.Fatalf("lqip = '%v', Should start with '%v'", lqip, prefix)
+	}
+
+	jpegBytes, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(lqip, prefix))
+	if err != nil {
+		t.Fatalf("DecodeString returned error '%v'", err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(jpegBytes))
+	if err != nil {
+		t.Fatalf("jpeg.Decode returned error '%v'", err)
+	}
+
+	if size := img.Bounds().Size(); size.X != 16 || size.Y != 8 {
+		t.Fatalf("size = '%v', Should be '(16,8)'", size)
+	}
+
+	// Transparent pixels are drawn over white
+	if r, _, _, _ := img.At(8, 4).RGBA(); r>>8 < 250 {
+		t.Fatalf("r = '%v', Should be white", r>>8)
+	}
+}
@@ -0,0 +1,165 @@
+package imageHandler
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// The most pixels that are sampled to build a palette. Larger images are
+// sampled evenly.
+const maxQuantizeSamples = 1 << 16
+
+// Builds GIF palettes with the median cut algorithm. The colors of the image
+// are split into boxes along their widest channel until there's a box for
+// every color of the palette, then each box is averaged into one color. The
+// image/gif encoder uses the Plan 9 palette without a quantizer, which suits
+// few photos.
+type medianCutQuantizer struct{}
+
+type quantizeBox struct {
+	colors []color.RGBA
+}
+
+// Adds colors for m to p until p reaches its capacity. One color is
+// transparent if m has transparent pixels.
+func (medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	size := cap(p) - len(p)
+	if size <= 0 {
+		return p
+	}
+
+	colors, transparent := sampleColors(m)
+
+	if transparent {
+		p = append(p, color.RGBA{})
+		size--
+	}
+
+	if len(colors) == 0 || size <= 0 {
+		return p
+	}
+
+	boxes := []quantizeBox{{colors: colors}}
+
+	for len(boxes) < size {
+		index, channel := widestBox(boxes)
+		if index < 0 {
+			break
+		}
+
+		low, high := boxes[index].split(channel)
+		boxes[index] = low
+		boxes = append(boxes, high)
+	}
+
+	for _, box := range boxes {
+		p = append(p, box.average())
+	}
+
+	return p
+}
+
+// Returns the opaque colors of the image and whether it has transparent pixels
+func sampleColors(m image.Image) ([]color.RGBA, bool) {
+	bounds := m.Bounds()
+
+	step := 1
+	for (bounds.Dx()/step)*(bounds.Dy()/step) > maxQuantizeSamples {
+		step++
+	}
+
+	colors := make([]color.RGBA, 0)
+	transparent := false
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, a := m.At(x, y).RGBA()
+
+			if a == 0 {
+				transparent = true
+				continue
+			}
+
+			colors = append(colors, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255})
+		}
+	}
+
+	return colors, transparent
+}
+
+// Returns the index of the box with the widest range of a channel and that
+// channel. Returns -1 if every box has a single color.
+func widestBox(boxes []quantizeBox) (int, int) {
+	index, channel, widest := -1, 0, 0
+
+	for i, box := range boxes {
+		if len(box.colors) < 2 {
+			continue
+		}
+
+		for c := 0; c < 3; c++ {
+			low, high := box.channelRange(c)
+
+			if high-low > widest {
+				index, channel, widest = i, c, high-low
+			}
+		}
+	}
+
+	return index, channel
+}
+
+func channelValue(c color.RGBA, channel int) int {
+	switch channel {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	default:
+		return int(c.B)
+	}
+}
+
+func (box quantizeBox) channelRange(channel int) (int, int) {
+	low, high := 255, 0
+
+	for _, c := range box.colors {
+		v := channelValue(c, channel)
+
+		if v < low {
+			low = v
+		}
+
+		if v > high {
+			high = v
+		}
+	}
+
+	return low, high
+}
+
+// Splits the box at the median of the channel
+func (box quantizeBox) split(channel int) (quantizeBox, quantizeBox) {
+	sort.Slice(box.colors, func(i, j int) bool {
+		return channelValue(box.colors[i], channel) < channelValue(box.colors[j], channel)
+	})
+
+	median := len(box.colors) / 2
+
+	return quantizeBox{colors: box.colors[:median]}, quantizeBox{colors: box.colors[median:]}
+}
+
+func (box quantizeBox) average() color.RGBA {
+	var r, g, b int
+
+	for _, c := range box.colors {
+		r += int(c.R)
+		g += int(c.G)
+		b += int(c.B)
+	}
+
+	n := len(box.colors)
+
+	return color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+}
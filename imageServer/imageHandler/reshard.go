@@ -0,0 +1,166 @@
+package imageHandler
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The file in RootPath that records which SubPathLength the files are saved
+// with. It's hidden, so Walk skips it.
+const LAYOUT_FILENAME = ".layout"
+
+// Reads the layout file to find out whether files are still saved with an
+// older SubPathLength. Stores that were created before the layout file existed
+// get one based on the names of their sub folders.
+func (lfs *LocalFileStore) loadLayout() error {
+	data, err := os.ReadFile(path.Join(lfs.RootPath, LAYOUT_FILENAME))
+
+	var layout int
+
+	if os.IsNotExist(err) {
+		layout, err = lfs.inferLayout()
+
+		if err != nil {
+			return err
+		}
+
+		if err := lfs.writeLayout(layout); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		layout, err = strconv.Atoi(strings.TrimSpace(string(data)))
+
+		if err != nil || layout < 1 {
+			return errors.New("invalid layout file in " + lfs.RootPath)
+		}
+	}
+
+	if layout != lfs.SubPathLength {
+		lfs.PreviousSubPathLength = layout
+	}
+
+	return nil
+}
+
+func (lfs *LocalFileStore) writeLayout(subPathLength int) error {
+	return os.WriteFile(path.Join(lfs.RootPath, LAYOUT_FILENAME), []byte(strconv.Itoa(subPathLength)), 0644)
+}
+
+// Sub folders are named with the first SubPathLength characters of the
+// filenames, so the most common sub folder name length is the layout that the
+// files were saved with. An empty store uses the current layout.
+func (lfs *LocalFileStore) inferLayout() (int, error) {
+	entries, err := os.ReadDir(lfs.RootPath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	counts := make(map[int]int)
+	layout := lfs.SubPathLength
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		length := len(entry.Name())
+		counts[length]++
+
+		if counts[length] > counts[layout] {
+			layout = length
+		}
+	}
+
+	return layout, nil
+}
+
+// Returns true if files may still be saved with the previous SubPathLength
+func (lfs *LocalFileStore) NeedsReshard() bool {
+	return lfs.hasPreviousLayout()
+}
+
+// Moves every file into the sub folder for the current SubPathLength and
+// returns the number of files that were moved. Lookups keep finding files in
+// the previous layout while this runs. The layout file is only updated once
+// every file was moved, so Reshard can be run again after a failure and will
+// continue where it stopped.
+func (lfs *LocalFileStore) Reshard() (int, error) {
+	moved := 0
+
+	err := filepath.WalkDir(lfs.RootPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		target := lfs.FilePath(entry.Name())
+
+		if filePath == target {
+			return nil
+		}
+
+		// The file was written again after the layout changed, so the
+		// file in the new layout is the current one.
+		if _, err := os.Stat(target); err == nil {
+			return os.Remove(filePath)
+		}
+
+		if err := CheckOrCreateImageFolder(lfs.folderPath(entry.Name())); err != nil {
+			return err
+		}
+
+		if err := os.Rename(filePath, target); err != nil {
+			return err
+		}
+
+		moved++
+
+		return nil
+	})
+
+	if err != nil {
+		return moved, err
+	}
+
+	lfs.removeEmptyFolders()
+
+	if err := lfs.writeLayout(lfs.SubPathLength); err != nil {
+		return moved, err
+	}
+
+	lfs.PreviousSubPathLength = 0
+
+	return moved, nil
+}
+
+// Removes the sub folders that were left empty by Reshard
+func (lfs *LocalFileStore) removeEmptyFolders() {
+	entries, err := os.ReadDir(lfs.RootPath)
+
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		folderPath := path.Join(lfs.RootPath, entry.Name())
+
+		if files, err := os.ReadDir(folderPath); err == nil && len(files) == 0 {
+			os.Remove(folderPath)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package imageHandler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReshard(t *testing.T) {
+	root, err := ioutil.TempDir("", "image-store")
+	if err != nil {
+		t.Fatalf("Error making temp dir")
+	}
+	defer os.RemoveAll(root)
+
+	old := &LocalFileStore{RootPath: root, SubPathLength: 2}
+	old.Put("abcdef.jpg", []byte("abc"))
+	old.Put("ghijkl.jpg", []byte("ghi"))
+
+	// Stores without a layout file get the layout of their sub folders
+	store := &LocalFileStore{RootPath: root, SubPathLength: 3}
+	if err := store.loadLayout(); err != nil {
+		t.Fatalf("loadLayout returned error '%v'", err)
+	}
+
+	if store.PreviousSubPathLength != 2 || !store.NeedsReshard() {
+		t.Fatalf("store.PreviousSubPathLength = '%v', Should be '2'", store.PreviousSubPathLength)
+	}
+
+	// Files are found in the old layout until they're moved
+	if data, err := store.Get("abcdef.jpg"); err != nil || string(data) != "abc" {
+		t.Fatalf("Get should fall back to the previous layout")
+	}
+
+	// A file written after the layout changed replaces the old file
+	store.Put("ghijkl.jpg", []byte("new"))
+
+	moved, err := store.Reshard()
+
+	if err != nil {
+		t.Fatalf("Reshard returned error '%v'", err)
+	}
+
+	if moved != 1 {
+		t.Fatalf("moved = '%v', Should be '1'", moved)
+	}
+
+	if _, err := os.Stat(root + "/abc/abcdef.jpg"); err != nil {
+		t.Fatalf("file should be moved to the 'abc' sub folder")
+	}
+
+	if _, err := os.Stat(root + "/ab"); err == nil {
+		t.Fatalf("the empty 'ab' sub folder should be removed")
+	}
+
+	if data, _ := store.Get("ghijkl.jpg"); string(data) != "new" {
+		t.Fatalf("data = '%v', Should be 'new'", string(data))
+	}
+
+	if store.NeedsReshard() {
+		t.Fatalf("store should not need a reshard after Reshard")
+	}
+
+	// The layout file now records the new layout
+	reloaded := &LocalFileStore{RootPath: root, SubPathLength: 3}
+	reloaded.loadLayout()
+
+	if reloaded.NeedsReshard() {
+		t.Fatalf("reloaded store should not need a reshard")
+	}
+}
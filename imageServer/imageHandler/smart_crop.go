@@ -0,0 +1,344 @@
+package imageHandler
+
+import (
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// Smart cropping looks for the most interesting region of an image. The image
+// is scaled down and each pixel is scored by its edges, skin tones and
+// saturation. Windows with the requested aspect ratio are then scored by the
+// features inside of them and by the entropy of their luminance, and the best
+// window is cropped out of the original image.
+
+// The longest side of the image that's analyzed
+const smartCropAnalysisSize = 256
+
+// How much each pixel feature adds to the pixel's score
+const (
+	smartCropEdgeWeight       = 1.0
+	smartCropSkinWeight       = 1.8
+	smartCropSaturationWeight = 0.3
+)
+
+// How much the parts of a window's score count. Coverage is the share of the
+// image's features inside the window, focus is how dense the features are in
+// the center of the window and entropy is how varied the window's luminance is.
+const (
+	smartCropCoverageWeight = 1.0
+	smartCropFocusWeight    = 0.5
+	smartCropEntropyWeight  = 0.3
+	smartCropCenterWeight   = 0.01
+)
+
+// Windows are tried at these fractions of the largest window with the
+// requested aspect ratio
+var smartCropScales = []float64{1, 0.9, 0.8, 0.7}
+
+// The luminance histograms used for entropy have this many bins
+const smartCropEntropyBins = 16
+
+// A color is considered skin when it's this close to smartCropSkinColor
+const smartCropSkinThreshold = 0.8
+
+var smartCropSkinColor = [3]float64{0.78, 0.57, 0.44}
+
+// Crops the most interesting region of the image with the aspect ratio of
+// width x height and scales it to width x height. Returns the region of the
+// original image that was kept.
+func smartCropImage(img *image.Image, width, height uint, filter ResampleFilter) (*image.Image, image.Rectangle) {
+	rect := smartCropWindow(*img, width, height)
+
+	return fillImage(cropToRect(img, rect), width, height, filter), rect
+}
+
+// Finds the most interesting region of img with the aspect ratio of width x
+// height
+func smartCropWindow(img image.Image, width, height uint) image.Rectangle {
+	bounds := img.Bounds()
+
+	scale := math.Min(1, smartCropAnalysisSize/float64(maxInt(bounds.Dx(), bounds.Dy())))
+	analysisWidth := maxInt(int(math.Round(float64(bounds.Dx())*scale)), 1)
+	analysisHeight := maxInt(int(math.Round(float64(bounds.Dy())*scale)), 1)
+
+	small := resize.Resize(uint(analysisWidth), uint(analysisHeight), img, resize.Bilinear)
+	analysis := analyzeSmartCrop(small)
+
+	analysisBounds := image.Rect(0, 0, analysis.width, analysis.height)
+	windowWidth, windowHeight := aspectWindowSize(analysisBounds, width, height)
+
+	step := maxInt(minInt(analysis.width, analysis.height)/24, 1)
+
+	bestScore := math.Inf(-1)
+	bestX, bestY, bestScale := 0.0, 0.0, 1.0
+
+	for _, windowScale := range smartCropScales {
+		w := maxInt(int(math.Round(float64(windowWidth)*windowScale)), 1)
+		h := maxInt(int(math.Round(float64(windowHeight)*windowScale)), 1)
+
+		for _, y := range windowPositions(analysis.height-h, step) {
+			for _, x := range windowPositions(analysis.width-w, step) {
+				score := analysis.score(image.Rect(x, y, x+w, y+h))
+
+				if score > bestScore {
+					bestScore = score
+					bestScale = windowScale
+
+					// The position is kept as a fraction of the free space so that
+					// it can be placed in the original image
+					bestX = windowFraction(x, analysis.width-w)
+					bestY = windowFraction(y, analysis.height-h)
+				}
+			}
+		}
+	}
+
+	fullWidth, fullHeight := aspectWindowSize(bounds, width, height)
+	cropWidth := maxInt(int(math.Round(float64(fullWidth)*bestScale)), 1)
+	cropHeight := maxInt(int(math.Round(float64(fullHeight)*bestScale)), 1)
+
+	return placeWindow(bounds, cropWidth, cropHeight, bestX, bestY)
+}
+
+// Returns the positions from 0 to limit, including limit
+func windowPositions(limit, step int) []int {
+	positions := make([]int, 0)
+	for p := 0; p < limit; p += step {
+		positions = append(positions, p)
+	}
+
+	return append(positions, maxInt(limit, 0))
+}
+
+func windowFraction(position, limit int) float64 {
+	if limit <= 0 {
+		return 0.5
+	}
+
+	return float64(position) / float64(limit)
+}
+
+// The features of the analyzed image as summed-area tables, so that the sum of
+// any window can be found without visiting its pixels
+type smartCropAnalysis struct {
+	width  int
+	height int
+
+	features   summedArea
+	histograms [smartCropEntropyBins]summedArea
+}
+
+func analyzeSmartCrop(img image.Image) smartCropAnalysis {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	luma := make([]float64, width*height)
+	skin := make([]float64, width*height)
+	saturation := make([]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r16, g16, b16, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			r := float64(r16) / 0xffff
+			g := float64(g16) / 0xffff
+			b := float64(b16) / 0xffff
+
+			i := y*width + x
+			luma[i] = 0.2126*r + 0.7152*g + 0.0722*b
+			skin[i] = skinScore(r, g, b, luma[i])
+			saturation[i] = saturationScore(r, g, b)
+		}
+	}
+
+	analysis := smartCropAnalysis{
+		width:    width,
+		height:   height,
+		features: makeSummedArea(width, height),
+	}
+
+	for bin := range analysis.histograms {
+		analysis.histograms[bin] = makeSummedArea(width, height)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			edge := math.Min(edgeScore(luma, width, height, x, y), 1)
+
+			analysis.features.set(x, y, smartCropEdgeWeight*edge+
+				smartCropSkinWeight*skin[i]+
+				smartCropSaturationWeight*saturation[i])
+
+			bin := minInt(int(luma[i]*smartCropEntropyBins), smartCropEntropyBins-1)
+			for b := range analysis.histograms {
+				value := 0.0
+				if b == bin {
+					value = 1
+				}
+				analysis.histograms[b].set(x, y, value)
+			}
+		}
+	}
+
+	analysis.features.accumulate()
+	for bin := range analysis.histograms {
+		analysis.histograms[bin].accumulate()
+	}
+
+	return analysis
+}
+
+// The absolute value of the Laplacian of the luminance. Pixels outside of the
+// image repeat the nearest edge pixel.
+func edgeScore(luma []float64, width, height, x, y int) float64 {
+	at := func(x, y int) float64 {
+		x = maxInt(minInt(x, width-1), 0)
+		y = maxInt(minInt(y, height-1), 0)
+		return luma[y*width+x]
+	}
+
+	return math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+}
+
+// Scores how close a color is to skin tones, from 0 to 1. Very dark colors are
+// ignored.
+func skinScore(r, g, b, luma float64) float64 {
+	if luma < 0.2 {
+		return 0
+	}
+
+	magnitude := math.Sqrt(r*r + g*g + b*b)
+	if magnitude == 0 {
+		return 0
+	}
+
+	dr := r/magnitude - smartCropSkinColor[0]
+	dg := g/magnitude - smartCropSkinColor[1]
+	db := b/magnitude - smartCropSkinColor[2]
+
+	similarity := 1 - math.Sqrt(dr*dr+dg*dg+db*db)
+	if similarity < smartCropSkinThreshold {
+		return 0
+	}
+
+	return (similarity - smartCropSkinThreshold) / (1 - smartCropSkinThreshold)
+}
+
+// Scores the HSL saturation of a color, from 0 to 1. Saturation below 0.4 and
+// colors that are nearly black or white are ignored.
+func saturationScore(r, g, b float64) float64 {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+
+	lightness := (max + min) / 2
+	if max == min || lightness < 0.05 || lightness > 0.9 {
+		return 0
+	}
+
+	var saturation float64
+	if lightness > 0.5 {
+		saturation = (max - min) / (2 - max - min)
+	} else {
+		saturation = (max - min) / (max + min)
+	}
+
+	if saturation < 0.4 {
+		return 0
+	}
+
+	return (saturation - 0.4) / 0.6
+}
+
+// Scores a window of the analyzed image. Larger windows that keep more of the
+// image's features are preferred, and windows near the center of the image
+// win ties.
+func (a smartCropAnalysis) score(rect image.Rectangle) float64 {
+	area := float64(rect.Dx() * rect.Dy())
+	total := a.features.sum(image.Rect(0, 0, a.width, a.height))
+
+	var coverage, focus float64
+	if total > 0 {
+		coverage = a.features.sum(rect) / total
+
+		inner := image.Rect(
+			rect.Min.X+rect.Dx()/4,
+			rect.Min.Y+rect.Dy()/4,
+			rect.Max.X-rect.Dx()/4,
+			rect.Max.Y-rect.Dy()/4,
+		)
+
+		if !inner.Empty() {
+			meanDensity := total / float64(a.width*a.height)
+			innerDensity := a.features.sum(inner) / float64(inner.Dx()*inner.Dy())
+			focus = math.Min(innerDensity/meanDensity, 4) / 4
+		}
+	}
+
+	entropy := 0.0
+	for bin := range a.histograms {
+		p := a.histograms[bin].sum(rect) / area
+		if p > 0 {
+			entropy -= p * math.Log2(p)
+		}
+	}
+	entropy /= math.Log2(smartCropEntropyBins)
+
+	centerX := float64(rect.Min.X+rect.Max.X)/2/float64(a.width) - 0.5
+	centerY := float64(rect.Min.Y+rect.Max.Y)/2/float64(a.height) - 0.5
+	centerDistance := math.Sqrt(centerX*centerX + centerY*centerY)
+
+	return smartCropCoverageWeight*coverage +
+		smartCropFocusWeight*focus +
+		smartCropEntropyWeight*entropy -
+		smartCropCenterWeight*centerDistance
+}
+
+// A summed-area table. Values are set for each pixel, then accumulate turns
+// them into sums.
+type summedArea struct {
+	width  int
+	values []float64
+}
+
+// The table has an extra row and column of zeros at the top and left, so that
+// sums don't need to check the edges
+func makeSummedArea(width, height int) summedArea {
+	return summedArea{
+		width:  width + 1,
+		values: make([]float64, (width+1)*(height+1)),
+	}
+}
+
+func (sa summedArea) set(x, y int, value float64) {
+	sa.values[(y+1)*sa.width+x+1] = value
+}
+
+func (sa summedArea) accumulate() {
+	height := len(sa.values) / sa.width
+
+	for y := 1; y < height; y++ {
+		for x := 1; x < sa.width; x++ {
+			i := y*sa.width + x
+			sa.values[i] += sa.values[i-1] + sa.values[i-sa.width] - sa.values[i-sa.width-1]
+		}
+	}
+}
+
+// Returns the sum of the values inside of rect
+func (sa summedArea) sum(rect image.Rectangle) float64 {
+	at := func(x, y int) float64 {
+		return sa.values[y*sa.width+x]
+	}
+
+	return at(rect.Max.X, rect.Max.Y) - at(rect.Min.X, rect.Max.Y) - at(rect.Max.X, rect.Min.Y) + at(rect.Min.X, rect.Min.Y)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
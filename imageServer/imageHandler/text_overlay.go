@@ -0,0 +1,466 @@
+package imageHandler
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+type TextOverlayRequest struct {
+	// The text that's drawn over the image. The text can use the following
+	// template variables, which are filled in from the image's document:
+	// {{title}}     : The image's title
+	// {{author}}    : The name of the image's author
+	// {{dateAdded}} : The date when the image was added, e.g. 2021-11-28
+	// {{year}}      : The year when the image was added
+	Text string `json:"text"`
+
+	// The name of an uploaded font. The bundled Go Regular font is used if it's
+	// not set.
+	Font string `json:"font"`
+
+	// The size of the text in pixels. Defaults to 24.
+	Size float64 `json:"size"`
+
+	// Colors are hex strings, e.g. "#fff", "#ffffff" or "#ffffff80". The text is
+	// white by default.
+	Color string `json:"color"`
+
+	// The width in pixels and color of the outline around the text. The outline
+	// is black by default.
+	StrokeWidth int    `json:"strokeWidth"`
+	StrokeColor string `json:"strokeColor"`
+
+	// The distance in pixels that the shadow is moved down and to the right and
+	// the shadow's color. The shadow is translucent black by default.
+	ShadowOffset int    `json:"shadowOffset"`
+	ShadowColor  string `json:"shadowColor"`
+
+	// The color of the box behind the text and the space in pixels between the
+	// text and the box's edges. No box is drawn if the color isn't set.
+	BackgroundColor string `json:"backgroundColor"`
+	Padding         int    `json:"padding"`
+
+	// How the lines of the text are aligned. The following are valid Align values:
+	// left (default), center, right
+	Align string `json:"align"`
+
+	// Where the text is placed. Uses the same values as the conversion request's
+	// Gravity, but defaults to south.
+	Gravity string `json:"gravity"`
+
+	// The space in pixels between the text's box and the edges of the image
+	Margin int `json:"margin"`
+
+	// The widest that the text's lines can be, as a fraction of the image's width
+	// from 0 to 1. Longer lines are wrapped between words. Lines can use the whole
+	// width inside of the margins if it's not set.
+	MaxWidth float64 `json:"maxWidth"`
+}
+
+type TextAlign int8
+
+const (
+	AlignLeft TextAlign = iota
+	AlignCenter
+	AlignRight
+)
+
+// Text that's drawn over the output of a conversion operation. The template
+// variables in the text are filled in and the font is loaded before the
+// operations run.
+type TextOverlay struct {
+	Text            string
+	Font            string
+	Size            float64
+	Color           color.NRGBA
+	StrokeWidth     int
+	StrokeColor     color.NRGBA
+	ShadowOffset    int
+	ShadowColor     color.NRGBA
+	BackgroundColor color.NRGBA
+	Padding         int
+	Align           TextAlign
+	Gravity         Gravity
+	Margin          int
+	MaxWidth        float64
+
+	font *opentype.Font
+}
+
+// Loads the uploaded fonts that text overlays refer to by name. Returns the
+// font's TrueType or OpenType file, or a MissingAssetError if no font has the
+// name.
+type FontSource interface {
+	GetFontFile(name string) ([]byte, error)
+}
+
+// The values of the template variables in text overlays
+type TemplateValues struct {
+	Title     string
+	Author    string
+	DateAdded time.Time
+}
+
+var templateVariablePattern = regexp.MustCompile(`{{\s*(\w+)\s*}}`)
+
+func (values TemplateValues) lookup(name string) (string, bool) {
+	switch name {
+	case "title":
+		return values.Title, true
+	case "author":
+		return values.Author, true
+	case "dateAdded":
+		return values.DateAdded.Format("2006-01-02"), true
+	case "year":
+		return strconv.Itoa(values.DateAdded.Year()), true
+	default:
+		return "", false
+	}
+}
+
+// Replaces the template variables in the text with their values
+func (values TemplateValues) fill(text string) string {
+	return templateVariablePattern.ReplaceAllStringFunc(text, func(variable string) string {
+		name := templateVariablePattern.FindStringSubmatch(variable)[1]
+		value, _ := values.lookup(name)
+
+		return value
+	})
+}
+
+func makeTextOverlayFromRequest(req TextOverlayRequest) (TextOverlay, error) {
+	if len(strings.TrimSpace(req.Text)) == 0 {
+		return TextOverlay{}, errors.New("text overlays need text")
+	}
+
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(req.Text, -1) {
+		if _, ok := (TemplateValues{}).lookup(match[1]); !ok {
+			return TextOverlay{}, errors.New("invalid template variable: " + match[1])
+		}
+	}
+
+	size := req.Size
+	if size == 0 {
+		size = 24
+	}
+
+	if size < 0 || size > 1000 {
+		return TextOverlay{}, errors.New("invalid text size")
+	}
+
+	if req.StrokeWidth < 0 || req.StrokeWidth > 50 {
+		return TextOverlay{}, errors.New("invalid text stroke width")
+	}
+
+	if req.ShadowOffset < 0 || req.ShadowOffset > 100 {
+		return TextOverlay{}, errors.New("invalid text shadow offset")
+	}
+
+	if req.Padding < 0 || req.Margin < 0 {
+		return TextOverlay{}, errors.New("invalid text padding or margin")
+	}
+
+	if req.MaxWidth < 0 || req.MaxWidth > 1 {
+		return TextOverlay{}, errors.New("invalid text max width")
+	}
+
+	textColor, colorErr := parseColorOrDefault(req.Color, color.NRGBA{255, 255, 255, 255})
+	strokeColor, strokeErr := parseColorOrDefault(req.StrokeColor, color.NRGBA{0, 0, 0, 255})
+	shadowColor, shadowErr := parseColorOrDefault(req.ShadowColor, color.NRGBA{0, 0, 0, 128})
+	backgroundColor, backgroundErr := parseColorOrDefault(req.BackgroundColor, color.NRGBA{})
+
+	for _, err := range []error{colorErr, strokeErr, shadowErr, backgroundErr} {
+		if err != nil {
+			return TextOverlay{}, err
+		}
+	}
+
+	align, alignErr := parseTextAlign(req.Align)
+	if alignErr != nil {
+		return TextOverlay{}, alignErr
+	}
+
+	gravity := South
+	if len(req.Gravity) > 0 {
+		var gravityErr error
+		gravity, gravityErr = parseGravity(req.Gravity)
+
+		if gravityErr != nil {
+			return TextOverlay{}, gravityErr
+		}
+	}
+
+	return TextOverlay{
+		Text:            req.Text,
+		Font:            req.Font,
+		Size:            size,
+		Color:           textColor,
+		StrokeWidth:     req.StrokeWidth,
+		StrokeColor:     strokeColor,
+		ShadowOffset:    req.ShadowOffset,
+		ShadowColor:     shadowColor,
+		BackgroundColor: backgroundColor,
+		Padding:         req.Padding,
+		Align:           align,
+		Gravity:         gravity,
+		Margin:          req.Margin,
+		MaxWidth:        req.MaxWidth,
+	}, nil
+}
+
+func parseTextAlign(align string) (TextAlign, error) {
+	switch strings.ToLower(align) {
+	case "", "left":
+		return AlignLeft, nil
+	case "center":
+		return AlignCenter, nil
+	case "right":
+		return AlignRight, nil
+	default:
+		return AlignLeft, errors.New("invalid text alignment")
+	}
+}
+
+// Parses "#rgb", "#rrggbb" and "#rrggbbaa" colors. The # is optional. Returns
+// the default color for an empty string.
+func parseColorOrDefault(hex string, defaultColor color.NRGBA) (color.NRGBA, error) {
+	hex = strings.TrimPrefix(strings.TrimSpace(hex), "#")
+
+	if len(hex) == 0 {
+		return defaultColor, nil
+	}
+
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	if len(hex) != 8 {
+		return color.NRGBA{}, errors.New("invalid color: " + hex)
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errors.New("invalid color: " + hex)
+	}
+
+	return color.NRGBA{
+		R: uint8(value >> 24),
+		G: uint8(value >> 16),
+		B: uint8(value >> 8),
+		A: uint8(value),
+	}, nil
+}
+
+// Fills in the template variables of every text overlay, then loads the fonts
+// that the overlays use. Each font is only loaded once.
+func loadTextOverlays(ops []ConversionOp, source FontSource, values TemplateValues) ([]ConversionOp, error) {
+	fonts := make(map[string]*opentype.Font)
+
+	for i, op := range ops {
+		if len(op.TextOverlays) == 0 {
+			continue
+		}
+
+		overlays := make([]TextOverlay, len(op.TextOverlays))
+
+		for j, overlay := range op.TextOverlays {
+			f, ok := fonts[overlay.Font]
+
+			if !ok {
+				var err error
+				f, err = loadFont(overlay.Font, source)
+
+				if err != nil {
+					return ops, err
+				}
+
+				fonts[overlay.Font] = f
+			}
+
+			overlay.Text = values.fill(overlay.Text)
+			overlay.font = f
+
+			overlays[j] = overlay
+		}
+
+		op.TextOverlays = overlays
+		ops[i] = op
+	}
+
+	return ops, nil
+}
+
+func loadFont(name string, source FontSource) (*opentype.Font, error) {
+	if len(name) == 0 {
+		return opentype.Parse(goregular.TTF)
+	}
+
+	if source == nil {
+		return nil, errors.New("uploaded fonts aren't available")
+	}
+
+	data, err := source.GetFontFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return opentype.Parse(data)
+}
+
+// Draws the text over a copy of the image. The lines are wrapped to fit the
+// image and the box around them is placed inside of the margins at the
+// overlay's gravity.
+func applyTextOverlay(img *image.Image, overlay TextOverlay) *image.Image {
+	bounds := (*img).Bounds()
+
+	output := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(output, output.Bounds(), *img, bounds.Min, draw.Src)
+
+	var result image.Image = output
+
+	if overlay.font == nil {
+		return &result
+	}
+
+	face, faceErr := opentype.NewFace(overlay.font, &opentype.FaceOptions{
+		Size:    overlay.Size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+
+	if faceErr != nil {
+		return &result
+	}
+	defer face.Close()
+
+	// The space around the lines inside of the box
+	inset := overlay.Padding + overlay.StrokeWidth
+
+	maxWidth := bounds.Dx() - 2*overlay.Margin
+	if overlay.MaxWidth > 0 {
+		maxWidth = int(float64(bounds.Dx()) * overlay.MaxWidth)
+	}
+
+	lines := wrapText(face, overlay.Text, maxWidth-2*inset)
+
+	if len(lines) == 0 {
+		return &result
+	}
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+
+	lineWidths := make([]int, len(lines))
+	blockWidth := 0
+
+	for i, line := range lines {
+		lineWidths[i] = font.MeasureString(face, line).Ceil()
+
+		if lineWidths[i] > blockWidth {
+			blockWidth = lineWidths[i]
+		}
+	}
+
+	inner := output.Bounds().Inset(overlay.Margin)
+	anchorX, anchorY := overlay.Gravity.anchor()
+
+	box := placeWindow(inner, blockWidth+2*inset, lineHeight*len(lines)+2*inset, anchorX, anchorY)
+
+	if overlay.BackgroundColor.A > 0 {
+		draw.Draw(output, box, image.NewUniform(overlay.BackgroundColor), image.Point{}, draw.Over)
+	}
+
+	drawer := font.Drawer{Dst: output, Face: face}
+
+	drawLines := func(c color.Color, dx, dy int) {
+		drawer.Src = image.NewUniform(c)
+
+		for i, line := range lines {
+			x := box.Min.X + inset + dx
+
+			switch overlay.Align {
+			case AlignCenter:
+				x += (blockWidth - lineWidths[i]) / 2
+			case AlignRight:
+				x += blockWidth - lineWidths[i]
+			}
+
+			y := box.Min.Y + inset + metrics.Ascent.Ceil() + i*lineHeight + dy
+
+			drawer.Dot = fixed.P(x, y)
+			drawer.DrawString(line)
+		}
+	}
+
+	if overlay.ShadowOffset > 0 && overlay.ShadowColor.A > 0 {
+		drawLines(overlay.ShadowColor, overlay.ShadowOffset, overlay.ShadowOffset)
+	}
+
+	// The stroke is drawn by drawing the text at every offset inside of a circle
+	// with the stroke's width, then drawing the text over it
+	if overlay.StrokeWidth > 0 && overlay.StrokeColor.A > 0 {
+		width := overlay.StrokeWidth
+		for dy := -width; dy <= width; dy++ {
+			for dx := -width; dx <= width; dx++ {
+				if (dx != 0 || dy != 0) && dx*dx+dy*dy <= width*width {
+					drawLines(overlay.StrokeColor, dx, dy)
+				}
+			}
+		}
+	}
+
+	drawLines(overlay.Color, 0, 0)
+
+	return &result
+}
+
+// Splits the text into lines that are at most maxWidth pixels wide. Newlines
+// in the text are kept. Lines are only broken between words, so a word that's
+// wider than maxWidth gets a line of its own.
+func wrapText(face font.Face, text string, maxWidth int) []string {
+	lines := make([]string, 0)
+
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+
+		for _, word := range strings.Fields(paragraph) {
+			if len(line) == 0 {
+				line = word
+				continue
+			}
+
+			candidate := line + " " + word
+
+			if font.MeasureString(face, candidate).Ceil() <= maxWidth {
+				line = candidate
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	// Blank lines at the end of the text would only make the box taller
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
@@ -0,0 +1,263 @@
+package imageHandler
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+)
+
+func makeTestTextOverlay(t *testing.T, req TextOverlayRequest) TextOverlay {
+	overlay, err := makeTextOverlayFromRequest(req)
+
+	if err != nil {
+		t.Fatalf("makeTextOverlayFromRequest returned error '%v'", err)
+	}
+
+	overlay.font, err = opentype.Parse(goregular.TTF)
+
+	if err != nil {
+		t.Fatalf("opentype.Parse returned error '%v'", err)
+	}
+
+	return overlay
+}
+
+// Returns the smallest rectangle that holds every pixel with the color
+func findColor(img image.Image, matches func(color.Color) bool) image.Rectangle {
+	found := image.Rectangle{}
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if matches(img.At(x, y)) {
+				found = found.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	return found
+}
+
+func isBlack(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r == 0 && g == 0 && b == 0
+}
+
+func TestApplyTextOverlay(t *testing.T) {
+	img := makeSolidImage(200, 100, color.White)
+
+	overlay := makeTestTextOverlay(t, TextOverlayRequest{
+		Text:   "Hello",
+		Color:  "#ff0000",
+		Margin: 10,
+	})
+
+	output := *applyTextOverlay(img, overlay)
+	text := findColor(output, isRed)
+
+	if text.Empty() {
+		t.Fatalf("the text should be drawn in red")
+	}
+
+	// The text is placed at the bottom center by default
+	if text.Max.Y > 90 || text.Min.Y < 50 || text.Min.X < 60 || text.Max.X > 140 {
+		t.Fatalf("text = '%v', Should be at the bottom center inside of the margin", text)
+	}
+
+	if isRed((*img).At(text.Min.X, text.Min.Y)) {
+		t.Fatalf("the source image shouldn't be changed")
+	}
+
+	overlay.Gravity = NorthWest
+	overlay.BackgroundColor = color.NRGBA{0, 0, 0, 255}
+	overlay.Padding = 5
+
+	output = *applyTextOverlay(img, overlay)
+	box := findColor(output, isBlack)
+
+	if box.Min != image.Pt(10, 10) {
+		t.Fatalf("box.Min = '%v', Should be '%v'", box.Min, image.Pt(10, 10))
+	}
+
+	text = findColor(output, isRed)
+	if !text.In(box.Inset(5)) {
+		t.Fatalf("text = '%v', Should be inside of the padding of '%v'", text, box)
+	}
+}
+
+func TestApplyTextOverlayStrokeAndShadow(t *testing.T) {
+	img := makeSolidImage(200, 100, color.White)
+
+	overlay := makeTestTextOverlay(t, TextOverlayRequest{Text: "Hello", Color: "#f00", Gravity: "center"})
+	plain := findColor(*applyTextOverlay(img, overlay), isBlack)
+
+	if !plain.Empty() {
+		t.Fatalf("text without a stroke or shadow shouldn't draw black pixels")
+	}
+
+	text := findColor(*applyTextOverlay(img, overlay), isRed)
+
+	overlay.StrokeWidth = 2
+	stroke := findColor(*applyTextOverlay(img, overlay), isBlack)
+
+	if stroke.Min.X > text.Min.X-1 || stroke.Max.X < text.Max.X+1 {
+		t.Fatalf("stroke = '%v', Should surround '%v'", stroke, text)
+	}
+
+	overlay.StrokeWidth = 0
+	overlay.ShadowOffset = 4
+	overlay.ShadowColor = color.NRGBA{0, 0, 0, 255}
+
+	shadow := findColor(*applyTextOverlay(img, overlay), isBlack)
+
+	if shadow.Max.Y <= text.Max.Y || shadow.Max.X <= text.Max.X {
+		t.Fatalf("shadow = '%v', Should be below and to the right of '%v'", shadow, text)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	f, _ := opentype.Parse(goregular.TTF)
+	face, _ := opentype.NewFace(f, &opentype.FaceOptions{Size: 20, DPI: 72})
+	defer face.Close()
+
+	wordWidth := font.MeasureString(face, "word word").Ceil()
+
+	lines := wrapText(face, "word word word word\nnext", wordWidth)
+
+	expected := []string{"word word", "word word", "next"}
+	if len(lines) != len(expected) {
+		t.Fatalf("lines = '%v', Should be '%v'", lines, expected)
+	}
+
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Fatalf("lines[%v] = '%v', Should be '%v'", i, lines[i], expected[i])
+		}
+	}
+
+	// Words that are too long aren't broken
+	lines = wrapText(face, "extraordinarily", 10)
+	if len(lines) != 1 || lines[0] != "extraordinarily" {
+		t.Fatalf("lines = '%v', Should be '[extraordinarily]'", lines)
+	}
+
+	overlay := makeTestTextOverlay(t, TextOverlayRequest{Text: "one two three four five six seven", Size: 20, MaxWidth: 0.5, Color: "#f00"})
+	img := makeSolidImage(200, 200, color.White)
+
+	text := findColor(*applyTextOverlay(img, overlay), isRed)
+	if text.Dx() > 100 || text.Dy() < 40 {
+		t.Fatalf("text = '%v', Should be wrapped into lines that are at most 100 pixels wide", text)
+	}
+}
+
+func TestTemplateValues(t *testing.T) {
+	values := TemplateValues{
+		Title:     "Sunset",
+		Author:    "Test Author",
+		DateAdded: time.Date(2021, 11, 28, 12, 0, 0, 0, time.UTC),
+	}
+
+	output := values.fill("{{title}} by {{ author }}, {{dateAdded}} © {{year}}")
+	expected := "Sunset by Test Author, 2021-11-28 © 2021"
+
+	if output != expected {
+		t.Fatalf("output = '%v', Should be '%v'", output, expected)
+	}
+}
+
+func TestMakeOpFromRequestTextOverlays(t *testing.T) {
+	op, err := makeOpFromRequest(ConversionRequest{
+		ResizeOp:     "scale",
+		LongestSide:  100,
+		TextOverlays: []TextOverlayRequest{{Text: "© {{author}}", Color: "#ffffff80", Align: "right"}},
+	})
+
+	if err != nil {
+		t.Fatalf("makeOpFromRequest returned error '%v'", err)
+	}
+
+	if len(op.TextOverlays) != 1 {
+		t.Fatalf("len(op.TextOverlays) = '%v', Should be '1'", len(op.TextOverlays))
+	}
+
+	overlay := op.TextOverlays[0]
+	if overlay.Size != 24 || overlay.Gravity != South || overlay.Align != AlignRight || overlay.Color != (color.NRGBA{255, 255, 255, 128}) {
+		t.Fatalf("overlay = '%v', Should have the default size and gravity", overlay)
+	}
+
+	invalid := []TextOverlayRequest{
+		{Text: " "},
+		{Text: "{{unknown}}"},
+		{Text: "text", Size: -1},
+		{Text: "text", Color: "red"},
+		{Text: "text", Align: "justify"},
+		{Text: "text", MaxWidth: 2},
+		{Text: "text", StrokeWidth: -1},
+		{Text: "text", Gravity: "up"},
+	}
+
+	for _, req := range invalid {
+		_, err := makeOpFromRequest(ConversionRequest{ResizeOp: "thumbnail", TextOverlays: []TextOverlayRequest{req}})
+
+		if err == nil {
+			t.Fatalf("makeOpFromRequest should return an error for '%v'", req)
+		}
+	}
+
+	_, err = makeOpFromRequest(ConversionRequest{ResizeOp: "original", TextOverlays: []TextOverlayRequest{{Text: "text"}}})
+	if err == nil {
+		t.Fatalf("the original image shouldn't have text overlays")
+	}
+}
+
+type testFontSource map[string][]byte
+
+func (source testFontSource) GetFontFile(name string) ([]byte, error) {
+	data, ok := source[name]
+
+	if !ok {
+		return nil, errors.New("unknown font")
+	}
+
+	return data, nil
+}
+
+func TestLoadTextOverlays(t *testing.T) {
+	source := testFontSource{"custom": goregular.TTF}
+	values := TemplateValues{Title: "Sunset"}
+
+	overlays := []TextOverlay{{Text: "{{title}}"}, {Text: "caption", Font: "custom"}}
+
+	ops := []ConversionOp{
+		makeThumbnailOp(),
+		{Suffix: "web", ResizeOp: Scale, LongestSide: 100, TextOverlays: overlays},
+	}
+
+	ops, err := loadTextOverlays(ops, source, values)
+
+	if err != nil {
+		t.Fatalf("loadTextOverlays returned error '%v'", err)
+	}
+
+	loaded := ops[1].TextOverlays
+
+	if loaded[0].Text != "Sunset" || loaded[0].font == nil || loaded[1].font == nil {
+		t.Fatalf("the overlays should have their text filled in and their fonts loaded")
+	}
+
+	if overlays[0].Text != "{{title}}" {
+		t.Fatalf("the request's overlays shouldn't be changed")
+	}
+
+	_, err = loadTextOverlays([]ConversionOp{{ResizeOp: Scale, TextOverlays: []TextOverlay{{Font: "missing"}}}}, source, values)
+
+	if err == nil {
+		t.Fatalf("an unknown font should return an error")
+	}
+}
@@ -0,0 +1,229 @@
+package imageHandler
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Which way an image is mirrored
+type FlipDirection int8
+
+const (
+	NoFlip FlipDirection = iota
+	FlipHorizontal
+	FlipVertical
+	FlipBoth
+)
+
+func parseFlipDirection(flip string) (FlipDirection, error) {
+	switch strings.ToLower(flip) {
+	case "":
+		return NoFlip, nil
+	case "horizontal":
+		return FlipHorizontal, nil
+	case "vertical":
+		return FlipVertical, nil
+	case "both":
+		return FlipBoth, nil
+	default:
+		return NoFlip, errors.New("invalid flip direction")
+	}
+}
+
+// Returns the name that MakeTransform parses
+func (f FlipDirection) String() string {
+	switch f {
+	case FlipHorizontal:
+		return "horizontal"
+	case FlipVertical:
+		return "vertical"
+	case FlipBoth:
+		return "both"
+	default:
+		return ""
+	}
+}
+
+// Rotates and flips an image before it's resized. The image is rotated first,
+// then flipped.
+type Transform struct {
+	// The clockwise rotation in degrees
+	Rotate float64
+
+	Flip FlipDirection
+
+	// The color of the corners that are uncovered by rotations that aren't
+	// multiples of 90 degrees
+	Background color.NRGBA
+}
+
+// Makes a transform from the rotate, flip and background values of a request.
+// The background is white by default.
+func MakeTransform(rotate float64, flip, background string) (Transform, error) {
+	if math.IsNaN(rotate) || math.IsInf(rotate, 0) {
+		return Transform{}, errors.New("invalid rotation")
+	}
+
+	flipDirection, flipErr := parseFlipDirection(flip)
+	if flipErr != nil {
+		return Transform{}, flipErr
+	}
+
+	backgroundColor, colorErr := parseColorOrDefault(background, color.NRGBA{255, 255, 255, 255})
+	if colorErr != nil {
+		return Transform{}, colorErr
+	}
+
+	return Transform{
+		Rotate:     normalizeDegrees(rotate),
+		Flip:       flipDirection,
+		Background: backgroundColor,
+	}, nil
+}
+
+// Returns the angle from 0 up to 360 degrees
+func normalizeDegrees(degrees float64) float64 {
+	degrees = math.Mod(degrees, 360)
+
+	if degrees < 0 {
+		degrees += 360
+	}
+
+	return degrees
+}
+
+// Returns true if the transform doesn't change images
+func (t Transform) IsIdentity() bool {
+	return t.Rotate == 0 && t.Flip == NoFlip
+}
+
+// Returns the background as "#rrggbbaa", which MakeTransform parses
+func (t Transform) BackgroundHex() string {
+	bg := t.Background
+	return fmt.Sprintf("#%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A)
+}
+
+// Returns the transform that has the same result as applying t and then next.
+// Mirroring an image reverses the direction of the rotations after it, and
+// mirroring twice in the same direction undoes it. Rotations that aren't
+// multiples of 90 degrees become one rotation, so the corners are only filled
+// once, with the background of the latest one.
+func (t Transform) Then(next Transform) Transform {
+	rotate := next.Rotate
+	if t.Flip == FlipHorizontal || t.Flip == FlipVertical {
+		rotate = -rotate
+	}
+
+	background := t.Background
+	if math.Mod(next.Rotate, 90) != 0 {
+		background = next.Background
+	}
+
+	// Rounding keeps floating point error from turning 90 degree rotations into
+	// ones that are resampled
+	rotate = math.Round((t.Rotate+rotate)*1e9) / 1e9
+
+	return Transform{
+		Rotate:     normalizeDegrees(rotate),
+		Flip:       t.Flip ^ next.Flip,
+		Background: background,
+	}
+}
+
+func (t Transform) apply(img *image.Image) *image.Image {
+	if t.IsIdentity() {
+		return img
+	}
+
+	output := rotateImage(*img, t.Rotate, t.Background)
+
+	switch t.Flip {
+	case FlipHorizontal:
+		output = orientImage(output, MirrorHorizontal)
+	case FlipVertical:
+		output = orientImage(output, MirrorVertical)
+	case FlipBoth:
+		output = orientImage(output, Rotate180)
+	}
+
+	return &output
+}
+
+// Rotates an image clockwise. Multiples of 90 degrees move the pixels without
+// resampling them. Other angles are sampled bilinearly onto a canvas that fits
+// the whole rotated image, and the uncovered corners are filled with the
+// background.
+func rotateImage(img image.Image, degrees float64, background color.NRGBA) image.Image {
+	switch degrees {
+	case 0:
+		return img
+	case 90:
+		return orientImage(img, RotateCW)
+	case 180:
+		return orientImage(img, Rotate180)
+	case 270:
+		return orientImage(img, RotateCCW)
+	}
+
+	src := toRGBA(img)
+	width, height := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+
+	radians := degrees * math.Pi / 180
+	sin, cos := math.Sin(radians), math.Cos(radians)
+
+	// The small tolerance keeps floating point error from adding a pixel
+	newWidth := int(math.Ceil(math.Abs(width*cos) + math.Abs(height*sin) - 1e-6))
+	newHeight := int(math.Ceil(math.Abs(width*sin) + math.Abs(height*cos) - 1e-6))
+
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	bg := color.RGBAModel.Convert(background).(color.RGBA)
+
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			// The pixel's center relative to the center of the canvas, rotated back
+			// into the source image
+			dx := float64(x) + 0.5 - float64(newWidth)/2
+			dy := float64(y) + 0.5 - float64(newHeight)/2
+
+			sx := dx*cos + dy*sin + width/2 - 0.5
+			sy := -dx*sin + dy*cos + height/2 - 0.5
+
+			dst.SetRGBA(x, y, sampleBilinear(src, sx, sy, bg))
+		}
+	}
+
+	return dst
+}
+
+// Samples an image between pixels. Pixels outside of the image have the
+// background color, so the edges of a rotated image blend into the background.
+func sampleBilinear(img *image.RGBA, x, y float64, background color.RGBA) color.RGBA {
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	pixel := func(px, py int) [4]float64 {
+		c := background
+		if image.Pt(px, py).In(img.Bounds()) {
+			c = img.RGBAAt(px, py)
+		}
+
+		return [4]float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+	}
+
+	p00, p10 := pixel(x0, y0), pixel(x0+1, y0)
+	p01, p11 := pixel(x0, y0+1), pixel(x0+1, y0+1)
+
+	var result [4]uint8
+	for c := 0; c < 4; c++ {
+		top := p00[c]*(1-fx) + p10[c]*fx
+		bottom := p01[c]*(1-fx) + p11[c]*fx
+
+		result[c] = clampUint8(top*(1-fy) + bottom*fy)
+	}
+
+	return color.RGBA{result[0], result[1], result[2], result[3]}
+}
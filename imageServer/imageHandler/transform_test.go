@@ -0,0 +1,283 @@
+package imageHandler
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Makes a 4x2 blue image with a red top left pixel
+func makeCornerImage() *image.Image {
+	img := makeSolidImage(4, 2, color.RGBA{0, 0, 255, 255})
+	(*img).(*image.RGBA).SetRGBA(0, 0, color.RGBA{255, 0, 0, 255})
+
+	return img
+}
+
+func TestTransformApply(t *testing.T) {
+	tests := []struct {
+		transform Transform
+		size      ImageSize
+		red       image.Point
+	}{
+		{Transform{Rotate: 90}, ImageSize{2, 4}, image.Pt(1, 0)},
+		{Transform{Rotate: 180}, ImageSize{4, 2}, image.Pt(3, 1)},
+		{Transform{Rotate: 270}, ImageSize{2, 4}, image.Pt(0, 3)},
+		{Transform{Flip: FlipHorizontal}, ImageSize{4, 2}, image.Pt(3, 0)},
+		{Transform{Flip: FlipVertical}, ImageSize{4, 2}, image.Pt(0, 1)},
+		{Transform{Flip: FlipBoth}, ImageSize{4, 2}, image.Pt(3, 1)},
+		// Rotated first, then flipped
+		{Transform{Rotate: 90, Flip: FlipHorizontal}, ImageSize{2, 4}, image.Pt(0, 0)},
+	}
+
+	for _, test := range tests {
+		output := test.transform.apply(makeCornerImage())
+
+		if size := GetImageSize(output); size != test.size {
+			t.Fatalf("size = '%v', Should be '%v' for '%v'", size, test.size, test.transform)
+		}
+
+		if !isRed((*output).At(test.red.X, test.red.Y)) {
+			t.Fatalf("pixel '%v' should be red for '%v'", test.red, test.transform)
+		}
+	}
+}
+
+// Every combination of the 90 degree rotations and flips has the same result
+// as the two transforms applied one after the other
+func TestTransformThen(t *testing.T) {
+	transforms := make([]Transform, 0, 16)
+	for _, rotate := range []float64{0, 90, 180, 270} {
+		for _, flip := range []FlipDirection{NoFlip, FlipHorizontal, FlipVertical, FlipBoth} {
+			transforms = append(transforms, Transform{Rotate: rotate, Flip: flip})
+		}
+	}
+
+	for _, first := range transforms {
+		for _, second := range transforms {
+			expected := second.apply(first.apply(makeCornerImage()))
+			output := first.Then(second).apply(makeCornerImage())
+
+			if GetImageSize(output) != GetImageSize(expected) {
+				t.Fatalf("size = '%v', Should be '%v' for '%v' then '%v'", GetImageSize(output), GetImageSize(expected), first, second)
+			}
+
+			size := GetImageSize(output)
+			for y := 0; y < size.Height; y++ {
+				for x := 0; x < size.Width; x++ {
+					if isRed((*output).At(x, y)) != isRed((*expected).At(x, y)) {
+						t.Fatalf("pixel (%v, %v) is wrong for '%v' then '%v'", x, y, first, second)
+					}
+				}
+			}
+		}
+	}
+
+	// Opposite rotations cancel out
+	if transform := (Transform{Rotate: 30}).Then(Transform{Rotate: 330}); !transform.IsIdentity() {
+		t.Fatalf("transform = '%v', Should be the identity", transform)
+	}
+
+	background := color.NRGBA{0, 255, 0, 255}
+	if transform := (Transform{Rotate: 10}).Then(Transform{Rotate: 20, Background: background}); transform.Background != background {
+		t.Fatalf("transform.Background = '%v', Should be '%v'", transform.Background, background)
+	}
+}
+
+func TestRotateArbitraryAngle(t *testing.T) {
+	background := color.NRGBA{0, 255, 0, 255}
+	output := Transform{Rotate: 45, Background: background}.apply(makeSolidImage(10, 10, color.RGBA{255, 0, 0, 255}))
+
+	// The canvas fits the diagonal of the square
+	if size := GetImageSize(output); size != (ImageSize{15, 15}) {
+		t.Fatalf("size = '%v', Should be '%v'", size, ImageSize{15, 15})
+	}
+
+	if c := getNRGBA(output, 0, 0); c != background {
+		t.Fatalf("corner = '%v', Should be the background '%v'", c, background)
+	}
+
+	if !isRed((*output).At(7, 7)) {
+		t.Fatalf("center = '%v', Should be red", (*output).At(7, 7))
+	}
+}
+
+func TestMakeTransform(t *testing.T) {
+	transform, err := MakeTransform(-90, "Vertical", "#000")
+
+	if err != nil {
+		t.Fatalf("MakeTransform returned error '%v'", err)
+	}
+
+	expected := Transform{Rotate: 270, Flip: FlipVertical, Background: color.NRGBA{0, 0, 0, 255}}
+	if transform != expected {
+		t.Fatalf("transform = '%v', Should be '%v'", transform, expected)
+	}
+
+	if transform, _ := MakeTransform(720, "", ""); !transform.IsIdentity() {
+		t.Fatalf("transform = '%v', Should be the identity", transform)
+	}
+
+	// The names parse back to the same transform
+	if parsed, _ := MakeTransform(transform.Rotate, transform.Flip.String(), transform.BackgroundHex()); parsed != transform {
+		t.Fatalf("parsed = '%v', Should be '%v'", parsed, transform)
+	}
+
+	if _, err := MakeTransform(0, "diagonal", ""); err == nil {
+		t.Fatalf("an invalid flip should return an error")
+	}
+
+	if _, err := MakeTransform(0, "", "blue"); err == nil {
+		t.Fatalf("an invalid background should return an error")
+	}
+
+	// The original can't be transformed
+	if _, err := makeOpFromRequest(ConversionRequest{ResizeOp: "original", Rotate: 90}); err == nil {
+		t.Fatalf("rotating the original should return an error")
+	}
+}
+
+func TestRewriteImageFiles(t *testing.T) {
+	dat := imageData{ImageData: makeCornerImage(), OriginalImageType: Png}
+	encoded, _ := dat.EncodeImage(ConversionOp{ResizeOp: Original, CompressTo: Png})
+
+	files := []StoredImageFile{
+		{Filename: "abc@original.png", FormatName: "original", ImageType: Png, ImageSize: ImageSize{4, 2}, Private: true},
+		{Filename: "abc@small.png", FormatName: "small", ImageType: Png, ImageSize: ImageSize{2, 1}, Request: &ConversionRequest{Suffix: "small", ResizeOp: "scale", LongestSide: 2}},
+		{Filename: "abc@square.png", FormatName: "square", ImageType: Png, ImageSize: ImageSize{2, 2}, Crop: &CropRect{0, 0, 2, 2}},
+	}
+
+	// The request replaces the operation of the file with the same suffix
+	requests := []ConversionRequest{{Suffix: "square", ResizeOp: "fill", Width: 3, Height: 3, CompressTo: "jpeg"}}
+
+	store := MakeMemoryFileStore()
+	result, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, requests, store, nil, TemplateValues{})
+
+	if err != nil {
+		t.Fatalf("RewriteImageFiles returned error '%v'", err)
+	}
+
+	expected := []ImageSize{{2, 4}, {1, 2}, {3, 3}}
+
+	for i, format := range result.SizeFormats {
+		if format.Filename != files[i].Filename || format.ImageType != Png {
+			t.Fatalf("format = '%v', Should keep the filename and type of '%v'", format, files[i])
+		}
+
+		if format.ImageSize != expected[i] {
+			t.Fatalf("size = '%v', Should be '%v' for '%v'", format.ImageSize, expected[i], format.Filename)
+		}
+	}
+
+	if !result.SizeFormats[0].Private {
+		t.Fatalf("the original should stay private")
+	}
+
+	original, _ := store.Get(result.SizeFormats[0].GetStorageName())
+	output, err := makeImageDataFromBytes(original)
+
+	if err != nil {
+		t.Fatalf("makeImageDataFromBytes returned error '%v'", err)
+	}
+
+	if !isRed((*output.ImageData).At(1, 0)) {
+		t.Fatalf("the original should be rotated")
+	}
+}
+
+// Files without a stored request can't be made the same way again, so they
+// need a request unless they are the original or the default thumbnail
+func TestRewriteImageFilesMissingRequests(t *testing.T) {
+	dat := imageData{ImageData: makeCornerImage(), OriginalImageType: Png}
+	encoded, _ := dat.EncodeImage(ConversionOp{ResizeOp: Original, CompressTo: Png})
+
+	files := []StoredImageFile{
+		{Filename: "abc@original.png", FormatName: "original", ImageType: Png, ImageSize: ImageSize{4, 2}},
+		{Filename: "abc@thumb.png", FormatName: "thumb", ImageType: Png, ImageSize: ImageSize{4, 2}},
+		{Filename: "abc@small.png", FormatName: "small", ImageType: Png, ImageSize: ImageSize{2, 1}},
+	}
+
+	missing := GetMissingRewriteRequests(files, nil)
+
+	if len(missing) != 1 || missing[0] != "small" {
+		t.Fatalf("missing = '%v', Should be '[small]'", missing)
+	}
+
+	if _, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, nil, MakeMemoryFileStore(), nil, TemplateValues{}); err == nil {
+		t.Fatalf("RewriteImageFiles should return an error for files without a request")
+	}
+
+	requests := []ConversionRequest{{Suffix: "small", ResizeOp: "scale", LongestSide: 2}}
+
+	if missing := GetMissingRewriteRequests(files, requests); len(missing) != 0 {
+		t.Fatalf("missing = '%v', Should be empty", missing)
+	}
+
+	if _, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, requests, MakeMemoryFileStore(), nil, TemplateValues{}); err != nil {
+		t.Fatalf("RewriteImageFiles returned error '%v'", err)
+	}
+}
+
+type testAssetSource struct{ err error }
+
+func (source testAssetSource) GetWatermarkFile(name string) ([]byte, error) {
+	return nil, source.err
+}
+
+func (source testAssetSource) GetFontFile(name string) ([]byte, error) {
+	return nil, source.err
+}
+
+// Stored requests can refer to watermarks and fonts that were deleted since.
+// The files are made without them, but requests for the transform still need
+// their assets.
+func TestRewriteImageFilesDeletedAssets(t *testing.T) {
+	dat := imageData{ImageData: makeCornerImage(), OriginalImageType: Png}
+	encoded, _ := dat.EncodeImage(ConversionOp{ResizeOp: Original, CompressTo: Png})
+
+	watermarked := ConversionRequest{
+		Suffix:       "small",
+		ResizeOp:     "scale",
+		LongestSide:  2,
+		Watermark:    &WatermarkRequest{Name: "logo"},
+		TextOverlays: []TextOverlayRequest{{Text: "a", Font: "serif"}, {Text: "b"}},
+	}
+
+	files := []StoredImageFile{
+		{Filename: "abc@original.png", FormatName: "original", ImageType: Png, ImageSize: ImageSize{4, 2}},
+		{Filename: "abc@small.png", FormatName: "small", ImageType: Png, ImageSize: ImageSize{2, 1}, Request: &watermarked},
+	}
+
+	deleted := testAssetSource{NewMissingAssetError("unknown asset")}
+	result, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, nil, MakeMemoryFileStore(), deleted, TemplateValues{})
+
+	if err != nil {
+		t.Fatalf("RewriteImageFiles returned error '%v'", err)
+	}
+
+	if len(result.RemovedAssets) != 2 {
+		t.Fatalf("result.RemovedAssets = '%v', Should have the watermark and the font", result.RemovedAssets)
+	}
+
+	stored := result.SizeFormats[1].Request
+
+	if stored.Watermark != nil || len(stored.TextOverlays) != 1 || stored.TextOverlays[0].Text != "b" {
+		t.Fatalf("stored = '%v', Should only keep the overlay in the default font", stored)
+	}
+
+	if watermarked.Watermark == nil || len(watermarked.TextOverlays) != 2 {
+		t.Fatalf("the file's request shouldn't be changed")
+	}
+
+	// Other errors aren't treated as deleted assets
+	unavailable := testAssetSource{errors.New("unavailable")}
+	if _, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, nil, MakeMemoryFileStore(), unavailable, TemplateValues{}); err == nil {
+		t.Fatalf("RewriteImageFiles should return an error if an asset can't be loaded")
+	}
+
+	requests := []ConversionRequest{watermarked}
+	if _, err := RewriteImageFiles(encoded.Bytes, Transform{Rotate: 90}, files, requests, MakeMemoryFileStore(), deleted, TemplateValues{}); err == nil {
+		t.Fatalf("RewriteImageFiles should return an error for a request with a deleted watermark")
+	}
+}
@@ -0,0 +1,260 @@
+package imageHandler
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/nfnt/resize"
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+type WatermarkRequest struct {
+	// The name of an uploaded watermark. The PNG file in the WATERMARK_PATH
+	// environment variable is used if it's not set.
+	Name string `json:"name"`
+
+	// Where the watermark is placed. Uses the same values as the conversion
+	// request's Gravity, but defaults to southeast.
+	Gravity string `json:"gravity"`
+
+	// The space in pixels between the watermark and the edges of the image. When
+	// tiling, this is also the space between the watermarks.
+	Margin int `json:"margin"`
+
+	// The width of the watermark as a fraction of the image's width, from 0 to 1.
+	// The watermark keeps its own size if it's not set, unless it's too large
+	// for the image.
+	Scale float64 `json:"scale"`
+
+	// The opacity of the watermark, from 0 to 1. Watermarks are opaque by default.
+	Opacity float64 `json:"opacity"`
+
+	// Whether the watermark is repeated over the whole image. Gravity is ignored
+	// when tiling.
+	Tile bool `json:"tile"`
+}
+
+// A watermark that's composited over the output of a conversion operation. The
+// watermark's image is loaded before the operations run.
+type Watermark struct {
+	Name    string
+	Gravity Gravity
+	Margin  int
+	Scale   float64
+	Opacity float64
+	Tile    bool
+
+	image image.Image
+}
+
+// Loads the uploaded watermarks that conversion operations refer to by name.
+// Returns the watermark's PNG file, or a MissingAssetError if no watermark has
+// the name.
+type WatermarkSource interface {
+	GetWatermarkFile(name string) ([]byte, error)
+}
+
+// Loads the uploaded files that conversion operations use
+type AssetSource interface {
+	WatermarkSource
+	FontSource
+}
+
+func makeWatermarkFromRequest(req WatermarkRequest) (Watermark, error) {
+	gravity := SouthEast
+	if len(req.Gravity) > 0 {
+		var gravityErr error
+		gravity, gravityErr = parseGravity(req.Gravity)
+
+		if gravityErr != nil {
+			return Watermark{}, gravityErr
+		}
+	}
+
+	if req.Margin < 0 {
+		return Watermark{}, errors.New("invalid watermark margin")
+	}
+
+	if req.Scale < 0 || req.Scale > 1 {
+		return Watermark{}, errors.New("invalid watermark scale")
+	}
+
+	if req.Opacity < 0 || req.Opacity > 1 {
+		return Watermark{}, errors.New("invalid watermark opacity")
+	}
+
+	opacity := req.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+
+	return Watermark{
+		Name:    req.Name,
+		Gravity: gravity,
+		Margin:  req.Margin,
+		Scale:   req.Scale,
+		Opacity: opacity,
+		Tile:    req.Tile,
+	}, nil
+}
+
+// The watermark that's added to operations with a suffix in WATERMARK_SUFFIXES
+// when their request doesn't ask for one
+func makeConfiguredWatermark() Watermark {
+	watermark, _ := makeWatermarkFromRequest(WatermarkRequest{})
+
+	return watermark
+}
+
+// Adds the configured watermark to the operations that should have it, then
+// loads the image of every watermark that the operations use. Each watermark
+// is only loaded once.
+func loadWatermarks(ops []ConversionOp, source WatermarkSource) ([]ConversionOp, error) {
+	suffixes := getWatermarkSuffixes()
+	images := make(map[string]image.Image)
+
+	for i, op := range ops {
+		if op.Watermark == nil && op.ResizeOp != Original && suffixes[op.Suffix] {
+			watermark := makeConfiguredWatermark()
+			op.Watermark = &watermark
+		}
+
+		if op.Watermark == nil {
+			continue
+		}
+
+		img, ok := images[op.Watermark.Name]
+
+		if !ok {
+			var err error
+			img, err = loadWatermarkImage(op.Watermark.Name, source)
+
+			if err != nil {
+				return ops, err
+			}
+
+			images[op.Watermark.Name] = img
+		}
+
+		watermark := *op.Watermark
+		watermark.image = img
+		op.Watermark = &watermark
+
+		ops[i] = op
+	}
+
+	return ops, nil
+}
+
+func loadWatermarkImage(name string, source WatermarkSource) (image.Image, error) {
+	var data []byte
+	var err error
+
+	if len(name) == 0 {
+		path := os.Getenv(constants.WATERMARK_PATH)
+
+		if len(path) == 0 {
+			return nil, errors.New("no watermark is configured")
+		}
+
+		data, err = os.ReadFile(path)
+	} else if source != nil {
+		data, err = source.GetWatermarkFile(name)
+	} else {
+		return nil, errors.New("uploaded watermarks aren't available")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return png.Decode(bytes.NewReader(data))
+}
+
+// Composites the watermark over a copy of the image
+func applyWatermark(img *image.Image, watermark Watermark) *image.Image {
+	bounds := (*img).Bounds()
+
+	output := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(output, output.Bounds(), *img, bounds.Min, draw.Src)
+
+	var result image.Image = output
+
+	if watermark.image == nil {
+		return &result
+	}
+
+	mark := sizeWatermark(watermark, output.Bounds())
+	markWidth := mark.Bounds().Dx()
+	markHeight := mark.Bounds().Dy()
+
+	if markWidth == 0 || markHeight == 0 {
+		return &result
+	}
+
+	mask := image.NewUniform(color.Alpha16{A: uint16(math.Round(watermark.Opacity * 0xffff))})
+
+	drawAt := func(rect image.Rectangle) {
+		draw.DrawMask(output, rect, mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+	}
+
+	if watermark.Tile {
+		for y := watermark.Margin; y < bounds.Dy(); y += markHeight + watermark.Margin {
+			for x := watermark.Margin; x < bounds.Dx(); x += markWidth + watermark.Margin {
+				drawAt(image.Rect(x, y, x+markWidth, y+markHeight))
+			}
+		}
+
+		return &result
+	}
+
+	inner := output.Bounds().Inset(watermark.Margin)
+	anchorX, anchorY := watermark.Gravity.anchor()
+
+	drawAt(placeWindow(inner, markWidth, markHeight, anchorX, anchorY))
+
+	return &result
+}
+
+// Scales the watermark to its share of the image's width. A watermark that
+// doesn't fit inside of the margins is scaled down until it does.
+func sizeWatermark(watermark Watermark, bounds image.Rectangle) image.Image {
+	mark := watermark.image
+	markBounds := mark.Bounds()
+
+	width := float64(markBounds.Dx())
+	height := float64(markBounds.Dy())
+
+	if width == 0 || height == 0 {
+		return mark
+	}
+
+	scale := 1.0
+	if watermark.Scale > 0 {
+		scale = float64(bounds.Dx()) * watermark.Scale / width
+	}
+
+	maxWidth := float64(bounds.Dx() - 2*watermark.Margin)
+	maxHeight := float64(bounds.Dy() - 2*watermark.Margin)
+
+	if maxWidth < 1 || maxHeight < 1 {
+		return image.NewRGBA(image.Rectangle{})
+	}
+
+	scale = math.Min(scale, math.Min(maxWidth/width, maxHeight/height))
+
+	if scale == 1 {
+		return mark
+	}
+
+	newWidth := uint(math.Max(math.Round(width*scale), 1))
+	newHeight := uint(math.Max(math.Round(height*scale), 1))
+
+	return resize.Resize(newWidth, newHeight, mark, resize.Lanczos3)
+}
@@ -0,0 +1,206 @@
+package imageHandler
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+func makeSolidImage(width, height int, c color.Color) *image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	var result image.Image = img
+
+	return &result
+}
+
+func makeTestWatermark(width, height int) Watermark {
+	return Watermark{
+		Gravity: SouthEast,
+		Opacity: 1,
+		image:   *makeSolidImage(width, height, color.RGBA{255, 0, 0, 255}),
+	}
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r == 0xffff && g == 0 && b == 0
+}
+
+func TestApplyWatermark(t *testing.T) {
+	img := makeSolidImage(100, 80, color.White)
+
+	watermark := makeTestWatermark(10, 10)
+	watermark.Margin = 5
+
+	output := *applyWatermark(img, watermark)
+
+	if !isRed(output.At(94, 74)) || !isRed(output.At(85, 65)) {
+		t.Fatalf("the watermark should be in the bottom right corner inside of the margin")
+	}
+
+	if isRed(output.At(95, 75)) || isRed(output.At(84, 64)) {
+		t.Fatalf("the watermark should be 10 x 10 pixels")
+	}
+
+	if isRed((*img).At(94, 74)) {
+		t.Fatalf("the source image shouldn't be changed")
+	}
+
+	watermark.Gravity = NorthWest
+	watermark.Opacity = 0.5
+	output = *applyWatermark(img, watermark)
+
+	r, g, _, _ := output.At(5, 5).RGBA()
+	if r != 0xffff || g < 0x7000 || g > 0x9000 {
+		t.Fatalf("color = '%v', Should be half red and half white", output.At(5, 5))
+	}
+}
+
+func TestApplyWatermarkScaleAndTile(t *testing.T) {
+	img := makeSolidImage(200, 100, color.White)
+
+	watermark := makeTestWatermark(10, 5)
+	watermark.Gravity = NorthWest
+	watermark.Scale = 0.25
+
+	output := *applyWatermark(img, watermark)
+
+	if !isRed(output.At(49, 24)) || isRed(output.At(51, 10)) || isRed(output.At(10, 26)) {
+		t.Fatalf("the watermark should be scaled to 50 x 25 pixels")
+	}
+
+	watermark = makeTestWatermark(10, 10)
+	watermark.Margin = 10
+	watermark.Tile = true
+
+	output = *applyWatermark(img, watermark)
+
+	count := 0
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			if isRed(output.At(x, y)) {
+				count++
+			}
+		}
+	}
+
+	// Tiles start at 10, 30, ... 190 horizontally and 10, 30, ... 90 vertically
+	expected := 10 * 5 * 100
+	if count != expected {
+		t.Fatalf("count = '%v', Should be '%v'", count, expected)
+	}
+
+	// A watermark that's larger than the image is scaled down to fit
+	watermark = makeTestWatermark(400, 400)
+	output = *applyWatermark(img, watermark)
+
+	if !isRed(output.At(150, 50)) || isRed(output.At(99, 50)) {
+		t.Fatalf("the watermark should be scaled down to 100 x 100 pixels")
+	}
+}
+
+func TestMakeOpFromRequestWatermark(t *testing.T) {
+	op, err := makeOpFromRequest(ConversionRequest{
+		ResizeOp:    "scale",
+		LongestSide: 100,
+		Watermark:   &WatermarkRequest{Name: "logo", Margin: 4, Scale: 0.2},
+	})
+
+	if err != nil {
+		t.Fatalf("makeOpFromRequest returned error '%v'", err)
+	}
+
+	if op.Watermark == nil || op.Watermark.Gravity != SouthEast || op.Watermark.Opacity != 1 {
+		t.Fatalf("the watermark should default to an opaque southeast watermark")
+	}
+
+	invalid := []ConversionRequest{
+		{ResizeOp: "original", Watermark: &WatermarkRequest{}},
+		{ResizeOp: "thumbnail", Watermark: &WatermarkRequest{Opacity: 1.5}},
+		{ResizeOp: "thumbnail", Watermark: &WatermarkRequest{Scale: -1}},
+		{ResizeOp: "thumbnail", Watermark: &WatermarkRequest{Margin: -1}},
+		{ResizeOp: "thumbnail", Watermark: &WatermarkRequest{Gravity: "up"}},
+	}
+
+	for _, req := range invalid {
+		if _, err := makeOpFromRequest(req); err == nil {
+			t.Fatalf("makeOpFromRequest should return an error for '%v'", *req.Watermark)
+		}
+	}
+}
+
+type testWatermarkSource map[string][]byte
+
+func (source testWatermarkSource) GetWatermarkFile(name string) ([]byte, error) {
+	data, ok := source[name]
+
+	if !ok {
+		return nil, errors.New("unknown watermark")
+	}
+
+	return data, nil
+}
+
+func encodeTestPng(t *testing.T, img image.Image) []byte {
+	buffer := new(bytes.Buffer)
+
+	if err := png.Encode(buffer, img); err != nil {
+		t.Fatalf("png.Encode returned error '%v'", err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestLoadWatermarks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watermark.png")
+	os.WriteFile(path, encodeTestPng(t, *makeSolidImage(4, 4, color.Black)), 0644)
+
+	t.Setenv(constants.WATERMARK_PATH, path)
+	t.Setenv(constants.WATERMARK_SUFFIXES, "web, large")
+
+	source := testWatermarkSource{
+		"logo": encodeTestPng(t, *makeSolidImage(8, 2, color.White)),
+	}
+
+	ops := []ConversionOp{
+		makeThumbnailOp(),
+		makeOriginalOp(),
+		{Suffix: "web", ResizeOp: Scale, LongestSide: 100},
+		{Suffix: "large", ResizeOp: Scale, LongestSide: 100, Watermark: &Watermark{Name: "logo", Opacity: 1}},
+	}
+	ops[1].Suffix = "web"
+
+	ops, err := loadWatermarks(ops, source)
+
+	if err != nil {
+		t.Fatalf("loadWatermarks returned error '%v'", err)
+	}
+
+	if ops[0].Watermark != nil || ops[1].Watermark != nil {
+		t.Fatalf("thumbnails and originals shouldn't be watermarked")
+	}
+
+	if ops[2].Watermark == nil || ops[2].Watermark.image.Bounds().Dx() != 4 {
+		t.Fatalf("the web operation should have the configured watermark")
+	}
+
+	if ops[3].Watermark.image.Bounds().Dx() != 8 {
+		t.Fatalf("the large operation should keep its own watermark")
+	}
+
+	_, err = loadWatermarks([]ConversionOp{{ResizeOp: Scale, Watermark: &Watermark{Name: "missing"}}}, source)
+
+	if err == nil {
+		t.Fatalf("an unknown watermark should return an error")
+	}
+}
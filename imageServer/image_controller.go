@@ -1,9 +1,12 @@
 package imageServer
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"path"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,15 +16,25 @@ import (
 	"methompson.com/image-microservice/imageServer/logging"
 )
 
+// The default and largest CIE76 differences between a palette color and the
+// color that images are filtered by. A difference of 20 keeps the hue while
+// allowing lighter and darker shades.
+const DEFAULT_COLOR_DISTANCE = 20
+const MAX_COLOR_DISTANCE = 100
+
 type ImageController struct {
 	DBController *dbController.DatabaseController
+	FileStore    imageHandler.FileStore
 	Loggers      []*logging.ImageLogger
+	blobLocks    *blobLocks
 }
 
-func InitController(dbc *dbController.DatabaseController) ImageController {
+func InitController(dbc *dbController.DatabaseController, fileStore imageHandler.FileStore) ImageController {
 	ic := ImageController{
 		DBController: dbc,
+		FileStore:    fileStore,
 		Loggers:      make([]*logging.ImageLogger, 0),
+		blobLocks:    makeBlobLocks(),
 	}
 
 	return ic
@@ -31,41 +44,281 @@ func (ic *ImageController) AddLogger(logger *logging.ImageLogger) {
 	ic.Loggers = append(ic.Loggers, logger)
 }
 
+// Logs an error that happened after a request's changes were saved, so the
+// request itself doesn't fail
+func (ic *ImageController) logError(msg string) {
+	errorLog := logging.InfoLogData{
+		Timestamp: time.Now(),
+		Type:      "error",
+		Message:   msg,
+	}
+
+	for _, logger := range ic.Loggers {
+		l := *logger
+		l.AddInfoLog(errorLog)
+	}
+}
+
 func (ic *ImageController) AddImageFile(ctx *gin.Context) error {
 	metaStr := ctx.PostForm("meta")
 	imageFormData := parseAddImageFormString(metaStr)
 
-	output, conversionErr := imageHandler.ProcessImageFile(ctx, imageFormData.Operations)
+	// The files are staged in memory and only written to the file store while
+	// their digests are locked. See saveStagedFiles.
+	fileStore := imageHandler.MakeMemoryFileStore()
+
+	authorId := ctx.GetString("userId")
+	dateAdded := time.Now()
+
+	templateValues, templateErr := ic.getTemplateValues(dbController.ImageDocument{
+		Title:     imageFormData.Title,
+		AuthorId:  authorId,
+		DateAdded: dateAdded,
+	})
+
+	if templateErr != nil {
+		return templateErr
+	}
+
+	output, conversionErr := imageHandler.ProcessImageFile(ctx, imageFormData.Operations, fileStore, ic, templateValues)
 
 	if conversionErr != nil {
 		return conversionErr
 	}
 
 	addImgDoc := dbController.AddImageDocument{
-		Title:       imageFormData.Title,
-		Tags:        imageFormData.Tags,
-		IdName:      output.IdName,
-		Filename:    output.OriginalFilename,
-		SizeFormats: output.SizeFormats,
-		AuthorId:    ctx.GetString("userId"),
-		DateAdded:   time.Now(),
+		Title:          imageFormData.Title,
+		Tags:           imageFormData.Tags,
+		IdName:         output.IdName,
+		Filename:       output.OriginalFilename,
+		SizeFormats:    output.SizeFormats,
+		AuthorId:       authorId,
+		DateAdded:      dateAdded,
+		OriginalSha256: output.OriginalSha256,
+		BlurHash:       output.Placeholders.BlurHash,
+		Lqip:           output.Placeholders.Lqip,
+		Palette:        output.Palette,
 	}
 
 	fmt.Println(output.OriginalFilename)
 	fmt.Println(addImgDoc.AuthorId)
 
-	_, addImageErr := (*ic.DBController).AddImageData(addImgDoc)
+	return ic.saveStagedFiles(output, fileStore, func(onTransaction func(context.Context) error) error {
+		addImgDoc.OnTransaction = onTransaction
+		_, err := (*ic.DBController).AddImageData(addImgDoc)
+		return err
+	})
+}
+
+// Rotates or flips an image and makes every file of the image again. The files
+// are made from the image's source with every transform so far combined, so
+// the image loses no quality no matter how often it's transformed. The
+// original from before the first transform becomes the source. The image and
+// its files keep their ids and filenames. Operations in the body replace the
+// rebuilt operations of the files with the same suffix. Stored files that are
+// no longer used are deleted once the database is updated. Returns a
+// ConflictError if the image was transformed by another request in the
+// meantime.
+func (ic *ImageController) TransformImage(body TransformImageBody) error {
+	transform, transformErr := imageHandler.MakeTransform(body.Rotate, body.Flip, body.Background)
+
+	if transformErr != nil {
+		return dbController.NewInvalidInputError(transformErr.Error())
+	}
+
+	if transform.IsIdentity() && len(body.Operations) == 0 {
+		return dbController.NewInvalidInputError("no changes to make")
+	}
+
+	doc, docErr := (*ic.DBController).GetImageDataById(body.Id, true)
+
+	if docErr != nil {
+		return docErr
+	}
+
+	var original *dbController.ImageFileDocument
+	files := make([]imageHandler.StoredImageFile, 0, len(doc.ImageFiles))
+
+	for i, imgFile := range doc.ImageFiles {
+		if imgFile.FormatName == "original" {
+			original = &doc.ImageFiles[i]
+		}
+
+		files = append(files, imageHandler.StoredImageFile{
+			Filename:   imgFile.Filename,
+			FormatName: imgFile.FormatName,
+			ImageType:  imgFile.ImageType,
+			ImageSize:  imgFile.ImageSize,
+			Private:    imgFile.Private,
+			Crop:       imgFile.Crop,
+			Encoding:   imgFile.Encoding,
+			Request:    imgFile.Request,
+		})
+	}
+
+	if original == nil {
+		return dbController.NewInvalidInputError("the image has no original file")
+	}
 
-	if addImageErr != nil {
-		// TODO Rollback database writes
-		imageHandler.RollBackWrites(output)
-		return addImageErr
+	// Files without a stored request would lose their watermarks, text overlays
+	// and filters if we rebuilt them from their size
+	if missing := imageHandler.GetMissingRewriteRequests(files, body.Operations); len(missing) > 0 {
+		return dbController.NewInvalidInputError("operations are required for " + strings.Join(missing, ", "))
+	}
+
+	source := imageHandler.ImageSource{Sha256: original.Sha256, ImageType: original.ImageType}
+	sourceName := original.GetStorageName()
+
+	if doc.Source != nil {
+		source = *doc.Source
+		sourceName = source.GetStorageName()
+	}
+
+	sourceBytes, getErr := ic.FileStore.Get(sourceName)
+
+	if _, notFound := getErr.(imageHandler.FileNotFoundError); notFound && doc.Source == nil && ic.originalChanged(doc.Id, *original) {
+		return dbController.NewConflictError("the image was changed while it was transformed")
+	}
+
+	if getErr != nil {
+		return getErr
+	}
+
+	// Originals from before content-addressing are stored under their filename,
+	// so the source gets stored under its digest
+	if len(source.Sha256) == 0 {
+		source.Sha256 = imageHandler.HashBytes(sourceBytes)
+	}
+
+	newSource := source
+	newSource.Transform = source.Transform.Then(transform)
+
+	templateValues, templateErr := ic.getTemplateValues(doc)
+
+	if templateErr != nil {
+		return templateErr
+	}
+
+	// The files are staged like they are in AddImageFile
+	fileStore := imageHandler.MakeMemoryFileStore()
+
+	output, conversionErr := imageHandler.RewriteImageFiles(sourceBytes, newSource.Transform, files, body.Operations, fileStore, ic, templateValues)
+
+	if conversionErr != nil {
+		return conversionErr
+	}
+
+	if len(output.RemovedAssets) > 0 {
+		ic.logError("transforming image " + doc.Id + " left out deleted assets: " + strings.Join(output.RemovedAssets, ", "))
+	}
+
+	// The source is usually stored already. Staging it anyway keeps it locked
+	// until the image refers to it. It's already staged if the original was made
+	// from it unchanged.
+	if _, statErr := fileStore.Stat(newSource.GetStorageName()); statErr != nil {
+		if putErr := fileStore.Put(newSource.GetStorageName(), sourceBytes); putErr != nil {
+			return putErr
+		}
+
+		output.NewFiles = append(output.NewFiles, newSource.GetStorageName())
+	}
+
+	// Another transform of the image may have finished while this one ran. The
+	// database only saves the new files if the old ones are still the ones we
+	// read, so the other transform's files aren't lost or left behind.
+	previousSha256 := make(map[string]string)
+	for _, imgFile := range doc.ImageFiles {
+		previousSha256[imgFile.Filename] = imgFile.Sha256
+	}
+
+	replaceDoc := dbController.ReplaceImageFilesDocument{
+		ImageId:        doc.Id,
+		SizeFormats:    output.SizeFormats,
+		PreviousSha256: previousSha256,
+		Source:         &newSource,
+		BlurHash:       output.Placeholders.BlurHash,
+		Lqip:           output.Placeholders.Lqip,
+	}
+
+	replaceErr := ic.saveStagedFiles(output, fileStore, func(onTransaction func(context.Context) error) error {
+		replaceDoc.OnTransaction = onTransaction
+		return (*ic.DBController).ReplaceImageFiles(replaceDoc)
+	})
+
+	if replaceErr != nil {
+		return replaceErr
+	}
+
+	newFiles := make(map[string]bool)
+	for _, sizeFormat := range output.SizeFormats {
+		newFiles[sizeFormat.GetStorageName()] = true
+	}
+
+	// The image already uses the new files, so the request succeeded even if an
+	// old file can't be deleted. The consistency check finds files left behind.
+	for _, imgFile := range doc.ImageFiles {
+		storageName := imgFile.GetStorageName()
+
+		if newFiles[storageName] {
+			continue
+		}
+
+		newFiles[storageName] = true
+
+		err := ic.DeleteFileWithImageFileDocument(imgFile)
+		if err != nil {
+			ic.logError("deleting " + storageName + " after transforming image " + doc.Id + " failed: " + err.Error())
+		}
 	}
 
 	return nil
 }
 
-func (ic *ImageController) GetImages(page, paginationNum int, sortBy string, showPrivate bool) ([]dbController.ImageDocument, error) {
+// Another transform of the image deletes the original it replaced, so a
+// missing original may just mean the image changed after it was read
+func (ic *ImageController) originalChanged(id string, original dbController.ImageFileDocument) bool {
+	doc, err := (*ic.DBController).GetImageDataById(id, true)
+
+	if err != nil {
+		return false
+	}
+
+	for _, imgFile := range doc.ImageFiles {
+		if imgFile.Filename == original.Filename {
+			return imgFile.Sha256 != original.Sha256
+		}
+	}
+
+	return false
+}
+
+// Returns the values of the template variables in text overlays for the image.
+// The author's name is looked up if the document doesn't have it. Authors that
+// aren't users have no name.
+func (ic *ImageController) getTemplateValues(doc dbController.ImageDocument) (imageHandler.TemplateValues, error) {
+	author := doc.Author
+
+	if len(author) == 0 && len(doc.AuthorId) > 0 {
+		user, err := (*ic.DBController).GetUserByUID(doc.AuthorId)
+
+		if err == nil {
+			author = user.Name
+		} else if _, noResults := err.(dbController.NoResultsError); !noResults {
+			return imageHandler.TemplateValues{}, err
+		}
+	}
+
+	return imageHandler.TemplateValues{
+		Title:     doc.Title,
+		Author:    author,
+		DateAdded: doc.DateAdded,
+	}, nil
+}
+
+// colorHex filters the images to those with a palette color near the hex
+// color. colorDistance is the largest CIE76 difference that matches and
+// defaults to DEFAULT_COLOR_DISTANCE. Both are ignored when colorHex is empty.
+func (ic *ImageController) GetImages(page, paginationNum int, sortBy string, showPrivate bool, colorHex, colorDistance string) ([]dbController.ImageDocument, error) {
 	var _pagination int
 	if paginationNum <= 0 {
 		_pagination = 50
@@ -76,10 +329,46 @@ func (ic *ImageController) GetImages(page, paginationNum int, sortBy string, sho
 	filter := dbController.MakeSortImageFilter(sortBy)
 	filter.ShowPrivate = showPrivate
 
+	if len(colorHex) > 0 {
+		colorFilter, colorErr := makeColorFilter(colorHex, colorDistance)
+
+		if colorErr != nil {
+			return nil, colorErr
+		}
+
+		filter.Color = &colorFilter
+	}
+
 	return (*ic.DBController).GetImagesData(page, _pagination, filter)
 }
 
-func (ic *ImageController) GetImageByName(ctx *gin.Context) (filepath string, imgDoc dbController.ImageFileDocument, err error) {
+func makeColorFilter(colorHex, colorDistance string) (dbController.ColorFilter, error) {
+	lab, labErr := imageHandler.ParseLabColor(colorHex)
+
+	if labErr != nil {
+		return dbController.ColorFilter{}, dbController.NewInvalidInputError("invalid color")
+	}
+
+	distance := float64(DEFAULT_COLOR_DISTANCE)
+
+	if len(colorDistance) > 0 {
+		parsed, parseErr := strconv.ParseFloat(colorDistance, 64)
+
+		if parseErr != nil || parsed <= 0 || parsed > MAX_COLOR_DISTANCE {
+			msg := fmt.Sprintf("colorDistance must be greater than 0 and at most %v", MAX_COLOR_DISTANCE)
+			return dbController.ColorFilter{}, dbController.NewInvalidInputError(msg)
+		}
+
+		distance = parsed
+	}
+
+	return dbController.ColorFilter{
+		Color:    lab,
+		Distance: distance,
+	}, nil
+}
+
+func (ic *ImageController) GetImageByName(ctx *gin.Context) (imgDoc dbController.ImageFileDocument, err error) {
 	name := ctx.Param("imageName")
 
 	if len(name) == 0 {
@@ -96,14 +385,30 @@ func (ic *ImageController) GetImageByName(ctx *gin.Context) (filepath string, im
 		return
 	}
 
-	filename := img.Filename
-	// Make a file path from the file name
-	filepath = path.Join(imageHandler.GetImagePath(filename), filename)
 	imgDoc = img
 
 	return
 }
 
+// Gets a URL that clients can use to download the file directly from the file
+// store. Returns an empty string if the store doesn't support direct downloads
+// or is configured to stream files through this service.
+func (ic *ImageController) GetImageFileURL(imgDoc dbController.ImageFileDocument) (string, error) {
+	urlStore, ok := ic.FileStore.(imageHandler.URLFileStore)
+
+	if !ok {
+		return "", nil
+	}
+
+	return urlStore.FileURL(imgDoc.GetStorageName())
+}
+
+// Opens the file described by the image file document for reading. The caller
+// is responsible for closing the returned ReadCloser.
+func (ic *ImageController) GetImageFileStream(imgDoc dbController.ImageFileDocument) (io.ReadCloser, imageHandler.FileInfo, error) {
+	return ic.FileStore.Stream(imgDoc.GetStorageName())
+}
+
 func (ic *ImageController) GetImageDataById(ctx *gin.Context, showPrivate bool) (doc dbController.ImageDocument, err error) {
 	id := ctx.Param("imageId")
 
@@ -166,19 +471,17 @@ func (ic *ImageController) RenameImageFile(editDoc dbController.EditImageFileDoc
 		editDoc.Obfuscate,
 	)
 
-	// Get the new path and create the directory.
-	newPath := imageHandler.GetImagePath(newName)
-	err = imageHandler.CheckOrCreateImageFolder(newPath)
-
-	if err != nil {
-		return err
+	// Content-addressed files are stored under their digest, so only the
+	// image file's filename in the database changes.
+	if len(imgFile.Sha256) > 0 {
+		editDoc.NewName = newName
+		return ic.MakeImageFileDBEdit(editDoc)
 	}
 
-	// Make the file pathes and move the file.
-	oldFilePath := path.Join(imageHandler.GetImagePath(imgFile.Filename), imgFile.Filename)
-	newFilePath := path.Join(newPath, newName)
+	// Move the file to its new name
+	oldName := imgFile.Filename
 
-	err = imageHandler.MoveFile(oldFilePath, newFilePath)
+	err = ic.FileStore.Move(oldName, newName)
 
 	if err != nil {
 		return err
@@ -192,7 +495,7 @@ func (ic *ImageController) RenameImageFile(editDoc dbController.EditImageFileDoc
 	// If we have an error, we roll the move back
 	// TODO determine how to make a compound error
 	if err != nil {
-		imageHandler.MoveFile(newFilePath, oldFilePath)
+		ic.FileStore.Move(newName, oldName)
 
 		return err
 	}
@@ -214,6 +517,9 @@ func (ic *ImageController) MakeImageFileDBEdit(editDoc dbController.EditImageFil
 	return nil
 }
 
+// We remove the image from the database before deleting its files. The
+// reference counts of content-addressed files only drop once the image files
+// are gone from the database.
 func (ic *ImageController) DeleteImageDocument(delDoc dbController.DeleteImageDocument) (err error) {
 	img, imgErr := (*ic.DBController).GetImageDataById(delDoc.Id, true)
 
@@ -221,14 +527,34 @@ func (ic *ImageController) DeleteImageDocument(delDoc dbController.DeleteImageDo
 		return imgErr
 	}
 
+	err = (*ic.DBController).DeleteImage(delDoc)
+
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[string]bool)
+
 	for _, imgFile := range img.ImageFiles {
-		err := DeleteFileWithImageFileDocument(imgFile)
+		storageName := imgFile.GetStorageName()
+
+		if deleted[storageName] {
+			continue
+		}
+
+		deleted[storageName] = true
+
+		err := ic.DeleteFileWithImageFileDocument(imgFile)
 		if err != nil {
 			return err
 		}
 	}
 
-	return (*ic.DBController).DeleteImage(delDoc)
+	if img.Source != nil && !deleted[img.Source.GetStorageName()] {
+		return ic.deleteStoredFile(img.Source.Sha256, img.Source.GetStorageName())
+	}
+
+	return nil
 }
 
 func (ic *ImageController) DeleteImageFileDocument(delDoc dbController.DeleteImageFileDocument) (err error) {
@@ -238,12 +564,181 @@ func (ic *ImageController) DeleteImageFileDocument(delDoc dbController.DeleteIma
 		return
 	}
 
-	return DeleteFileWithImageFileDocument(imgDoc)
+	return ic.DeleteFileWithImageFileDocument(imgDoc)
 }
 
-func DeleteFileWithImageFileDocument(imgDoc dbController.ImageFileDocument) error {
-	folderPath := imageHandler.GetImagePath(imgDoc.Filename)
-	filePath := path.Join(folderPath, imgDoc.Filename)
+// Deletes the stored file of an image file that was removed from the database.
+// A content-addressed file is only deleted when no other image file refers to
+// it.
+func (ic *ImageController) DeleteFileWithImageFileDocument(imgDoc dbController.ImageFileDocument) error {
+	if len(imgDoc.Sha256) == 0 {
+		return ic.FileStore.Delete(imgDoc.Filename)
+	}
+
+	return ic.deleteStoredFile(imgDoc.Sha256, imgDoc.GetStorageName())
+}
+
+// Writes the files that a conversion staged in memory to the file store and
+// calls save to update the database. The files stay locked until the database
+// is updated, so a file that this request found in the file store can't be
+// deleted before the new documents refer to it. If the file store can take
+// part in the database transaction, save gets a function that copies the files
+// inside of the transaction. Otherwise the files are copied first and the ones
+// that were copied are deleted again if save fails.
+func (ic *ImageController) saveStagedFiles(output imageHandler.ImageConversionResult, staged imageHandler.FileStore, save func(onTransaction func(context.Context) error) error) error {
+	unlock := ic.blobLocks.Lock(output.NewFiles...)
+	defer unlock()
+
+	if contextStore, transactional := ic.FileStore.(imageHandler.ContextFileStore); transactional {
+		err := save(func(transCtx context.Context) error {
+			_, err := imageHandler.CopyFiles(output, staged, contextStore.WithContext(transCtx))
+			return err
+		})
+
+		if err == nil {
+			ic.restoreMissingFiles(output.NewFiles, staged.Get)
+		}
+
+		return err
+	}
+
+	copied, err := imageHandler.CopyFiles(output, staged, ic.FileStore)
+
+	if err == nil {
+		err = save(nil)
+	}
+
+	if err != nil {
+		imageHandler.RollBackWrites(copied, ic.FileStore)
+		return err
+	}
+
+	ic.restoreMissingFiles(output.NewFiles, staged.Get)
+
+	return nil
+}
+
+// Writes files that went missing while the database was updated. The blob
+// locks only cover this process, so another instance that shares the file
+// store may have found no references and deleted a file after this request
+// found it, but before the new documents referred to it. The database refers
+// to the files now, so a delete that starts later keeps them. The request
+// already succeeded, so files that can't be written are only logged and the
+// consistency check reports them as missing.
+func (ic *ImageController) restoreMissingFiles(names []string, get func(name string) ([]byte, error)) {
+	for _, name := range names {
+		_, statErr := ic.FileStore.Stat(name)
+
+		if _, notFound := statErr.(imageHandler.FileNotFoundError); !notFound {
+			continue
+		}
+
+		data, err := get(name)
+
+		if err == nil {
+			err = ic.FileStore.Put(name, data)
+		}
+
+		if err != nil {
+			ic.logError("restoring " + name + " after saving failed: " + err.Error())
+		}
+	}
+}
+
+// Deletes a content-addressed file once no image files, image sources or
+// assets refer to it. The file is locked while it's counted and deleted, so
+// that a request saving a document that refers to it finishes first.
+func (ic *ImageController) deleteStoredFile(sha256, storageName string) error {
+	unlock := ic.blobLocks.Lock(storageName)
+	defer unlock()
+
+	isReferenced := func() (bool, error) {
+		count, err := ic.countSha256References(sha256)
+		return count > 0, err
+	}
+
+	_, err := ic.removeUnreferencedFile(storageName, isReferenced, false)
+
+	// The file may have been deleted by an earlier request or removed by hand
+	if _, notFound := err.(imageHandler.FileNotFoundError); notFound {
+		return nil
+	}
+
+	return err
+}
+
+// Deletes or quarantines a file that nothing refers to. Another instance that
+// shares the file store may save a document that refers to the file while we
+// remove it, because the blob locks only cover this process. So the references
+// are checked again once the file is gone, and the file is put back if a
+// document refers to it by then. A document that's saved later finds the file
+// missing and writes it again, see restoreMissingFiles. Returns whether the
+// file was removed.
+func (ic *ImageController) removeUnreferencedFile(storageName string, isReferenced func() (bool, error), quarantine bool) (bool, error) {
+	referenced, err := isReferenced()
+
+	if err != nil || referenced {
+		return false, err
+	}
+
+	var restore func() error
+
+	if quarantine {
+		quarantineName := QUARANTINE_PREFIX + storageName
+
+		if err := ic.FileStore.Move(storageName, quarantineName); err != nil {
+			return false, err
+		}
+
+		restore = func() error { return ic.FileStore.Move(quarantineName, storageName) }
+	} else {
+		data, err := ic.FileStore.Get(storageName)
+
+		if err != nil {
+			return false, err
+		}
+
+		if err := ic.FileStore.Delete(storageName); err != nil {
+			return false, err
+		}
+
+		restore = func() error { return ic.FileStore.Put(storageName, data) }
+	}
+
+	referenced, err = isReferenced()
+
+	if err == nil && !referenced {
+		return true, nil
+	}
+
+	// We can't tell whether the file is referenced, so it's safer to keep it
+	if restoreErr := restore(); restoreErr != nil {
+		return true, restoreErr
+	}
+
+	return false, err
+}
+
+// Returns the number of image files, image sources and assets whose file has
+// the digest
+func (ic *ImageController) countSha256References(sha256 string) (int, error) {
+	imageFiles, err := (*ic.DBController).CountImageFilesWithSha256(sha256)
+
+	if err != nil {
+		return 0, err
+	}
+
+	sources, err := (*ic.DBController).CountImageSourcesWithSha256(sha256)
+
+	if err != nil {
+		return 0, err
+	}
+
+	assets, err := (*ic.DBController).CountAssetsWithSha256(sha256)
+
+	if err != nil {
+		return 0, err
+	}
 
-	return imageHandler.DeleteFile(filePath)
+	return imageFiles + sources + assets, nil
 }
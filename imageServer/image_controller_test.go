@@ -0,0 +1,942 @@
+package imageServer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/logging"
+	"methompson.com/image-microservice/imageServer/memoryDbController"
+)
+
+// Makes an ImageController backed by the memory database and file store with
+// a single image saved in both.
+func makeTestController(t *testing.T) (ImageController, string) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := imageHandler.MakeMemoryFileStore()
+
+	ic := InitController(&dbc, store)
+
+	formats := []imageHandler.ImageSizeFormat{
+		{FormatName: "thumb", Filename: "abc@thumb.jpg", Private: false, ImageType: imageHandler.Jpeg},
+		{FormatName: "web", Filename: "abc@web.jpg", Private: false, ImageType: imageHandler.Jpeg},
+	}
+
+	for _, f := range formats {
+		store.Put(f.Filename, []byte(f.Filename))
+	}
+
+	id, err := dbc.AddImageData(dbController.AddImageDocument{
+		Title:       "test",
+		Filename:    "test.jpg",
+		IdName:      "abc",
+		SizeFormats: formats,
+		DateAdded:   time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	return ic, id
+}
+
+func TestRenameImageFile(t *testing.T) {
+	ic, id := makeTestController(t)
+
+	img, _ := (*ic.DBController).GetImageDataById(id, true)
+	file := img.ImageFiles[0]
+
+	obfuscate := true
+	err := ic.EditImageFileDocument(EditImageFileBody{
+		Id:        file.Id,
+		Obfuscate: &obfuscate,
+	})
+
+	if err != nil {
+		t.Fatalf("EditImageFileDocument returned error '%v'", err)
+	}
+
+	renamed, _ := (*ic.DBController).GetImageFileById(file.Id)
+
+	if renamed.Filename == file.Filename {
+		t.Fatalf("filename should change when obfuscating")
+	}
+
+	if _, err := ic.FileStore.Stat(renamed.Filename); err != nil {
+		t.Fatalf("file should be moved to '%v'", renamed.Filename)
+	}
+
+	if _, err := ic.FileStore.Stat(file.Filename); err == nil {
+		t.Fatalf("file should no longer exist at '%v'", file.Filename)
+	}
+}
+
+func TestDeleteImageDocument(t *testing.T) {
+	ic, id := makeTestController(t)
+
+	err := ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: id})
+
+	if err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	for _, name := range []string{"abc@thumb.jpg", "abc@web.jpg"} {
+		if _, err := ic.FileStore.Stat(name); err == nil {
+			t.Fatalf("'%v' should be deleted", name)
+		}
+	}
+}
+
+// Adds an image whose files are stored content-addressed under the digest of
+// each format's contents.
+func addContentAddressedImage(t *testing.T, ic ImageController, idName string, contents []string) string {
+	formats := make([]imageHandler.ImageSizeFormat, 0)
+
+	for _, c := range contents {
+		sha := imageHandler.HashBytes([]byte(c))
+		f := imageHandler.ImageSizeFormat{
+			FormatName: c,
+			Filename:   idName + "@" + c + ".jpg",
+			ImageType:  imageHandler.Jpeg,
+			Sha256:     sha,
+		}
+
+		ic.FileStore.Put(f.GetStorageName(), []byte(c))
+		formats = append(formats, f)
+	}
+
+	id, err := (*ic.DBController).AddImageData(dbController.AddImageDocument{
+		Title:       idName,
+		Filename:    idName + ".jpg",
+		IdName:      idName,
+		SizeFormats: formats,
+		DateAdded:   time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	return id
+}
+
+func TestRenameContentAddressedImageFile(t *testing.T) {
+	ic, _ := makeTestController(t)
+	id := addContentAddressedImage(t, ic, "def", []string{"thumb"})
+
+	img, _ := (*ic.DBController).GetImageDataById(id, true)
+	file := img.ImageFiles[0]
+
+	obfuscate := true
+	err := ic.EditImageFileDocument(EditImageFileBody{
+		Id:        file.Id,
+		Obfuscate: &obfuscate,
+	})
+
+	if err != nil {
+		t.Fatalf("EditImageFileDocument returned error '%v'", err)
+	}
+
+	renamed, _ := (*ic.DBController).GetImageFileById(file.Id)
+
+	if renamed.Filename == file.Filename {
+		t.Fatalf("filename should change when obfuscating")
+	}
+
+	if renamed.GetStorageName() != file.GetStorageName() {
+		t.Fatalf("storage name = '%v', Should be '%v'", renamed.GetStorageName(), file.GetStorageName())
+	}
+
+	if _, err := ic.FileStore.Stat(file.GetStorageName()); err != nil {
+		t.Fatalf("file should not be moved from '%v'", file.GetStorageName())
+	}
+}
+
+func TestDeleteSharedContentAddressedFiles(t *testing.T) {
+	ic, _ := makeTestController(t)
+	first := addContentAddressedImage(t, ic, "def", []string{"thumb", "web"})
+	second := addContentAddressedImage(t, ic, "ghi", []string{"thumb"})
+
+	sharedName := imageHandler.MakeBlobName(imageHandler.HashBytes([]byte("thumb")), imageHandler.Jpeg)
+	webName := imageHandler.MakeBlobName(imageHandler.HashBytes([]byte("web")), imageHandler.Jpeg)
+
+	err := ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: first})
+
+	if err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(sharedName); err != nil {
+		t.Fatalf("'%v' is still referenced and should not be deleted", sharedName)
+	}
+
+	if _, err := ic.FileStore.Stat(webName); err == nil {
+		t.Fatalf("'%v' should be deleted", webName)
+	}
+
+	err = ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: second})
+
+	if err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(sharedName); err == nil {
+		t.Fatalf("'%v' should be deleted", sharedName)
+	}
+}
+
+func TestWatermarkFilesAreShared(t *testing.T) {
+	ic, _ := makeTestController(t)
+
+	sha := imageHandler.HashBytes([]byte("logo"))
+	storageName := imageHandler.MakeBlobName(sha, imageHandler.Png)
+
+	watermarkId, err := ic.addAsset(dbController.AddAssetDocument{
+		Kind:   dbController.WatermarkAsset,
+		Name:   "logo",
+		Sha256: sha,
+	}, []byte("logo"))
+
+	if err != nil {
+		t.Fatalf("addAsset returned error '%v'", err)
+	}
+
+	file, err := ic.GetWatermarkFile("logo")
+	if err != nil || string(file) != "logo" {
+		t.Fatalf("GetWatermarkFile = '%v' '%v', Should be 'logo'", string(file), err)
+	}
+
+	if _, err := ic.GetWatermarkFile("missing"); err == nil {
+		t.Fatalf("GetWatermarkFile should return an error for an unknown watermark")
+	} else if _, ok := err.(imageHandler.MissingAssetError); !ok {
+		t.Fatalf("GetWatermarkFile should return a MissingAssetError for an unknown watermark")
+	}
+
+	// An image whose original is the same PNG file shares the stored file
+	id, err := (*ic.DBController).AddImageData(dbController.AddImageDocument{
+		Title:    "def",
+		Filename: "logo.png",
+		IdName:   "def",
+		SizeFormats: []imageHandler.ImageSizeFormat{
+			{FormatName: "original", Filename: "def@original.png", ImageType: imageHandler.Png, Sha256: sha},
+		},
+		DateAdded: time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	if err := ic.DeleteWatermark(dbController.DeleteAssetDocument{Id: watermarkId}); err != nil {
+		t.Fatalf("DeleteWatermark returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(storageName); err != nil {
+		t.Fatalf("'%v' is still referenced by the image file and should not be deleted", storageName)
+	}
+
+	if err := ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: id}); err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(storageName); err == nil {
+		t.Fatalf("'%v' should be deleted", storageName)
+	}
+}
+
+func TestGetTemplateValues(t *testing.T) {
+	ic, _ := makeTestController(t)
+
+	(*ic.DBController).(*memoryDbController.MemoryDbController).AddUser(dbController.UserDataDocument{UID: "author", Name: "Test Author"})
+
+	dateAdded := time.Date(2021, 11, 28, 0, 0, 0, 0, time.UTC)
+
+	values, err := ic.getTemplateValues(dbController.ImageDocument{Title: "Sunset", AuthorId: "author", DateAdded: dateAdded})
+	if err != nil {
+		t.Fatalf("getTemplateValues returned error '%v'", err)
+	}
+
+	if values.Title != "Sunset" || values.Author != "Test Author" || !values.DateAdded.Equal(dateAdded) {
+		t.Fatalf("values = '%v', Should have the image's title, author and date", values)
+	}
+
+	values, err = ic.getTemplateValues(dbController.ImageDocument{AuthorId: "unknown"})
+	if err != nil || values.Author != "" {
+		t.Fatalf("getTemplateValues = '%v' '%v', Should have no author", values, err)
+	}
+}
+
+func TestGetFontFile(t *testing.T) {
+	ic, _ := makeTestController(t)
+
+	_, err := ic.addAsset(dbController.AddAssetDocument{
+		Kind:   dbController.FontAsset,
+		Name:   "serif",
+		Sha256: imageHandler.HashBytes([]byte("serif")),
+	}, []byte("serif"))
+
+	if err != nil {
+		t.Fatalf("addAsset returned error '%v'", err)
+	}
+
+	file, err := ic.GetFontFile("serif")
+	if err != nil || string(file) != "serif" {
+		t.Fatalf("GetFontFile = '%v' '%v', Should be 'serif'", string(file), err)
+	}
+
+	// Fonts and watermarks have separate names
+	if _, err := ic.GetWatermarkFile("serif"); err == nil {
+		t.Fatalf("GetWatermarkFile should return an error for a font")
+	}
+}
+
+// Adds an image with a 40x20 red PNG original and a web file that isn't a
+// real image. Returns the image's id and its size formats.
+func addPngImage(t *testing.T, ic ImageController) (string, []imageHandler.ImageSizeFormat) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+
+	original := imageHandler.ImageSizeFormat{
+		FormatName: "original",
+		Filename:   "abc@original.png",
+		ImageSize:  imageHandler.ImageSize{Width: 40, Height: 20},
+		Private:    true,
+		ImageType:  imageHandler.Png,
+		Sha256:     imageHandler.HashBytes(buf.Bytes()),
+	}
+	web := imageHandler.ImageSizeFormat{
+		FormatName: "web",
+		Filename:   "abc@web.png",
+		ImageSize:  imageHandler.ImageSize{Width: 20, Height: 10},
+		ImageType:  imageHandler.Png,
+		Sha256:     imageHandler.HashBytes([]byte("web")),
+		Request:    &imageHandler.ConversionRequest{Suffix: "web", ResizeOp: "scale", LongestSide: 20},
+	}
+
+	ic.FileStore.Put(original.GetStorageName(), buf.Bytes())
+	ic.FileStore.Put(web.GetStorageName(), []byte("web"))
+
+	id, err := (*ic.DBController).AddImageData(dbController.AddImageDocument{
+		Title:       "test",
+		Filename:    "test.png",
+		IdName:      "abc",
+		SizeFormats: []imageHandler.ImageSizeFormat{original, web},
+		DateAdded:   time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	return id, []imageHandler.ImageSizeFormat{original, web}
+}
+
+func TestTransformImage(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	ic := InitController(&dbc, imageHandler.MakeMemoryFileStore())
+
+	id, formats := addPngImage(t, ic)
+
+	before, _ := dbc.GetImageDataById(id, true)
+
+	if err := ic.TransformImage(TransformImageBody{Id: id}); err == nil {
+		t.Fatalf("TransformImage should return an error without changes")
+	}
+
+	err := ic.TransformImage(TransformImageBody{Id: id, Rotate: 90})
+
+	if err != nil {
+		t.Fatalf("TransformImage returned error '%v'", err)
+	}
+
+	after, err := dbc.GetImageDataById(id, true)
+
+	if err != nil {
+		t.Fatalf("GetImageDataById returned error '%v'", err)
+	}
+
+	expected := map[string]imageHandler.ImageSize{
+		"original": {Width: 20, Height: 40},
+		"web":      {Width: 10, Height: 20},
+	}
+
+	for i, file := range after.ImageFiles {
+		if file.Id != before.ImageFiles[i].Id || file.Filename != before.ImageFiles[i].Filename {
+			t.Fatalf("file = '%v', Should keep its id and filename", file.Filename)
+		}
+
+		if file.ImageSize != expected[file.FormatName] {
+			t.Fatalf("size = '%v', Should be '%v' for '%v'", file.ImageSize, expected[file.FormatName], file.FormatName)
+		}
+
+		if _, err := ic.FileStore.Stat(file.GetStorageName()); err != nil {
+			t.Fatalf("'%v' should be stored", file.GetStorageName())
+		}
+	}
+
+	if len(after.BlurHash) == 0 || len(after.Lqip) == 0 {
+		t.Fatalf("the placeholders should be made from the transformed image")
+	}
+
+	// The original from before the transform is kept as the source
+	if after.Source == nil || after.Source.Sha256 != formats[0].Sha256 || after.Source.Transform.Rotate != 90 {
+		t.Fatalf("after.Source = '%v', Should be the old original rotated by 90 degrees", after.Source)
+	}
+
+	if _, err := ic.FileStore.Stat(formats[0].GetStorageName()); err != nil {
+		t.Fatalf("'%v' should be kept as the source", formats[0].GetStorageName())
+	}
+
+	if _, err := ic.FileStore.Stat(formats[1].GetStorageName()); err == nil {
+		t.Fatalf("'%v' should be deleted", formats[1].GetStorageName())
+	}
+}
+
+// Transforms start from the source, so undoing them gives back the original
+// instead of one that was encoded again
+func TestTransformImageFromSource(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	ic := InitController(&dbc, imageHandler.MakeMemoryFileStore())
+
+	id, formats := addPngImage(t, ic)
+
+	for _, body := range []TransformImageBody{{Id: id, Rotate: 90}, {Id: id, Flip: "horizontal"}, {Id: id, Rotate: 90}, {Id: id, Flip: "horizontal"}} {
+		if err := ic.TransformImage(body); err != nil {
+			t.Fatalf("TransformImage returned error '%v'", err)
+		}
+	}
+
+	doc, _ := dbc.GetImageDataById(id, true)
+
+	if !doc.Source.Transform.IsIdentity() {
+		t.Fatalf("doc.Source.Transform = '%v', Should be the identity", doc.Source.Transform)
+	}
+
+	if doc.ImageFiles[0].Sha256 != formats[0].Sha256 {
+		t.Fatalf("original sha256 = '%v', Should be '%v'", doc.ImageFiles[0].Sha256, formats[0].Sha256)
+	}
+
+	// The source is deleted with the image
+	if err := ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: id}); err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(doc.Source.GetStorageName()); err == nil {
+		t.Fatalf("'%v' should be deleted", doc.Source.GetStorageName())
+	}
+}
+
+func TestBackfillPlaceholders(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	ic := InitController(&dbc, imageHandler.MakeMemoryFileStore())
+
+	id, _ := addPngImage(t, ic)
+
+	report, err := ic.BackfillPlaceholders()
+
+	if err != nil {
+		t.Fatalf("BackfillPlaceholders returned error '%v'", err)
+	}
+
+	if report.ImagesScanned != 1 || len(report.Updated) != 1 || len(report.Errors) != 0 {
+		t.Fatalf("report = '%v', Should have updated one image", report)
+	}
+
+	img, _ := dbc.GetImageDataById(id, true)
+
+	if len(img.BlurHash) == 0 || len(img.Lqip) == 0 {
+		t.Fatalf("img = '%v', Should have placeholders", img)
+	}
+
+	// Images with placeholders are skipped
+	report, _ = ic.BackfillPlaceholders()
+
+	if len(report.Updated) != 0 {
+		t.Fatalf("report.Updated = '%v', Should be empty", report.Updated)
+	}
+}
+
+func TestGetImagesByColor(t *testing.T) {
+	ic, _ := makeTestController(t)
+
+	id, err := (*ic.DBController).AddImageData(dbController.AddImageDocument{
+		Title:       "red",
+		Filename:    "red.jpg",
+		IdName:      "red",
+		SizeFormats: []imageHandler.ImageSizeFormat{{FormatName: "web", Filename: "red@web.jpg", ImageType: imageHandler.Jpeg}},
+		DateAdded:   time.Now(),
+		Palette:     []imageHandler.PaletteColor{{Color: "#fa0a0a", Percentage: 100}},
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	images, err := ic.GetImages(1, 10, "", true, "#ff0000", "")
+
+	if err != nil {
+		t.Fatalf("GetImages returned error '%v'", err)
+	}
+
+	if len(images) != 1 || images[0].Id != id {
+		t.Fatalf("images = '%v', Should only contain the red image", images)
+	}
+
+	if images, _ := ic.GetImages(1, 10, "", true, "", ""); len(images) != 2 {
+		t.Fatalf("len(images) = '%v', Should be '2' without a color", len(images))
+	}
+
+	tests := []struct {
+		color    string
+		distance string
+	}{
+		{"red", ""},
+		{"#ff000080", ""},
+		{"#ff0000", "0"},
+		{"#ff0000", "101"},
+		{"#ff0000", "far"},
+	}
+
+	for _, test := range tests {
+		_, err := ic.GetImages(1, 10, "", true, test.color, test.distance)
+
+		if _, ok := err.(dbController.InvalidInputError); !ok {
+			t.Fatalf("err = '%v', Should be an InvalidInputError for '%v'", err, test)
+		}
+	}
+}
+
+// A file store that calls onStat after a file was found, so that tests can run
+// another request between an upload's check for a file and its database write
+type statHookFileStore struct {
+	*imageHandler.MemoryFileStore
+	onStat func(filename string)
+}
+
+func (s *statHookFileStore) Stat(filename string) (imageHandler.FileInfo, error) {
+	info, err := s.MemoryFileStore.Stat(filename)
+
+	if err == nil && s.onStat != nil {
+		onStat := s.onStat
+		s.onStat = nil
+		onStat(filename)
+	}
+
+	return info, err
+}
+
+// Stages an image whose single file has the contents, like AddImageFile does
+// before saving it.
+func stageContentAddressedImage(idName, contents string) (imageHandler.ImageConversionResult, imageHandler.FileStore, dbController.AddImageDocument) {
+	staged := imageHandler.MakeMemoryFileStore()
+
+	f := imageHandler.ImageSizeFormat{
+		FormatName: contents,
+		Filename:   idName + "@" + contents + ".jpg",
+		ImageType:  imageHandler.Jpeg,
+		Sha256:     imageHandler.HashBytes([]byte(contents)),
+	}
+	staged.Put(f.GetStorageName(), []byte(contents))
+
+	output := imageHandler.ImageConversionResult{
+		IdName:      idName,
+		SizeFormats: []imageHandler.ImageSizeFormat{f},
+		NewFiles:    []string{f.GetStorageName()},
+	}
+
+	doc := dbController.AddImageDocument{
+		Title:       idName,
+		Filename:    idName + ".jpg",
+		IdName:      idName,
+		SizeFormats: output.SizeFormats,
+		DateAdded:   time.Now(),
+	}
+
+	return output, staged, doc
+}
+
+// An upload that finds a shared file in the file store and a delete of the
+// last image that refers to it run at the same time. The file must survive,
+// because the uploaded image refers to it once both have finished.
+func TestUploadDuringDeleteKeepsSharedFile(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := &statHookFileStore{MemoryFileStore: imageHandler.MakeMemoryFileStore()}
+	ic := InitController(&dbc, store)
+
+	first := addContentAddressedImage(t, ic, "def", []string{"web"})
+	sharedName := imageHandler.MakeBlobName(imageHandler.HashBytes([]byte("web")), imageHandler.Jpeg)
+
+	output, staged, doc := stageContentAddressedImage("ghi", "web")
+
+	deleted := make(chan error, 1)
+	store.onStat = func(filename string) {
+		go func() {
+			deleted <- ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: first})
+		}()
+
+		// The delete waits for the upload to finish, so it shouldn't be done
+		select {
+		case err := <-deleted:
+			deleted <- err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	err := ic.saveStagedFiles(output, staged, func(onTransaction func(context.Context) error) error {
+		_, err := (*ic.DBController).AddImageData(doc)
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("saveStagedFiles returned error '%v'", err)
+	}
+
+	if err := <-deleted; err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(sharedName); err != nil {
+		t.Fatalf("'%v' is referenced by the uploaded image and should not be deleted", sharedName)
+	}
+}
+
+// Instances that share a database and a file store don't share blob locks. An
+// instance that deletes the shared file after the upload found it doesn't
+// leave the uploaded image without its file.
+func TestUploadDuringDeleteOnAnotherInstance(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := &statHookFileStore{MemoryFileStore: imageHandler.MakeMemoryFileStore()}
+	ic := InitController(&dbc, store)
+	other := InitController(&dbc, store)
+
+	first := addContentAddressedImage(t, ic, "def", []string{"web"})
+	sharedName := imageHandler.MakeBlobName(imageHandler.HashBytes([]byte("web")), imageHandler.Jpeg)
+
+	output, staged, doc := stageContentAddressedImage("ghi", "web")
+
+	store.onStat = func(filename string) {
+		if err := other.DeleteImageDocument(dbController.DeleteImageDocument{Id: first}); err != nil {
+			t.Fatalf("DeleteImageDocument returned error '%v'", err)
+		}
+	}
+
+	err := ic.saveStagedFiles(output, staged, func(onTransaction func(context.Context) error) error {
+		_, err := (*ic.DBController).AddImageData(doc)
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("saveStagedFiles returned error '%v'", err)
+	}
+
+	if _, err := ic.FileStore.Stat(sharedName); err != nil {
+		t.Fatalf("'%v' is referenced by the uploaded image and should be written again", sharedName)
+	}
+}
+
+// A file store that calls onDelete after a file was deleted
+type deleteHookFileStore struct {
+	*imageHandler.MemoryFileStore
+	onDelete func(filename string)
+}
+
+func (s *deleteHookFileStore) Delete(filename string) error {
+	err := s.MemoryFileStore.Delete(filename)
+
+	if err == nil && s.onDelete != nil {
+		onDelete := s.onDelete
+		s.onDelete = nil
+		onDelete(filename)
+	}
+
+	return err
+}
+
+// A document that another instance saves while the file is deleted gets its
+// file back
+func TestDeleteDuringUploadOnAnotherInstance(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := &deleteHookFileStore{MemoryFileStore: imageHandler.MakeMemoryFileStore()}
+	ic := InitController(&dbc, store)
+
+	first := addContentAddressedImage(t, ic, "def", []string{"web"})
+	sharedName := imageHandler.MakeBlobName(imageHandler.HashBytes([]byte("web")), imageHandler.Jpeg)
+
+	_, _, doc := stageContentAddressedImage("ghi", "web")
+
+	store.onDelete = func(filename string) {
+		if _, err := dbc.AddImageData(doc); err != nil {
+			t.Fatalf("AddImageData returned error '%v'", err)
+		}
+	}
+
+	if err := ic.DeleteImageDocument(dbController.DeleteImageDocument{Id: first}); err != nil {
+		t.Fatalf("DeleteImageDocument returned error '%v'", err)
+	}
+
+	if data, err := ic.FileStore.Get(sharedName); err != nil || string(data) != "web" {
+		t.Fatalf("'%v' is referenced by the saved image and should be put back", sharedName)
+	}
+}
+
+// Files that existed before a failed save belong to other images, so only the
+// files that the save copied are removed.
+func TestFailedSaveKeepsExistingFiles(t *testing.T) {
+	ic, _ := makeTestController(t)
+	addContentAddressedImage(t, ic, "def", []string{"web"})
+
+	output, staged, _ := stageContentAddressedImage("ghi", "web")
+	newOutput, newStaged, _ := stageContentAddressedImage("ghi", "thumb")
+
+	for _, name := range newOutput.NewFiles {
+		data, _ := newStaged.Get(name)
+		staged.Put(name, data)
+	}
+
+	output.NewFiles = append(output.NewFiles, newOutput.NewFiles...)
+
+	err := ic.saveStagedFiles(output, staged, func(onTransaction func(context.Context) error) error {
+		return errors.New("save failed")
+	})
+
+	if err == nil {
+		t.Fatalf("saveStagedFiles should return the error of save")
+	}
+
+	if _, err := ic.FileStore.Stat(output.NewFiles[0]); err != nil {
+		t.Fatalf("'%v' existed before the save and should not be deleted", output.NewFiles[0])
+	}
+
+	if _, err := ic.FileStore.Stat(output.NewFiles[1]); err == nil {
+		t.Fatalf("'%v' was copied by the failed save and should be deleted", output.NewFiles[1])
+	}
+}
+
+// A ContextFileStore whose writes with a context only reach the store when the
+// test commits them, like GridFS writes in a transaction
+type fakeTransactionStore struct {
+	*imageHandler.MemoryFileStore
+	pending *imageHandler.MemoryFileStore
+}
+
+type fakeTransactionView struct {
+	*imageHandler.MemoryFileStore
+	base *imageHandler.MemoryFileStore
+}
+
+func (s *fakeTransactionStore) WithContext(ctx context.Context) imageHandler.FileStore {
+	s.pending = imageHandler.MakeMemoryFileStore()
+	return fakeTransactionView{s.pending, s.MemoryFileStore}
+}
+
+func (s *fakeTransactionStore) commit() {
+	s.pending.Walk(func(info imageHandler.FileInfo) error {
+		data, _ := s.pending.Get(info.Filename)
+		return s.MemoryFileStore.Put(info.Filename, data)
+	})
+	s.pending = nil
+}
+
+func (v fakeTransactionView) Stat(filename string) (imageHandler.FileInfo, error) {
+	if info, err := v.MemoryFileStore.Stat(filename); err == nil {
+		return info, nil
+	}
+
+	return v.base.Stat(filename)
+}
+
+// Saves the staged files of an image whose web file is already stored and
+// whose thumb file is new. The save commits the transaction unless saveErr is
+// set.
+func saveStagedFilesInTransaction(t *testing.T, saveErr error) (ImageController, *fakeTransactionStore, []string) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := &fakeTransactionStore{MemoryFileStore: imageHandler.MakeMemoryFileStore()}
+	ic := InitController(&dbc, store)
+
+	addContentAddressedImage(t, ic, "def", []string{"web"})
+
+	output, staged, doc := stageContentAddressedImage("ghi", "web")
+	thumbOutput, thumbStaged, _ := stageContentAddressedImage("ghi", "thumb")
+
+	thumbName := thumbOutput.NewFiles[0]
+	thumbData, _ := thumbStaged.Get(thumbName)
+	staged.Put(thumbName, thumbData)
+	output.NewFiles = append(output.NewFiles, thumbName)
+
+	err := ic.saveStagedFiles(output, staged, func(onTransaction func(context.Context) error) error {
+		if onTransaction == nil {
+			t.Fatalf("a transactional store should copy the files in the transaction")
+		}
+
+		if _, err := store.Stat(thumbName); err == nil {
+			t.Fatalf("'%v' should not be written before the transaction", thumbName)
+		}
+
+		if err := onTransaction(context.Background()); err != nil {
+			return err
+		}
+
+		if saveErr != nil {
+			return saveErr
+		}
+
+		_, err := (*ic.DBController).AddImageData(doc)
+		store.commit()
+
+		return err
+	})
+
+	if err != saveErr {
+		t.Fatalf("saveStagedFiles returned error '%v', Should be '%v'", err, saveErr)
+	}
+
+	return ic, store, output.NewFiles
+}
+
+func TestSaveStagedFilesInTransaction(t *testing.T) {
+	_, store, names := saveStagedFilesInTransaction(t, nil)
+
+	for _, name := range names {
+		if _, err := store.Stat(name); err != nil {
+			t.Fatalf("'%v' should be stored once the transaction commits", name)
+		}
+	}
+}
+
+func TestSaveStagedFilesAbortedTransaction(t *testing.T) {
+	_, store, names := saveStagedFilesInTransaction(t, errors.New("abort"))
+
+	if _, err := store.Stat(names[0]); err != nil {
+		t.Fatalf("'%v' existed before the transaction and should not be deleted", names[0])
+	}
+
+	if _, err := store.Stat(names[1]); err == nil {
+		t.Fatalf("'%v' should not be stored when the transaction aborts", names[1])
+	}
+}
+
+// A file store whose deletes fail
+type failingDeleteFileStore struct {
+	*imageHandler.MemoryFileStore
+}
+
+func (s failingDeleteFileStore) Delete(filename string) error {
+	return errors.New("delete failed")
+}
+
+// Keeps the info logs
+type testLogger struct {
+	infoLogs []logging.InfoLogData
+}
+
+func (l *testLogger) AddRequestLog(log logging.RequestLogData) error {
+	return nil
+}
+
+func (l *testLogger) AddInfoLog(log logging.InfoLogData) error {
+	l.infoLogs = append(l.infoLogs, log)
+	return nil
+}
+
+// Old files are deleted after the image uses the new ones, so failing to
+// delete them is logged instead of failing the transform
+func TestTransformImageLogsCleanupErrors(t *testing.T) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	ic := InitController(&dbc, failingDeleteFileStore{imageHandler.MakeMemoryFileStore()})
+
+	logger := &testLogger{}
+	var imageLogger logging.ImageLogger = logger
+	ic.AddLogger(&imageLogger)
+
+	id, _ := addPngImage(t, ic)
+
+	if err := ic.TransformImage(TransformImageBody{Id: id, Rotate: 90}); err != nil {
+		t.Fatalf("TransformImage returned error '%v'", err)
+	}
+
+	if len(logger.infoLogs) == 0 || logger.infoLogs[0].Type != "error" {
+		t.Fatalf("infoLogs = '%v', Should have the failed deletes", logger.infoLogs)
+	}
+}
+
+// A file store that runs a function the first time a file is read, either
+// before or after reading it
+type getHookFileStore struct {
+	*imageHandler.MemoryFileStore
+	onGet    func(filename string)
+	afterGet bool
+}
+
+func (s *getHookFileStore) Get(filename string) ([]byte, error) {
+	onGet := s.onGet
+	s.onGet = nil
+
+	if onGet != nil && !s.afterGet {
+		onGet(filename)
+	}
+
+	data, err := s.MemoryFileStore.Get(filename)
+
+	if onGet != nil && s.afterGet {
+		onGet(filename)
+	}
+
+	return data, err
+}
+
+// A transform that finishes while another one of the same image runs makes the
+// other one fail, so neither transform's files are lost
+func TestConcurrentTransformsConflict(t *testing.T) {
+	// The other transform finishes while the original is converted
+	testConcurrentTransforms(t, true)
+
+	// The other transform deletes the original before it's read
+	testConcurrentTransforms(t, false)
+}
+
+func testConcurrentTransforms(t *testing.T, afterGet bool) {
+	var dbc dbController.DatabaseController = memoryDbController.MakeMemoryDbController()
+	store := &getHookFileStore{MemoryFileStore: imageHandler.MakeMemoryFileStore(), afterGet: afterGet}
+	ic := InitController(&dbc, store)
+
+	id, _ := addPngImage(t, ic)
+
+	var otherErr error
+	store.onGet = func(filename string) {
+		otherErr = ic.TransformImage(TransformImageBody{Id: id, Rotate: 180})
+	}
+
+	err := ic.TransformImage(TransformImageBody{Id: id, Rotate: 90})
+
+	if otherErr != nil {
+		t.Fatalf("TransformImage returned error '%v'", otherErr)
+	}
+
+	if _, ok := err.(dbController.ConflictError); !ok {
+		t.Fatalf("err = '%v', Should be a ConflictError", err)
+	}
+
+	doc, _ := (*ic.DBController).GetImageDataById(id, true)
+
+	for _, imgFile := range doc.ImageFiles {
+		if imgFile.ImageSize.Width != 40 && imgFile.ImageSize.Width != 20 {
+			t.Fatalf("%v width = '%v', Should have the 180 degree rotation's size", imgFile.Filename, imgFile.ImageSize.Width)
+		}
+
+		if _, err := store.Stat(imgFile.GetStorageName()); err != nil {
+			t.Fatalf("Stat of %v returned error '%v'", imgFile.GetStorageName(), err)
+		}
+	}
+}
@@ -15,8 +15,12 @@ import (
 
 	"methompson.com/image-microservice/imageServer/constants"
 	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
 	"methompson.com/image-microservice/imageServer/logging"
+	"methompson.com/image-microservice/imageServer/memoryDbController"
 	"methompson.com/image-microservice/imageServer/mongoDbController"
+	"methompson.com/image-microservice/imageServer/s3FileStore"
+	"methompson.com/image-microservice/imageServer/sqlDbController"
 )
 
 func MakeAndStartServer() {
@@ -88,10 +92,16 @@ func configureReleaseLogging(is *ImageServer) []error {
 }
 
 func makeServer() (*ImageServer, error) {
-	mdbController, mdbControllerErr := makeAndInitDatabase()
+	dbc, dbcErr := makeAndInitDatabase()
 
-	if mdbControllerErr != nil {
-		log.Fatal("Error Initializing Database: ", mdbControllerErr.Error())
+	if dbcErr != nil {
+		log.Fatal("Error Initializing Database: ", dbcErr.Error())
+	}
+
+	fileStore, fileStoreErr := makeFileStore(dbc)
+
+	if fileStoreErr != nil {
+		log.Fatal("Error Initializing File Store: ", fileStoreErr.Error())
 	}
 
 	app, err := makeFirebaseApp()
@@ -102,23 +112,52 @@ func makeServer() (*ImageServer, error) {
 
 	engine := makeGinEngine()
 
-	// First we assign the pointer-to MongoDbController of mongoDbController to
-	// a variable of type DatabaseController. Then we get the pointer-to
-	// DatabaseController and assign that to cont. We can use pointer-to
-	// DatabaseController to run InitController to initialize the BlogController.
-	var passedController dbController.DatabaseController = mdbController
-	ptrToCont := &passedController
+	// We get the pointer-to DatabaseController and assign that to ptrToCont. We
+	// can use pointer-to DatabaseController to run InitController to initialize
+	// the ImageController.
+	ptrToCont := &dbc
 
 	srv := ImageServer{
 		FirebaseApp:     app,
-		ImageController: InitController(ptrToCont),
+		ImageController: InitController(ptrToCont, fileStore),
 		GinEngine:       engine,
 	}
 
 	return &srv, nil
 }
 
-func makeAndInitDatabase() (*mongoDbController.MongoDbController, error) {
+// Makes the database controller and initializes the database. The DB_TYPE
+// environment variable selects the implementation. MongoDB is used by default.
+// The memory controller keeps everything in memory and is meant for local
+// development.
+func makeAndInitDatabase() (dbController.DatabaseController, error) {
+	switch os.Getenv(constants.DB_TYPE) {
+	case "", "mongodb":
+		return makeAndInitMongoDatabase()
+	case "memory":
+		return memoryDbController.MakeMemoryDbController(), nil
+	case sqlDbController.SQLITE, sqlDbController.POSTGRES:
+		return makeAndInitSqlDatabase(os.Getenv(constants.DB_TYPE))
+	default:
+		return nil, errors.New("unknown database type: " + os.Getenv(constants.DB_TYPE))
+	}
+}
+
+func makeAndInitSqlDatabase(dialect string) (*sqlDbController.SqlDbController, error) {
+	sdbController, err := sqlDbController.MakeSqlDbControllerFromEnv(dialect)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sdbController.InitDatabase(); err != nil {
+		return nil, err
+	}
+
+	return sdbController, nil
+}
+
+func makeAndInitMongoDatabase() (*mongoDbController.MongoDbController, error) {
 	mdbController, mdbControllerErr := mongoDbController.MakeMongoDbController(constants.IMAGE_DB_NAME)
 
 	if mdbControllerErr != nil {
@@ -136,6 +175,44 @@ func makeAndInitDatabase() (*mongoDbController.MongoDbController, error) {
 	return mdbController, nil
 }
 
+// Makes the storage backend for image files. The FILE_STORE environment
+// variable selects the backend. The local file system is used by default.
+// The GridFS backend shares the MongoDB client of the database controller.
+func makeFileStore(dbc dbController.DatabaseController) (imageHandler.FileStore, error) {
+	switch os.Getenv(constants.FILE_STORE) {
+	case "", "local":
+		store, err := imageHandler.MakeLocalFileStore()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if store.NeedsReshard() {
+			log.Printf(
+				"Image files are still saved with a sub path length of %v. Run the reshard command to move them to %v",
+				store.PreviousSubPathLength,
+				store.SubPathLength,
+			)
+		}
+
+		return store, nil
+	case "memory":
+		return imageHandler.MakeMemoryFileStore(), nil
+	case "s3":
+		return s3FileStore.MakeS3FileStoreFromEnv()
+	case "gridfs":
+		mdbController, ok := dbc.(*mongoDbController.MongoDbController)
+
+		if !ok {
+			return nil, errors.New("the gridfs file store requires the mongodb database")
+		}
+
+		return mongoDbController.MakeGridFSStore(mdbController)
+	default:
+		return nil, errors.New("unknown file store: " + os.Getenv(constants.FILE_STORE))
+	}
+}
+
 func makeFirebaseApp() (*firebase.App, error) {
 	if len(os.Getenv(constants.GOOGLE_APPLICATION_CREDENTIALS)) == 0 {
 		log.Fatal("No Google Application credential path listed")
@@ -0,0 +1,122 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package jpegEncoder encodes images as baseline JPEG files with a choice of
+// chroma subsampling. image/jpeg always subsamples the chroma of color images
+// to 4:2:0, so the encoder is a copy of the image/jpeg encoder that can also
+// write 4:2:2 and 4:4:4 files.
+package jpegEncoder
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+)
+
+const DEFAULT_QUALITY = 75
+
+// How much of the color information is kept. The luminance of every pixel is
+// always kept.
+type Subsampling int8
+
+const (
+	// One color sample for every 2 x 2 pixels
+	Subsampling420 Subsampling = iota
+	// One color sample for every 2 x 1 pixels
+	Subsampling422
+	// One color sample for every pixel
+	Subsampling444
+)
+
+// Returns the number of luminance blocks per MCU horizontally and vertically
+func (s Subsampling) samplingFactors() (int, int) {
+	switch s {
+	case Subsampling422:
+		return 2, 1
+	case Subsampling444:
+		return 1, 1
+	default:
+		return 2, 2
+	}
+}
+
+type Options struct {
+	// The quality from 1 to 100. Values outside of this range are clamped.
+	Quality int
+
+	// The chroma subsampling of color images. Grayscale images have no chroma.
+	Subsampling Subsampling
+}
+
+// Writes m to w as a baseline JPEG file. Default options are used if o is nil.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	// Clip quality to [1, 100].
+	quality := DEFAULT_QUALITY
+	subsampling := Subsampling420
+	if o != nil {
+		quality = o.Quality
+		if quality < 1 {
+			quality = 1
+		} else if quality > 100 {
+			quality = 100
+		}
+		subsampling = o.Subsampling
+	}
+	// Convert from a quality rating to a scaling factor.
+	var scale int
+	if quality < 50 {
+		scale = 5000 / quality
+	} else {
+		scale = 200 - quality*2
+	}
+	// Initialize the quantization tables.
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			x := int(unscaledQuant[i][j])
+			x = (x*scale + 50) / 100
+			if x < 1 {
+				x = 1
+			} else if x > 255 {
+				x = 255
+			}
+			e.quant[i][j] = uint8(x)
+		}
+	}
+	// Compute number of components based on input image type.
+	nComponent := 3
+	switch m.(type) {
+	case *image.Gray:
+		nComponent = 1
+	}
+	h, v := subsampling.samplingFactors()
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	// Write the quantization tables.
+	e.writeDQT()
+	// Write the image dimensions.
+	e.writeSOF0(b.Size(), nComponent, h, v)
+	// Write the Huffman tables.
+	e.writeDHT(nComponent)
+	// Write the image data.
+	e.writeSOS(m, h, v)
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
@@ -0,0 +1,115 @@
+package jpegEncoder
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// Makes an image with gradients and a block of solid color. The width and
+// height aren't multiples of 16, so the encoder has to pad the last MCUs.
+func makeTestImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8((x + y) * 255 / (width + height)),
+				A: 255,
+			}
+
+			if x > width/2 && y > height/2 {
+				c = color.RGBA{R: 200, G: 40, B: 90, A: 255}
+			}
+
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+// Returns the average difference of the red, green and blue channels
+func averageDifference(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	total := 0.0
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+
+			total += math.Abs(float64(r1>>8) - float64(r2>>8))
+			total += math.Abs(float64(g1>>8) - float64(g2>>8))
+			total += math.Abs(float64(b1>>8) - float64(b2>>8))
+		}
+	}
+
+	return total / float64(3*bounds.Dx()*bounds.Dy())
+}
+
+func TestEncodeSubsampling(t *testing.T) {
+	img := makeTestImage(61, 37)
+
+	ratios := map[Subsampling]image.YCbCrSubsampleRatio{
+		Subsampling420: image.YCbCrSubsampleRatio420,
+		Subsampling422: image.YCbCrSubsampleRatio422,
+		Subsampling444: image.YCbCrSubsampleRatio444,
+	}
+
+	for subsampling, ratio := range ratios {
+		buffer := new(bytes.Buffer)
+
+		if err := Encode(buffer, img, &Options{Quality: 90, Subsampling: subsampling}); err != nil {
+			t.Fatalf("Encode returned error '%v'", err)
+		}
+
+		decoded, err := jpeg.Decode(buffer)
+		if err != nil {
+			t.Fatalf("jpeg.Decode returned error '%v'", err)
+		}
+
+		ycbcr, ok := decoded.(*image.YCbCr)
+		if !ok {
+			t.Fatalf("decoded is '%T', Should be '*image.YCbCr'", decoded)
+		}
+
+		if ycbcr.SubsampleRatio != ratio {
+			t.Fatalf("SubsampleRatio = '%v', Should be '%v'", ycbcr.SubsampleRatio, ratio)
+		}
+
+		if diff := averageDifference(img, decoded); diff > 4 {
+			t.Fatalf("diff = '%v' for '%v', Should be at most '4'", diff, ratio)
+		}
+	}
+}
+
+func TestEncodeMatchesImageJpeg(t *testing.T) {
+	img := makeTestImage(48, 32)
+
+	expected := new(bytes.Buffer)
+	jpeg.Encode(expected, img, &jpeg.Options{Quality: 80})
+
+	output := new(bytes.Buffer)
+	Encode(output, img, &Options{Quality: 80})
+
+	if !bytes.Equal(expected.Bytes(), output.Bytes()) {
+		t.Fatalf("4:2:0 files should be the same as image/jpeg's files")
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 20, 20))
+	output.Reset()
+
+	if err := Encode(output, gray, &Options{Quality: 80, Subsampling: Subsampling444}); err != nil {
+		t.Fatalf("Encode returned error '%v'", err)
+	}
+
+	if _, err := jpeg.Decode(output); err != nil {
+		t.Fatalf("jpeg.Decode returned error '%v'", err)
+	}
+}
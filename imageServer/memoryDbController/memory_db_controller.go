@@ -0,0 +1,801 @@
+package memoryDbController
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/logging"
+)
+
+// The maximum amount of logs of each type that we keep. Older logs are
+// discarded, similar to the capped logging collection in MongoDB.
+const MAX_LOGS = 1000
+
+// MemoryDbController is an implementation of DatabaseController that keeps all
+// data in memory. Nothing is persisted between runs, so it's meant for local
+// development and tests. It mirrors the behavior of the MongoDbController,
+// including the unique filename and idName constraints.
+type MemoryDbController struct {
+	images      map[string]imageRecord
+	imageFiles  map[string]dbController.ImageFileDocument
+	assets      map[string]dbController.AssetDocument
+	users       map[string]dbController.UserDataDocument
+	requestLogs []logging.RequestLogData
+	infoLogs    []logging.InfoLogData
+	mutex       sync.RWMutex
+}
+
+// The image data that is stored. The image files are stored separately and
+// are tied to the image by their ImageId.
+type imageRecord struct {
+	Id             string
+	Title          string
+	Filename       string
+	IdName         string
+	Tags           []string
+	AuthorId       string
+	DateAdded      time.Time
+	OriginalSha256 string
+	BlurHash       string
+	Lqip           string
+	Palette        []imageHandler.PaletteColor
+	Source         *imageHandler.ImageSource
+}
+
+// Sources are copied so that callers can't change the stored sources
+func copySource(source *imageHandler.ImageSource) *imageHandler.ImageSource {
+	if source == nil {
+		return nil
+	}
+
+	result := *source
+
+	return &result
+}
+
+// Palettes are copied so that callers can't change the stored palettes
+func copyPalette(palette []imageHandler.PaletteColor) []imageHandler.PaletteColor {
+	if palette == nil {
+		return nil
+	}
+
+	result := make([]imageHandler.PaletteColor, len(palette))
+	copy(result, palette)
+
+	return result
+}
+
+func MakeMemoryDbController() *MemoryDbController {
+	mdbc := &MemoryDbController{}
+	mdbc.InitDatabase()
+
+	return mdbc
+}
+
+// Resets all of the data held by the controller
+func (mdbc *MemoryDbController) InitDatabase() error {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	mdbc.images = make(map[string]imageRecord)
+	mdbc.imageFiles = make(map[string]dbController.ImageFileDocument)
+	mdbc.assets = make(map[string]dbController.AssetDocument)
+	mdbc.users = make(map[string]dbController.UserDataDocument)
+	mdbc.requestLogs = make([]logging.RequestLogData, 0)
+	mdbc.infoLogs = make([]logging.InfoLogData, 0)
+
+	return nil
+}
+
+// Adds user data. Users are used to get the author's name for images. Users
+// are keyed by their UID.
+func (mdbc *MemoryDbController) AddUser(user dbController.UserDataDocument) {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	if len(user.Id) == 0 {
+		user.Id = makeId()
+	}
+
+	mdbc.users[user.UID] = user
+}
+
+func (mdbc *MemoryDbController) GetUserByUID(uid string) (dbController.UserDataDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	user, ok := mdbc.users[uid]
+
+	if !ok {
+		return user, dbController.NewNoResultsError("")
+	}
+
+	return user, nil
+}
+
+// Ids are UUID strings
+func makeId() string {
+	return uuid.New().String()
+}
+
+func isValidId(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// Adds the image and image file data. The writes only become visible once all
+// checks pass and the OnTransaction function, if any, returns without error.
+func (mdbc *MemoryDbController) AddImageData(doc dbController.AddImageDocument) (string, error) {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	if len(doc.SizeFormats) == 0 {
+		return "", dbController.NewInvalidInputError("No images to save")
+	}
+
+	for _, img := range mdbc.images {
+		if img.IdName == doc.IdName {
+			return "", dbController.NewDuplicateEntryError("duplicate idName: " + doc.IdName)
+		}
+	}
+
+	imgId := makeId()
+
+	// We skip image formats without a valid image type, like MongoDbController
+	files := make([]dbController.ImageFileDocument, 0)
+	filenames := make(map[string]bool)
+	for _, img := range doc.SizeFormats {
+		if img.ImageType == imageHandler.Same {
+			continue
+		}
+
+		if _, exists := mdbc.getImageFileByName(img.Filename); exists || filenames[img.Filename] {
+			return "", dbController.NewDuplicateEntryError("duplicate filename: " + img.Filename)
+		}
+		filenames[img.Filename] = true
+
+		files = append(files, dbController.ImageFileDocument{
+			Id:          makeId(),
+			ImageId:     imgId,
+			ImageIdName: doc.IdName,
+			Filename:    img.Filename,
+			FormatName:  img.FormatName,
+			ImageSize:   img.ImageSize,
+			FileSize:    img.FileSize,
+			Private:     img.Private,
+			ImageType:   img.ImageType,
+			Sha256:      img.Sha256,
+			Crop:        img.Crop,
+			Encoding:    img.Encoding,
+			Capped:      img.Capped,
+			Request:     img.Request,
+		})
+	}
+
+	if len(files) == 0 {
+		return "", dbController.NewInvalidInputError("no images to save")
+	}
+
+	if doc.OnTransaction != nil {
+		if err := doc.OnTransaction(context.Background()); err != nil {
+			return "", err
+		}
+	}
+
+	tags := make([]string, len(doc.Tags))
+	copy(tags, doc.Tags)
+
+	mdbc.images[imgId] = imageRecord{
+		Id:             imgId,
+		Title:          doc.Title,
+		Filename:       doc.Filename,
+		IdName:         doc.IdName,
+		Tags:           tags,
+		AuthorId:       doc.AuthorId,
+		DateAdded:      doc.DateAdded,
+		OriginalSha256: doc.OriginalSha256,
+		BlurHash:       doc.BlurHash,
+		Lqip:           doc.Lqip,
+		Palette:        copyPalette(doc.Palette),
+	}
+
+	for _, file := range files {
+		mdbc.imageFiles[file.Id] = file
+	}
+
+	return imgId, nil
+}
+
+// Must be called while holding the mutex
+func (mdbc *MemoryDbController) getImageFileByName(name string) (dbController.ImageFileDocument, bool) {
+	for _, file := range mdbc.imageFiles {
+		if file.Filename == name {
+			return file, true
+		}
+	}
+
+	return dbController.ImageFileDocument{}, false
+}
+
+func (mdbc *MemoryDbController) GetImageByName(name string) (dbController.ImageFileDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	file, ok := mdbc.getImageFileByName(name)
+
+	if !ok {
+		return file, dbController.NewNoResultsError("")
+	}
+
+	return file, nil
+}
+
+// Builds an ImageDocument from an image record. Private image files are
+// filtered out unless showPrivate is true. Must be called while holding
+// the mutex.
+func (mdbc *MemoryDbController) getImageDocument(img imageRecord, showPrivate bool) dbController.ImageDocument {
+	imageFiles := make([]dbController.ImageFileDocument, 0)
+
+	for _, file := range mdbc.imageFiles {
+		if file.ImageId != img.Id {
+			continue
+		}
+
+		if file.Private && !showPrivate {
+			continue
+		}
+
+		imageFiles = append(imageFiles, file)
+	}
+
+	// Map iteration order is random, so we sort the files to keep results stable
+	sort.Slice(imageFiles, func(i, j int) bool {
+		return imageFiles[i].Filename < imageFiles[j].Filename
+	})
+
+	author := ""
+	if user, ok := mdbc.users[img.AuthorId]; ok {
+		author = user.Name
+	}
+
+	tags := make([]string, len(img.Tags))
+	copy(tags, img.Tags)
+
+	return dbController.ImageDocument{
+		Id:             img.Id,
+		Title:          img.Title,
+		Filename:       img.Filename,
+		IdName:         img.IdName,
+		Tags:           tags,
+		ImageFiles:     imageFiles,
+		Author:         author,
+		AuthorId:       img.AuthorId,
+		DateAdded:      img.DateAdded,
+		OriginalSha256: img.OriginalSha256,
+		BlurHash:       img.BlurHash,
+		Lqip:           img.Lqip,
+		Palette:        copyPalette(img.Palette),
+		Source:         copySource(img.Source),
+	}
+}
+
+func (mdbc *MemoryDbController) GetImageDataById(id string, showPrivate bool) (dbController.ImageDocument, error) {
+	if !isValidId(id) {
+		return dbController.ImageDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	img, ok := mdbc.images[id]
+
+	if !ok {
+		return dbController.ImageDocument{}, dbController.NewNoResultsError("")
+	}
+
+	return mdbc.getImageDocument(img, showPrivate), nil
+}
+
+// Sorts all images based on the sort filter, then returns the requested page.
+func (mdbc *MemoryDbController) GetImagesData(page, pagination int, sortFilter dbController.SortImageFilter) ([]dbController.ImageDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	images := make([]imageRecord, 0)
+	for _, img := range mdbc.images {
+		if sortFilter.Color != nil && !sortFilter.Color.Matches(img.Palette) {
+			continue
+		}
+
+		images = append(images, img)
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		switch sortFilter.Sortby {
+		case dbController.Name:
+			return strings.ToLower(images[i].Filename) < strings.ToLower(images[j].Filename)
+		case dbController.NameReverse:
+			return strings.ToLower(images[i].Filename) > strings.ToLower(images[j].Filename)
+		case dbController.DateAddedReverse:
+			return images[i].DateAdded.Before(images[j].DateAdded)
+		// case dbController.DateAdded:
+		default:
+			return images[i].DateAdded.After(images[j].DateAdded)
+		}
+	})
+
+	imgDocs := make([]dbController.ImageDocument, 0)
+
+	start := (page - 1) * pagination
+	if start < 0 || pagination <= 0 || start >= len(images) {
+		return imgDocs, nil
+	}
+
+	end := start + pagination
+	if end > len(images) {
+		end = len(images)
+	}
+
+	for _, img := range images[start:end] {
+		imgDocs = append(imgDocs, mdbc.getImageDocument(img, sortFilter.ShowPrivate))
+	}
+
+	return imgDocs, nil
+}
+
+func (mdbc *MemoryDbController) GetImageFileById(id string) (dbController.ImageFileDocument, error) {
+	if !isValidId(id) {
+		return dbController.ImageFileDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	file, ok := mdbc.imageFiles[id]
+
+	if !ok {
+		return file, dbController.NewNoResultsError("")
+	}
+
+	return file, nil
+}
+
+func (mdbc *MemoryDbController) ImageHasFiles(id string) (bool, error) {
+	image, err := mdbc.GetImageDataById(id, true)
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(image.ImageFiles) > 0, nil
+}
+
+func (mdbc *MemoryDbController) CountImageFilesWithSha256(sha256 string) (int, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	count := 0
+	for _, file := range mdbc.imageFiles {
+		if len(sha256) > 0 && file.Sha256 == sha256 {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (mdbc *MemoryDbController) CountImageSourcesWithSha256(sha256 string) (int, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	count := 0
+	for _, img := range mdbc.images {
+		if len(sha256) > 0 && img.Source != nil && img.Source.Sha256 == sha256 {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (mdbc *MemoryDbController) GetImageSources() ([]imageHandler.ImageSource, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	sources := make([]imageHandler.ImageSource, 0)
+	for _, img := range mdbc.images {
+		if img.Source != nil {
+			sources = append(sources, *img.Source)
+		}
+	}
+
+	return sources, nil
+}
+
+func (mdbc *MemoryDbController) GetAllImageFiles() ([]dbController.ImageFileDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	files := make([]dbController.ImageFileDocument, 0, len(mdbc.imageFiles))
+	for _, file := range mdbc.imageFiles {
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// Edits the title, filename and tags of an image. Only values that are not
+// nil are changed.
+func (mdbc *MemoryDbController) EditImageData(doc dbController.EditImageDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	img, ok := mdbc.images[doc.Id]
+
+	if !ok {
+		return dbController.NewNoResultsError("")
+	}
+
+	if doc.Title != nil {
+		img.Title = *doc.Title
+	}
+
+	if doc.Filename != nil {
+		img.Filename = *doc.Filename
+	}
+
+	if doc.Tags != nil {
+		img.Tags = make([]string, len(*doc.Tags))
+		copy(img.Tags, *doc.Tags)
+	}
+
+	mdbc.images[doc.Id] = img
+
+	return nil
+}
+
+func (mdbc *MemoryDbController) EditImageFileData(doc dbController.EditImageFileDocument) (dbController.EditImageFileResult, error) {
+	result := dbController.EditImageFileResult{}
+
+	if !doc.ChangesExist() {
+		return result, dbController.NewInvalidInputError("no edits to be made")
+	}
+
+	if !isValidId(doc.Id) {
+		return result, dbController.NewInvalidInputError("Invalid User ID")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	file, ok := mdbc.imageFiles[doc.Id]
+
+	if !ok {
+		return result, dbController.NewNoResultsError("")
+	}
+
+	result.OldName = file.Filename
+	result.NewName = file.Filename
+
+	if doc.ChangeObfuscate {
+		if existing, exists := mdbc.getImageFileByName(doc.NewName); exists && existing.Id != file.Id {
+			return result, dbController.NewDuplicateEntryError("duplicate filename: " + doc.NewName)
+		}
+
+		file.Filename = doc.NewName
+		result.NewName = doc.NewName
+	}
+
+	if doc.ChangePrivate {
+		file.Private = doc.Private
+	}
+
+	mdbc.imageFiles[doc.Id] = file
+
+	return result, nil
+}
+
+// Updates the content of an image's files. The files are only changed once
+// every size format matches a file of the image and the OnTransaction
+// function, if any, returns without error.
+func (mdbc *MemoryDbController) ReplaceImageFiles(doc dbController.ReplaceImageFilesDocument) error {
+	if !isValidId(doc.ImageId) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	if len(doc.SizeFormats) == 0 {
+		return dbController.NewInvalidInputError("no images to save")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	img, ok := mdbc.images[doc.ImageId]
+	if !ok {
+		return dbController.NewNoResultsError("")
+	}
+
+	files := make([]dbController.ImageFileDocument, 0, len(doc.SizeFormats))
+	for _, img := range doc.SizeFormats {
+		file, exists := mdbc.getImageFileByName(img.Filename)
+
+		if !exists || file.ImageId != doc.ImageId {
+			return dbController.NewInvalidInputError("no image file named " + img.Filename)
+		}
+
+		if previous, ok := doc.PreviousSha256[img.Filename]; ok && previous != file.Sha256 {
+			return dbController.NewConflictError(img.Filename + " was changed")
+		}
+
+		file.ImageSize = img.ImageSize
+		file.FileSize = img.FileSize
+		file.ImageType = img.ImageType
+		file.Sha256 = img.Sha256
+		file.Crop = img.Crop
+		file.Encoding = img.Encoding
+		file.Capped = img.Capped
+		file.Request = img.Request
+
+		files = append(files, file)
+	}
+
+	if doc.OnTransaction != nil {
+		if err := doc.OnTransaction(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		mdbc.imageFiles[file.Id] = file
+	}
+
+	if len(doc.BlurHash) > 0 {
+		img.BlurHash = doc.BlurHash
+		img.Lqip = doc.Lqip
+	}
+
+	if doc.Source != nil {
+		img.Source = copySource(doc.Source)
+	}
+
+	mdbc.images[doc.ImageId] = img
+
+	return nil
+}
+
+func (mdbc *MemoryDbController) SetImagePlaceholders(doc dbController.ImagePlaceholdersDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	img, ok := mdbc.images[doc.Id]
+	if !ok {
+		return dbController.NewNoResultsError("")
+	}
+
+	img.BlurHash = doc.BlurHash
+	img.Lqip = doc.Lqip
+	mdbc.images[doc.Id] = img
+
+	return nil
+}
+
+// Deletes the image and all of its image files
+func (mdbc *MemoryDbController) DeleteImage(doc dbController.DeleteImageDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	if _, ok := mdbc.images[doc.Id]; !ok {
+		return dbController.NewInvalidInputError("invalid id. no image deleted")
+	}
+
+	for id, file := range mdbc.imageFiles {
+		if file.ImageId == doc.Id {
+			delete(mdbc.imageFiles, id)
+		}
+	}
+
+	delete(mdbc.images, doc.Id)
+
+	return nil
+}
+
+// Deletes an image file. If it was the last image file of an image, the image
+// is deleted as well.
+func (mdbc *MemoryDbController) DeleteImageFile(doc dbController.DeleteImageFileDocument) (dbController.ImageFileDocument, error) {
+	if !isValidId(doc.Id) {
+		return dbController.ImageFileDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	file, ok := mdbc.imageFiles[doc.Id]
+
+	if !ok {
+		return file, dbController.NewNoResultsError("")
+	}
+
+	delete(mdbc.imageFiles, doc.Id)
+
+	for _, other := range mdbc.imageFiles {
+		if other.ImageId == file.ImageId {
+			return file, nil
+		}
+	}
+
+	delete(mdbc.images, file.ImageId)
+
+	return file, nil
+}
+
+// Adds an asset. Names are unique for each kind of asset.
+func (mdbc *MemoryDbController) AddAsset(doc dbController.AddAssetDocument) (string, error) {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	if len(doc.Kind) == 0 || len(doc.Name) == 0 {
+		return "", dbController.NewInvalidInputError("assets require a kind and name")
+	}
+
+	if _, exists := mdbc.getAssetByName(doc.Kind, doc.Name); exists {
+		return "", dbController.NewDuplicateEntryError("duplicate asset name: " + doc.Name)
+	}
+
+	id := makeId()
+
+	mdbc.assets[id] = dbController.AssetDocument{
+		Id:        id,
+		Kind:      doc.Kind,
+		Name:      doc.Name,
+		Filename:  doc.Filename,
+		Sha256:    doc.Sha256,
+		FileSize:  doc.FileSize,
+		AuthorId:  doc.AuthorId,
+		DateAdded: doc.DateAdded,
+	}
+
+	return id, nil
+}
+
+// Must be called while holding the mutex
+func (mdbc *MemoryDbController) getAssetByName(kind dbController.AssetKind, name string) (dbController.AssetDocument, bool) {
+	for _, asset := range mdbc.assets {
+		if asset.Kind == kind && asset.Name == name {
+			return asset, true
+		}
+	}
+
+	return dbController.AssetDocument{}, false
+}
+
+// Returns the assets sorted by name
+func (mdbc *MemoryDbController) GetAssets(kind dbController.AssetKind) ([]dbController.AssetDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	assets := make([]dbController.AssetDocument, 0)
+	for _, asset := range mdbc.assets {
+		if len(kind) == 0 || asset.Kind == kind {
+			assets = append(assets, asset)
+		}
+	}
+
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+
+	return assets, nil
+}
+
+func (mdbc *MemoryDbController) GetAssetByName(kind dbController.AssetKind, name string) (dbController.AssetDocument, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	asset, ok := mdbc.getAssetByName(kind, name)
+
+	if !ok {
+		return asset, dbController.NewNoResultsError("")
+	}
+
+	return asset, nil
+}
+
+func (mdbc *MemoryDbController) DeleteAsset(doc dbController.DeleteAssetDocument) (dbController.AssetDocument, error) {
+	if !isValidId(doc.Id) {
+		return dbController.AssetDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	asset, ok := mdbc.assets[doc.Id]
+
+	if !ok {
+		return asset, dbController.NewNoResultsError("")
+	}
+
+	delete(mdbc.assets, doc.Id)
+
+	return asset, nil
+}
+
+func (mdbc *MemoryDbController) CountAssetsWithSha256(sha256 string) (int, error) {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	count := 0
+	for _, asset := range mdbc.assets {
+		if len(sha256) > 0 && asset.Sha256 == sha256 {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (mdbc *MemoryDbController) AddRequestLog(log logging.RequestLogData) error {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	mdbc.requestLogs = append(mdbc.requestLogs, log)
+
+	if len(mdbc.requestLogs) > MAX_LOGS {
+		mdbc.requestLogs = mdbc.requestLogs[len(mdbc.requestLogs)-MAX_LOGS:]
+	}
+
+	return nil
+}
+
+func (mdbc *MemoryDbController) AddInfoLog(log logging.InfoLogData) error {
+	mdbc.mutex.Lock()
+	defer mdbc.mutex.Unlock()
+
+	mdbc.infoLogs = append(mdbc.infoLogs, log)
+
+	if len(mdbc.infoLogs) > MAX_LOGS {
+		mdbc.infoLogs = mdbc.infoLogs[len(mdbc.infoLogs)-MAX_LOGS:]
+	}
+
+	return nil
+}
+
+// Returns a copy of the request logs, oldest first
+func (mdbc *MemoryDbController) GetRequestLogs() []logging.RequestLogData {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	logs := make([]logging.RequestLogData, len(mdbc.requestLogs))
+	copy(logs, mdbc.requestLogs)
+
+	return logs
+}
+
+// Returns a copy of the info logs, oldest first
+func (mdbc *MemoryDbController) GetInfoLogs() []logging.InfoLogData {
+	mdbc.mutex.RLock()
+	defer mdbc.mutex.RUnlock()
+
+	logs := make([]logging.InfoLogData, len(mdbc.infoLogs))
+	copy(logs, mdbc.infoLogs)
+
+	return logs
+}
@@ -0,0 +1,432 @@
+package memoryDbController
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+func makeAddImageDocument(idName, filename string, dateAdded time.Time) dbController.AddImageDocument {
+	return dbController.AddImageDocument{
+		Title:    "title " + idName,
+		Filename: filename,
+		IdName:   idName,
+		Tags:     []string{"tag"},
+		SizeFormats: []imageHandler.ImageSizeFormat{
+			{
+				FormatName: "thumb",
+				Filename:   idName + "@thumb.jpg",
+				ImageSize:  imageHandler.ImageSize{Width: 128, Height: 96},
+				FileSize:   100,
+				Private:    false,
+				ImageType:  imageHandler.Jpeg,
+			},
+			{
+				FormatName: "original",
+				Filename:   idName + "@original.jpg",
+				ImageSize:  imageHandler.ImageSize{Width: 1024, Height: 768},
+				FileSize:   1000,
+				Private:    true,
+				ImageType:  imageHandler.Jpeg,
+			},
+		},
+		AuthorId:  "author",
+		DateAdded: dateAdded,
+	}
+}
+
+func TestAddAndGetImageData(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+	mdbc.AddUser(dbController.UserDataDocument{UID: "author", Name: "Test Author"})
+
+	id, err := mdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	public, err := mdbc.GetImageDataById(id, false)
+	if err != nil {
+		t.Fatalf("GetImageDataById returned error '%v'", err)
+	}
+	if len(public.ImageFiles) != 1 {
+		t.Fatalf("len(public.ImageFiles) = '%v', Should be '1'", len(public.ImageFiles))
+	}
+	if public.Author != "Test Author" {
+		t.Fatalf("public.Author = '%v', Should be 'Test Author'", public.Author)
+	}
+
+	private, _ := mdbc.GetImageDataById(id, true)
+	if len(private.ImageFiles) != 2 {
+		t.Fatalf("len(private.ImageFiles) = '%v', Should be '2'", len(private.ImageFiles))
+	}
+
+	file, err := mdbc.GetImageByName("abc@thumb.jpg")
+	if err != nil {
+		t.Fatalf("GetImageByName returned error '%v'", err)
+	}
+	if file.ImageId != id {
+		t.Fatalf("file.ImageId = '%v', Should be '%v'", file.ImageId, id)
+	}
+
+	if _, err := mdbc.AddImageData(makeAddImageDocument("abc", "b.jpg", time.Now())); err == nil {
+		t.Fatalf("AddImageData with a duplicate idName should return an error")
+	}
+
+	if _, err := mdbc.GetImageDataById("not an id", true); err == nil {
+		t.Fatalf("GetImageDataById with an invalid id should return an error")
+	} else if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err is '%T', Should be 'InvalidInputError'", err)
+	}
+}
+
+func TestAddImageDataOnTransactionError(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	doc := makeAddImageDocument("abc", "a.jpg", time.Now())
+	doc.OnTransaction = func(ctx context.Context) error {
+		return errors.New("transaction error")
+	}
+
+	if _, err := mdbc.AddImageData(doc); err == nil {
+		t.Fatalf("AddImageData should return the OnTransaction error")
+	}
+
+	if _, err := mdbc.GetImageByName("abc@thumb.jpg"); err == nil {
+		t.Fatalf("no image files should be saved when OnTransaction fails")
+	}
+}
+
+func TestReplaceImageFiles(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	id, err := mdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	before, _ := mdbc.GetImageByName("abc@thumb.jpg")
+
+	thumb := imageHandler.ImageSizeFormat{
+		FormatName: "thumb",
+		Filename:   "abc@thumb.jpg",
+		ImageSize:  imageHandler.ImageSize{Width: 96, Height: 128},
+		FileSize:   120,
+		ImageType:  imageHandler.Jpeg,
+		Sha256:     "def",
+	}
+
+	// A failing OnTransaction leaves the files unchanged
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     id,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+		OnTransaction: func(ctx context.Context) error {
+			return errors.New("transaction error")
+		},
+	})
+
+	if err == nil {
+		t.Fatalf("ReplaceImageFiles should return the OnTransaction error")
+	}
+
+	if file, _ := mdbc.GetImageByName("abc@thumb.jpg"); file.Sha256 != before.Sha256 {
+		t.Fatalf("file.Sha256 = '%v', Should be '%v'", file.Sha256, before.Sha256)
+	}
+
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     id,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+	})
+
+	if err != nil {
+		t.Fatalf("ReplaceImageFiles returned error '%v'", err)
+	}
+
+	file, _ := mdbc.GetImageByName("abc@thumb.jpg")
+
+	if file.Id != before.Id || file.ImageSize != thumb.ImageSize || file.FileSize != 120 || file.Sha256 != "def" {
+		t.Fatalf("file = '%v', Should have the new size and digest", file)
+	}
+
+	if file.Crop != nil || file.Encoding != nil || file.Capped {
+		t.Fatalf("file = '%v', Should not have a crop, encoding or cap", file)
+	}
+
+	// Files that were changed since they were read aren't replaced
+	stale := thumb
+	stale.Sha256 = "ghi"
+
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        id,
+		SizeFormats:    []imageHandler.ImageSizeFormat{stale},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": before.Sha256},
+	})
+
+	if _, ok := err.(dbController.ConflictError); !ok {
+		t.Fatalf("err = '%v', Should be a ConflictError", err)
+	}
+
+	if file, _ := mdbc.GetImageByName("abc@thumb.jpg"); file.Sha256 != "def" {
+		t.Fatalf("file.Sha256 = '%v', Should be 'def'", file.Sha256)
+	}
+
+	source := imageHandler.ImageSource{
+		Sha256:    imageHandler.HashBytes([]byte("source")),
+		ImageType: imageHandler.Png,
+		Transform: imageHandler.Transform{Rotate: 45, Flip: imageHandler.FlipVertical, Background: color.NRGBA{0, 0, 0, 255}},
+	}
+
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        id,
+		SizeFormats:    []imageHandler.ImageSizeFormat{stale},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": "def"},
+		Source:         &source,
+	})
+
+	if err != nil {
+		t.Fatalf("ReplaceImageFiles returned error '%v'", err)
+	}
+
+	if img, _ := mdbc.GetImageDataById(id, true); img.Source == nil || *img.Source != source {
+		t.Fatalf("img.Source = '%v', Should be '%v'", img.Source, source)
+	}
+
+	if count, err := mdbc.CountImageSourcesWithSha256(source.Sha256); err != nil || count != 1 {
+		t.Fatalf("count = '%v' err = '%v', Should be '1'", count, err)
+	}
+
+	if sources, err := mdbc.GetImageSources(); err != nil || len(sources) != 1 || sources[0] != source {
+		t.Fatalf("sources = '%v' err = '%v', Should be '%v'", sources, err, source)
+	}
+
+	// Files of other images can't be replaced
+	otherId, _ := mdbc.AddImageData(makeAddImageDocument("xyz", "x.jpg", time.Now()))
+
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     otherId,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+	})
+
+	if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err = '%v', Should be an InvalidInputError for another image's file", err)
+	}
+
+	err = mdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        otherId,
+		SizeFormats:    []imageHandler.ImageSizeFormat{thumb},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": "ghi"},
+	})
+
+	if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err = '%v', Should be an InvalidInputError for another image's file", err)
+	}
+}
+
+func TestSetImagePlaceholders(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	doc := makeAddImageDocument("abc", "a.jpg", time.Now())
+	doc.BlurHash = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+	doc.Lqip = "data:image/jpeg;base64,abc"
+
+	id, err := mdbc.AddImageData(doc)
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	img, _ := mdbc.GetImageDataById(id, true)
+	if img.BlurHash != doc.BlurHash || img.Lqip != doc.Lqip {
+		t.Fatalf("img = '%v', Should have the placeholders", img)
+	}
+
+	err = mdbc.SetImagePlaceholders(dbController.ImagePlaceholdersDocument{Id: id, BlurHash: "hash", Lqip: "data:image/jpeg;base64,def"})
+	if err != nil {
+		t.Fatalf("SetImagePlaceholders returned error '%v'", err)
+	}
+
+	images, _ := mdbc.GetImagesData(1, 10, dbController.MakeSortImageFilter(""))
+	if len(images) != 1 || images[0].BlurHash != "hash" || images[0].Lqip != "data:image/jpeg;base64,def" {
+		t.Fatalf("images = '%v', Should have the new placeholders", images)
+	}
+
+	err = mdbc.SetImagePlaceholders(dbController.ImagePlaceholdersDocument{Id: "00000000-0000-0000-0000-000000000000"})
+	if _, ok := err.(dbController.NoResultsError); !ok {
+		t.Fatalf("err = '%v', Should be a NoResultsError", err)
+	}
+}
+
+func TestGetImagesDataColorFilter(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	now := time.Now()
+
+	red := makeAddImageDocument("red", "red.jpg", now)
+	red.Palette = []imageHandler.PaletteColor{{Color: "#0000ff", Percentage: 60}, {Color: "#f01010", Percentage: 40}}
+	redId, _ := mdbc.AddImageData(red)
+
+	green := makeAddImageDocument("green", "green.jpg", now.Add(-1*time.Hour))
+	green.Palette = []imageHandler.PaletteColor{{Color: "#00ff00", Percentage: 100}}
+	mdbc.AddImageData(green)
+
+	// Images without a palette never match
+	mdbc.AddImageData(makeAddImageDocument("none", "none.jpg", now.Add(-2*time.Hour)))
+
+	img, _ := mdbc.GetImageDataById(redId, true)
+	if len(img.Palette) != 2 || img.Palette[1] != red.Palette[1] {
+		t.Fatalf("img.Palette = '%v', Should be '%v'", img.Palette, red.Palette)
+	}
+
+	redLab, _ := imageHandler.ParseLabColor("#ff0000")
+
+	filter := dbController.MakeSortImageFilter("")
+	filter.Color = &dbController.ColorFilter{Color: redLab, Distance: 10}
+
+	images, err := mdbc.GetImagesData(1, 10, filter)
+	if err != nil {
+		t.Fatalf("GetImagesData returned error '%v'", err)
+	}
+
+	if len(images) != 1 || images[0].Filename != "red.jpg" || len(images[0].Palette) != 2 {
+		t.Fatalf("images = '%v', Should only contain 'red.jpg' with its palette", images)
+	}
+
+	filter.Color.Distance = 1
+	images, _ = mdbc.GetImagesData(1, 10, filter)
+	if len(images) != 0 {
+		t.Fatalf("images = '%v', Should be empty", images)
+	}
+}
+
+func TestGetImagesDataSorting(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	now := time.Now()
+	mdbc.AddImageData(makeAddImageDocument("b", "B.jpg", now.Add(-2*time.Hour)))
+	mdbc.AddImageData(makeAddImageDocument("a", "a.jpg", now.Add(-1*time.Hour)))
+	mdbc.AddImageData(makeAddImageDocument("c", "c.jpg", now))
+
+	tests := []struct {
+		sortBy   string
+		expected []string
+	}{
+		{"name", []string{"a.jpg", "B.jpg", "c.jpg"}},
+		{"namereverse", []string{"c.jpg", "B.jpg", "a.jpg"}},
+		{"dateadded", []string{"c.jpg", "a.jpg", "B.jpg"}},
+		{"dateaddedreverse", []string{"B.jpg", "a.jpg", "c.jpg"}},
+	}
+
+	for _, test := range tests {
+		docs, _ := mdbc.GetImagesData(1, 10, dbController.MakeSortImageFilter(test.sortBy))
+
+		for i, doc := range docs {
+			if doc.Filename != test.expected[i] {
+				t.Fatalf("%v: docs[%v].Filename = '%v', Should be '%v'", test.sortBy, i, doc.Filename, test.expected[i])
+			}
+		}
+	}
+
+	page2, _ := mdbc.GetImagesData(2, 2, dbController.MakeSortImageFilter("name"))
+	if len(page2) != 1 || page2[0].Filename != "c.jpg" {
+		t.Fatalf("page 2 should only contain 'c.jpg'")
+	}
+}
+
+func TestDeleteImageFileCascade(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	id, _ := mdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	img, _ := mdbc.GetImageDataById(id, true)
+
+	mdbc.DeleteImageFile(dbController.DeleteImageFileDocument{Id: img.ImageFiles[0].Id})
+
+	if hasFiles, _ := mdbc.ImageHasFiles(id); !hasFiles {
+		t.Fatalf("image should still have one file")
+	}
+
+	deleted, err := mdbc.DeleteImageFile(dbController.DeleteImageFileDocument{Id: img.ImageFiles[1].Id})
+	if err != nil {
+		t.Fatalf("DeleteImageFile returned error '%v'", err)
+	}
+	if deleted.Filename != img.ImageFiles[1].Filename {
+		t.Fatalf("deleted.Filename = '%v', Should be '%v'", deleted.Filename, img.ImageFiles[1].Filename)
+	}
+
+	if _, err := mdbc.GetImageDataById(id, true); err == nil {
+		t.Fatalf("image should be deleted with its last image file")
+	}
+}
+
+func TestAssets(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+
+	doc := dbController.AddAssetDocument{
+		Kind:      dbController.WatermarkAsset,
+		Name:      "logo",
+		Filename:  "logo.png",
+		Sha256:    "abc",
+		FileSize:  10,
+		DateAdded: time.Now(),
+	}
+
+	id, err := mdbc.AddAsset(doc)
+	if err != nil {
+		t.Fatalf("AddAsset returned error '%v'", err)
+	}
+
+	if _, err := mdbc.AddAsset(doc); err == nil {
+		t.Fatalf("AddAsset with a duplicate name should return an error")
+	} else if _, ok := err.(dbController.DuplicateEntryError); !ok {
+		t.Fatalf("err is '%T', Should be 'DuplicateEntryError'", err)
+	}
+
+	asset, err := mdbc.GetAssetByName(dbController.WatermarkAsset, "logo")
+	if err != nil {
+		t.Fatalf("GetAssetByName returned error '%v'", err)
+	}
+	if asset.Id != id || asset.GetStorageName() != "abc.png" {
+		t.Fatalf("asset = '%v', Should have the id '%v' and storage name 'abc.png'", asset, id)
+	}
+
+	if count, _ := mdbc.CountAssetsWithSha256("abc"); count != 1 {
+		t.Fatalf("count = '%v', Should be '1'", count)
+	}
+
+	if assets, _ := mdbc.GetAssets(""); len(assets) != 1 {
+		t.Fatalf("len(assets) = '%v', Should be '1'", len(assets))
+	}
+
+	deleted, err := mdbc.DeleteAsset(dbController.DeleteAssetDocument{Id: id})
+	if err != nil {
+		t.Fatalf("DeleteAsset returned error '%v'", err)
+	}
+	if deleted.Name != "logo" {
+		t.Fatalf("deleted.Name = '%v', Should be 'logo'", deleted.Name)
+	}
+
+	if _, err := mdbc.GetAssetByName(dbController.WatermarkAsset, "logo"); err == nil {
+		t.Fatalf("the asset should be deleted")
+	}
+}
+
+func TestGetUserByUID(t *testing.T) {
+	mdbc := MakeMemoryDbController()
+	mdbc.AddUser(dbController.UserDataDocument{UID: "author", Name: "Test Author"})
+
+	user, err := mdbc.GetUserByUID("author")
+	if err != nil {
+		t.Fatalf("GetUserByUID returned error '%v'", err)
+	}
+	if user.Name != "Test Author" {
+		t.Fatalf("user.Name = '%v', Should be 'Test Author'", user.Name)
+	}
+
+	if _, err := mdbc.GetUserByUID("missing"); err == nil {
+		t.Fatalf("GetUserByUID should return an error for an unknown user")
+	} else if _, ok := err.(dbController.NoResultsError); !ok {
+		t.Fatalf("err is '%T', Should be 'NoResultsError'", err)
+	}
+}
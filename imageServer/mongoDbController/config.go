@@ -0,0 +1,249 @@
+package mongoDbController
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"methompson.com/image-microservice/imageServer/constants"
+)
+
+const DEFAULT_CONNECT_TIMEOUT = 10 * time.Second
+const DEFAULT_OPERATION_TIMEOUT = 5 * time.Second
+
+// MongoConfig holds the connection options for the MongoDB client. The
+// connection string is chosen in this order:
+// URI is a complete connection string, e.g. mongodb://localhost:27017
+// Hosts is a list of host:port values that are combined with the discrete
+// auth, TLS and replica set options below into a mongodb:// connection string
+// SrvUrl is the legacy MONGO_DB_URL value, which is used to build a
+// mongodb+srv:// connection string with the username and password
+type MongoConfig struct {
+	URI    string
+	Hosts  []string
+	SrvUrl string
+
+	Username      string
+	Password      string
+	AuthSource    string
+	AuthMechanism string
+	ReplicaSet    string
+
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertificateKeyFile string
+	TLSInsecure           bool
+
+	ConnectTimeout   time.Duration
+	OperationTimeout time.Duration
+	MaxPoolSize      uint64
+	MinPoolSize      uint64
+	MaxConnIdleTime  time.Duration
+
+	// Runs pending migrations in InitDatabase. See migrations.go
+	AutoMigrate bool
+}
+
+// Reads the MongoDB configuration from the environment. MONGO_DB_HOST may hold
+// several comma separated hosts. MONGO_DB_PORT is added to hosts without a
+// port. Timeouts are set in seconds.
+func GetMongoConfigFromEnv() (MongoConfig, error) {
+	config := MongoConfig{
+		URI:                   os.Getenv(constants.MONGO_DB_URI),
+		SrvUrl:                os.Getenv(constants.MONGO_DB_URL),
+		Username:              os.Getenv(constants.MONGO_DB_USERNAME),
+		Password:              os.Getenv(constants.MONGO_DB_PASSWORD),
+		AuthSource:            os.Getenv(constants.MONGO_DB_AUTH_SOURCE),
+		AuthMechanism:         os.Getenv(constants.MONGO_DB_AUTH_MECHANISM),
+		ReplicaSet:            os.Getenv(constants.MONGO_DB_REPLICA_SET),
+		TLS:                   os.Getenv(constants.MONGO_DB_TLS) == "true",
+		TLSCAFile:             os.Getenv(constants.MONGO_DB_TLS_CA_FILE),
+		TLSCertificateKeyFile: os.Getenv(constants.MONGO_DB_TLS_CERT_KEY_FILE),
+		TLSInsecure:           os.Getenv(constants.MONGO_DB_TLS_INSECURE) == "true",
+		ConnectTimeout:        DEFAULT_CONNECT_TIMEOUT,
+		OperationTimeout:      DEFAULT_OPERATION_TIMEOUT,
+		AutoMigrate:           os.Getenv(constants.MONGO_DB_AUTO_MIGRATE) != "false",
+	}
+
+	if hosts := os.Getenv(constants.MONGO_DB_HOST); len(hosts) > 0 {
+		port := os.Getenv(constants.MONGO_DB_PORT)
+
+		for _, host := range strings.Split(hosts, ",") {
+			config.Hosts = append(config.Hosts, addDefaultPort(strings.TrimSpace(host), port))
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		constants.MONGO_DB_CONNECT_TIMEOUT:    &config.ConnectTimeout,
+		constants.MONGO_DB_OPERATION_TIMEOUT:  &config.OperationTimeout,
+		constants.MONGO_DB_MAX_CONN_IDLE_TIME: &config.MaxConnIdleTime,
+	}
+
+	for name, duration := range durations {
+		value := os.Getenv(name)
+		if len(value) == 0 {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return config, NewEnvironmentVariableError(name + " must be a positive number of seconds")
+		}
+
+		*duration = time.Duration(seconds) * time.Second
+	}
+
+	sizes := map[string]*uint64{
+		constants.MONGO_DB_MAX_POOL_SIZE: &config.MaxPoolSize,
+		constants.MONGO_DB_MIN_POOL_SIZE: &config.MinPoolSize,
+	}
+
+	for name, size := range sizes {
+		value := os.Getenv(name)
+		if len(value) == 0 {
+			continue
+		}
+
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return config, NewEnvironmentVariableError(name + " must be a positive number")
+		}
+
+		*size = parsed
+	}
+
+	return config, nil
+}
+
+// Returns the connection string for the configuration
+func (mc MongoConfig) GetConnectionURI() (string, error) {
+	if len(mc.URI) > 0 {
+		return mc.URI, nil
+	}
+
+	if len(mc.Hosts) > 0 {
+		return mc.getHostsURI(), nil
+	}
+
+	return mc.getSrvURI()
+}
+
+// Adds the port to a host that doesn't have one. IPv6 literals, e.g. ::1 or
+// [::1], are returned in brackets so that they can be used in a URI.
+func addDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	hostname := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if len(port) > 0 {
+		return net.JoinHostPort(hostname, port)
+	}
+
+	if strings.Contains(hostname, ":") {
+		return "[" + hostname + "]"
+	}
+
+	return hostname
+}
+
+// Builds a mongodb:// connection string from the hosts and discrete options.
+// The username and password are optional, e.g. for a local mongod or when
+// authenticating with an X.509 certificate.
+func (mc MongoConfig) getHostsURI() string {
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   strings.Join(mc.Hosts, ","),
+		Path:   "/",
+	}
+
+	if len(mc.Username) > 0 && len(mc.Password) > 0 {
+		u.User = url.UserPassword(mc.Username, mc.Password)
+	} else if len(mc.Username) > 0 {
+		u.User = url.User(mc.Username)
+	}
+
+	query := url.Values{}
+
+	params := map[string]string{
+		"authSource":            mc.AuthSource,
+		"authMechanism":         mc.AuthMechanism,
+		"replicaSet":            mc.ReplicaSet,
+		"tlsCAFile":             mc.TLSCAFile,
+		"tlsCertificateKeyFile": mc.TLSCertificateKeyFile,
+	}
+
+	for key, value := range params {
+		if len(value) > 0 {
+			query.Set(key, value)
+		}
+	}
+
+	if mc.TLS || len(mc.TLSCAFile) > 0 || len(mc.TLSCertificateKeyFile) > 0 {
+		query.Set("tls", "true")
+	}
+
+	if mc.TLSInsecure {
+		query.Set("tlsInsecure", "true")
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// The legacy connection string, kept so that existing environments continue
+// to work. The username and password are required.
+func (mc MongoConfig) getSrvURI() (string, error) {
+	if len(mc.SrvUrl) == 0 {
+		msg := "MONGO_DB_URI, MONGO_DB_HOST or MONGO_DB_URL environment variable is required"
+		return "", NewEnvironmentVariableError(msg)
+	}
+
+	if len(mc.Username) == 0 {
+		msg := "MONGO_DB_USERNAME environment variable is required"
+		return "", NewEnvironmentVariableError(msg)
+	}
+
+	if len(mc.Password) == 0 {
+		msg := "MONGO_DB_PASSWORD environment variable is required"
+		return "", NewEnvironmentVariableError(msg)
+	}
+
+	return fmt.Sprintf("mongodb+srv://%v:%v@%v", mc.Username, mc.Password, mc.SrvUrl), nil
+}
+
+// Returns the client options for the connection string, timeouts and pool
+// settings.
+func (mc MongoConfig) GetClientOptions() (*options.ClientOptions, error) {
+	uri, err := mc.GetConnectionURI()
+
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := options.Client().
+		ApplyURI(uri).
+		SetConnectTimeout(mc.ConnectTimeout)
+
+	if mc.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(mc.MaxPoolSize)
+	}
+
+	if mc.MinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(mc.MinPoolSize)
+	}
+
+	if mc.MaxConnIdleTime > 0 {
+		clientOptions.SetMaxConnIdleTime(mc.MaxConnIdleTime)
+	}
+
+	return clientOptions, clientOptions.Validate()
+}
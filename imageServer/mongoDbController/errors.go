@@ -5,3 +5,9 @@ type EnvironmentVariableError struct{ ErrMsg string }
 
 func (err EnvironmentVariableError) Error() string { return err.ErrMsg }
 func NewEnvironmentVariableError(msg string) error { return EnvironmentVariableError{msg} }
+
+// Used when the database schema version doesn't match the migrations
+type SchemaVersionError struct{ ErrMsg string }
+
+func (err SchemaVersionError) Error() string { return err.ErrMsg }
+func NewSchemaVersionError(msg string) error { return SchemaVersionError{msg} }
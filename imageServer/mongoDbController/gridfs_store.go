@@ -0,0 +1,401 @@
+package mongoDbController
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// The GridFS bucket name. The files and chunks collections are named
+// imageFs.files and imageFs.chunks.
+const GRIDFS_BUCKET = "imageFs"
+
+// The default chunk size defined by the GridFS spec
+const GRIDFS_CHUNK_SIZE = 255 * 1024
+
+// GridFSStore keeps image files in a GridFS bucket in the image database.
+// Files are keyed by the same filename that the imageFiles collection uses.
+// The store reads and writes the GridFS collections directly rather than
+// using the driver's gridfs package, because that package can't take part
+// in a session. Use WithContext to get a store that performs its operations
+// inside of a transaction.
+type GridFSStore struct {
+	mdbc *MongoDbController
+}
+
+type gridFSFileDoc struct {
+	Id         primitive.ObjectID `bson:"_id"`
+	Length     int64              `bson:"length"`
+	ChunkSize  int32              `bson:"chunkSize"`
+	UploadDate time.Time          `bson:"uploadDate"`
+	Filename   string             `bson:"filename"`
+}
+
+type gridFSChunkDoc struct {
+	Id      primitive.ObjectID `bson:"_id"`
+	FilesId primitive.ObjectID `bson:"files_id"`
+	N       int32              `bson:"n"`
+	Data    []byte             `bson:"data"`
+}
+
+// Makes a GridFSStore that uses the MongoDbController's client and database
+// and makes sure that the bucket's indexes exist.
+func MakeGridFSStore(mdbc *MongoDbController) (*GridFSStore, error) {
+	store := &GridFSStore{mdbc}
+
+	if err := store.initIndexes(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// We use a unique index on the filename, because we only ever keep one
+// revision of a file. The chunk index is the one required by the GridFS spec.
+func (gs *GridFSStore) initIndexes() error {
+	ctx, cancel := gs.mdbc.getContext()
+	defer cancel()
+
+	filesIndex := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "filename", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+
+	_, err := gs.filesCollection().Indexes().CreateMany(ctx, filesIndex)
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	chunksIndex := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "files_id", Value: 1}, {Key: "n", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+
+	_, err = gs.chunksCollection().Indexes().CreateMany(ctx, chunksIndex)
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+func (gs *GridFSStore) filesCollection() *mongo.Collection {
+	return gs.mdbc.MongoClient.Database(gs.mdbc.dbName).Collection(GRIDFS_BUCKET + ".files")
+}
+
+func (gs *GridFSStore) chunksCollection() *mongo.Collection {
+	return gs.mdbc.MongoClient.Database(gs.mdbc.dbName).Collection(GRIDFS_BUCKET + ".chunks")
+}
+
+// Returns a FileStore that runs all operations with ctx. If ctx is a
+// mongo.SessionContext with an active transaction, e.g. the one passed to
+// AddImageDocument.OnTransaction, the writes become part of that transaction.
+func (gs *GridFSStore) WithContext(ctx context.Context) imageHandler.FileStore {
+	return &gridFSContextStore{gs, ctx}
+}
+
+func (gs *GridFSStore) getContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 30*time.Second)
+}
+
+func (gs *GridFSStore) Put(filename string, data []byte) error {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.putWithContext(ctx, filename, data)
+}
+
+func (gs *GridFSStore) Get(filename string) ([]byte, error) {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.getWithContext(ctx, filename)
+}
+
+func (gs *GridFSStore) Stat(filename string) (imageHandler.FileInfo, error) {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.statWithContext(ctx, filename)
+}
+
+func (gs *GridFSStore) Delete(filename string) error {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.deleteWithContext(ctx, filename)
+}
+
+func (gs *GridFSStore) Move(oldFilename, newFilename string) error {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.moveWithContext(ctx, oldFilename, newFilename)
+}
+
+func (gs *GridFSStore) Stream(filename string) (io.ReadCloser, imageHandler.FileInfo, error) {
+	ctx, cancel := gs.getContext()
+	defer cancel()
+
+	return gs.streamWithContext(ctx, filename)
+}
+
+// Writes the chunks first and the files document last, as the GridFS spec
+// requires. Any existing file with the same name is replaced.
+func (gs *GridFSStore) putWithContext(ctx context.Context, filename string, data []byte) error {
+	err := gs.deleteWithContext(ctx, filename)
+
+	if _, notFound := err.(imageHandler.FileNotFoundError); err != nil && !notFound {
+		return err
+	}
+
+	fileId := primitive.NewObjectID()
+
+	chunks := make([]interface{}, 0)
+	for n := 0; n*GRIDFS_CHUNK_SIZE < len(data); n++ {
+		start := n * GRIDFS_CHUNK_SIZE
+		end := start + GRIDFS_CHUNK_SIZE
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunks = append(chunks, gridFSChunkDoc{
+			Id:      primitive.NewObjectID(),
+			FilesId: fileId,
+			N:       int32(n),
+			Data:    data[start:end],
+		})
+	}
+
+	if len(chunks) > 0 {
+		if _, err := gs.chunksCollection().InsertMany(ctx, chunks); err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+	}
+
+	_, err = gs.filesCollection().InsertOne(ctx, gridFSFileDoc{
+		Id:         fileId,
+		Length:     int64(len(data)),
+		ChunkSize:  GRIDFS_CHUNK_SIZE,
+		UploadDate: time.Now(),
+		Filename:   filename,
+	})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Walks the files collection. Walks read the whole collection, so they get
+// SCAN_TIMEOUT instead of the regular GridFS timeout.
+func (gs *GridFSStore) Walk(fn func(info imageHandler.FileInfo) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
+	defer cancel()
+
+	cursor, err := gs.filesCollection().Find(ctx, bson.M{})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var fileDoc gridFSFileDoc
+
+		if err := cursor.Decode(&fileDoc); err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+
+		if err := fn(fileDoc.getFileInfo()); err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+func (gs *GridFSStore) findFileDoc(ctx context.Context, filename string) (gridFSFileDoc, error) {
+	var fileDoc gridFSFileDoc
+
+	err := gs.filesCollection().FindOne(ctx, bson.M{"filename": filename}).Decode(&fileDoc)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fileDoc, imageHandler.NewFileNotFoundError("file not found: " + filename)
+		}
+		return fileDoc, dbController.NewDBError(err.Error())
+	}
+
+	return fileDoc, nil
+}
+
+// Reads all chunks of the file in order and joins them together
+func (gs *GridFSStore) getWithContext(ctx context.Context, filename string) ([]byte, error) {
+	fileDoc, err := gs.findFileDoc(ctx, filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := gs.chunksCollection().Find(
+		ctx,
+		bson.M{"files_id": fileDoc.Id},
+		options.Find().SetSort(bson.D{{Key: "n", Value: 1}}),
+	)
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	var chunks []gridFSChunkDoc
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	data := make([]byte, 0, fileDoc.Length)
+	for i, chunk := range chunks {
+		if chunk.N != int32(i) {
+			return nil, dbController.NewDBError("missing chunk for file " + filename)
+		}
+
+		data = append(data, chunk.Data...)
+	}
+
+	if int64(len(data)) != fileDoc.Length {
+		return nil, dbController.NewDBError("incomplete file " + filename)
+	}
+
+	return data, nil
+}
+
+func (gs *GridFSStore) statWithContext(ctx context.Context, filename string) (imageHandler.FileInfo, error) {
+	fileDoc, err := gs.findFileDoc(ctx, filename)
+
+	if err != nil {
+		return imageHandler.FileInfo{}, err
+	}
+
+	return fileDoc.getFileInfo(), nil
+}
+
+func (gs *GridFSStore) deleteWithContext(ctx context.Context, filename string) error {
+	fileDoc, err := gs.findFileDoc(ctx, filename)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := gs.filesCollection().DeleteOne(ctx, bson.M{"_id": fileDoc.Id}); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	if _, err := gs.chunksCollection().DeleteMany(ctx, bson.M{"files_id": fileDoc.Id}); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Renaming only requires changing the files document. The unique index
+// prevents us from overwriting an existing file.
+func (gs *GridFSStore) moveWithContext(ctx context.Context, oldFilename, newFilename string) error {
+	result, err := gs.filesCollection().UpdateOne(
+		ctx,
+		bson.M{"filename": oldFilename},
+		bson.M{"$set": bson.M{"filename": newFilename}},
+	)
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	if result.MatchedCount == 0 {
+		return imageHandler.NewFileNotFoundError("file not found: " + oldFilename)
+	}
+
+	return nil
+}
+
+// Image files are small enough to read into memory, which also lets us
+// return a reader that can seek.
+func (gs *GridFSStore) streamWithContext(ctx context.Context, filename string) (io.ReadCloser, imageHandler.FileInfo, error) {
+	fileDoc, err := gs.findFileDoc(ctx, filename)
+
+	if err != nil {
+		return nil, imageHandler.FileInfo{}, err
+	}
+
+	data, err := gs.getWithContext(ctx, filename)
+
+	if err != nil {
+		return nil, imageHandler.FileInfo{}, err
+	}
+
+	return gridFSReader{bytes.NewReader(data)}, fileDoc.getFileInfo(), nil
+}
+
+func (fd gridFSFileDoc) getFileInfo() imageHandler.FileInfo {
+	return imageHandler.FileInfo{
+		Filename: fd.Filename,
+		Size:     fd.Length,
+		ModTime:  fd.UploadDate,
+	}
+}
+
+type gridFSReader struct {
+	*bytes.Reader
+}
+
+func (gridFSReader) Close() error { return nil }
+
+// A GridFSStore bound to a specific context. See GridFSStore.WithContext
+type gridFSContextStore struct {
+	store *GridFSStore
+	ctx   context.Context
+}
+
+func (gcs *gridFSContextStore) Put(filename string, data []byte) error {
+	return gcs.store.putWithContext(gcs.ctx, filename, data)
+}
+
+func (gcs *gridFSContextStore) Get(filename string) ([]byte, error) {
+	return gcs.store.getWithContext(gcs.ctx, filename)
+}
+
+func (gcs *gridFSContextStore) Stat(filename string) (imageHandler.FileInfo, error) {
+	return gcs.store.statWithContext(gcs.ctx, filename)
+}
+
+func (gcs *gridFSContextStore) Delete(filename string) error {
+	return gcs.store.deleteWithContext(gcs.ctx, filename)
+}
+
+func (gcs *gridFSContextStore) Move(oldFilename, newFilename string) error {
+	return gcs.store.moveWithContext(gcs.ctx, oldFilename, newFilename)
+}
+
+func (gcs *gridFSContextStore) Stream(filename string) (io.ReadCloser, imageHandler.FileInfo, error) {
+	return gcs.store.streamWithContext(gcs.ctx, filename)
+}
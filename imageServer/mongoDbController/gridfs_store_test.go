@@ -0,0 +1,264 @@
+package mongoDbController
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// The GridFS tests need a running MongoDB server and are skipped unless
+// MONGO_TEST_URI is set, e.g. to mongodb://localhost:27017/?replicaSet=rs0.
+// Transactions require a replica set. Each test uses its own database, which
+// is dropped afterwards.
+const MONGO_TEST_URI = "MONGO_TEST_URI"
+
+func makeTestGridFSStore(t *testing.T) (*MongoDbController, *GridFSStore) {
+	uri := os.Getenv(MONGO_TEST_URI)
+	if len(uri) == 0 {
+		t.Skipf("%v is not set", MONGO_TEST_URI)
+	}
+
+	dbName := "imageServerTest" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	mdbc, err := MakeMongoDbControllerWithConfig(dbName, MongoConfig{URI: uri, AutoMigrate: true})
+	if err != nil {
+		t.Fatalf("MakeMongoDbControllerWithConfig returned error '%v'", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := mdbc.getContext()
+		defer cancel()
+
+		mdbc.MongoClient.Database(dbName).Drop(ctx)
+		mdbc.MongoClient.Disconnect(ctx)
+	})
+
+	store, err := MakeGridFSStore(mdbc)
+	if err != nil {
+		t.Fatalf("MakeGridFSStore returned error '%v'", err)
+	}
+
+	return mdbc, store
+}
+
+// Returns the data of every chunk of the file in order
+func getTestChunks(t *testing.T, store *GridFSStore, filename string) [][]byte {
+	ctx, cancel := store.getContext()
+	defer cancel()
+
+	fileDoc, err := store.findFileDoc(ctx, filename)
+	if err != nil {
+		t.Fatalf("findFileDoc returned error '%v'", err)
+	}
+
+	return getTestChunksById(t, store, fileDoc.Id)
+}
+
+func getTestChunksById(t *testing.T, store *GridFSStore, filesId interface{}) [][]byte {
+	ctx, cancel := store.getContext()
+	defer cancel()
+
+	cursor, err := store.chunksCollection().Find(ctx, bson.M{"files_id": filesId})
+	if err != nil {
+		t.Fatalf("Find returned error '%v'", err)
+	}
+
+	var chunks []gridFSChunkDoc
+	if err := cursor.All(ctx, &chunks); err != nil {
+		t.Fatalf("All returned error '%v'", err)
+	}
+
+	data := make([][]byte, len(chunks))
+	for _, chunk := range chunks {
+		data[chunk.N] = chunk.Data
+	}
+
+	return data
+}
+
+func TestGridFSStoreChunks(t *testing.T) {
+	_, store := makeTestGridFSStore(t)
+
+	data := bytes.Repeat([]byte("0123456789"), GRIDFS_CHUNK_SIZE/4)
+
+	if err := store.Put("large.jpg", data); err != nil {
+		t.Fatalf("Put returned error '%v'", err)
+	}
+
+	chunks := getTestChunks(t, store, "large.jpg")
+
+	if len(chunks) != 3 {
+		t.Fatalf("len(chunks) = '%v', Should be '3'", len(chunks))
+	}
+
+	if len(chunks[0]) != GRIDFS_CHUNK_SIZE || len(chunks[2]) != len(data)-2*GRIDFS_CHUNK_SIZE {
+		t.Fatalf("chunk sizes = '%v', '%v', Should be '%v', '%v'", len(chunks[0]), len(chunks[2]), GRIDFS_CHUNK_SIZE, len(data)-2*GRIDFS_CHUNK_SIZE)
+	}
+
+	got, err := store.Get("large.jpg")
+	if err != nil {
+		t.Fatalf("Get returned error '%v'", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Get should return the data that was put")
+	}
+
+	if err := store.Put("empty.jpg", []byte{}); err != nil {
+		t.Fatalf("Put returned error '%v'", err)
+	}
+
+	if got, err := store.Get("empty.jpg"); err != nil || len(got) != 0 {
+		t.Fatalf("Get = '%v' err = '%v', Should be empty", got, err)
+	}
+}
+
+func TestGridFSStorePutReplaces(t *testing.T) {
+	_, store := makeTestGridFSStore(t)
+
+	store.Put("abc.jpg", bytes.Repeat([]byte("a"), GRIDFS_CHUNK_SIZE+1))
+
+	ctx, cancel := store.getContext()
+	oldDoc, _ := store.findFileDoc(ctx, "abc.jpg")
+	cancel()
+
+	if err := store.Put("abc.jpg", []byte("new")); err != nil {
+		t.Fatalf("Put returned error '%v'", err)
+	}
+
+	if got, _ := store.Get("abc.jpg"); string(got) != "new" {
+		t.Fatalf("Get = '%v', Should be 'new'", string(got))
+	}
+
+	if chunks := getTestChunksById(t, store, oldDoc.Id); len(chunks) != 0 {
+		t.Fatalf("len(old chunks) = '%v', Should be '0'", len(chunks))
+	}
+
+	ctx, cancel = store.getContext()
+	defer cancel()
+
+	count, err := store.filesCollection().CountDocuments(ctx, bson.M{"filename": "abc.jpg"})
+	if err != nil || count != 1 {
+		t.Fatalf("count = '%v' err = '%v', Should be '1'", count, err)
+	}
+}
+
+func TestGridFSStoreMove(t *testing.T) {
+	_, store := makeTestGridFSStore(t)
+
+	store.Put("abc.jpg", []byte("abc"))
+	store.Put("def.jpg", []byte("def"))
+
+	if err := store.Move("abc.jpg", "ghi.jpg"); err != nil {
+		t.Fatalf("Move returned error '%v'", err)
+	}
+
+	if got, _ := store.Get("ghi.jpg"); string(got) != "abc" {
+		t.Fatalf("Get = '%v', Should be 'abc'", string(got))
+	}
+
+	if _, err := store.Stat("abc.jpg"); err == nil {
+		t.Fatalf("Stat of the old name should return an error after Move")
+	}
+
+	if err := store.Move("ghi.jpg", "def.jpg"); err == nil {
+		t.Fatalf("Move should not overwrite an existing file")
+	}
+
+	if got, _ := store.Get("def.jpg"); string(got) != "def" {
+		t.Fatalf("Get = '%v', Should be 'def'", string(got))
+	}
+
+	if _, ok := store.Move("missing.jpg", "jkl.jpg").(imageHandler.FileNotFoundError); !ok {
+		t.Fatalf("Move of a missing file should return a FileNotFoundError")
+	}
+}
+
+func TestGridFSStoreDelete(t *testing.T) {
+	_, store := makeTestGridFSStore(t)
+
+	store.Put("abc.jpg", bytes.Repeat([]byte("a"), GRIDFS_CHUNK_SIZE+1))
+
+	ctx, cancel := store.getContext()
+	fileDoc, _ := store.findFileDoc(ctx, "abc.jpg")
+	cancel()
+
+	if err := store.Delete("abc.jpg"); err != nil {
+		t.Fatalf("Delete returned error '%v'", err)
+	}
+
+	if _, err := store.Get("abc.jpg"); err == nil {
+		t.Fatalf("Get should return an error after Delete")
+	}
+
+	if chunks := getTestChunksById(t, store, fileDoc.Id); len(chunks) != 0 {
+		t.Fatalf("len(chunks) = '%v', Should be '0'", len(chunks))
+	}
+
+	if _, ok := store.Delete("abc.jpg").(imageHandler.FileNotFoundError); !ok {
+		t.Fatalf("Delete of a missing file should return a FileNotFoundError")
+	}
+}
+
+// Files that are copied from the memory store inside of a transaction are
+// gone when the transaction is aborted, and kept when it commits.
+func TestGridFSStoreStagedCopies(t *testing.T) {
+	mdbc, store := makeTestGridFSStore(t)
+
+	if _, err := mdbc.RunMigrations(); err != nil {
+		t.Fatalf("RunMigrations returned error '%v'", err)
+	}
+
+	staged := imageHandler.MakeMemoryFileStore()
+	staged.Put("abc.jpg", []byte("abc"))
+
+	output := imageHandler.ImageConversionResult{NewFiles: []string{"abc.jpg"}}
+	doc := dbController.AddImageDocument{
+		Title:    "abc",
+		Filename: "abc.jpg",
+		IdName:   "abc",
+		SizeFormats: []imageHandler.ImageSizeFormat{
+			{FormatName: "original", Filename: "abc.jpg", ImageType: imageHandler.Jpeg},
+		},
+		Tags:      []string{},
+		DateAdded: time.Now(),
+	}
+
+	abortErr := errors.New("abort")
+	doc.OnTransaction = func(ctx context.Context) error {
+		if _, err := imageHandler.CopyFiles(output, staged, store.WithContext(ctx)); err != nil {
+			return err
+		}
+
+		return abortErr
+	}
+
+	if _, err := mdbc.AddImageData(doc); !errors.Is(err, abortErr) {
+		t.Fatalf("AddImageData returned error '%v', Should be '%v'", err, abortErr)
+	}
+
+	if _, err := store.Stat("abc.jpg"); err == nil {
+		t.Fatalf("the copy should be rolled back with the transaction")
+	}
+
+	doc.OnTransaction = func(ctx context.Context) error {
+		_, err := imageHandler.CopyFiles(output, staged, store.WithContext(ctx))
+		return err
+	}
+
+	if _, err := mdbc.AddImageData(doc); err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	if got, _ := store.Get("abc.jpg"); string(got) != "abc" {
+		t.Fatalf("Get = '%v', Should be 'abc'", string(got))
+	}
+}
@@ -0,0 +1,371 @@
+package mongoDbController
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+// The collection that records which migrations have been applied. Each
+// document's _id is the migration's version.
+const MIGRATION_COLLECTION = "migrations"
+
+// Migrations can include data backfills, so they get more time than regular
+// operations.
+const MIGRATION_TIMEOUT = 5 * time.Minute
+
+// A migration moves the database from version-1 to version. Migrations should
+// be idempotent, since a migration that fails partway will run again.
+type migration struct {
+	version     int
+	description string
+	up          func(mdbc *MongoDbController, ctx context.Context) error
+}
+
+type migrationDoc struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// All migrations in the order they're applied. Versions must start at 1 and
+// increase by 1. Never change a migration that has been released, add a new
+// one instead.
+//
+// Validators aren't changed by migrations. syncValidators runs after the
+// migrations every time they run, so changes to the schemas in schemas.go only
+// need a migration when existing documents have to change as well.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create the image, image file and logging collections",
+		up:          createCollections,
+	},
+	{
+		version:     2,
+		description: "index image files by imageId",
+		up:          indexImageFilesByImageId,
+	},
+	{
+		version:     3,
+		description: "index image files by sha256",
+		up:          indexImageFilesBySha256,
+	},
+	{
+		version:     4,
+		description: "create the asset collection",
+		up:          createAssetCollection,
+	},
+	{
+		version:     5,
+		description: "index image palettes by Lab color",
+		up:          indexImagePalettes,
+	},
+	{
+		version:     6,
+		description: "index images by source sha256",
+		up:          indexImageSources,
+	},
+}
+
+// Returns the version of the newest migration that this binary knows about
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func (mdbc *MongoDbController) getMigrationCollection() *mongo.Collection {
+	return mdbc.MongoClient.Database(mdbc.dbName).Collection(MIGRATION_COLLECTION)
+}
+
+// Returns the version of the newest migration that was applied to the
+// database, or 0 if no migrations were applied.
+func (mdbc *MongoDbController) GetSchemaVersion() (int, error) {
+	ctx, cancel := mdbc.getContext()
+	defer cancel()
+
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+
+	var doc migrationDoc
+	err := mdbc.getMigrationCollection().FindOne(ctx, bson.M{}, opts).Decode(&doc)
+
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	} else if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return doc.Version, nil
+}
+
+// Returns an error if the database doesn't match the binary's schema version
+func (mdbc *MongoDbController) CheckSchemaVersion() error {
+	version, err := mdbc.GetSchemaVersion()
+
+	if err != nil {
+		return err
+	}
+
+	return checkSchemaVersion(version, false)
+}
+
+// A database that is ahead of the binary was migrated by a newer release. We
+// can't know whether the data is still compatible, so we refuse to use it. A
+// database that is behind is only an error when we aren't going to migrate it.
+func checkSchemaVersion(version int, willMigrate bool) error {
+	latest := LatestSchemaVersion()
+
+	if version > latest {
+		msg := fmt.Sprintf("database schema version %v is newer than the latest supported version %v", version, latest)
+		return NewSchemaVersionError(msg)
+	}
+
+	if version < latest && !willMigrate {
+		msg := fmt.Sprintf("database schema version %v is older than version %v. Run the migrate command", version, latest)
+		return NewSchemaVersionError(msg)
+	}
+
+	return nil
+}
+
+// Returns the migrations that haven't been applied to a database at version
+func getPendingMigrations(version int) []migration {
+	pending := make([]migration, 0)
+
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+// Applies all pending migrations in order and returns the versions that were
+// applied. Each version is recorded as soon as its migration succeeds, so a
+// failure leaves the database at the last successful version. The validators
+// are synced with the current schemas afterwards, even when no migrations were
+// pending.
+func (mdbc *MongoDbController) RunMigrations() ([]int, error) {
+	applied := make([]int, 0)
+
+	version, err := mdbc.GetSchemaVersion()
+
+	if err != nil {
+		return applied, err
+	}
+
+	if err := checkSchemaVersion(version, true); err != nil {
+		return applied, err
+	}
+
+	for _, m := range getPendingMigrations(version) {
+		if err := mdbc.runMigration(m); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, m.version)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), MIGRATION_TIMEOUT)
+	defer cancel()
+
+	return applied, syncValidators(mdbc, ctx)
+}
+
+func (mdbc *MongoDbController) runMigration(m migration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), MIGRATION_TIMEOUT)
+	defer cancel()
+
+	if err := m.up(mdbc, ctx); err != nil {
+		msg := fmt.Sprintf("migration %v (%v) failed: %v", m.version, m.description, err.Error())
+		return dbController.NewDBError(msg)
+	}
+
+	_, err := mdbc.getMigrationCollection().InsertOne(ctx, migrationDoc{
+		Version:     m.version,
+		Description: m.description,
+		AppliedAt:   time.Now(),
+	})
+
+	// Another instance may have run the same migration at the same time. The
+	// migrations are idempotent, so we only need one record.
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Replaces the validator of an existing collection
+func (mdbc *MongoDbController) setValidator(ctx context.Context, collectionName string, schema bson.M) error {
+	command := bson.D{
+		{Key: "collMod", Value: collectionName},
+		{Key: "validator", Value: bson.M{"$jsonSchema": schema}},
+	}
+
+	err := mdbc.MongoClient.Database(mdbc.dbName).RunCommand(ctx, command).Err()
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+/****************************************************************************************
+* Migrations
+****************************************************************************************/
+
+// Databases created before migrations existed already have these collections,
+// so we ignore errors for collections that exist.
+func createCollections(mdbc *MongoDbController, ctx context.Context) error {
+	inits := []func(dbName string) error{
+		mdbc.initImageCollection,
+		mdbc.initImageFileCollection,
+		mdbc.initLoggingCollection,
+	}
+
+	for _, initCollection := range inits {
+		err := initCollection(mdbc.dbName)
+
+		if err != nil && !strings.Contains(err.Error(), "Collection already exists") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces the validators of the collections with the schemas of this binary.
+// This isn't a migration: it runs after every migration run, so collections
+// created by older releases, or before migrations existed, always get the
+// current validators. The validators are replaced as a whole, so running it
+// again has no effect.
+func syncValidators(mdbc *MongoDbController, ctx context.Context) error {
+	for collectionName, schema := range getValidators() {
+		if err := mdbc.setValidator(ctx, collectionName, schema); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The schema of every collection that has a validator
+func getValidators() map[string]bson.M {
+	return map[string]bson.M{
+		IMAGE_COLLECTION:      getImageSchema(),
+		IMAGE_FILE_COLLECTION: getImageFileSchema(),
+		ASSET_COLLECTION:      getAssetSchema(),
+		LOGGING_COLLECTION:    getLoggingSchema(),
+	}
+}
+
+// Image files are looked up by imageId when getting and deleting images
+func indexImageFilesByImageId(mdbc *MongoDbController, ctx context.Context) error {
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"imageId": 1},
+	})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Image files are stored under their SHA-256 digest and are counted by digest
+// before a stored file is deleted. Existing image files have no digest and keep
+// using their filename, so the digests are optional.
+func indexImageFilesBySha256(mdbc *MongoDbController, ctx context.Context) error {
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"sha256": 1},
+	})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Assets are uploaded files that conversion operations use, like watermarks.
+// Names are unique for each kind of asset and asset files are counted by
+// digest, like image files.
+func createAssetCollection(mdbc *MongoDbController, ctx context.Context) error {
+	db := mdbc.MongoClient.Database(mdbc.dbName)
+
+	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": getAssetSchema()})
+	err := db.CreateCollection(ctx, ASSET_COLLECTION, colOpts)
+
+	if err != nil && !strings.Contains(err.Error(), "Collection already exists") {
+		return dbController.NewDBError(err.Error())
+	}
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"sha256": 1},
+		},
+	}
+
+	_, err = db.Collection(ASSET_COLLECTION).Indexes().CreateMany(ctx, indexes)
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Images are filtered by color with a box around the color in the Lab color
+// space. The palette colors of an image share one array, so the compound
+// index can bound all three components of the same color.
+func indexImagePalettes(mdbc *MongoDbController, ctx context.Context) error {
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_COLLECTION)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "palette.l", Value: 1},
+			{Key: "palette.a", Value: 1},
+			{Key: "palette.b", Value: 1},
+		},
+	})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// The source files of transformed images are counted by digest before a stored
+// file is deleted, like image files. Images that were never transformed have
+// no source.
+func indexImageSources(mdbc *MongoDbController, ctx context.Context) error {
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_COLLECTION)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"source.sha256": 1},
+	})
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package mongoDbController
+
+import (
+	"testing"
+)
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migrations[%v].version = '%v', Should be '%v'", i, m.version, i+1)
+		}
+
+		if m.up == nil {
+			t.Fatalf("migration %v has no up function", m.version)
+		}
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	latest := LatestSchemaVersion()
+
+	if err := checkSchemaVersion(latest, false); err != nil {
+		t.Fatalf("the latest version should be valid, got '%v'", err)
+	}
+
+	if _, ok := checkSchemaVersion(latest+1, true).(SchemaVersionError); !ok {
+		t.Fatalf("a database ahead of the binary should return a SchemaVersionError")
+	}
+
+	if _, ok := checkSchemaVersion(latest-1, false).(SchemaVersionError); !ok {
+		t.Fatalf("an older database should return a SchemaVersionError when not migrating")
+	}
+
+	if err := checkSchemaVersion(0, true); err != nil {
+		t.Fatalf("an older database should be valid when migrating, got '%v'", err)
+	}
+}
+
+func TestGetPendingMigrations(t *testing.T) {
+	pending := getPendingMigrations(1)
+
+	if len(pending) != len(migrations)-1 {
+		t.Fatalf("len(pending) = '%v', Should be '%v'", len(pending), len(migrations)-1)
+	}
+
+	if pending[0].version != 2 {
+		t.Fatalf("pending[0].version = '%v', Should be '2'", pending[0].version)
+	}
+
+	if len(getPendingMigrations(LatestSchemaVersion())) != 0 {
+		t.Fatalf("there should be no pending migrations at the latest version")
+	}
+}
+
+func TestGetValidators(t *testing.T) {
+	validators := getValidators()
+
+	collections := []string{
+		IMAGE_COLLECTION,
+		IMAGE_FILE_COLLECTION,
+		ASSET_COLLECTION,
+		LOGGING_COLLECTION,
+	}
+
+	for _, name := range collections {
+		if validators[name] == nil {
+			t.Fatalf("the %v collection should have a validator", name)
+		}
+	}
+}
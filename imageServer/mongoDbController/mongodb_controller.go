@@ -3,7 +3,6 @@ package mongoDbController
 import (
 	"context"
 	"errors"
-	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,9 +15,20 @@ import (
 	"methompson.com/image-microservice/imageServer/logging"
 )
 
+// Operations that read whole collections, e.g. GetAllImageFiles, get more time
+// than regular operations.
+const SCAN_TIMEOUT = 5 * time.Minute
+
 type MongoDbController struct {
-	MongoClient *mongo.Client
-	dbName      string
+	MongoClient      *mongo.Client
+	dbName           string
+	operationTimeout time.Duration
+	autoMigrate      bool
+}
+
+// Returns a context that times out after the configured operation timeout
+func (mdbc *MongoDbController) getContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), mdbc.operationTimeout)
 }
 
 // getCollection is a convenience function that performs a function used regularly
@@ -28,7 +38,7 @@ type MongoDbController struct {
 func (mdbc *MongoDbController) getCollection(collectionName string) (*mongo.Collection, context.Context, context.CancelFunc) {
 	// Write the hash to the database
 	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(collectionName)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := mdbc.getContext()
 
 	return collection, ctx, cancel
 }
@@ -40,67 +50,8 @@ func (mdbc *MongoDbController) getCollection(collectionName string) (*mongo.Coll
 func (mdbc *MongoDbController) initImageFileCollection(dbName string) error {
 	db := mdbc.MongoClient.Database(dbName)
 
-	// We define a schema here for image file documents
-	jsonSchema := bson.M{
-		"bsonType": "object",
-		"required": []string{
-			"imageId",
-			"imageIdName",
-			"formatName",
-			"imageType",
-			"filename",
-			"imageSize",
-			"fileSize",
-			"private",
-		},
-		"properties": bson.M{
-			"imageId": bson.M{
-				"bsonType":    "objectId",
-				"description": "id of the image document to which this image belongs",
-			},
-			"imageIdName": bson.M{
-				"bsonType":    "string",
-				"description": "imageIdName is the idName of the image file",
-			},
-			"formatName": bson.M{
-				"bsonType":    "string",
-				"description": "formatName must be a string",
-			},
-			"imageType": bson.M{
-				"bsonType":    "string",
-				"description": "imageType must be a string",
-			},
-			"filename": bson.M{
-				"bsonType":    "string",
-				"description": "filename must be a string",
-			},
-			"imageSize": bson.M{
-				"bsonType":    "object",
-				"description": "imageSize must be an objet of image size data",
-				"properties": bson.M{
-					"width": bson.M{
-						"bsonType":    "int",
-						"description": "width must be an int",
-					},
-					"height": bson.M{
-						"bsonType":    "int",
-						"description": "height must be an int",
-					},
-				},
-			},
-			"fileSize": bson.M{
-				"bsonType":    "int",
-				"description": "fileSize must be an int",
-			},
-			"private": bson.M{
-				"bsonType":    "bool",
-				"description": "private must be a bool",
-			},
-		},
-	}
-
-	// We set a validator for the schema defined above.
-	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": jsonSchema})
+	// We set a validator for the image file schema.
+	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": getImageFileSchema()})
 
 	// We create the collection using the validator set above.
 	createCollectionErr := db.CreateCollection(context.TODO(), IMAGE_FILE_COLLECTION, colOpts)
@@ -135,51 +86,8 @@ func (mdbc *MongoDbController) initImageFileCollection(dbName string) error {
 func (mdbc *MongoDbController) initImageCollection(dbName string) error {
 	db := mdbc.MongoClient.Database(dbName)
 
-	// We define a schema here for image documents
-	jsonSchema := bson.M{
-		"bsonType": "object",
-		"required": []string{
-			"title",
-			"filename",
-			"idName",
-			"tags",
-			"authorId",
-			"dateAdded",
-		},
-		"properties": bson.M{
-			"title": bson.M{
-				"bsonType":    "string",
-				"description": "title must be a string",
-			},
-			"filename": bson.M{
-				"bsonType":    "string",
-				"description": "filename must be a string",
-			},
-			"idName": bson.M{
-				"bsonType":    "string",
-				"description": "idName must be a string",
-			},
-			"tags": bson.M{
-				"bsonType":    "array",
-				"description": "tags must be an array",
-				"items": bson.M{
-					"bsonType":    "string",
-					"description": "Tag Items must be string",
-				},
-			},
-			"authorId": bson.M{
-				"bsonType":    "string",
-				"description": "authorId must be a string",
-			},
-			"dateAdded": bson.M{
-				"bsonType":    "timestamp",
-				"description": "dateAdded must be a timestamp",
-			},
-		},
-	}
-
-	// We set a validator for the schema defined above.
-	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": jsonSchema})
+	// We set a validator for the image schema.
+	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": getImageSchema()})
 
 	// We create the collection using the validator set above.
 	createCollectionErr := db.CreateCollection(context.TODO(), IMAGE_COLLECTION, colOpts)
@@ -213,22 +121,7 @@ func (mdbc *MongoDbController) initImageCollection(dbName string) error {
 func (mdbc *MongoDbController) initLoggingCollection(dbName string) error {
 	db := mdbc.MongoClient.Database(dbName)
 
-	jsonSchema := bson.M{
-		"bsonType": "object",
-		"required": []string{"timestamp", "type"},
-		"properties": bson.M{
-			"timestamp": bson.M{
-				"bsonType":    "timestamp",
-				"description": "timestamp is required and must be a timestamp",
-			},
-			"type": bson.M{
-				"bsonType":    "string",
-				"description": "type is required and must be a string",
-			},
-		},
-	}
-
-	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": jsonSchema})
+	colOpts := options.CreateCollection().SetValidator(bson.M{"$jsonSchema": getLoggingSchema()})
 	colOpts.SetCapped(true)
 	colOpts.SetSizeInBytes(100000)
 
@@ -241,32 +134,18 @@ func (mdbc *MongoDbController) initLoggingCollection(dbName string) error {
 	return nil
 }
 
-// Initializes the image collection, image file collection and logging collection. It determines
-// if any errors are due to the collection already existing and ignores those.
+// Brings the database up to the binary's schema version. Pending migrations
+// are applied when auto migration is enabled. Otherwise, we only check that the
+// database was already migrated. Either way, a database that was migrated by a
+// newer release returns an error.
 func (mdbc *MongoDbController) InitDatabase() error {
-	imageCreationErr := mdbc.initImageCollection(mdbc.dbName)
-
-	if imageCreationErr != nil && !strings.Contains(imageCreationErr.Error(), "Collection already exists") {
-		return imageCreationErr
-	}
-
-	imageFileCreationErr := mdbc.initImageFileCollection(mdbc.dbName)
-
-	if imageFileCreationErr != nil && !strings.Contains(imageFileCreationErr.Error(), "Collection already exists") {
-		return imageFileCreationErr
+	if !mdbc.autoMigrate {
+		return mdbc.CheckSchemaVersion()
 	}
 
-	if imageCreationErr != nil && !strings.Contains(imageCreationErr.Error(), "Collection already exists") {
-		return imageCreationErr
-	}
+	_, err := mdbc.RunMigrations()
 
-	loggingCreationErr := mdbc.initLoggingCollection(mdbc.dbName)
-
-	if loggingCreationErr != nil && !strings.Contains(loggingCreationErr.Error(), "Collection already exists") {
-		return loggingCreationErr
-	}
-
-	return nil
+	return err
 }
 
 // Adds image and image file documents to the databases. The individual image files are used
@@ -274,7 +153,7 @@ func (mdbc *MongoDbController) InitDatabase() error {
 // to hold meta information about the image and to hold the different sized versions together
 // as a common set of data.
 func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := mdbc.getContext()
 	defer cancel()
 
 	imgFileCollection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
@@ -296,8 +175,34 @@ func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (
 			"dateAdded": primitive.Timestamp{T: uint32(doc.DateAdded.Unix())},
 		}
 
+		if len(doc.OriginalSha256) > 0 {
+			imgDoc["originalSha256"] = doc.OriginalSha256
+		}
+
+		if len(doc.BlurHash) > 0 {
+			imgDoc["blurHash"] = doc.BlurHash
+			imgDoc["lqip"] = doc.Lqip
+		}
+
+		if len(doc.Palette) > 0 {
+			palette := make([]bson.M, 0, len(doc.Palette))
+			for _, pc := range doc.Palette {
+				lab := pc.Lab()
+
+				palette = append(palette, bson.M{
+					"color":      pc.Color,
+					"percentage": pc.Percentage,
+					"l":          lab.L,
+					"a":          lab.A,
+					"b":          lab.B,
+				})
+			}
+
+			imgDoc["palette"] = palette
+		}
+
 		// We insert a value into the image collection and check for an error
-		colInsertResult, colInsertErr := imgCollection.InsertOne(ctx, imgDoc)
+		colInsertResult, colInsertErr := imgCollection.InsertOne(sessCtx, imgDoc)
 		if colInsertErr != nil {
 			return "", dbController.NewDBError(colInsertErr.Error())
 		}
@@ -314,24 +219,12 @@ func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (
 		// a value for the imageId key.
 		images := make([]interface{}, 0)
 		for _, img := range doc.SizeFormats {
-			var imgType string
-
-			switch img.ImageType {
-			case imageHandler.Jpeg:
-				imgType = "jpeg"
-			case imageHandler.Png:
-				imgType = "png"
-			case imageHandler.Gif:
-				imgType = "gif"
-			case imageHandler.Bmp:
-				imgType = "bmp"
-			case imageHandler.Tiff:
-				imgType = "tiff"
-			default:
+			imgType := getImageTypeString(img.ImageType)
+			if len(imgType) == 0 {
 				continue
 			}
 
-			images = append(images, bson.M{
+			imageFile := bson.M{
 				"imageId":     imgId,
 				"imageIdName": doc.IdName,
 				"formatName":  img.FormatName,
@@ -343,7 +236,36 @@ func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (
 				"fileSize":  img.FileSize,
 				"private":   img.Private,
 				"imageType": imgType,
-			})
+				"sha256":    img.Sha256,
+			}
+
+			if img.Crop != nil {
+				imageFile["crop"] = bson.M{
+					"x":      img.Crop.X,
+					"y":      img.Crop.Y,
+					"width":  img.Crop.Width,
+					"height": img.Crop.Height,
+				}
+			}
+
+			if img.Encoding != nil {
+				imageFile["encoding"] = img.Encoding.GetMap()
+			}
+
+			if img.Capped {
+				imageFile["capped"] = img.Capped
+			}
+
+			request, requestErr := getRequestValue(img.Request)
+			if requestErr != nil {
+				return nil, dbController.NewInvalidInputError("invalid conversion request for " + img.Filename)
+			}
+
+			if len(request) > 0 {
+				imageFile["request"] = request
+			}
+
+			images = append(images, imageFile)
 		}
 
 		// If we have no images to insert, we throw an error to rollback the writes
@@ -364,6 +286,14 @@ func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (
 			return nil, dbController.NewDBError("no images inserted")
 		}
 
+		// Any additional writes, e.g. image files saved to GridFS, are performed
+		// using the session context so that they are part of this transaction.
+		if doc.OnTransaction != nil {
+			if onTransErr := doc.OnTransaction(sessCtx); onTransErr != nil {
+				return nil, onTransErr
+			}
+		}
+
 		// We return a hex string of the image document that was inserted.
 		return imgId.Hex(), nil
 	}
@@ -391,6 +321,27 @@ func (mdbc *MongoDbController) AddImageData(doc dbController.AddImageDocument) (
 	}
 }
 
+// Returns the value of the imageType field. Returns an empty string for image
+// types that can't be stored.
+func getImageTypeString(iType imageHandler.ImageType) string {
+	switch iType {
+	case imageHandler.Jpeg:
+		return "jpeg"
+	case imageHandler.Png:
+		return "png"
+	case imageHandler.Gif:
+		return "gif"
+	case imageHandler.Bmp:
+		return "bmp"
+	case imageHandler.Tiff:
+		return "tiff"
+	case imageHandler.Webp:
+		return "webp"
+	default:
+		return ""
+	}
+}
+
 // Returns a series of bson objects that are used during the GET process for image documents,
 // the image files associated with that document and user information.
 func (mdbc *MongoDbController) GetImageDataAggregationStages() (authorLookupStage, imageFileLookupStage bson.D) {
@@ -423,13 +374,18 @@ func (mdbc *MongoDbController) getPublicImageProjectStage() bson.D {
 		{
 			Key: "$project",
 			Value: bson.M{
-				"title":     1,
-				"filename":  1,
-				"idName":    1,
-				"tags":      1,
-				"imageIds":  1,
-				"authorId":  1,
-				"dateAdded": 1,
+				"title":          1,
+				"filename":       1,
+				"idName":         1,
+				"tags":           1,
+				"imageIds":       1,
+				"authorId":       1,
+				"dateAdded":      1,
+				"originalSha256": 1,
+				"blurHash":       1,
+				"lqip":           1,
+				"palette":        1,
+				"source":         1,
 				"images": bson.M{
 					"$filter": bson.M{
 						"input": "$images",
@@ -454,14 +410,19 @@ func (mdbc *MongoDbController) getImageProjectStage() bson.D {
 		{
 			Key: "$project",
 			Value: bson.M{
-				"title":     1,
-				"filename":  1,
-				"idName":    1,
-				"tags":      1,
-				"imageIds":  1,
-				"authorId":  1,
-				"dateAdded": 1,
-				"images":    1,
+				"title":          1,
+				"filename":       1,
+				"idName":         1,
+				"tags":           1,
+				"imageIds":       1,
+				"authorId":       1,
+				"dateAdded":      1,
+				"originalSha256": 1,
+				"blurHash":       1,
+				"lqip":           1,
+				"palette":        1,
+				"source":         1,
+				"images":         1,
 			},
 		},
 	}
@@ -603,8 +564,13 @@ func (mdbc *MongoDbController) GetImagesData(page, pagination int, sort dbContro
 	// The aggregation pipeline. Essentially a mutable slice
 	pipeline := mongo.Pipeline{}
 
-	// The match stage is for matching by nothing in particular
-	pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{}}})
+	// The match stage matches every image, unless we filter by color
+	match := bson.M{}
+	if sort.Color != nil {
+		match = getColorMatch(*sort.Color)
+	}
+
+	pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
 
 	// This is the sort stage
 	switch sort.Sortby {
@@ -691,6 +657,55 @@ func (mdbc *MongoDbController) GetImagesData(page, pagination int, sort dbContro
 	return
 }
 
+// Matches images with a palette color within the filter's distance. The
+// $elemMatch on the box around the color can use the palette index, so the
+// exact distance is only computed for images with a palette color in the box.
+// Squared distances are compared to skip the square root.
+func getColorMatch(filter dbController.ColorFilter) bson.M {
+	squaredDifference := func(field string, value float64) bson.M {
+		return bson.M{"$pow": bson.A{bson.M{"$subtract": bson.A{"$$c." + field, value}}, 2}}
+	}
+
+	between := func(value float64) bson.M {
+		return bson.M{"$gte": value - filter.Distance, "$lte": value + filter.Distance}
+	}
+
+	box := bson.M{
+		"palette": bson.M{
+			"$elemMatch": bson.M{
+				"l": between(filter.Color.L),
+				"a": between(filter.Color.A),
+				"b": between(filter.Color.B),
+			},
+		},
+	}
+
+	distance := bson.M{
+		"$expr": bson.M{
+			"$anyElementTrue": bson.A{
+				bson.M{
+					"$map": bson.M{
+						"input": bson.M{"$ifNull": bson.A{"$palette", bson.A{}}},
+						"as":    "c",
+						"in": bson.M{
+							"$lte": bson.A{
+								bson.M{"$add": bson.A{
+									squaredDifference("l", filter.Color.L),
+									squaredDifference("a", filter.Color.A),
+									squaredDifference("b", filter.Color.B),
+								}},
+								filter.Distance * filter.Distance,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return bson.M{"$and": bson.A{box, distance}}
+}
+
 // This stage is used to generate lower case letters for each file name for when we're
 // sorting by file name.
 func (mdbc *MongoDbController) getLowerCaseStage() bson.D {
@@ -752,6 +767,103 @@ func (mdbc *MongoDbController) ImageHasFiles(id string) (bool, error) {
 	return true, nil
 }
 
+// Counts the image files that refer to the file stored under the digest
+func (mdbc *MongoDbController) CountImageFilesWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(IMAGE_FILE_COLLECTION)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"sha256": sha256})
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return int(count), nil
+}
+
+func (mdbc *MongoDbController) CountImageSourcesWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(IMAGE_COLLECTION)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"source.sha256": sha256})
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return int(count), nil
+}
+
+// Gets the sources of every transformed image
+func (mdbc *MongoDbController) GetImageSources() ([]imageHandler.ImageSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
+	defer cancel()
+
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_COLLECTION)
+
+	findOpts := options.Find().SetProjection(bson.M{"source": 1})
+	cursor, err := collection.Find(ctx, bson.M{"source": bson.M{"$exists": true}}, findOpts)
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	var results []ImageDocResult
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	sources := make([]imageHandler.ImageSource, 0, len(results))
+	for _, result := range results {
+		if result.Source == nil {
+			continue
+		}
+
+		source, err := result.Source.getImageSource()
+		if err != nil {
+			return nil, dbController.NewDBError(err.Error())
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// Gets every image file, including private files
+func (mdbc *MongoDbController) GetAllImageFiles() ([]dbController.ImageFileDocument, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
+	defer cancel()
+
+	collection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
+
+	cursor, err := collection.Find(ctx, bson.M{})
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	var results []ImageFileDocResult
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	files := make([]dbController.ImageFileDocument, 0, len(results))
+	for _, result := range results {
+		files = append(files, result.getImageFileDocument())
+	}
+
+	return files, nil
+}
+
 func (mdbc *MongoDbController) EditImageData(doc dbController.EditImageDocument) error {
 	return errors.New("Unimplemented")
 }
@@ -798,6 +910,188 @@ func (mdbc *MongoDbController) EditImageFileData(doc dbController.EditImageFileD
 	return
 }
 
+// Updates the content of an image's files in a transaction. The image files
+// are found by the image's id and their filename. Fields that a file no longer
+// has, like a crop region, are removed.
+func (mdbc *MongoDbController) ReplaceImageFiles(doc dbController.ReplaceImageFilesDocument) error {
+	imgId, idErr := primitive.ObjectIDFromHex(doc.ImageId)
+	if idErr != nil {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	if len(doc.SizeFormats) == 0 {
+		return dbController.NewInvalidInputError("no images to save")
+	}
+
+	ctx, cancel := mdbc.getContext()
+	defer cancel()
+
+	imgFileCollection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
+	imgCollection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_COLLECTION)
+
+	callback := func(sessCtx mongo.SessionContext) (interface{}, error) {
+		for _, img := range doc.SizeFormats {
+			imgType := getImageTypeString(img.ImageType)
+			if len(imgType) == 0 {
+				return nil, dbController.NewInvalidInputError("invalid image type for " + img.Filename)
+			}
+
+			values := bson.M{
+				"imageSize": bson.M{
+					"width":  img.ImageSize.Width,
+					"height": img.ImageSize.Height,
+				},
+				"fileSize":  img.FileSize,
+				"imageType": imgType,
+				"sha256":    img.Sha256,
+			}
+
+			removed := bson.M{}
+
+			if img.Crop != nil {
+				values["crop"] = bson.M{
+					"x":      img.Crop.X,
+					"y":      img.Crop.Y,
+					"width":  img.Crop.Width,
+					"height": img.Crop.Height,
+				}
+			} else {
+				removed["crop"] = ""
+			}
+
+			if img.Encoding != nil {
+				values["encoding"] = img.Encoding.GetMap()
+			} else {
+				removed["encoding"] = ""
+			}
+
+			if img.Capped {
+				values["capped"] = img.Capped
+			} else {
+				removed["capped"] = ""
+			}
+
+			request, requestErr := getRequestValue(img.Request)
+			if requestErr != nil {
+				return nil, dbController.NewInvalidInputError("invalid conversion request for " + img.Filename)
+			}
+
+			if len(request) > 0 {
+				values["request"] = request
+			} else {
+				removed["request"] = ""
+			}
+
+			update := bson.M{
+				"$set":   values,
+				"$unset": removed,
+			}
+
+			filter := bson.M{
+				"imageId":  imgId,
+				"filename": img.Filename,
+			}
+
+			// Files that were added before digests were stored have no sha256
+			previous, checkPrevious := doc.PreviousSha256[img.Filename]
+			if checkPrevious && len(previous) > 0 {
+				filter["sha256"] = previous
+			} else if checkPrevious {
+				filter["sha256"] = bson.M{"$in": bson.A{"", nil}}
+			}
+
+			result, updateErr := imgFileCollection.UpdateOne(sessCtx, filter, update)
+			if updateErr != nil {
+				return nil, dbController.NewDBError(updateErr.Error())
+			}
+
+			if result.MatchedCount == 0 && checkPrevious {
+				count, countErr := imgFileCollection.CountDocuments(sessCtx, bson.M{"imageId": imgId, "filename": img.Filename})
+				if countErr != nil {
+					return nil, dbController.NewDBError(countErr.Error())
+				}
+
+				if count > 0 {
+					return nil, dbController.NewConflictError(img.Filename + " was changed")
+				}
+			}
+
+			if result.MatchedCount == 0 {
+				return nil, dbController.NewInvalidInputError("no image file named " + img.Filename)
+			}
+		}
+
+		imgValues := bson.M{}
+
+		if len(doc.BlurHash) > 0 {
+			imgValues["blurHash"] = doc.BlurHash
+			imgValues["lqip"] = doc.Lqip
+		}
+
+		if doc.Source != nil {
+			imgValues["source"] = getImageSourceValue(*doc.Source)
+		}
+
+		if len(imgValues) > 0 {
+			_, updateErr := imgCollection.UpdateOne(sessCtx, bson.M{"_id": imgId}, bson.M{"$set": imgValues})
+
+			if updateErr != nil {
+				return nil, dbController.NewDBError(updateErr.Error())
+			}
+		}
+
+		if doc.OnTransaction != nil {
+			if onTransErr := doc.OnTransaction(sessCtx); onTransErr != nil {
+				return nil, onTransErr
+			}
+		}
+
+		return nil, nil
+	}
+
+	session, sessionErr := mdbc.MongoClient.StartSession()
+	if sessionErr != nil {
+		return dbController.NewDBError(sessionErr.Error())
+	}
+	defer session.EndSession(ctx)
+
+	_, transErr := session.WithTransaction(ctx, callback)
+	if transErr != nil {
+		session.AbortTransaction(ctx)
+		return transErr
+	}
+
+	return nil
+}
+
+func (mdbc *MongoDbController) SetImagePlaceholders(doc dbController.ImagePlaceholdersDocument) error {
+	id, idErr := primitive.ObjectIDFromHex(doc.Id)
+	if idErr != nil {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(IMAGE_COLLECTION)
+	defer cancel()
+
+	update := bson.M{
+		"$set": bson.M{
+			"blurHash": doc.BlurHash,
+			"lqip":     doc.Lqip,
+		},
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	if result.MatchedCount == 0 {
+		return dbController.NewNoResultsError("")
+	}
+
+	return nil
+}
+
 // This function deletes an image document, including the files associated with it
 func (mdbc *MongoDbController) DeleteImage(doc dbController.DeleteImageDocument) error {
 	docId, docIdErr := primitive.ObjectIDFromHex(doc.Id)
@@ -805,7 +1099,7 @@ func (mdbc *MongoDbController) DeleteImage(doc dbController.DeleteImageDocument)
 		return docIdErr
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := mdbc.getContext()
 	defer cancel()
 
 	imgFileCollection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
@@ -886,7 +1180,7 @@ func (mdbc *MongoDbController) DeleteImageFile(doc dbController.DeleteImageFileD
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := mdbc.getContext()
 	defer cancel()
 
 	imgFileCollection := mdbc.MongoClient.Database(mdbc.dbName).Collection(IMAGE_FILE_COLLECTION)
@@ -954,6 +1248,162 @@ func (mdbc *MongoDbController) DeleteImageFile(doc dbController.DeleteImageFileD
 	return
 }
 
+// Adds an asset. The unique index on kind and name keeps names unique for each
+// kind of asset.
+func (mdbc *MongoDbController) AddAsset(doc dbController.AddAssetDocument) (string, error) {
+	if len(doc.Kind) == 0 || len(doc.Name) == 0 {
+		return "", dbController.NewInvalidInputError("assets require a kind and name")
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(ASSET_COLLECTION)
+	defer cancel()
+
+	insert := bson.M{
+		"kind":      string(doc.Kind),
+		"name":      doc.Name,
+		"filename":  doc.Filename,
+		"sha256":    doc.Sha256,
+		"fileSize":  doc.FileSize,
+		"authorId":  doc.AuthorId,
+		"dateAdded": primitive.Timestamp{T: uint32(doc.DateAdded.Unix())},
+	}
+
+	result, err := collection.InsertOne(ctx, insert)
+
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return "", dbController.NewDuplicateEntryError("duplicate asset name: " + doc.Name)
+		}
+		return "", dbController.NewDBError(err.Error())
+	}
+
+	id, idOk := result.InsertedID.(primitive.ObjectID)
+	if !idOk {
+		return "", dbController.NewDBError("invalid id returned by database")
+	}
+
+	return id.Hex(), nil
+}
+
+// Gets the assets sorted by name
+func (mdbc *MongoDbController) GetAssets(kind dbController.AssetKind) ([]dbController.AssetDocument, error) {
+	collection, ctx, cancel := mdbc.getCollection(ASSET_COLLECTION)
+	defer cancel()
+
+	filter := bson.M{}
+	if len(kind) > 0 {
+		filter["kind"] = string(kind)
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	var results []AssetDocResult
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	assets := make([]dbController.AssetDocument, 0, len(results))
+	for _, result := range results {
+		assets = append(assets, result.getAssetDocument())
+	}
+
+	return assets, nil
+}
+
+func (mdbc *MongoDbController) GetAssetByName(kind dbController.AssetKind, name string) (asset dbController.AssetDocument, err error) {
+	collection, ctx, cancel := mdbc.getCollection(ASSET_COLLECTION)
+	defer cancel()
+
+	var result AssetDocResult
+
+	err = collection.FindOne(
+		ctx,
+		bson.M{
+			"kind": string(kind),
+			"name": name,
+		},
+	).Decode(&result)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return asset, dbController.NewNoResultsError("")
+		}
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	return result.getAssetDocument(), nil
+}
+
+func (mdbc *MongoDbController) DeleteAsset(doc dbController.DeleteAssetDocument) (asset dbController.AssetDocument, err error) {
+	idObj, idObjErr := primitive.ObjectIDFromHex(doc.Id)
+
+	if idObjErr != nil {
+		err = dbController.NewInvalidInputError("invalid id")
+		return
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(ASSET_COLLECTION)
+	defer cancel()
+
+	var result AssetDocResult
+
+	err = collection.FindOneAndDelete(
+		ctx,
+		bson.M{
+			"_id": idObj,
+		},
+	).Decode(&result)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return asset, dbController.NewNoResultsError("")
+		}
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	return result.getAssetDocument(), nil
+}
+
+// Counts the assets that refer to the file stored under the digest
+func (mdbc *MongoDbController) CountAssetsWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	collection, ctx, cancel := mdbc.getCollection(ASSET_COLLECTION)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"sha256": sha256})
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return int(count), nil
+}
+
+func (mdbc *MongoDbController) GetUserByUID(uid string) (user dbController.UserDataDocument, err error) {
+	collection, ctx, cancel := mdbc.getCollection(USER_COLLECTION)
+	defer cancel()
+
+	var result UserDocResult
+
+	err = collection.FindOne(ctx, bson.M{"uid": uid}).Decode(&result)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return user, dbController.NewNoResultsError("")
+		}
+		return user, dbController.NewDBError(err.Error())
+	}
+
+	return *result.GetUserDataDoc(), nil
+}
+
 func (mdbc *MongoDbController) AddRequestLog(log logging.RequestLogData) error {
 	collection, ctx, cancel := mdbc.getCollection(LOGGING_COLLECTION)
 	defer cancel()
@@ -0,0 +1,38 @@
+package mongoDbController
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+func TestGetColorMatchBox(t *testing.T) {
+	filter := dbController.ColorFilter{
+		Color:    imageHandler.LabColor{L: 50, A: -10, B: 20},
+		Distance: 5,
+	}
+
+	conditions := getColorMatch(filter)["$and"].(bson.A)
+	elemMatch := conditions[0].(bson.M)["palette"].(bson.M)["$elemMatch"].(bson.M)
+
+	expected := map[string][2]float64{
+		"l": {45, 55},
+		"a": {-15, -5},
+		"b": {15, 25},
+	}
+
+	for field, bounds := range expected {
+		r := elemMatch[field].(bson.M)
+
+		if r["$gte"] != bounds[0] || r["$lte"] != bounds[1] {
+			t.Fatalf("%v = '%v', Should be between '%v'", field, r, bounds)
+		}
+	}
+
+	if _, ok := conditions[1].(bson.M)["$expr"]; !ok {
+		t.Fatalf("conditions[1] = '%v', Should check the exact distance", conditions[1])
+	}
+}
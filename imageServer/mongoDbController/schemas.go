@@ -0,0 +1,321 @@
+package mongoDbController
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// These are the current validators for each collection. New databases are
+// created with them, but existing databases only receive changes through a
+// migration. When changing a schema, add a migration that applies it with
+// collMod. See migrations.go
+
+// The $jsonSchema for documents in the image collection
+func getImageSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": []string{
+			"title",
+			"filename",
+			"idName",
+			"tags",
+			"authorId",
+			"dateAdded",
+		},
+		"properties": bson.M{
+			"title": bson.M{
+				"bsonType":    "string",
+				"description": "title must be a string",
+			},
+			"filename": bson.M{
+				"bsonType":    "string",
+				"description": "filename must be a string",
+			},
+			"idName": bson.M{
+				"bsonType":    "string",
+				"description": "idName must be a string",
+			},
+			"tags": bson.M{
+				"bsonType":    "array",
+				"description": "tags must be an array",
+				"items": bson.M{
+					"bsonType":    "string",
+					"description": "Tag Items must be string",
+				},
+			},
+			"authorId": bson.M{
+				"bsonType":    "string",
+				"description": "authorId must be a string",
+			},
+			"dateAdded": bson.M{
+				"bsonType":    "timestamp",
+				"description": "dateAdded must be a timestamp",
+			},
+			"originalSha256": bson.M{
+				"bsonType":    "string",
+				"description": "originalSha256 must be a hex encoded SHA-256 digest",
+				"pattern":     "^[0-9a-f]{64}$",
+			},
+			"blurHash": bson.M{
+				"bsonType":    "string",
+				"description": "blurHash must be a string",
+			},
+			"lqip": bson.M{
+				"bsonType":    "string",
+				"description": "lqip must be a data URL",
+				"pattern":     "^data:image/",
+			},
+			"source": bson.M{
+				"bsonType":    "object",
+				"description": "source must be the file and transform that the image files are made from",
+				"required":    []string{"sha256", "imageType", "rotate", "flip", "background"},
+				"properties": bson.M{
+					"sha256": bson.M{
+						"bsonType":    "string",
+						"description": "sha256 must be a hex encoded SHA-256 digest",
+						"pattern":     "^[0-9a-f]{64}$",
+					},
+					"imageType": bson.M{
+						"bsonType":    "string",
+						"description": "imageType must be a string",
+					},
+					"rotate": bson.M{
+						"bsonType":    "double",
+						"description": "rotate must be a double",
+					},
+					"flip": bson.M{
+						"bsonType":    "string",
+						"description": "flip must be a string",
+					},
+					"background": bson.M{
+						"bsonType":    "string",
+						"description": "background must be a hex color",
+						"pattern":     "^#[0-9a-f]{8}$",
+					},
+				},
+			},
+			"palette": bson.M{
+				"bsonType":    "array",
+				"description": "palette must be an array of colors",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": []string{"color", "percentage", "l", "a", "b"},
+					"properties": bson.M{
+						"color": bson.M{
+							"bsonType":    "string",
+							"description": "color must be a hex color",
+							"pattern":     "^#[0-9a-f]{6}$",
+						},
+						"percentage": bson.M{
+							"bsonType":    "double",
+							"description": "percentage must be a double",
+						},
+						"l": bson.M{
+							"bsonType":    "double",
+							"description": "l must be a double",
+						},
+						"a": bson.M{
+							"bsonType":    "double",
+							"description": "a must be a double",
+						},
+						"b": bson.M{
+							"bsonType":    "double",
+							"description": "b must be a double",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// The $jsonSchema for documents in the image file collection
+func getImageFileSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": []string{
+			"imageId",
+			"imageIdName",
+			"formatName",
+			"imageType",
+			"filename",
+			"imageSize",
+			"fileSize",
+			"private",
+		},
+		"properties": bson.M{
+			"imageId": bson.M{
+				"bsonType":    "objectId",
+				"description": "id of the image document to which this image belongs",
+			},
+			"imageIdName": bson.M{
+				"bsonType":    "string",
+				"description": "imageIdName is the idName of the image file",
+			},
+			"formatName": bson.M{
+				"bsonType":    "string",
+				"description": "formatName must be a string",
+			},
+			"imageType": bson.M{
+				"bsonType":    "string",
+				"description": "imageType must be a string",
+			},
+			"filename": bson.M{
+				"bsonType":    "string",
+				"description": "filename must be a string",
+			},
+			"imageSize": bson.M{
+				"bsonType":    "object",
+				"description": "imageSize must be an objet of image size data",
+				"properties": bson.M{
+					"width": bson.M{
+						"bsonType":    "int",
+						"description": "width must be an int",
+					},
+					"height": bson.M{
+						"bsonType":    "int",
+						"description": "height must be an int",
+					},
+				},
+			},
+			"fileSize": bson.M{
+				"bsonType":    "int",
+				"description": "fileSize must be an int",
+			},
+			"private": bson.M{
+				"bsonType":    "bool",
+				"description": "private must be a bool",
+			},
+			"sha256": bson.M{
+				"bsonType":    "string",
+				"description": "sha256 must be a hex encoded SHA-256 digest",
+				"pattern":     "^[0-9a-f]{64}$",
+			},
+			"crop": bson.M{
+				"bsonType":    "object",
+				"description": "crop must be an object with the region of the original image that was kept",
+				"required":    []string{"x", "y", "width", "height"},
+				"properties": bson.M{
+					"x": bson.M{
+						"bsonType":    "int",
+						"description": "x must be an int",
+					},
+					"y": bson.M{
+						"bsonType":    "int",
+						"description": "y must be an int",
+					},
+					"width": bson.M{
+						"bsonType":    "int",
+						"description": "width must be an int",
+					},
+					"height": bson.M{
+						"bsonType":    "int",
+						"description": "height must be an int",
+					},
+				},
+			},
+			"request": bson.M{
+				"bsonType":    "string",
+				"description": "request must be the JSON encoded conversion request that the file was made from",
+			},
+			"encoding": bson.M{
+				"bsonType":    "object",
+				"description": "encoding must be an object with the encoder settings of the file",
+				"properties": bson.M{
+					"quality": bson.M{
+						"bsonType":    "int",
+						"description": "quality must be an int",
+					},
+					"lossless": bson.M{
+						"bsonType":    "bool",
+						"description": "lossless must be a bool",
+					},
+					"subsampling": bson.M{
+						"bsonType":    "string",
+						"description": "subsampling must be a string",
+					},
+					"compression": bson.M{
+						"bsonType":    "string",
+						"description": "compression must be a string",
+					},
+					"colors": bson.M{
+						"bsonType":    "int",
+						"description": "colors must be an int",
+					},
+					"dither": bson.M{
+						"bsonType":    "bool",
+						"description": "dither must be a bool",
+					},
+				},
+			},
+			"capped": bson.M{
+				"bsonType":    "bool",
+				"description": "capped must be a bool that's true if the file was limited to the size of the original",
+			},
+		},
+	}
+}
+
+// The $jsonSchema for documents in the asset collection
+func getAssetSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": []string{
+			"kind",
+			"name",
+			"filename",
+			"sha256",
+			"fileSize",
+			"authorId",
+			"dateAdded",
+		},
+		"properties": bson.M{
+			"kind": bson.M{
+				"bsonType":    "string",
+				"description": "kind must be a string",
+			},
+			"name": bson.M{
+				"bsonType":    "string",
+				"description": "name must be a string",
+			},
+			"filename": bson.M{
+				"bsonType":    "string",
+				"description": "filename must be a string",
+			},
+			"sha256": bson.M{
+				"bsonType":    "string",
+				"description": "sha256 must be a hex encoded SHA-256 digest",
+				"pattern":     "^[0-9a-f]{64}$",
+			},
+			"fileSize": bson.M{
+				"bsonType":    "int",
+				"description": "fileSize must be an int",
+			},
+			"authorId": bson.M{
+				"bsonType":    "string",
+				"description": "authorId must be a string",
+			},
+			"dateAdded": bson.M{
+				"bsonType":    "timestamp",
+				"description": "dateAdded must be a timestamp",
+			},
+		},
+	}
+}
+
+// The $jsonSchema for documents in the logging collection
+func getLoggingSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": []string{"timestamp", "type"},
+		"properties": bson.M{
+			"timestamp": bson.M{
+				"bsonType":    "timestamp",
+				"description": "timestamp is required and must be a timestamp",
+			},
+			"type": bson.M{
+				"bsonType":    "string",
+				"description": "type is required and must be a string",
+			},
+		},
+	}
+}
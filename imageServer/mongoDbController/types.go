@@ -1,14 +1,18 @@
 package mongoDbController
 
 import (
+	"encoding/json"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+
 	"methompson.com/image-microservice/imageServer/dbController"
 	"methompson.com/image-microservice/imageServer/imageHandler"
 )
 
 const IMAGE_COLLECTION = "images"
 const IMAGE_FILE_COLLECTION = "imageFiles"
+const ASSET_COLLECTION = "assets"
 const LOGGING_COLLECTION = "logging"
 const USER_COLLECTION = "users"
 
@@ -33,33 +37,68 @@ func (udr *UserDocResult) GetUserDataDoc() *dbController.UserDataDocument {
 }
 
 type ImageFileDocResult struct {
-	Id          string                 `bson:"_id"`
-	ImageId     string                 `bson:"imageId"`
-	ImageIdName string                 `bson:"imageIdName"`
-	Filename    string                 `bson:"filename"`
-	FormatName  string                 `bson:"formatName"`
-	ImageSize   imageHandler.ImageSize `bson:"imageSize"`
-	FileSize    int                    `bson:"fileSize"`
-	Private     bool                   `bson:"private"`
-	ImageType   string                 `bson:"imageType"`
+	Id          string                        `bson:"_id"`
+	ImageId     string                        `bson:"imageId"`
+	ImageIdName string                        `bson:"imageIdName"`
+	Filename    string                        `bson:"filename"`
+	FormatName  string                        `bson:"formatName"`
+	ImageSize   imageHandler.ImageSize        `bson:"imageSize"`
+	FileSize    int                           `bson:"fileSize"`
+	Private     bool                          `bson:"private"`
+	ImageType   string                        `bson:"imageType"`
+	Sha256      string                        `bson:"sha256"`
+	Crop        *imageHandler.CropRect        `bson:"crop,omitempty"`
+	Encoding    *imageHandler.EncoderSettings `bson:"encoding,omitempty"`
+	Capped      bool                          `bson:"capped,omitempty"`
+	Request     string                        `bson:"request,omitempty"`
 }
 
-func (ifdr ImageFileDocResult) getImageFileDocument() dbController.ImageFileDocument {
-	var imgType imageHandler.ImageType
-	switch ifdr.ImageType {
+// Conversion requests are stored as JSON, so that they keep the field names
+// that clients send
+func getRequestValue(req *imageHandler.ConversionRequest) (string, error) {
+	if req == nil {
+		return "", nil
+	}
+
+	requestJson, err := json.Marshal(req)
+
+	return string(requestJson), err
+}
+
+func parseRequestValue(value string) *imageHandler.ConversionRequest {
+	if len(value) == 0 {
+		return nil
+	}
+
+	var req imageHandler.ConversionRequest
+	if err := json.Unmarshal([]byte(value), &req); err != nil {
+		return nil
+	}
+
+	return &req
+}
+
+func getImageTypeFromString(iType string) imageHandler.ImageType {
+	switch iType {
 	case "jpeg":
-		imgType = imageHandler.Jpeg
+		return imageHandler.Jpeg
 	case "png":
-		imgType = imageHandler.Png
+		return imageHandler.Png
 	case "gif":
-		imgType = imageHandler.Gif
+		return imageHandler.Gif
 	case "bmp":
-		imgType = imageHandler.Bmp
+		return imageHandler.Bmp
 	case "tiff":
-		imgType = imageHandler.Tiff
+		return imageHandler.Tiff
+	case "webp":
+		return imageHandler.Webp
 	default:
-		imgType = imageHandler.Same
+		return imageHandler.Same
 	}
+}
+
+func (ifdr ImageFileDocResult) getImageFileDocument() dbController.ImageFileDocument {
+	imgType := getImageTypeFromString(ifdr.ImageType)
 
 	return dbController.ImageFileDocument{
 		Id:          ifdr.Id,
@@ -71,6 +110,11 @@ func (ifdr ImageFileDocResult) getImageFileDocument() dbController.ImageFileDocu
 		FileSize:    ifdr.FileSize,
 		Private:     ifdr.Private,
 		ImageType:   imgType,
+		Sha256:      ifdr.Sha256,
+		Crop:        ifdr.Crop,
+		Encoding:    ifdr.Encoding,
+		Capped:      ifdr.Capped,
+		Request:     parseRequestValue(ifdr.Request),
 	}
 }
 
@@ -85,19 +129,72 @@ func (ifdr ImageFileDocResult) GetMap() map[string]interface{} {
 	m["imageSize"] = ifdr.ImageSize.GetMap()
 	m["imageType"] = ifdr.ImageType
 
+	if ifdr.Crop != nil {
+		m["crop"] = ifdr.Crop.GetMap()
+	}
+
+	if ifdr.Encoding != nil {
+		m["encoding"] = ifdr.Encoding.GetMap()
+	}
+
+	if ifdr.Capped {
+		m["capped"] = ifdr.Capped
+	}
+
 	return m
 }
 
 type ImageDocResult struct {
-	Id        string               `bson:"_id"`
-	Title     string               `bson:"title"`
-	Filename  string               `bson:"filename"`
-	IdName    string               `bson:"idName"`
-	Images    []ImageFileDocResult `bson:"images"`
-	Tags      []string             `bson:"tags"`
-	Author    []UserDocResult      `bson:"author"`
-	AuthorId  string               `bson:"authorId"`
-	DateAdded time.Time            `bson:"dateAdded"`
+	Id             string               `bson:"_id"`
+	Title          string               `bson:"title"`
+	Filename       string               `bson:"filename"`
+	IdName         string               `bson:"idName"`
+	Images         []ImageFileDocResult `bson:"images"`
+	Tags           []string             `bson:"tags"`
+	Author         []UserDocResult      `bson:"author"`
+	AuthorId       string               `bson:"authorId"`
+	DateAdded      time.Time            `bson:"dateAdded"`
+	OriginalSha256 string               `bson:"originalSha256"`
+	BlurHash       string               `bson:"blurHash"`
+	Lqip           string               `bson:"lqip"`
+	Palette        []PaletteColorResult `bson:"palette"`
+	Source         *ImageSourceResult   `bson:"source"`
+}
+
+// The source of a transformed image. The transform is stored with the names
+// that MakeTransform parses.
+type ImageSourceResult struct {
+	Sha256     string  `bson:"sha256"`
+	ImageType  string  `bson:"imageType"`
+	Rotate     float64 `bson:"rotate"`
+	Flip       string  `bson:"flip"`
+	Background string  `bson:"background"`
+}
+
+func getImageSourceValue(source imageHandler.ImageSource) bson.M {
+	return bson.M{
+		"sha256":     source.Sha256,
+		"imageType":  getImageTypeString(source.ImageType),
+		"rotate":     source.Transform.Rotate,
+		"flip":       source.Transform.Flip.String(),
+		"background": source.Transform.BackgroundHex(),
+	}
+}
+
+func (isr ImageSourceResult) getImageSource() (imageHandler.ImageSource, error) {
+	transform, err := imageHandler.MakeTransform(isr.Rotate, isr.Flip, isr.Background)
+
+	return imageHandler.ImageSource{
+		Sha256:    isr.Sha256,
+		ImageType: getImageTypeFromString(isr.ImageType),
+		Transform: transform,
+	}, err
+}
+
+// The Lab values of palette colors are only used to find images by color
+type PaletteColorResult struct {
+	Color      string  `bson:"color"`
+	Percentage float64 `bson:"percentage"`
 }
 
 func (idr *ImageDocResult) GetImageDocument() dbController.ImageDocument {
@@ -112,15 +209,61 @@ func (idr *ImageDocResult) GetImageDocument() dbController.ImageDocument {
 		imageFiles = append(imageFiles, res.getImageFileDocument())
 	}
 
+	var palette []imageHandler.PaletteColor
+	for _, res := range idr.Palette {
+		palette = append(palette, imageHandler.PaletteColor{
+			Color:      res.Color,
+			Percentage: res.Percentage,
+		})
+	}
+
+	// Sources with a transform that can't be parsed are dropped, like requests,
+	// so the image is transformed from its original again
+	var source *imageHandler.ImageSource
+	if idr.Source != nil {
+		if parsed, err := idr.Source.getImageSource(); err == nil {
+			source = &parsed
+		}
+	}
+
 	return dbController.ImageDocument{
-		Id:         idr.Id,
-		Title:      idr.Title,
-		Filename:   idr.Filename,
-		IdName:     idr.IdName,
-		Tags:       idr.Tags,
-		ImageFiles: imageFiles,
-		Author:     author,
-		AuthorId:   idr.AuthorId,
-		DateAdded:  idr.DateAdded,
+		Id:             idr.Id,
+		Title:          idr.Title,
+		Filename:       idr.Filename,
+		IdName:         idr.IdName,
+		Tags:           idr.Tags,
+		ImageFiles:     imageFiles,
+		Author:         author,
+		AuthorId:       idr.AuthorId,
+		DateAdded:      idr.DateAdded,
+		OriginalSha256: idr.OriginalSha256,
+		BlurHash:       idr.BlurHash,
+		Lqip:           idr.Lqip,
+		Palette:        palette,
+		Source:         source,
+	}
+}
+
+type AssetDocResult struct {
+	Id        string    `bson:"_id"`
+	Kind      string    `bson:"kind"`
+	Name      string    `bson:"name"`
+	Filename  string    `bson:"filename"`
+	Sha256    string    `bson:"sha256"`
+	FileSize  int       `bson:"fileSize"`
+	AuthorId  string    `bson:"authorId"`
+	DateAdded time.Time `bson:"dateAdded"`
+}
+
+func (adr AssetDocResult) getAssetDocument() dbController.AssetDocument {
+	return dbController.AssetDocument{
+		Id:        adr.Id,
+		Kind:      dbController.AssetKind(adr.Kind),
+		Name:      adr.Name,
+		Filename:  adr.Filename,
+		Sha256:    adr.Sha256,
+		FileSize:  adr.FileSize,
+		AuthorId:  adr.AuthorId,
+		DateAdded: adr.DateAdded,
 	}
 }
@@ -0,0 +1,116 @@
+package imageServer
+
+import (
+	"fmt"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// The number of images that are read from the database at a time while
+// backfilling placeholders
+const PLACEHOLDER_BACKFILL_PAGE_SIZE = 100
+
+// The result of adding placeholders to existing images. Errors holds problems
+// with individual images, which don't stop the backfill.
+type PlaceholderBackfillReport struct {
+	ImagesScanned int
+	Updated       []string
+	Errors        []string
+}
+
+func (pr PlaceholderBackfillReport) Print() {
+	fmt.Printf("Images scanned: %v\n", pr.ImagesScanned)
+	fmt.Printf("Images updated: %v\n", len(pr.Updated))
+
+	for _, msg := range pr.Errors {
+		fmt.Printf("Error: %v\n", msg)
+	}
+}
+
+// Makes the BlurHash and LQIP of every image that doesn't have them. The
+// placeholders are made from the image's original file, or from its largest
+// file if the original wasn't kept.
+func (ic *ImageController) BackfillPlaceholders() (PlaceholderBackfillReport, error) {
+	report := PlaceholderBackfillReport{
+		Updated: make([]string, 0),
+		Errors:  make([]string, 0),
+	}
+
+	filter := dbController.MakeSortImageFilter("")
+	filter.ShowPrivate = true
+
+	// Setting placeholders doesn't change the order of the images, so the pages
+	// stay the same while we update them.
+	for page := 1; ; page++ {
+		images, err := (*ic.DBController).GetImagesData(page, PLACEHOLDER_BACKFILL_PAGE_SIZE, filter)
+
+		if err != nil {
+			return report, err
+		}
+
+		for _, img := range images {
+			report.ImagesScanned++
+
+			if len(img.BlurHash) > 0 && len(img.Lqip) > 0 {
+				continue
+			}
+
+			if err := ic.addPlaceholders(img); err != nil {
+				report.Errors = append(report.Errors, img.Id+": "+err.Error())
+				continue
+			}
+
+			report.Updated = append(report.Updated, img.Id)
+		}
+
+		if len(images) < PLACEHOLDER_BACKFILL_PAGE_SIZE {
+			return report, nil
+		}
+	}
+}
+
+func (ic *ImageController) addPlaceholders(img dbController.ImageDocument) error {
+	source, ok := getPlaceholderSource(img.ImageFiles)
+
+	if !ok {
+		return dbController.NewInvalidInputError("the image has no files")
+	}
+
+	fileBytes, err := ic.FileStore.Get(source.GetStorageName())
+
+	if err != nil {
+		return err
+	}
+
+	placeholders, err := imageHandler.MakePlaceholdersFromBytes(fileBytes)
+
+	if err != nil {
+		return err
+	}
+
+	return (*ic.DBController).SetImagePlaceholders(dbController.ImagePlaceholdersDocument{
+		Id:       img.Id,
+		BlurHash: placeholders.BlurHash,
+		Lqip:     placeholders.Lqip,
+	})
+}
+
+// Returns the original file, or the largest file of the image
+func getPlaceholderSource(files []dbController.ImageFileDocument) (dbController.ImageFileDocument, bool) {
+	var source dbController.ImageFileDocument
+	largest := -1
+
+	for _, file := range files {
+		if file.FormatName == "original" {
+			return file, true
+		}
+
+		if area := file.ImageSize.Width * file.ImageSize.Height; area > largest {
+			source = file
+			largest = area
+		}
+	}
+
+	return source, largest >= 0
+}
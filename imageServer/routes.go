@@ -1,13 +1,16 @@
 package imageServer
 
 import (
+	"io"
 	"net/http"
 	"strconv"
 
 	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
 
+	"methompson.com/image-microservice/imageServer/constants"
 	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
 )
 
 func (srv *ImageServer) SetRoutes() {
@@ -26,8 +29,21 @@ func (srv *ImageServer) SetRoutes() {
 
 	srv.GinEngine.POST("/add-image", srv.EnsureLoggedIn, srv.PostAddImage)
 	srv.GinEngine.POST("/edit-image-file", srv.EnsureLoggedIn, srv.PostEditImageFile)
+	srv.GinEngine.POST("/transform-image", srv.EnsureLoggedIn, srv.PostTransformImage)
 	srv.GinEngine.POST("/delete-image", srv.EnsureLoggedIn, srv.PostDeleteImage)
 	srv.GinEngine.POST("/delete-image-file", srv.EnsureLoggedIn, srv.PostDeleteImageFile)
+
+	// Watermarks that conversion requests can composite over image files
+	srv.GinEngine.GET("/watermarks", srv.EnsureLoggedIn, srv.GetWatermarks)
+	srv.GinEngine.POST("/add-watermark", srv.EnsureLoggedIn, srv.PostAddWatermark)
+	srv.GinEngine.POST("/delete-watermark", srv.EnsureLoggedIn, srv.PostDeleteWatermark)
+
+	// Fonts that text overlays can use
+	srv.GinEngine.GET("/fonts", srv.EnsureLoggedIn, srv.GetFonts)
+	srv.GinEngine.POST("/add-font", srv.EnsureLoggedIn, srv.PostAddFont)
+	srv.GinEngine.POST("/delete-font", srv.EnsureLoggedIn, srv.PostDeleteFont)
+
+	srv.GinEngine.POST("/admin/check-consistency", srv.EnsureLoggedIn, srv.EnsureAdmin, srv.PostCheckConsistency)
 }
 
 func (srv *ImageServer) SetMaxImageUploadSize(ctx *gin.Context) {
@@ -79,7 +95,7 @@ func (srv *ImageServer) HandleParsedToken(ctx *gin.Context, token *auth.Token, t
 		return
 	}
 
-	ctx.Set("role", role)
+	ctx.Set("userRole", role)
 }
 
 func (srv *ImageServer) EnsureLoggedIn(ctx *gin.Context) {
@@ -97,7 +113,20 @@ func (srv *ImageServer) EnsureLoggedIn(ctx *gin.Context) {
 	// Role Error
 	role := ctx.GetString("userRole")
 
-	if len(role) <= 0 && !srv.CanEditImages(role) {
+	if !srv.CanEditImages(role) {
+		ctx.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{"error": "not authorized"},
+		)
+		return
+	}
+
+	ctx.Next()
+}
+
+// Must run after EnsureLoggedIn
+func (srv *ImageServer) EnsureAdmin(ctx *gin.Context) {
+	if ctx.GetString("userRole") != constants.USER_ADMIN {
 		ctx.AbortWithStatusJSON(
 			http.StatusUnauthorized,
 			gin.H{"error": "not authorized"},
@@ -126,10 +155,14 @@ func (srv *ImageServer) GetImagesByPage(ctx *gin.Context) {
 	srv.GetImages(ctx, pageNum)
 }
 
-// TODO start defining filters that users can pass via query parameters
+// The color query parameter filters images by their palette, e.g. ?color=%231a2b3c
+// or ?color=1a2b3c. colorDistance sets how close a palette color has to be.
+// TODO start defining more filters that users can pass via query parameters
 func (srv *ImageServer) GetImages(ctx *gin.Context, page int) {
 	pagination := ctx.Query("pagination")
 	sortBy := ctx.Query("sortBy")
+	colorHex := ctx.Query("color")
+	colorDistance := ctx.Query("colorDistance")
 
 	paginationNum, paginationNumErr := strconv.Atoi(pagination)
 	if paginationNumErr != nil {
@@ -138,7 +171,7 @@ func (srv *ImageServer) GetImages(ctx *gin.Context, page int) {
 
 	showPrivate := userLoggedIn(ctx)
 
-	images, err := srv.ImageController.GetImages(page, paginationNum, sortBy, showPrivate)
+	images, err := srv.ImageController.GetImages(page, paginationNum, sortBy, showPrivate, colorHex, colorDistance)
 
 	if err != nil {
 		handleControllerErrors(ctx, err)
@@ -158,7 +191,7 @@ func (srv *ImageServer) GetImages(ctx *gin.Context, page int) {
 }
 
 func (srv *ImageServer) GetImageByName(ctx *gin.Context) {
-	filepath, imgDoc, err := srv.ImageController.GetImageByName(ctx)
+	imgDoc, err := srv.ImageController.GetImageByName(ctx)
 
 	if err != nil {
 		handleControllerErrors(ctx, err)
@@ -178,8 +211,43 @@ func (srv *ImageServer) GetImageByName(ctx *gin.Context) {
 	// ctx.Header("Content-Description", "File Transfer")
 	// ctx.Header("Content-Transfer-Encoding", "binary")
 	// ctx.Header("Content-Disposition", "attachment; filename="+imgDoc.Filename)
+	fileUrl, err := srv.ImageController.GetImageFileURL(imgDoc)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	// Some file stores let clients download the file directly
+	if len(fileUrl) > 0 {
+		ctx.Redirect(http.StatusTemporaryRedirect, fileUrl)
+		return
+	}
+
+	reader, fileInfo, err := srv.ImageController.GetImageFileStream(imgDoc)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+	defer reader.Close()
+
 	ctx.Header("Content-Type", imgDoc.GetMimeType())
-	ctx.File(filepath)
+
+	// If the store lets us seek, we let http.ServeContent handle ranged and
+	// conditional requests. Otherwise, we just stream the whole file.
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(ctx.Writer, ctx.Request, imgDoc.Filename, fileInfo.ModTime, seeker)
+		return
+	}
+
+	ctx.DataFromReader(
+		http.StatusOK,
+		fileInfo.Size,
+		imgDoc.GetMimeType(),
+		reader,
+		nil,
+	)
 }
 
 func (srv *ImageServer) GetImageById(ctx *gin.Context) {
@@ -198,6 +266,46 @@ func (srv *ImageServer) GetImageById(ctx *gin.Context) {
 	)
 }
 
+func (srv *ImageServer) GetWatermarks(ctx *gin.Context) {
+	watermarks, err := srv.ImageController.GetWatermarks()
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	output := make([]map[string]interface{}, 0)
+
+	for _, watermark := range watermarks {
+		output = append(output, watermark.GetMap())
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		output,
+	)
+}
+
+func (srv *ImageServer) GetFonts(ctx *gin.Context) {
+	fonts, err := srv.ImageController.GetFonts()
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	output := make([]map[string]interface{}, 0)
+
+	for _, font := range fonts {
+		output = append(output, font.GetMap())
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		output,
+	)
+}
+
 // POST
 
 // POST /add-image
@@ -250,6 +358,33 @@ func (srv *ImageServer) PostEditImageFile(ctx *gin.Context) {
 	)
 }
 
+// POST /transform-image
+// Rotates or flips an image's original and rewrites all of the image's files
+// from it. The image keeps its id.
+func (srv *ImageServer) PostTransformImage(ctx *gin.Context) {
+	var body TransformImageBody
+
+	if bindJsonErr := ctx.ShouldBindJSON(&body); bindJsonErr != nil {
+		ctx.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{"error": "missing required values"},
+		)
+		return
+	}
+
+	err := srv.ImageController.TransformImage(body)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{},
+	)
+}
+
 func (srv *ImageServer) PostDeleteImage(ctx *gin.Context) {
 	// Extract the body
 	var body DeleteImageBody
@@ -300,16 +435,141 @@ func (srv *ImageServer) PostDeleteImageFile(ctx *gin.Context) {
 	)
 }
 
+// POST /add-watermark
+// Saves a PNG watermark that conversion requests can refer to by name. The
+// form has the watermark's name and a "watermark" file.
+func (srv *ImageServer) PostAddWatermark(ctx *gin.Context) {
+	id, err := srv.ImageController.AddWatermark(ctx)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"id": id},
+	)
+}
+
+func (srv *ImageServer) PostDeleteWatermark(ctx *gin.Context) {
+	var body DeleteAssetBody
+
+	if bindJsonErr := ctx.ShouldBindJSON(&body); bindJsonErr != nil {
+		ctx.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{"error": "missing required values"},
+		)
+		return
+	}
+
+	err := srv.ImageController.DeleteWatermark(body.GetAssetDocument())
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{},
+	)
+}
+
+// POST /add-font
+// Saves a TrueType or OpenType font that text overlays can refer to by name.
+// The form has the font's name and a "font" file.
+func (srv *ImageServer) PostAddFont(ctx *gin.Context) {
+	id, err := srv.ImageController.AddFont(ctx)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{"id": id},
+	)
+}
+
+func (srv *ImageServer) PostDeleteFont(ctx *gin.Context) {
+	var body DeleteAssetBody
+
+	if bindJsonErr := ctx.ShouldBindJSON(&body); bindJsonErr != nil {
+		ctx.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{"error": "missing required values"},
+		)
+		return
+	}
+
+	err := srv.ImageController.DeleteFont(body.GetAssetDocument())
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		gin.H{},
+	)
+}
+
+// POST /admin/check-consistency
+// Compares the file store with the database. Orphaned files are only reported
+// unless the action is "quarantine" or "delete". minAge is in seconds.
+func (srv *ImageServer) PostCheckConsistency(ctx *gin.Context) {
+	var body CheckConsistencyBody
+
+	if bindJsonErr := ctx.ShouldBindJSON(&body); bindJsonErr != nil && bindJsonErr != io.EOF {
+		ctx.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{"error": "invalid body"},
+		)
+		return
+	}
+
+	opts, err := body.GetConsistencyOptions()
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	report, err := srv.ImageController.CheckConsistency(opts)
+
+	if err != nil {
+		handleControllerErrors(ctx, err)
+		return
+	}
+
+	ctx.JSON(
+		http.StatusOK,
+		report.GetMap(),
+	)
+}
+
 func handleControllerErrors(ctx *gin.Context, err error) {
 	var status int
 	var message string
 	switch err.(type) {
-	case dbController.InvalidInputError:
+	case dbController.InvalidInputError, imageHandler.MissingAssetError:
 		status = http.StatusBadRequest
 		message = "invalid input"
 	case dbController.NoResultsError:
 		status = http.StatusNotFound
 		message = "not found"
+	case dbController.DuplicateEntryError:
+		status = http.StatusConflict
+		message = "already exists"
+	case dbController.ConflictError:
+		status = http.StatusConflict
+		message = "conflict"
+	case imageHandler.FileNotFoundError:
+		status = http.StatusNotFound
+		message = "not found"
 	default:
 		status = http.StatusInternalServerError
 		message = "internal server error"
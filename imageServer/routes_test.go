@@ -0,0 +1,227 @@
+package imageServer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/gin-gonic/gin"
+
+	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// Makes a server with the real routes. The token middleware stands in for
+// Firebase and runs before the routes parse the request's auth.
+func makeRouteTestServer(t *testing.T, token *auth.Token) *ImageServer {
+	t.Setenv(constants.AUTH_TESTING_MODE, "false")
+	gin.SetMode(gin.TestMode)
+
+	ic, _ := makeTestController(t)
+
+	srv := &ImageServer{
+		ImageController: ic,
+		GinEngine:       gin.New(),
+	}
+
+	srv.GinEngine.Use(func(ctx *gin.Context) {
+		if token == nil {
+			srv.HandleParsedToken(ctx, nil, errors.New("no token"))
+		} else {
+			srv.HandleParsedToken(ctx, token, nil)
+		}
+	})
+
+	srv.SetRoutes()
+
+	return srv
+}
+
+func makeRoleToken(role string) *auth.Token {
+	return &auth.Token{
+		UID:    "uid-" + role,
+		Claims: map[string]interface{}{"role": role},
+	}
+}
+
+func TestRouteAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         *auth.Token
+		canEdit       bool
+		canAdminister bool
+	}{
+		{"anonymous", nil, false, false},
+		{"no role", &auth.Token{UID: "uid"}, false, false},
+		{"viewer", makeRoleToken(constants.USER_VIEWER), false, false},
+		{"editor", makeRoleToken(constants.USER_EDITOR), true, false},
+		{"admin", makeRoleToken(constants.USER_ADMIN), true, true},
+	}
+
+	for _, test := range tests {
+		srv := makeRouteTestServer(t, test.token)
+
+		routes := []struct {
+			path    string
+			allowed bool
+		}{
+			{"/delete-image", test.canEdit},
+			{"/transform-image", test.canEdit},
+			{"/admin/check-consistency", test.canAdminister},
+		}
+
+		for _, route := range routes {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, route.path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+
+			srv.GinEngine.ServeHTTP(rec, req)
+
+			if allowed := rec.Code != http.StatusUnauthorized; allowed != route.allowed {
+				t.Fatalf("%v: %v status = '%v', Should be allowed: '%v'", test.name, route.path, rec.Code, route.allowed)
+			}
+		}
+	}
+}
+
+// Encodes a solid PNG image
+func makeSolidPng(width, height int, c color.RGBA) []byte {
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+
+	return buf.Bytes()
+}
+
+// Adds an image with a red PNG original and a web file made by the request
+func addRouteTestImage(t *testing.T, ic *ImageController, idName string, request *imageHandler.ConversionRequest) string {
+	originalBytes := makeSolidPng(40, 20, color.RGBA{255, 0, 0, 255})
+
+	original := imageHandler.ImageSizeFormat{
+		FormatName: "original",
+		Filename:   idName + "@original.png",
+		ImageSize:  imageHandler.ImageSize{Width: 40, Height: 20},
+		ImageType:  imageHandler.Png,
+		Sha256:     imageHandler.HashBytes(originalBytes),
+	}
+	web := imageHandler.ImageSizeFormat{
+		FormatName: "web",
+		Filename:   idName + "@web.png",
+		ImageSize:  imageHandler.ImageSize{Width: 20, Height: 10},
+		ImageType:  imageHandler.Png,
+		Sha256:     imageHandler.HashBytes([]byte(idName)),
+		Request:    request,
+	}
+
+	ic.FileStore.Put(original.GetStorageName(), originalBytes)
+	ic.FileStore.Put(web.GetStorageName(), []byte(idName))
+
+	id, err := (*ic.DBController).AddImageData(dbController.AddImageDocument{
+		Title:       idName,
+		Filename:    idName + ".png",
+		IdName:      idName,
+		SizeFormats: []imageHandler.ImageSizeFormat{original, web},
+		DateAdded:   time.Now(),
+	})
+
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	return id
+}
+
+func postTransformImage(srv *ImageServer, body string) int {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/transform-image", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	srv.GinEngine.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+// Files are made again from the request that they were made from, so a
+// watermarked file keeps its watermark when the image is rotated
+func TestTransformImageKeepsWatermark(t *testing.T) {
+	srv := makeRouteTestServer(t, makeRoleToken(constants.USER_EDITOR))
+	ic := &srv.ImageController
+
+	logo := makeSolidPng(4, 4, color.RGBA{0, 0, 255, 255})
+	_, err := ic.addAsset(dbController.AddAssetDocument{
+		Kind:   dbController.WatermarkAsset,
+		Name:   "logo",
+		Sha256: imageHandler.HashBytes(logo),
+	}, logo)
+
+	if err != nil {
+		t.Fatalf("addAsset returned error '%v'", err)
+	}
+
+	id := addRouteTestImage(t, ic, "wm", &imageHandler.ConversionRequest{
+		Suffix:      "web",
+		ResizeOp:    "scale",
+		LongestSide: 20,
+		Watermark:   &imageHandler.WatermarkRequest{Name: "logo", Gravity: "northwest"},
+	})
+
+	if code := postTransformImage(srv, `{"id": "`+id+`", "rotate": 180}`); code != http.StatusOK {
+		t.Fatalf("status = '%v', Should be '%v'", code, http.StatusOK)
+	}
+
+	web, err := (*ic.DBController).GetImageByName("wm@web.png")
+	if err != nil {
+		t.Fatalf("GetImageByName returned error '%v'", err)
+	}
+
+	if web.Request == nil || web.Request.Watermark == nil {
+		t.Fatalf("web.Request = '%v', Should keep the watermark", web.Request)
+	}
+
+	webBytes, err := ic.FileStore.Get(web.GetStorageName())
+	if err != nil {
+		t.Fatalf("Get returned error '%v'", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(webBytes))
+	if err != nil {
+		t.Fatalf("Decode returned error '%v'", err)
+	}
+
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0 || g != 0 || b != 0xffff {
+		t.Fatalf("pixel = '%v %v %v', Should be the blue watermark", r, g, b)
+	}
+
+	if r, _, b, _ := img.At(19, 9).RGBA(); r != 0xffff || b != 0 {
+		t.Fatalf("pixel = '%v %v', Should be the red image", r, b)
+	}
+}
+
+// Files that were made before requests were stored can't be made again
+// unless the transform includes their operation
+func TestTransformImageRequiresUnstoredOperations(t *testing.T) {
+	srv := makeRouteTestServer(t, makeRoleToken(constants.USER_EDITOR))
+	id := addRouteTestImage(t, &srv.ImageController, "old", nil)
+
+	if code := postTransformImage(srv, `{"id": "`+id+`", "rotate": 90}`); code != http.StatusBadRequest {
+		t.Fatalf("status = '%v', Should be '%v'", code, http.StatusBadRequest)
+	}
+
+	body := `{"id": "` + id + `", "rotate": 90, "operations": [{"suffix": "web", "resizeOp": "scale", "longestSide": 20}]}`
+
+	if code := postTransformImage(srv, body); code != http.StatusOK {
+		t.Fatalf("status = '%v', Should be '%v'", code, http.StatusOK)
+	}
+}
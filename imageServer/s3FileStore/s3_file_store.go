@@ -0,0 +1,424 @@
+package s3FileStore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// Configuration for an S3 compatible storage backend.
+// Bucket is the name of the bucket that holds the image files
+// Prefix is prepended to every filename to make the object key, e.g. "images/"
+// Endpoint is the base URL of the S3 API. Defaults to AWS S3 in Region
+// Region is the region used to sign requests. Defaults to us-east-1
+// UsePathStyle addresses the bucket as endpoint/bucket instead of bucket.endpoint. Required by MinIO
+// ServeByRedirect makes FileURL return presigned URLs so clients download files from the bucket directly
+// PresignExpiry is how long presigned URLs remain valid
+type S3Config struct {
+	Bucket          string
+	Prefix          string
+	Endpoint        string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	UsePathStyle    bool
+	ServeByRedirect bool
+	PresignExpiry   time.Duration
+}
+
+// Gets the S3 configuration from environment variables. S3_BUCKET is required.
+func GetS3ConfigFromEnv() (S3Config, error) {
+	config := S3Config{
+		Bucket:          os.Getenv(constants.S3_BUCKET),
+		Prefix:          os.Getenv(constants.S3_PREFIX),
+		Endpoint:        os.Getenv(constants.S3_ENDPOINT),
+		Region:          os.Getenv(constants.S3_REGION),
+		AccessKeyId:     os.Getenv(constants.S3_ACCESS_KEY_ID),
+		SecretAccessKey: os.Getenv(constants.S3_SECRET_ACCESS_KEY),
+		UsePathStyle:    os.Getenv(constants.S3_USE_PATH_STYLE) == "true",
+		ServeByRedirect: os.Getenv(constants.S3_SERVE_MODE) == "redirect",
+		PresignExpiry:   15 * time.Minute,
+	}
+
+	if len(config.Bucket) == 0 {
+		return config, errors.New("S3_BUCKET environment variable is required")
+	}
+
+	if expiry, err := strconv.Atoi(os.Getenv(constants.S3_PRESIGN_EXPIRY)); err == nil && expiry > 0 {
+		config.PresignExpiry = time.Duration(expiry) * time.Second
+	}
+
+	return config, nil
+}
+
+// S3FileStore keeps image files as objects in an S3 compatible bucket. It
+// speaks the S3 REST API directly and signs requests with Signature Version 4,
+// so it works with AWS S3, MinIO and other S3 compatible servers.
+type S3FileStore struct {
+	config   S3Config
+	endpoint *url.URL
+	signer   signer
+	client   *http.Client
+}
+
+func MakeS3FileStoreFromEnv() (*S3FileStore, error) {
+	config, err := GetS3ConfigFromEnv()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return MakeS3FileStore(config)
+}
+
+func MakeS3FileStore(config S3Config) (*S3FileStore, error) {
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+
+	if config.PresignExpiry <= 0 {
+		config.PresignExpiry = 15 * time.Minute
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+
+	if err != nil || len(endpoint.Host) == 0 {
+		return nil, errors.New("invalid S3 endpoint: " + config.Endpoint)
+	}
+
+	return &S3FileStore{
+		config:   config,
+		endpoint: endpoint,
+		signer: signer{
+			AccessKeyId:     config.AccessKeyId,
+			SecretAccessKey: config.SecretAccessKey,
+			Region:          config.Region,
+		},
+		client: &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// Gets the object key for a filename
+func (sfs *S3FileStore) objectKey(filename string) string {
+	return sfs.config.Prefix + filename
+}
+
+// Makes the URL of an object, based on the path style setting
+func (sfs *S3FileStore) objectUrl(filename string) *url.URL {
+	u := *sfs.endpoint
+
+	var objectPath string
+	if sfs.config.UsePathStyle {
+		objectPath = path.Join("/", sfs.endpoint.Path, sfs.config.Bucket, sfs.objectKey(filename))
+	} else {
+		u.Host = sfs.config.Bucket + "." + sfs.endpoint.Host
+		objectPath = path.Join("/", sfs.endpoint.Path, sfs.objectKey(filename))
+	}
+
+	u.Path = objectPath
+	u.RawPath = uriEncode(objectPath, false)
+
+	return &u
+}
+
+// Makes the URL of the bucket itself, which is used to list objects
+func (sfs *S3FileStore) bucketUrl() *url.URL {
+	u := *sfs.endpoint
+
+	var bucketPath string
+	if sfs.config.UsePathStyle {
+		bucketPath = path.Join("/", sfs.endpoint.Path, sfs.config.Bucket) + "/"
+	} else {
+		u.Host = sfs.config.Bucket + "." + sfs.endpoint.Host
+		bucketPath = path.Join("/", sfs.endpoint.Path) + "/"
+	}
+
+	u.Path = bucketPath
+	u.RawPath = uriEncode(bucketPath, false)
+
+	return &u
+}
+
+// Makes, signs and sends a request to the S3 API.
+func (sfs *S3FileStore) doRequest(method string, u *url.URL, body []byte, headers map[string]string) (*http.Response, error) {
+	var reader io.Reader
+	payloadHash := emptyPayloadHash
+
+	if body != nil {
+		reader = bytes.NewReader(body)
+		payloadHash = hashHex(body)
+	}
+
+	req, err := http.NewRequest(method, u.String(), reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	sfs.signer.signRequest(req, payloadHash, time.Now())
+
+	return sfs.client.Do(req)
+}
+
+// Converts an unsuccessful response into an error. A 404 response results in
+// a FileNotFoundError. The response body is closed.
+func getResponseError(resp *http.Response, filename string) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return imageHandler.NewFileNotFoundError("file not found: " + filename)
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return fmt.Errorf("s3 request failed with status %d: %s", resp.StatusCode, string(body))
+}
+
+func isSuccessful(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// Gets file information from the headers of a GET or HEAD response
+func getFileInfo(resp *http.Response, filename string) imageHandler.FileInfo {
+	info := imageHandler.FileInfo{
+		Filename: filename,
+		Size:     resp.ContentLength,
+	}
+
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+
+	return info
+}
+
+func (sfs *S3FileStore) Put(filename string, data []byte) error {
+	headers := map[string]string{}
+
+	if contentType := mime.TypeByExtension(path.Ext(filename)); len(contentType) > 0 {
+		headers["Content-Type"] = contentType
+	}
+
+	resp, err := sfs.doRequest(http.MethodPut, sfs.objectUrl(filename), data, headers)
+
+	if err != nil {
+		return err
+	}
+
+	if !isSuccessful(resp) {
+		return getResponseError(resp, filename)
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+func (sfs *S3FileStore) Get(filename string) ([]byte, error) {
+	reader, _, err := sfs.Stream(filename)
+
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (sfs *S3FileStore) Stat(filename string) (imageHandler.FileInfo, error) {
+	resp, err := sfs.doRequest(http.MethodHead, sfs.objectUrl(filename), nil, nil)
+
+	if err != nil {
+		return imageHandler.FileInfo{}, err
+	}
+
+	if !isSuccessful(resp) {
+		return imageHandler.FileInfo{}, getResponseError(resp, filename)
+	}
+
+	resp.Body.Close()
+
+	return getFileInfo(resp, filename), nil
+}
+
+// S3 does not report whether an object existed when deleting it, so we check
+// for the file first in order to return a FileNotFoundError like other stores.
+func (sfs *S3FileStore) Delete(filename string) error {
+	if _, err := sfs.Stat(filename); err != nil {
+		return err
+	}
+
+	resp, err := sfs.doRequest(http.MethodDelete, sfs.objectUrl(filename), nil, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if !isSuccessful(resp) {
+		return getResponseError(resp, filename)
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+// S3 has no rename operation, so we copy the object to the new key and then
+// delete the old object.
+func (sfs *S3FileStore) Move(oldFilename, newFilename string) error {
+	copySource := uriEncode("/"+sfs.config.Bucket+"/"+sfs.objectKey(oldFilename), false)
+
+	resp, err := sfs.doRequest(
+		http.MethodPut,
+		sfs.objectUrl(newFilename),
+		nil,
+		map[string]string{"x-amz-copy-source": copySource},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if !isSuccessful(resp) {
+		return getResponseError(resp, oldFilename)
+	}
+
+	// A copy can fail after S3 has already sent a 200 status. In that case,
+	// the error is in the response body.
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if readErr != nil {
+		return readErr
+	}
+
+	if strings.Contains(string(body), "<Error>") {
+		return errors.New("s3 copy failed: " + string(body))
+	}
+
+	return sfs.Delete(oldFilename)
+}
+
+// Streams the object body. The returned ReadCloser is the body of the
+// response, so it can't seek.
+func (sfs *S3FileStore) Stream(filename string) (io.ReadCloser, imageHandler.FileInfo, error) {
+	resp, err := sfs.doRequest(http.MethodGet, sfs.objectUrl(filename), nil, nil)
+
+	if err != nil {
+		return nil, imageHandler.FileInfo{}, err
+	}
+
+	if !isSuccessful(resp) {
+		return nil, imageHandler.FileInfo{}, getResponseError(resp, filename)
+	}
+
+	return resp.Body, getFileInfo(resp, filename), nil
+}
+
+// Returns a presigned URL for the file if the store is configured to serve
+// files by redirect. Otherwise, returns an empty string so that the file is
+// streamed through this service.
+func (sfs *S3FileStore) FileURL(filename string) (string, error) {
+	if !sfs.config.ServeByRedirect {
+		return "", nil
+	}
+
+	return sfs.signer.presignUrl(
+		http.MethodGet,
+		sfs.objectUrl(filename),
+		sfs.config.PresignExpiry,
+		time.Now(),
+	), nil
+}
+
+// The parts of a ListObjectsV2 response that we use
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// Lists every object under the prefix with ListObjectsV2, one page at a time.
+// Objects are reported by their filename, i.e. the key without the prefix.
+func (sfs *S3FileStore) Walk(fn func(info imageHandler.FileInfo) error) error {
+	continuationToken := ""
+
+	for {
+		u := sfs.bucketUrl()
+
+		query := url.Values{}
+		query.Set("list-type", "2")
+
+		if len(sfs.config.Prefix) > 0 {
+			query.Set("prefix", sfs.config.Prefix)
+		}
+
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		u.RawQuery = getCanonicalQuery(query)
+
+		resp, err := sfs.doRequest(http.MethodGet, u, nil, nil)
+
+		if err != nil {
+			return err
+		}
+
+		if !isSuccessful(resp) {
+			return getResponseError(resp, sfs.config.Bucket)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			err := fn(imageHandler.FileInfo{
+				Filename: strings.TrimPrefix(object.Key, sfs.config.Prefix),
+				Size:     object.Size,
+				ModTime:  object.LastModified,
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+
+		continuationToken = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,206 @@
+package s3FileStore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const signingAlgorithm = "AWS4-HMAC-SHA256"
+const amzDateFormat = "20060102T150405Z"
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// The sha256 hash of an empty payload. Used for requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Credentials and region used to sign requests with AWS Signature Version 4
+type signer struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Region          string
+}
+
+// Signs the request by adding the x-amz-date, x-amz-content-sha256 and
+// Authorization headers. Every header that is set on the request at this
+// point, plus the host, is included in the signature.
+func (s signer) signRequest(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format(amzDateFormat)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders, signedHeaders := getCanonicalHeaders(req)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		getCanonicalUri(req.URL),
+		getCanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.getScope(t)
+	signature := s.getSignature(t, scope, canonicalRequest)
+
+	authorization := fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm,
+		s.AccessKeyId,
+		scope,
+		signedHeaders,
+		signature,
+	)
+
+	req.Header.Set("Authorization", authorization)
+}
+
+// Makes a presigned URL for the method and URL. Anyone with the resulting URL
+// can perform the request until the URL expires.
+func (s signer) presignUrl(method string, u *url.URL, expires time.Duration, t time.Time) string {
+	presigned := *u
+	scope := s.getScope(t)
+
+	query := presigned.Query()
+	query.Set("X-Amz-Algorithm", signingAlgorithm)
+	query.Set("X-Amz-Credential", s.AccessKeyId+"/"+scope)
+	query.Set("X-Amz-Date", t.UTC().Format(amzDateFormat))
+	query.Set("X-Amz-Expires", fmt.Sprint(int64(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		getCanonicalUri(&presigned),
+		getCanonicalQuery(query),
+		"host:" + presigned.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	signature := s.getSignature(t, scope, canonicalRequest)
+
+	presigned.RawQuery = getCanonicalQuery(query) + "&X-Amz-Signature=" + signature
+
+	return presigned.String()
+}
+
+func (s signer) getScope(t time.Time) string {
+	return t.UTC().Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// Derives the signing key from the secret and calculates the signature for
+// the canonical request.
+func (s signer) getSignature(t time.Time, scope, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		t.UTC().Format(amzDateFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	dateKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), t.UTC().Format("20060102"))
+	regionKey := hmacSha256(dateKey, s.Region)
+	serviceKey := hmacSha256(regionKey, "s3")
+	signingKey := hmacSha256(serviceKey, "aws4_request")
+
+	return hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+}
+
+// Returns the canonical header string and the list of signed headers. Header
+// names are lower cased and sorted and values are trimmed.
+func getCanonicalHeaders(req *http.Request) (canonicalHeaders, signedHeaders string) {
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+
+	for key, values := range req.Header {
+		trimmed := make([]string, 0)
+		for _, v := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(v), " "))
+		}
+
+		headers[strings.ToLower(key)] = strings.Join(trimmed, ",")
+	}
+
+	keys := make([]string, 0)
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, key := range keys {
+		builder.WriteString(key + ":" + headers[key] + "\n")
+	}
+
+	return builder.String(), strings.Join(keys, ";")
+}
+
+// S3 does not normalize the path, so we just URI encode every segment.
+func getCanonicalUri(u *url.URL) string {
+	if len(u.Path) == 0 {
+		return "/"
+	}
+
+	return uriEncode(u.Path, false)
+}
+
+// Query parameters are sorted by key and both keys and values are URI encoded
+func getCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0)
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0)
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+
+		for _, v := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// URI encodes every byte except for the unreserved characters defined in
+// RFC 3986. Slashes are only encoded if encodeSlash is true.
+func uriEncode(value string, encodeSlash bool) string {
+	var builder strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		if (c >= 'A' && c <= 'Z') ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' ||
+			(c == '/' && !encodeSlash) {
+			builder.WriteByte(c)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+
+	return builder.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
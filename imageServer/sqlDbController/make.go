@@ -0,0 +1,72 @@
+package sqlDbController
+
+import (
+	"database/sql"
+	"os"
+
+	// Database drivers for the supported dialects
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"methompson.com/image-microservice/imageServer/constants"
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+// The SQL dialects that are supported. Queries are written for SQLite and
+// rebound for PostgreSQL when required.
+const SQLITE = "sqlite"
+const POSTGRES = "postgres"
+
+// The default database file used when SQL_DSN isn't set for SQLite
+const DEFAULT_SQLITE_DSN = "./imageDb.sqlite"
+
+// Makes a SqlDbController for the dialect using the SQL_DSN environment
+// variable. SQLite uses a file in the working directory by default, while
+// PostgreSQL requires SQL_DSN to be set.
+func MakeSqlDbControllerFromEnv(dialect string) (*SqlDbController, error) {
+	dsn := os.Getenv(constants.SQL_DSN)
+
+	if len(dsn) == 0 {
+		if dialect != SQLITE {
+			return nil, dbController.NewDBError("SQL_DSN environment variable is required for " + dialect)
+		}
+
+		dsn = DEFAULT_SQLITE_DSN
+	}
+
+	return MakeSqlDbController(dialect, dsn)
+}
+
+// Opens a connection pool for the dialect and data source name and wraps it
+// in a SqlDbController.
+func MakeSqlDbController(dialect string, dsn string) (*SqlDbController, error) {
+	var driverName string
+
+	switch dialect {
+	case SQLITE:
+		driverName = "sqlite3"
+	case POSTGRES:
+		driverName = "postgres"
+	default:
+		return nil, dbController.NewInvalidInputError("unsupported sql dialect: " + dialect)
+	}
+
+	db, err := sql.Open(driverName, dsn)
+
+	if err != nil {
+		return nil, dbController.NewDBError("Error connecting: " + err.Error())
+	}
+
+	// SQLite only allows one writer at a time. Using a single connection
+	// prevents "database is locked" errors and lets in-memory databases work,
+	// since every connection to ":memory:" opens a new database.
+	if dialect == SQLITE {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, dbController.NewDBError("Error connecting: " + err.Error())
+	}
+
+	return &SqlDbController{db, dialect}, nil
+}
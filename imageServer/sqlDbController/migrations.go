@@ -0,0 +1,353 @@
+package sqlDbController
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+// The table that records which migrations have been applied. Each row's
+// version is the migration's version.
+const MIGRATION_TABLE = "schema_migrations"
+
+// Migrations can include data backfills, so they get more time than regular
+// operations.
+const MIGRATION_TIMEOUT = 5 * time.Minute
+
+// A migration moves the database from version-1 to version. Each migration
+// runs in one transaction with the record of its version. Databases created
+// before migrations existed have no record of which columns they already
+// have, so migrations must be idempotent.
+type migration struct {
+	version     int
+	description string
+	up          func(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error
+}
+
+// All migrations in the order they're applied. Versions must start at 1 and
+// increase by 1. Never change a migration that has been released, add a new
+// one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "add SHA-256 digests to images and image files",
+		up:          addSha256,
+	},
+	{
+		version:     2,
+		description: "add crop regions to image files",
+		up:          addCropRegions,
+	},
+	{
+		version:     3,
+		description: "create the asset table",
+		up:          createAssetTable,
+	},
+	{
+		version:     4,
+		description: "add encoder settings to image files",
+		up:          addEncoderSettings,
+	},
+	{
+		version:     5,
+		description: "add capped outputs to image files",
+		up:          addCappedOutputs,
+	},
+	{
+		version:     6,
+		description: "add placeholders to images",
+		up:          addPlaceholders,
+	},
+	{
+		version:     7,
+		description: "create the image palette color table",
+		up:          createPaletteTable,
+	},
+	{
+		version:     8,
+		description: "add conversion requests to image files",
+		up:          addConversionRequests,
+	},
+	{
+		version:     9,
+		description: "add sources to images",
+		up:          addImageSources,
+	},
+}
+
+// Returns the version of the newest migration that this binary knows about
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func (sdbc *SqlDbController) migrationTableStatement() string {
+	return `CREATE TABLE IF NOT EXISTS ` + MIGRATION_TABLE + ` (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`
+}
+
+// Returns the version of the newest migration that was applied to the
+// database, or 0 if no migrations were applied.
+func (sdbc *SqlDbController) GetSchemaVersion() (int, error) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var version int
+	err := sdbc.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+MIGRATION_TABLE).Scan(&version)
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return version, nil
+}
+
+// Returns the migrations that haven't been applied to a database at version
+func getPendingMigrations(version int) []migration {
+	pending := make([]migration, 0)
+
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+// Applies all pending migrations in order and returns the versions that were
+// applied. A database that is ahead of the binary was migrated by a newer
+// release, so we refuse to use it.
+func (sdbc *SqlDbController) RunMigrations() ([]int, error) {
+	applied := make([]int, 0)
+
+	version, err := sdbc.GetSchemaVersion()
+
+	if err != nil {
+		return applied, err
+	}
+
+	if latest := LatestSchemaVersion(); version > latest {
+		msg := fmt.Sprintf("database schema version %v is newer than the latest supported version %v", version, latest)
+		return applied, dbController.NewDBError(msg)
+	}
+
+	for _, m := range getPendingMigrations(version) {
+		if err := sdbc.runMigration(m); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, m.version)
+	}
+
+	return applied, nil
+}
+
+func (sdbc *SqlDbController) runMigration(m migration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), MIGRATION_TIMEOUT)
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := m.up(sdbc, ctx, tx); err != nil {
+		msg := fmt.Sprintf("migration %v (%v) failed: %v", m.version, m.description, err.Error())
+		return dbController.NewDBError(msg)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sdbc.rebind("INSERT INTO "+MIGRATION_TABLE+" (version, description, applied_at) VALUES (?, ?, ?)"),
+		m.version,
+		m.description,
+		timeToMillis(time.Now()),
+	)
+
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Returns whether the table has the column
+func (sdbc *SqlDbController) columnExists(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	if sdbc.dialect == POSTGRES {
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2"
+	}
+
+	var count int
+	if err := tx.QueryRowContext(ctx, query, table, column).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Adds the column unless the table already has it. NOT NULL columns need a
+// default, since existing rows get the default value.
+func (sdbc *SqlDbController) addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	exists, err := sdbc.columnExists(ctx, tx, table, column)
+
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+
+	return err
+}
+
+/****************************************************************************************
+* Migrations
+****************************************************************************************/
+
+// Image files are stored under their SHA-256 digest and are counted by digest
+// before a stored file is deleted. Existing image files have no digest and keep
+// using their filename, so the digests default to an empty string.
+func addSha256(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	if err := sdbc.addColumn(ctx, tx, IMAGE_TABLE, "original_sha256", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if err := sdbc.addColumn(ctx, tx, IMAGE_FILE_TABLE, "sha256", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS image_files_sha256 ON `+IMAGE_FILE_TABLE+` (sha256)`)
+
+	return err
+}
+
+// Files made by the cover, crop and smartcrop operations record the region of
+// the original image that was kept. Other files have no crop region.
+func addCropRegions(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	for _, column := range []string{"crop_x", "crop_y", "crop_width", "crop_height"} {
+		if err := sdbc.addColumn(ctx, tx, IMAGE_FILE_TABLE, column, "INTEGER"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Assets are uploaded files that conversion operations use, like watermarks.
+// Names are unique for each kind of asset and asset files are counted by
+// digest, like image files.
+func createAssetTable(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + ASSET_TABLE + ` (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			sha256 TEXT NOT NULL,
+			file_size INTEGER NOT NULL,
+			author_id TEXT NOT NULL,
+			date_added BIGINT NOT NULL,
+			UNIQUE (kind, name)
+		)`,
+		`CREATE INDEX IF NOT EXISTS assets_sha256 ON ` + ASSET_TABLE + ` (sha256)`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The encoder settings of a file are stored as a JSON object. Files that were
+// made before the settings were recorded have none.
+func addEncoderSettings(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	return sdbc.addColumn(ctx, tx, IMAGE_FILE_TABLE, "encoding", "TEXT")
+}
+
+// Whether the withoutEnlargement option limited a file to the size of the
+// original. Existing files weren't limited.
+func addCappedOutputs(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	return sdbc.addColumn(ctx, tx, IMAGE_FILE_TABLE, "capped", "BOOLEAN NOT NULL DEFAULT FALSE")
+}
+
+// The BlurHash and LQIP of images. Existing images get them from the
+// backfill-placeholders command.
+func addPlaceholders(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	if err := sdbc.addColumn(ctx, tx, IMAGE_TABLE, "blur_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	return sdbc.addColumn(ctx, tx, IMAGE_TABLE, "lqip", "TEXT NOT NULL DEFAULT ''")
+}
+
+// The palette colors are stored with their Lab values, so that images can be
+// found by color in the database. The index lets color queries skip colors
+// outside the box around the requested color.
+func createPaletteTable(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + PALETTE_TABLE + ` (
+			image_id TEXT NOT NULL REFERENCES ` + IMAGE_TABLE + `(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			color TEXT NOT NULL,
+			percentage DOUBLE PRECISION NOT NULL,
+			lab_l DOUBLE PRECISION NOT NULL,
+			lab_a DOUBLE PRECISION NOT NULL,
+			lab_b DOUBLE PRECISION NOT NULL,
+			PRIMARY KEY (image_id, position)
+		)`,
+		`CREATE INDEX IF NOT EXISTS image_palette_colors_lab ON ` + PALETTE_TABLE + ` (lab_l, lab_a, lab_b)`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The conversion request that a file was made from is stored as JSON, so that
+// the file can be made the same way again when its image is transformed.
+// Existing files have no request.
+func addConversionRequests(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	return sdbc.addColumn(ctx, tx, IMAGE_FILE_TABLE, "request", "TEXT")
+}
+
+// Transformed images are made from the file their original was before the
+// first transform. The index is used to count the images that refer to a
+// stored file before it's deleted. Images that were never transformed have an
+// empty source_sha256.
+func addImageSources(sdbc *SqlDbController, ctx context.Context, tx *sql.Tx) error {
+	columns := []struct{ name, definition string }{
+		{"source_sha256", "TEXT NOT NULL DEFAULT ''"},
+		{"source_type", "TEXT NOT NULL DEFAULT ''"},
+		{"source_rotate", "DOUBLE PRECISION NOT NULL DEFAULT 0"},
+		{"source_flip", "TEXT NOT NULL DEFAULT ''"},
+		{"source_background", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	for _, column := range columns {
+		if err := sdbc.addColumn(ctx, tx, IMAGE_TABLE, column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS images_source_sha256 ON `+IMAGE_TABLE+` (source_sha256)`)
+
+	return err
+}
@@ -0,0 +1,168 @@
+package sqlDbController
+
+import (
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+)
+
+// The image tables of a database created before migrations existed
+var baselineStatements = []string{
+	`CREATE TABLE images (
+		id TEXT PRIMARY KEY,
+		title TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		id_name TEXT NOT NULL UNIQUE,
+		tags TEXT NOT NULL,
+		author_id TEXT NOT NULL,
+		date_added BIGINT NOT NULL
+	)`,
+	`CREATE TABLE image_files (
+		id TEXT PRIMARY KEY,
+		image_id TEXT NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+		image_id_name TEXT NOT NULL,
+		filename TEXT NOT NULL UNIQUE,
+		format_name TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		file_size INTEGER NOT NULL,
+		private BOOLEAN NOT NULL,
+		image_type TEXT NOT NULL
+	)`,
+	`INSERT INTO images VALUES ('00000000-0000-0000-0000-000000000001', 'old', 'old.jpg', 'old', '[]', 'author', 0)`,
+	`INSERT INTO image_files VALUES ('00000000-0000-0000-0000-000000000002', '00000000-0000-0000-0000-000000000001', 'old', 'old@web.jpg', 'web', 10, 10, 100, FALSE, 'jpeg')`,
+}
+
+// The columns that migrations add to the baseline tables and the tables that
+// they create
+var migratedColumns = map[string][]string{
+	IMAGE_TABLE:      {"original_sha256", "blur_hash", "lqip", "source_sha256", "source_type", "source_rotate", "source_flip", "source_background"},
+	IMAGE_FILE_TABLE: {"sha256", "crop_x", "crop_y", "crop_width", "crop_height", "encoding", "capped", "request"},
+	ASSET_TABLE:      {"id", "kind", "name", "filename", "sha256", "file_size", "author_id", "date_added"},
+	PALETTE_TABLE:    {"image_id", "position", "color", "percentage", "lab_l", "lab_a", "lab_b"},
+}
+
+func makeBaselineController(t *testing.T) *SqlDbController {
+	sdbc, err := MakeSqlDbController(SQLITE, ":memory:")
+	if err != nil {
+		t.Skipf("sqlite unavailable: %v", err)
+	}
+
+	t.Cleanup(func() { sdbc.db.Close() })
+
+	for _, statement := range baselineStatements {
+		if _, err := sdbc.db.Exec(statement); err != nil {
+			t.Fatalf("Exec returned error '%v'", err)
+		}
+	}
+
+	return sdbc
+}
+
+func checkMigratedColumns(t *testing.T, sdbc *SqlDbController) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx returned error '%v'", err)
+	}
+	defer tx.Rollback()
+
+	for table, columns := range migratedColumns {
+		for _, column := range columns {
+			if exists, err := sdbc.columnExists(ctx, tx, table, column); err != nil || !exists {
+				t.Fatalf("%v.%v should exist, err = '%v'", table, column, err)
+			}
+		}
+	}
+}
+
+func TestMigrationVersionsAreSequential(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migrations[%v].version = '%v', Should be '%v'", i, m.version, i+1)
+		}
+
+		if m.up == nil {
+			t.Fatalf("migration %v has no up function", m.version)
+		}
+	}
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	sdbc := makeBaselineController(t)
+
+	if err := sdbc.InitDatabase(); err != nil {
+		t.Fatalf("InitDatabase returned error '%v'", err)
+	}
+
+	if version, _ := sdbc.GetSchemaVersion(); version != LatestSchemaVersion() {
+		t.Fatalf("version = '%v', Should be '%v'", version, LatestSchemaVersion())
+	}
+
+	checkMigratedColumns(t, sdbc)
+
+	// The images from before the migrations can be read and new images can be
+	// added next to them
+	img, err := sdbc.GetImageDataById("00000000-0000-0000-0000-000000000001", true)
+	if err != nil {
+		t.Fatalf("GetImageDataById returned error '%v'", err)
+	}
+
+	if len(img.ImageFiles) != 1 || img.ImageFiles[0].Filename != "old@web.jpg" || img.ImageFiles[0].Sha256 != "" {
+		t.Fatalf("img = '%v', Should have its file without a digest", img)
+	}
+
+	doc := makeAddImageDocument("new", "new.jpg", time.Now())
+	doc.Palette = []imageHandler.PaletteColor{{Color: "#ff0000", Percentage: 100}}
+
+	if _, err := sdbc.AddImageData(doc); err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	if images, err := sdbc.GetImagesData(1, 10, dbController.MakeSortImageFilter("")); err != nil || len(images) != 2 {
+		t.Fatalf("images = '%v' err = '%v', Should have both images", images, err)
+	}
+
+	// Initializing a migrated database doesn't apply anything again
+	if applied, err := sdbc.RunMigrations(); err != nil || len(applied) != 0 {
+		t.Fatalf("applied = '%v' err = '%v', Should be empty", applied, err)
+	}
+}
+
+func TestMigrationsAreIdempotent(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	// A database whose columns were added before its migrations were recorded
+	if _, err := sdbc.db.Exec("DELETE FROM " + MIGRATION_TABLE); err != nil {
+		t.Fatalf("Exec returned error '%v'", err)
+	}
+
+	applied, err := sdbc.RunMigrations()
+
+	if err != nil {
+		t.Fatalf("RunMigrations returned error '%v'", err)
+	}
+
+	if len(applied) != LatestSchemaVersion() {
+		t.Fatalf("applied = '%v', Should have every migration", applied)
+	}
+
+	checkMigratedColumns(t, sdbc)
+}
+
+func TestNewerSchemaVersion(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	_, err := sdbc.db.Exec(sdbc.rebind("INSERT INTO "+MIGRATION_TABLE+" (version, description, applied_at) VALUES (?, ?, ?)"), LatestSchemaVersion()+1, "newer", 0)
+	if err != nil {
+		t.Fatalf("Exec returned error '%v'", err)
+	}
+
+	if _, err := sdbc.RunMigrations(); err == nil {
+		t.Fatalf("a database ahead of the binary should return an error")
+	}
+}
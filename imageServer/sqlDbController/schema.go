@@ -0,0 +1,112 @@
+package sqlDbController
+
+import (
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+const IMAGE_TABLE = "images"
+const IMAGE_FILE_TABLE = "image_files"
+const PALETTE_TABLE = "image_palette_colors"
+const ASSET_TABLE = "assets"
+const LOGGING_TABLE = "logging"
+const USER_TABLE = "users"
+
+// The maximum amount of logs that we keep. Older logs are deleted when new
+// logs are added, similar to the capped logging collection in MongoDB.
+const MAX_LOGS = 1000
+
+// The image and image file tables mirror the MongoDB collections. The unique
+// constraints on idName and filename take the place of the MongoDB indexes.
+// Tags are stored as a JSON array and dates as Unix milliseconds, so that the
+// same schema works for both dialects.
+//
+// These statements are the schema from before migrations existed. Existing
+// databases already have these tables, so changes have to be made with a
+// migration in migrations.go instead.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS ` + USER_TABLE + ` (
+		id TEXT PRIMARY KEY,
+		uid TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		role TEXT NOT NULL,
+		email TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + IMAGE_TABLE + ` (
+		id TEXT PRIMARY KEY,
+		title TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		id_name TEXT NOT NULL UNIQUE,
+		tags TEXT NOT NULL,
+		author_id TEXT NOT NULL,
+		date_added BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ` + IMAGE_FILE_TABLE + ` (
+		id TEXT PRIMARY KEY,
+		image_id TEXT NOT NULL REFERENCES ` + IMAGE_TABLE + `(id) ON DELETE CASCADE,
+		image_id_name TEXT NOT NULL,
+		filename TEXT NOT NULL UNIQUE,
+		format_name TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		file_size INTEGER NOT NULL,
+		private BOOLEAN NOT NULL,
+		image_type TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS image_files_image_id ON ` + IMAGE_FILE_TABLE + ` (image_id)`,
+}
+
+// The logging table uses an auto incrementing id to find the oldest logs,
+// which is declared differently in each dialect.
+func (sdbc *SqlDbController) loggingTableStatement() string {
+	idColumn := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	if sdbc.dialect == POSTGRES {
+		idColumn = "id BIGSERIAL PRIMARY KEY"
+	}
+
+	return `CREATE TABLE IF NOT EXISTS ` + LOGGING_TABLE + ` (
+		` + idColumn + `,
+		timestamp BIGINT NOT NULL,
+		type TEXT NOT NULL,
+		client_ip TEXT,
+		method TEXT,
+		path TEXT,
+		protocol TEXT,
+		status_code INTEGER,
+		latency BIGINT,
+		user_agent TEXT,
+		error_message TEXT,
+		message TEXT
+	)`
+}
+
+// Creates the tables and indexes if they don't already exist, then applies the
+// pending migrations. The statements run in one transaction, so a failed
+// initialization leaves no partial schema behind in PostgreSQL.
+func (sdbc *SqlDbController) InitDatabase() error {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	statements := make([]string, 0, len(schemaStatements)+2)
+	statements = append(statements, schemaStatements...)
+	statements = append(statements, sdbc.loggingTableStatement(), sdbc.migrationTableStatement())
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return dbController.NewDBError("Error creating tables: " + err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	_, err = sdbc.RunMigrations()
+
+	return err
+}
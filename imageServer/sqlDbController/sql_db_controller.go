@@ -0,0 +1,1431 @@
+package sqlDbController
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/logging"
+)
+
+// SqlDbController is an implementation of DatabaseController that stores data
+// in a SQL database. SQLite is used for embedded, single server deployments
+// and PostgreSQL for everything else. It mirrors the behavior of the
+// MongoDbController, including the unique filename and idName constraints.
+type SqlDbController struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (sdbc *SqlDbController) getContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+// Queries are written with ? placeholders. PostgreSQL uses numbered
+// placeholders, so we replace them in order.
+func (sdbc *SqlDbController) rebind(query string) string {
+	if sdbc.dialect != POSTGRES {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// Returns a comma separated list of n placeholders for IN clauses
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// Ids are UUID strings
+func makeId() string {
+	return uuid.New().String()
+}
+
+func isValidId(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+
+	// The sqlite3 error type is only defined in cgo builds, so we check the
+	// message instead.
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// Converts a database error into one of the dbController errors
+func convertError(err error) error {
+	if isUniqueViolation(err) {
+		return dbController.NewDuplicateEntryError(err.Error())
+	}
+
+	return dbController.NewDBError(err.Error())
+}
+
+func getImageTypeString(iType imageHandler.ImageType) string {
+	switch iType {
+	case imageHandler.Jpeg:
+		return "jpeg"
+	case imageHandler.Png:
+		return "png"
+	case imageHandler.Gif:
+		return "gif"
+	case imageHandler.Bmp:
+		return "bmp"
+	case imageHandler.Tiff:
+		return "tiff"
+	case imageHandler.Webp:
+		return "webp"
+	default:
+		return ""
+	}
+}
+
+func getImageTypeFromString(iType string) imageHandler.ImageType {
+	switch iType {
+	case "jpeg":
+		return imageHandler.Jpeg
+	case "png":
+		return imageHandler.Png
+	case "gif":
+		return imageHandler.Gif
+	case "bmp":
+		return imageHandler.Bmp
+	case "tiff":
+		return imageHandler.Tiff
+	case "webp":
+		return imageHandler.Webp
+	default:
+		return imageHandler.Same
+	}
+}
+
+func timeToMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func millisToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Adds user data. Users are used to get the author's name for images. If a
+// user with the same UID exists, it's replaced.
+func (sdbc *SqlDbController) AddUser(user dbController.UserDataDocument) error {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	if len(user.Id) == 0 {
+		user.Id = makeId()
+	}
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+USER_TABLE+" WHERE uid = ?"), user.UID)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sdbc.rebind("INSERT INTO "+USER_TABLE+" (id, uid, name, role, email) VALUES (?, ?, ?, ?, ?)"),
+		user.Id, user.UID, user.Name, user.Role, user.Email,
+	)
+	if err != nil {
+		return convertError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+func (sdbc *SqlDbController) GetUserByUID(uid string) (dbController.UserDataDocument, error) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var user dbController.UserDataDocument
+
+	err := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT id, uid, name, role, email FROM "+USER_TABLE+" WHERE uid = ?"),
+		uid,
+	).Scan(&user.Id, &user.UID, &user.Name, &user.Role, &user.Email)
+
+	if err == sql.ErrNoRows {
+		return user, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return user, dbController.NewDBError(err.Error())
+	}
+
+	return user, nil
+}
+
+// Adds the image and image file rows in one transaction. The OnTransaction
+// function, if any, runs before the transaction is committed and returning an
+// error rolls back all writes.
+func (sdbc *SqlDbController) AddImageData(doc dbController.AddImageDocument) (string, error) {
+	if len(doc.SizeFormats) == 0 {
+		return "", dbController.NewInvalidInputError("No images to save")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tags := doc.Tags
+	if tags == nil {
+		tags = make([]string, 0)
+	}
+
+	tagsJson, err := json.Marshal(tags)
+	if err != nil {
+		return "", dbController.NewInvalidInputError("invalid tags")
+	}
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	imgId := makeId()
+
+	_, err = tx.ExecContext(
+		ctx,
+		sdbc.rebind("INSERT INTO "+IMAGE_TABLE+" (id, title, filename, id_name, tags, author_id, date_added, original_sha256, blur_hash, lqip) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		imgId, doc.Title, doc.Filename, doc.IdName, string(tagsJson), doc.AuthorId, timeToMillis(doc.DateAdded), doc.OriginalSha256, doc.BlurHash, doc.Lqip,
+	)
+	if err != nil {
+		return "", convertError(err)
+	}
+
+	fileQuery := sdbc.rebind("INSERT INTO " + IMAGE_FILE_TABLE + " (" + imageFileColumns + ") VALUES (" + placeholders(18) + ")")
+
+	// We skip image formats without a valid image type, like MongoDbController
+	inserted := 0
+	for _, img := range doc.SizeFormats {
+		imgType := getImageTypeString(img.ImageType)
+		if len(imgType) == 0 {
+			continue
+		}
+
+		cropX, cropY, cropWidth, cropHeight := getCropValues(img.Crop)
+
+		encoding, err := getEncodingValue(img.Encoding)
+		if err != nil {
+			return "", dbController.NewDBError(err.Error())
+		}
+
+		request, err := getRequestValue(img.Request)
+		if err != nil {
+			return "", dbController.NewDBError(err.Error())
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			fileQuery,
+			makeId(), imgId, doc.IdName, img.Filename, img.FormatName,
+			img.ImageSize.Width, img.ImageSize.Height, img.FileSize, img.Private, imgType, img.Sha256,
+			cropX, cropY, cropWidth, cropHeight, encoding, img.Capped, request,
+		)
+		if err != nil {
+			return "", convertError(err)
+		}
+
+		inserted++
+	}
+
+	if inserted == 0 {
+		return "", dbController.NewInvalidInputError("no images to save")
+	}
+
+	paletteQuery := sdbc.rebind("INSERT INTO " + PALETTE_TABLE + " (image_id, position, color, percentage, lab_l, lab_a, lab_b) VALUES (" + placeholders(7) + ")")
+
+	for i, pc := range doc.Palette {
+		lab := pc.Lab()
+
+		_, err = tx.ExecContext(ctx, paletteQuery, imgId, i, pc.Color, pc.Percentage, lab.L, lab.A, lab.B)
+		if err != nil {
+			return "", convertError(err)
+		}
+	}
+
+	if doc.OnTransaction != nil {
+		if err := doc.OnTransaction(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", dbController.NewDBError(err.Error())
+	}
+
+	return imgId, nil
+}
+
+const imageFileColumns = "id, image_id, image_id_name, filename, format_name, width, height, file_size, private, image_type, sha256, crop_x, crop_y, crop_width, crop_height, encoding, capped, request"
+
+// Image files without a crop region store NULL in the crop columns
+func getCropValues(crop *imageHandler.CropRect) (interface{}, interface{}, interface{}, interface{}) {
+	if crop == nil {
+		return nil, nil, nil, nil
+	}
+
+	return crop.X, crop.Y, crop.Width, crop.Height
+}
+
+// The encoder settings are stored as JSON. Image files without settings store
+// NULL.
+func getEncodingValue(settings *imageHandler.EncoderSettings) (interface{}, error) {
+	if settings == nil {
+		return nil, nil
+	}
+
+	settingsJson, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(settingsJson), nil
+}
+
+// The conversion request that a file was made from is stored as JSON. The
+// default files and files that were made before requests were stored have
+// NULL.
+func getRequestValue(req *imageHandler.ConversionRequest) (interface{}, error) {
+	if req == nil {
+		return nil, nil
+	}
+
+	requestJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(requestJson), nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanImageFile(row rowScanner) (dbController.ImageFileDocument, error) {
+	var file dbController.ImageFileDocument
+	var imgType string
+	var cropX, cropY, cropWidth, cropHeight sql.NullInt64
+	var encoding, request sql.NullString
+
+	err := row.Scan(
+		&file.Id,
+		&file.ImageId,
+		&file.ImageIdName,
+		&file.Filename,
+		&file.FormatName,
+		&file.ImageSize.Width,
+		&file.ImageSize.Height,
+		&file.FileSize,
+		&file.Private,
+		&imgType,
+		&file.Sha256,
+		&cropX,
+		&cropY,
+		&cropWidth,
+		&cropHeight,
+		&encoding,
+		&file.Capped,
+		&request,
+	)
+
+	file.ImageType = getImageTypeFromString(imgType)
+
+	if cropX.Valid && cropY.Valid && cropWidth.Valid && cropHeight.Valid {
+		file.Crop = &imageHandler.CropRect{
+			X:      int(cropX.Int64),
+			Y:      int(cropY.Int64),
+			Width:  int(cropWidth.Int64),
+			Height: int(cropHeight.Int64),
+		}
+	}
+
+	if err == nil && encoding.Valid {
+		var settings imageHandler.EncoderSettings
+		if jsonErr := json.Unmarshal([]byte(encoding.String), &settings); jsonErr != nil {
+			return file, jsonErr
+		}
+
+		file.Encoding = &settings
+	}
+
+	if err == nil && request.Valid {
+		var req imageHandler.ConversionRequest
+		if jsonErr := json.Unmarshal([]byte(request.String), &req); jsonErr != nil {
+			return file, jsonErr
+		}
+
+		file.Request = &req
+	}
+
+	return file, err
+}
+
+func (sdbc *SqlDbController) getImageFile(where string, arg interface{}) (dbController.ImageFileDocument, error) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	row := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT "+imageFileColumns+" FROM "+IMAGE_FILE_TABLE+" WHERE "+where+" = ?"),
+		arg,
+	)
+
+	file, err := scanImageFile(row)
+
+	if err == sql.ErrNoRows {
+		return file, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	return file, nil
+}
+
+func (sdbc *SqlDbController) GetImageByName(name string) (dbController.ImageFileDocument, error) {
+	return sdbc.getImageFile("filename", name)
+}
+
+func (sdbc *SqlDbController) GetImageFileById(id string) (dbController.ImageFileDocument, error) {
+	if !isValidId(id) {
+		return dbController.ImageFileDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	return sdbc.getImageFile("id", id)
+}
+
+const imageColumns = "i.id, i.title, i.filename, i.id_name, i.tags, i.author_id, i.date_added, i.original_sha256, i.blur_hash, i.lqip, " + sourceColumns + ", COALESCE(u.name, '')"
+
+const sourceColumns = "source_sha256, source_type, source_rotate, source_flip, source_background"
+
+// Images are joined with the users table to get the author's name
+const imageFrom = IMAGE_TABLE + " i LEFT JOIN " + USER_TABLE + " u ON u.uid = i.author_id"
+
+// Images that were never transformed have no source
+func scanSource(sha256, imgType string, rotate float64, flip, background string) (*imageHandler.ImageSource, error) {
+	if len(sha256) == 0 {
+		return nil, nil
+	}
+
+	transform, err := imageHandler.MakeTransform(rotate, flip, background)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageHandler.ImageSource{
+		Sha256:    sha256,
+		ImageType: getImageTypeFromString(imgType),
+		Transform: transform,
+	}, nil
+}
+
+func scanImage(row rowScanner) (dbController.ImageDocument, error) {
+	var img dbController.ImageDocument
+	var tags string
+	var dateAdded int64
+	var sourceSha256, sourceType, sourceFlip, sourceBackground string
+	var sourceRotate float64
+
+	err := row.Scan(
+		&img.Id,
+		&img.Title,
+		&img.Filename,
+		&img.IdName,
+		&tags,
+		&img.AuthorId,
+		&dateAdded,
+		&img.OriginalSha256,
+		&img.BlurHash,
+		&img.Lqip,
+		&sourceSha256,
+		&sourceType,
+		&sourceRotate,
+		&sourceFlip,
+		&sourceBackground,
+		&img.Author,
+	)
+
+	if err != nil {
+		return img, err
+	}
+
+	img.Source, err = scanSource(sourceSha256, sourceType, sourceRotate, sourceFlip, sourceBackground)
+	if err != nil {
+		return img, err
+	}
+
+	img.DateAdded = millisToTime(dateAdded)
+	img.ImageFiles = make([]dbController.ImageFileDocument, 0)
+
+	if err := json.Unmarshal([]byte(tags), &img.Tags); err != nil {
+		return img, err
+	}
+
+	return img, nil
+}
+
+// Gets the image files for all of the images and adds them to the images.
+// Private image files are filtered out unless showPrivate is true.
+func (sdbc *SqlDbController) addImageFiles(ctx context.Context, images []dbController.ImageDocument, showPrivate bool) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(images))
+	indexes := make(map[string]int)
+
+	for i, img := range images {
+		args = append(args, img.Id)
+		indexes[img.Id] = i
+	}
+
+	query := "SELECT " + imageFileColumns + " FROM " + IMAGE_FILE_TABLE + " WHERE image_id IN (" + placeholders(len(args)) + ")"
+
+	if !showPrivate {
+		query += " AND private = ?"
+		args = append(args, false)
+	}
+
+	query += " ORDER BY filename"
+
+	rows, err := sdbc.db.QueryContext(ctx, sdbc.rebind(query), args...)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := scanImageFile(rows)
+		if err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+
+		i := indexes[file.ImageId]
+		images[i].ImageFiles = append(images[i].ImageFiles, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Gets the palettes of all of the images and adds them to the images
+func (sdbc *SqlDbController) addPalettes(ctx context.Context, images []dbController.ImageDocument) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(images))
+	indexes := make(map[string]int)
+
+	for i, img := range images {
+		args = append(args, img.Id)
+		indexes[img.Id] = i
+	}
+
+	query := "SELECT image_id, color, percentage FROM " + PALETTE_TABLE + " WHERE image_id IN (" + placeholders(len(args)) + ") ORDER BY image_id, position"
+
+	rows, err := sdbc.db.QueryContext(ctx, sdbc.rebind(query), args...)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageId string
+		var pc imageHandler.PaletteColor
+
+		if err := rows.Scan(&imageId, &pc.Color, &pc.Percentage); err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+
+		i := indexes[imageId]
+		images[i].Palette = append(images[i].Palette, pc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+func (sdbc *SqlDbController) GetImageDataById(id string, showPrivate bool) (dbController.ImageDocument, error) {
+	if !isValidId(id) {
+		return dbController.ImageDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	row := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT "+imageColumns+" FROM "+imageFrom+" WHERE i.id = ?"),
+		id,
+	)
+
+	img, err := scanImage(row)
+
+	if err == sql.ErrNoRows {
+		return img, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return img, dbController.NewDBError(err.Error())
+	}
+
+	images := []dbController.ImageDocument{img}
+
+	if err := sdbc.addImageFiles(ctx, images, showPrivate); err != nil {
+		return img, err
+	}
+
+	if err := sdbc.addPalettes(ctx, images); err != nil {
+		return img, err
+	}
+
+	return images[0], nil
+}
+
+func getOrderBy(sortBy dbController.SortType) string {
+	switch sortBy {
+	case dbController.Name:
+		return "LOWER(i.filename) ASC"
+	case dbController.NameReverse:
+		return "LOWER(i.filename) DESC"
+	case dbController.DateAddedReverse:
+		return "i.date_added ASC"
+	// case dbController.DateAdded:
+	default:
+		return "i.date_added DESC"
+	}
+}
+
+// Sorts all images based on the sort filter, then returns the requested page.
+func (sdbc *SqlDbController) GetImagesData(page, pagination int, sortFilter dbController.SortImageFilter) ([]dbController.ImageDocument, error) {
+	images := make([]dbController.ImageDocument, 0)
+
+	if page < 1 || pagination <= 0 {
+		return images, nil
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	query := "SELECT " + imageColumns + " FROM " + imageFrom
+	args := make([]interface{}, 0)
+
+	// The box around the color can use the Lab index, then the exact distance
+	// is checked. Squared distances are compared, since SQLite has no square root.
+	if sortFilter.Color != nil {
+		query += " WHERE EXISTS (SELECT 1 FROM " + PALETTE_TABLE + " p WHERE p.image_id = i.id AND " +
+			"p.lab_l BETWEEN ? AND ? AND p.lab_a BETWEEN ? AND ? AND p.lab_b BETWEEN ? AND ? AND " +
+			"(p.lab_l - ?) * (p.lab_l - ?) + (p.lab_a - ?) * (p.lab_a - ?) + (p.lab_b - ?) * (p.lab_b - ?) <= ?)"
+
+		c := sortFilter.Color.Color
+		d := sortFilter.Color.Distance
+		args = append(args, c.L-d, c.L+d, c.A-d, c.A+d, c.B-d, c.B+d)
+		args = append(args, c.L, c.L, c.A, c.A, c.B, c.B, d*d)
+	}
+
+	query += " ORDER BY " + getOrderBy(sortFilter.Sortby) + ", i.id LIMIT ? OFFSET ?"
+	args = append(args, pagination, (page-1)*pagination)
+
+	rows, err := sdbc.db.QueryContext(ctx, sdbc.rebind(query), args...)
+	if err != nil {
+		return images, dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return images, dbController.NewDBError(err.Error())
+		}
+
+		images = append(images, img)
+	}
+
+	if err := rows.Err(); err != nil {
+		return images, dbController.NewDBError(err.Error())
+	}
+
+	// The rows need to be closed before we run another query, because SQLite
+	// only has a single connection.
+	rows.Close()
+
+	if err := sdbc.addImageFiles(ctx, images, sortFilter.ShowPrivate); err != nil {
+		return images, err
+	}
+
+	if err := sdbc.addPalettes(ctx, images); err != nil {
+		return images, err
+	}
+
+	return images, nil
+}
+
+func (sdbc *SqlDbController) ImageHasFiles(id string) (bool, error) {
+	if !isValidId(id) {
+		return false, dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var count int
+	err := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT COUNT(*) FROM "+IMAGE_FILE_TABLE+" WHERE image_id = ?"),
+		id,
+	).Scan(&count)
+
+	if err != nil {
+		return false, dbController.NewDBError(err.Error())
+	}
+
+	return count > 0, nil
+}
+
+func (sdbc *SqlDbController) CountImageFilesWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var count int
+	err := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT COUNT(*) FROM "+IMAGE_FILE_TABLE+" WHERE sha256 = ?"),
+		sha256,
+	).Scan(&count)
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return count, nil
+}
+
+func (sdbc *SqlDbController) CountImageSourcesWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var count int
+	err := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT COUNT(*) FROM "+IMAGE_TABLE+" WHERE source_sha256 = ?"),
+		sha256,
+	).Scan(&count)
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return count, nil
+}
+
+// Gets the sources of every transformed image. Like GetAllImageFiles, the
+// query isn't limited by the regular timeout.
+func (sdbc *SqlDbController) GetImageSources() ([]imageHandler.ImageSource, error) {
+	rows, err := sdbc.db.QueryContext(
+		context.Background(),
+		"SELECT "+sourceColumns+" FROM "+IMAGE_TABLE+" WHERE source_sha256 <> ''",
+	)
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	sources := make([]imageHandler.ImageSource, 0)
+
+	for rows.Next() {
+		var sha256, imgType, flip, background string
+		var rotate float64
+
+		if err := rows.Scan(&sha256, &imgType, &rotate, &flip, &background); err != nil {
+			return nil, dbController.NewDBError(err.Error())
+		}
+
+		source, err := scanSource(sha256, imgType, rotate, flip, background)
+		if err != nil {
+			return nil, dbController.NewDBError(err.Error())
+		}
+
+		sources = append(sources, *source)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	return sources, nil
+}
+
+// Gets every image file, including private files. The table can be large, so
+// the query isn't limited by the regular timeout.
+func (sdbc *SqlDbController) GetAllImageFiles() ([]dbController.ImageFileDocument, error) {
+	rows, err := sdbc.db.QueryContext(
+		context.Background(),
+		"SELECT "+imageFileColumns+" FROM "+IMAGE_FILE_TABLE,
+	)
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	files := make([]dbController.ImageFileDocument, 0)
+
+	for rows.Next() {
+		file, err := scanImageFile(rows)
+
+		if err != nil {
+			return nil, dbController.NewDBError(err.Error())
+		}
+
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	return files, nil
+}
+
+// Edits the title, filename and tags of an image. Only values that are not
+// nil are changed.
+func (sdbc *SqlDbController) EditImageData(doc dbController.EditImageDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	sets := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if doc.Title != nil {
+		sets = append(sets, "title = ?")
+		args = append(args, *doc.Title)
+	}
+
+	if doc.Filename != nil {
+		sets = append(sets, "filename = ?")
+		args = append(args, *doc.Filename)
+	}
+
+	if doc.Tags != nil {
+		tagsJson, err := json.Marshal(*doc.Tags)
+		if err != nil {
+			return dbController.NewInvalidInputError("invalid tags")
+		}
+
+		sets = append(sets, "tags = ?")
+		args = append(args, string(tagsJson))
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	// Without any edits, we still check that the image exists
+	if len(sets) == 0 {
+		sets = append(sets, "id = id")
+	}
+
+	args = append(args, doc.Id)
+
+	result, err := sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("UPDATE "+IMAGE_TABLE+" SET "+strings.Join(sets, ", ")+" WHERE id = ?"),
+		args...,
+	)
+	if err != nil {
+		return convertError(err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return dbController.NewDBError(err.Error())
+	} else if affected == 0 {
+		return dbController.NewNoResultsError("")
+	}
+
+	return nil
+}
+
+func (sdbc *SqlDbController) EditImageFileData(doc dbController.EditImageFileDocument) (dbController.EditImageFileResult, error) {
+	result := dbController.EditImageFileResult{}
+
+	if !doc.ChangesExist() {
+		return result, dbController.NewInvalidInputError("no edits to be made")
+	}
+
+	if !isValidId(doc.Id) {
+		return result, dbController.NewInvalidInputError("Invalid User ID")
+	}
+
+	file, err := sdbc.GetImageFileById(doc.Id)
+	if err != nil {
+		return result, err
+	}
+
+	result.OldName = file.Filename
+	result.NewName = file.Filename
+
+	sets := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if doc.ChangeObfuscate {
+		sets = append(sets, "filename = ?")
+		args = append(args, doc.NewName)
+		result.NewName = doc.NewName
+	}
+
+	if doc.ChangePrivate {
+		sets = append(sets, "private = ?")
+		args = append(args, doc.Private)
+	}
+
+	args = append(args, doc.Id)
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	_, err = sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("UPDATE "+IMAGE_FILE_TABLE+" SET "+strings.Join(sets, ", ")+" WHERE id = ?"),
+		args...,
+	)
+	if err != nil {
+		return result, convertError(err)
+	}
+
+	return result, nil
+}
+
+// Updates the content of an image's files in one transaction. Every size
+// format has to match a file of the image. The OnTransaction function, if any,
+// runs before the transaction is committed.
+func (sdbc *SqlDbController) ReplaceImageFiles(doc dbController.ReplaceImageFilesDocument) error {
+	if !isValidId(doc.ImageId) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	if len(doc.SizeFormats) == 0 {
+		return dbController.NewInvalidInputError("no images to save")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	updateQuery := "UPDATE " + IMAGE_FILE_TABLE + " SET width = ?, height = ?, file_size = ?, image_type = ?, sha256 = ?, crop_x = ?, crop_y = ?, crop_width = ?, crop_height = ?, encoding = ?, capped = ?, request = ? WHERE image_id = ? AND filename = ?"
+	fileQuery := sdbc.rebind(updateQuery)
+	conflictQuery := sdbc.rebind(updateQuery + " AND sha256 = ?")
+
+	for _, img := range doc.SizeFormats {
+		imgType := getImageTypeString(img.ImageType)
+		if len(imgType) == 0 {
+			return dbController.NewInvalidInputError("invalid image type for " + img.Filename)
+		}
+
+		cropX, cropY, cropWidth, cropHeight := getCropValues(img.Crop)
+
+		encoding, err := getEncodingValue(img.Encoding)
+		if err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+
+		request, err := getRequestValue(img.Request)
+		if err != nil {
+			return dbController.NewDBError(err.Error())
+		}
+
+		query := fileQuery
+		args := []interface{}{
+			img.ImageSize.Width, img.ImageSize.Height, img.FileSize, imgType, img.Sha256,
+			cropX, cropY, cropWidth, cropHeight, encoding, img.Capped, request,
+			doc.ImageId, img.Filename,
+		}
+
+		previous, checkPrevious := doc.PreviousSha256[img.Filename]
+		if checkPrevious {
+			query = conflictQuery
+			args = append(args, previous)
+		}
+
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return convertError(err)
+		}
+
+		if affected, err := result.RowsAffected(); err != nil {
+			return dbController.NewDBError(err.Error())
+		} else if affected == 0 {
+			return sdbc.getReplaceError(ctx, tx, doc.ImageId, img.Filename, checkPrevious)
+		}
+	}
+
+	if len(doc.BlurHash) > 0 {
+		_, err = tx.ExecContext(
+			ctx,
+			sdbc.rebind("UPDATE "+IMAGE_TABLE+" SET blur_hash = ?, lqip = ? WHERE id = ?"),
+			doc.BlurHash, doc.Lqip, doc.ImageId,
+		)
+		if err != nil {
+			return convertError(err)
+		}
+	}
+
+	if doc.Source != nil {
+		source := doc.Source
+		_, err = tx.ExecContext(
+			ctx,
+			sdbc.rebind("UPDATE "+IMAGE_TABLE+" SET source_sha256 = ?, source_type = ?, source_rotate = ?, source_flip = ?, source_background = ? WHERE id = ?"),
+			source.Sha256, getImageTypeString(source.ImageType), source.Transform.Rotate, source.Transform.Flip.String(), source.Transform.BackgroundHex(), doc.ImageId,
+		)
+		if err != nil {
+			return convertError(err)
+		}
+	}
+
+	if doc.OnTransaction != nil {
+		if err := doc.OnTransaction(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Returns why an image file wasn't updated. The file either doesn't exist or,
+// when its digest was checked, was changed since it was read.
+func (sdbc *SqlDbController) getReplaceError(ctx context.Context, tx *sql.Tx, imageId string, filename string, checkedPrevious bool) error {
+	if checkedPrevious {
+		var count int
+		err := tx.QueryRowContext(
+			ctx,
+			sdbc.rebind("SELECT COUNT(*) FROM "+IMAGE_FILE_TABLE+" WHERE image_id = ? AND filename = ?"),
+			imageId, filename,
+		).Scan(&count)
+
+		if err != nil {
+			return convertError(err)
+		}
+
+		if count > 0 {
+			return dbController.NewConflictError(filename + " was changed")
+		}
+	}
+
+	return dbController.NewInvalidInputError("no image file named " + filename)
+}
+
+func (sdbc *SqlDbController) SetImagePlaceholders(doc dbController.ImagePlaceholdersDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	result, err := sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("UPDATE "+IMAGE_TABLE+" SET blur_hash = ?, lqip = ? WHERE id = ?"),
+		doc.BlurHash, doc.Lqip, doc.Id,
+	)
+	if err != nil {
+		return convertError(err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return dbController.NewDBError(err.Error())
+	} else if affected == 0 {
+		return dbController.NewNoResultsError("")
+	}
+
+	return nil
+}
+
+// Deletes the image and all of its image files
+func (sdbc *SqlDbController) DeleteImage(doc dbController.DeleteImageDocument) error {
+	if !isValidId(doc.Id) {
+		return dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+IMAGE_FILE_TABLE+" WHERE image_id = ?"), doc.Id)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	_, err = tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+PALETTE_TABLE+" WHERE image_id = ?"), doc.Id)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	result, err := tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+IMAGE_TABLE+" WHERE id = ?"), doc.Id)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return dbController.NewDBError(err.Error())
+	} else if affected == 0 {
+		return dbController.NewInvalidInputError("invalid id. no image deleted")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+// Deletes an image file. If it was the last image file of an image, the image
+// is deleted as well.
+func (sdbc *SqlDbController) DeleteImageFile(doc dbController.DeleteImageFileDocument) (dbController.ImageFileDocument, error) {
+	if !isValidId(doc.Id) {
+		return dbController.ImageFileDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.ImageFileDocument{}, dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT "+imageFileColumns+" FROM "+IMAGE_FILE_TABLE+" WHERE id = ?"),
+		doc.Id,
+	)
+
+	file, err := scanImageFile(row)
+
+	if err == sql.ErrNoRows {
+		return file, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	_, err = tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+IMAGE_FILE_TABLE+" WHERE id = ?"), doc.Id)
+	if err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sdbc.rebind("DELETE FROM "+IMAGE_TABLE+" WHERE id = ? AND NOT EXISTS (SELECT 1 FROM "+IMAGE_FILE_TABLE+" WHERE image_id = ?)"),
+		file.ImageId, file.ImageId,
+	)
+	if err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	// SQLite doesn't enforce foreign keys by default, so the palette of a
+	// deleted image is removed here
+	_, err = tx.ExecContext(
+		ctx,
+		sdbc.rebind("DELETE FROM "+PALETTE_TABLE+" WHERE image_id = ? AND NOT EXISTS (SELECT 1 FROM "+IMAGE_TABLE+" WHERE id = ?)"),
+		file.ImageId, file.ImageId,
+	)
+	if err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return file, dbController.NewDBError(err.Error())
+	}
+
+	return file, nil
+}
+
+const assetColumns = "id, kind, name, filename, sha256, file_size, author_id, date_added"
+
+func scanAsset(row rowScanner) (dbController.AssetDocument, error) {
+	var asset dbController.AssetDocument
+	var kind string
+	var dateAdded int64
+
+	err := row.Scan(
+		&asset.Id,
+		&kind,
+		&asset.Name,
+		&asset.Filename,
+		&asset.Sha256,
+		&asset.FileSize,
+		&asset.AuthorId,
+		&dateAdded,
+	)
+
+	asset.Kind = dbController.AssetKind(kind)
+	asset.DateAdded = millisToTime(dateAdded)
+
+	return asset, err
+}
+
+// Adds an asset. The unique constraint on kind and name keeps names unique for
+// each kind of asset.
+func (sdbc *SqlDbController) AddAsset(doc dbController.AddAssetDocument) (string, error) {
+	if len(doc.Kind) == 0 || len(doc.Name) == 0 {
+		return "", dbController.NewInvalidInputError("assets require a kind and name")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	id := makeId()
+
+	_, err := sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("INSERT INTO "+ASSET_TABLE+" ("+assetColumns+") VALUES ("+placeholders(8)+")"),
+		id, string(doc.Kind), doc.Name, doc.Filename, doc.Sha256, doc.FileSize, doc.AuthorId, timeToMillis(doc.DateAdded),
+	)
+
+	if err != nil {
+		return "", convertError(err)
+	}
+
+	return id, nil
+}
+
+// Returns the assets sorted by name
+func (sdbc *SqlDbController) GetAssets(kind dbController.AssetKind) ([]dbController.AssetDocument, error) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	query := "SELECT " + assetColumns + " FROM " + ASSET_TABLE
+	args := make([]interface{}, 0)
+
+	if len(kind) > 0 {
+		query += " WHERE kind = ?"
+		args = append(args, string(kind))
+	}
+
+	rows, err := sdbc.db.QueryContext(ctx, sdbc.rebind(query+" ORDER BY name"), args...)
+
+	if err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+	defer rows.Close()
+
+	assets := make([]dbController.AssetDocument, 0)
+
+	for rows.Next() {
+		asset, err := scanAsset(rows)
+
+		if err != nil {
+			return nil, dbController.NewDBError(err.Error())
+		}
+
+		assets = append(assets, asset)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, dbController.NewDBError(err.Error())
+	}
+
+	return assets, nil
+}
+
+func (sdbc *SqlDbController) GetAssetByName(kind dbController.AssetKind, name string) (dbController.AssetDocument, error) {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	row := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT "+assetColumns+" FROM "+ASSET_TABLE+" WHERE kind = ? AND name = ?"),
+		string(kind), name,
+	)
+
+	asset, err := scanAsset(row)
+
+	if err == sql.ErrNoRows {
+		return asset, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	return asset, nil
+}
+
+func (sdbc *SqlDbController) DeleteAsset(doc dbController.DeleteAssetDocument) (dbController.AssetDocument, error) {
+	if !isValidId(doc.Id) {
+		return dbController.AssetDocument{}, dbController.NewInvalidInputError("invalid id")
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	tx, err := sdbc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbController.AssetDocument{}, dbController.NewDBError(err.Error())
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT "+assetColumns+" FROM "+ASSET_TABLE+" WHERE id = ?"),
+		doc.Id,
+	)
+
+	asset, err := scanAsset(row)
+
+	if err == sql.ErrNoRows {
+		return asset, dbController.NewNoResultsError("")
+	} else if err != nil {
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	_, err = tx.ExecContext(ctx, sdbc.rebind("DELETE FROM "+ASSET_TABLE+" WHERE id = ?"), doc.Id)
+	if err != nil {
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return asset, dbController.NewDBError(err.Error())
+	}
+
+	return asset, nil
+}
+
+func (sdbc *SqlDbController) CountAssetsWithSha256(sha256 string) (int, error) {
+	if len(sha256) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	var count int
+	err := sdbc.db.QueryRowContext(
+		ctx,
+		sdbc.rebind("SELECT COUNT(*) FROM "+ASSET_TABLE+" WHERE sha256 = ?"),
+		sha256,
+	).Scan(&count)
+
+	if err != nil {
+		return 0, dbController.NewDBError(err.Error())
+	}
+
+	return count, nil
+}
+
+// Inserts a log row and removes the oldest logs above MAX_LOGS
+func (sdbc *SqlDbController) addLog(columns []string, values []interface{}) error {
+	ctx, cancel := sdbc.getContext()
+	defer cancel()
+
+	_, err := sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("INSERT INTO "+LOGGING_TABLE+" ("+strings.Join(columns, ", ")+") VALUES ("+placeholders(len(values))+")"),
+		values...,
+	)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	_, err = sdbc.db.ExecContext(
+		ctx,
+		sdbc.rebind("DELETE FROM "+LOGGING_TABLE+" WHERE id <= (SELECT MAX(id) FROM "+LOGGING_TABLE+") - ?"),
+		MAX_LOGS,
+	)
+	if err != nil {
+		return dbController.NewDBError(err.Error())
+	}
+
+	return nil
+}
+
+func (sdbc *SqlDbController) AddRequestLog(log logging.RequestLogData) error {
+	return sdbc.addLog(
+		[]string{"timestamp", "type", "client_ip", "method", "path", "protocol", "status_code", "latency", "user_agent", "error_message"},
+		[]interface{}{
+			timeToMillis(log.Timestamp),
+			log.Type,
+			log.ClientIP,
+			log.Method,
+			log.Path,
+			log.Protocol,
+			log.StatusCode,
+			int64(log.Latency),
+			log.UserAgent,
+			log.ErrorMessage,
+		},
+	)
+}
+
+func (sdbc *SqlDbController) AddInfoLog(log logging.InfoLogData) error {
+	return sdbc.addLog(
+		[]string{"timestamp", "type", "message"},
+		[]interface{}{
+			timeToMillis(log.Timestamp),
+			log.Type,
+			log.Message,
+		},
+	)
+}
@@ -0,0 +1,596 @@
+package sqlDbController
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"testing"
+	"time"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+	"methompson.com/image-microservice/imageServer/imageHandler"
+	"methompson.com/image-microservice/imageServer/logging"
+)
+
+// Makes a controller with an in-memory SQLite database. The tests are skipped
+// when SQLite isn't available, e.g. when building without cgo.
+func makeTestController(t *testing.T) *SqlDbController {
+	sdbc, err := MakeSqlDbController(SQLITE, ":memory:")
+	if err != nil {
+		t.Skipf("sqlite unavailable: %v", err)
+	}
+
+	if err := sdbc.InitDatabase(); err != nil {
+		t.Fatalf("InitDatabase returned error '%v'", err)
+	}
+
+	t.Cleanup(func() { sdbc.db.Close() })
+
+	return sdbc
+}
+
+func makeAddImageDocument(idName, filename string, dateAdded time.Time) dbController.AddImageDocument {
+	return dbController.AddImageDocument{
+		Title:    "title " + idName,
+		Filename: filename,
+		IdName:   idName,
+		Tags:     []string{"tag"},
+		SizeFormats: []imageHandler.ImageSizeFormat{
+			{
+				FormatName: "thumb",
+				Filename:   idName + "@thumb.jpg",
+				ImageSize:  imageHandler.ImageSize{Width: 128, Height: 96},
+				FileSize:   100,
+				Private:    false,
+				ImageType:  imageHandler.Jpeg,
+				Crop:       &imageHandler.CropRect{X: 10, Y: 0, Width: 1000, Height: 750},
+				Encoding:   &imageHandler.EncoderSettings{Quality: 80, Subsampling: "4:4:4"},
+				Capped:     true,
+				Request:    &imageHandler.ConversionRequest{Suffix: "thumb", ResizeOp: "thumbnail", Filters: []imageHandler.FilterRequest{{Type: "grayscale"}}},
+			},
+			{
+				FormatName: "original",
+				Filename:   idName + "@original.jpg",
+				ImageSize:  imageHandler.ImageSize{Width: 1024, Height: 768},
+				FileSize:   1000,
+				Private:    true,
+				ImageType:  imageHandler.Jpeg,
+			},
+		},
+		AuthorId:  "author",
+		DateAdded: dateAdded,
+	}
+}
+
+func TestRebind(t *testing.T) {
+	sdbc := &SqlDbController{dialect: POSTGRES}
+
+	result := sdbc.rebind("SELECT a FROM b WHERE c = ? AND d IN (?,?)")
+	expected := "SELECT a FROM b WHERE c = $1 AND d IN ($2,$3)"
+
+	if result != expected {
+		t.Fatalf("rebind = '%v', Should be '%v'", result, expected)
+	}
+
+	sdbc.dialect = SQLITE
+	if sdbc.rebind("c = ?") != "c = ?" {
+		t.Fatalf("sqlite queries should not be rebound")
+	}
+}
+
+func TestAddAndGetImageData(t *testing.T) {
+	sdbc := makeTestController(t)
+	sdbc.AddUser(dbController.UserDataDocument{UID: "author", Name: "Test Author"})
+
+	id, err := sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	public, err := sdbc.GetImageDataById(id, false)
+	if err != nil {
+		t.Fatalf("GetImageDataById returned error '%v'", err)
+	}
+	if len(public.ImageFiles) != 1 {
+		t.Fatalf("len(public.ImageFiles) = '%v', Should be '1'", len(public.ImageFiles))
+	}
+	if public.Author != "Test Author" {
+		t.Fatalf("public.Author = '%v', Should be 'Test Author'", public.Author)
+	}
+	if len(public.Tags) != 1 || public.Tags[0] != "tag" {
+		t.Fatalf("public.Tags = '%v', Should be '[tag]'", public.Tags)
+	}
+
+	private, _ := sdbc.GetImageDataById(id, true)
+	if len(private.ImageFiles) != 2 {
+		t.Fatalf("len(private.ImageFiles) = '%v', Should be '2'", len(private.ImageFiles))
+	}
+
+	file, err := sdbc.GetImageByName("abc@thumb.jpg")
+	if err != nil {
+		t.Fatalf("GetImageByName returned error '%v'", err)
+	}
+	if file.ImageId != id || file.ImageType != imageHandler.Jpeg || file.ImageSize.Width != 128 {
+		t.Fatalf("file = '%v' doesn't match the inserted image file", file)
+	}
+	if file.Crop == nil || *file.Crop != (imageHandler.CropRect{X: 10, Y: 0, Width: 1000, Height: 750}) {
+		t.Fatalf("file.Crop = '%v', Should be '{10 0 1000 750}'", file.Crop)
+	}
+	if file.Encoding == nil || *file.Encoding != (imageHandler.EncoderSettings{Quality: 80, Subsampling: "4:4:4"}) {
+		t.Fatalf("file.Encoding = '%v', Should be '{80 false 4:4:4  0 false}'", file.Encoding)
+	}
+
+	if file.Request == nil || file.Request.ResizeOp != "thumbnail" || len(file.Request.Filters) != 1 || file.Request.Filters[0].Type != "grayscale" {
+		t.Fatalf("file.Request = '%v', Should be the stored thumbnail request", file.Request)
+	}
+
+	original, _ := sdbc.GetImageByName("abc@original.jpg")
+	if original.Crop != nil {
+		t.Fatalf("original.Crop = '%v', Should be nil", original.Crop)
+	}
+	if original.Encoding != nil {
+		t.Fatalf("original.Encoding = '%v', Should be nil", original.Encoding)
+	}
+	if original.Request != nil {
+		t.Fatalf("original.Request = '%v', Should be nil", original.Request)
+	}
+	if !file.Capped || original.Capped {
+		t.Fatalf("file.Capped = '%v' and original.Capped = '%v', Should be 'true' and 'false'", file.Capped, original.Capped)
+	}
+
+	_, err = sdbc.AddImageData(makeAddImageDocument("abc", "b.jpg", time.Now()))
+	if _, ok := err.(dbController.DuplicateEntryError); !ok {
+		t.Fatalf("err is '%T', Should be 'DuplicateEntryError'", err)
+	}
+
+	if _, err := sdbc.GetImageDataById("not an id", true); err == nil {
+		t.Fatalf("GetImageDataById with an invalid id should return an error")
+	} else if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err is '%T', Should be 'InvalidInputError'", err)
+	}
+}
+
+func TestGetAllImageFiles(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	sdbc.AddImageData(makeAddImageDocument("def", "b.jpg", time.Now()))
+
+	files, err := sdbc.GetAllImageFiles()
+	if err != nil {
+		t.Fatalf("GetAllImageFiles returned error '%v'", err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("len(files) = '%v', Should be '4'", len(files))
+	}
+}
+
+func TestAddImageDataOnTransactionError(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	doc := makeAddImageDocument("abc", "a.jpg", time.Now())
+	doc.OnTransaction = func(ctx context.Context) error {
+		return errors.New("transaction error")
+	}
+
+	if _, err := sdbc.AddImageData(doc); err == nil {
+		t.Fatalf("AddImageData should return the OnTransaction error")
+	}
+
+	if _, err := sdbc.GetImageByName("abc@thumb.jpg"); err == nil {
+		t.Fatalf("no image files should be saved when OnTransaction fails")
+	}
+}
+
+func TestReplaceImageFiles(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	id, err := sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	before, _ := sdbc.GetImageByName("abc@thumb.jpg")
+
+	thumb := imageHandler.ImageSizeFormat{
+		FormatName: "thumb",
+		Filename:   "abc@thumb.jpg",
+		ImageSize:  imageHandler.ImageSize{Width: 96, Height: 128},
+		FileSize:   120,
+		ImageType:  imageHandler.Jpeg,
+		Sha256:     "def",
+	}
+
+	// A failing OnTransaction leaves the files unchanged
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     id,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+		OnTransaction: func(ctx context.Context) error {
+			return errors.New("transaction error")
+		},
+	})
+
+	if err == nil {
+		t.Fatalf("ReplaceImageFiles should return the OnTransaction error")
+	}
+
+	if file, _ := sdbc.GetImageByName("abc@thumb.jpg"); file.Sha256 != before.Sha256 {
+		t.Fatalf("file.Sha256 = '%v', Should be '%v'", file.Sha256, before.Sha256)
+	}
+
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     id,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+	})
+
+	if err != nil {
+		t.Fatalf("ReplaceImageFiles returned error '%v'", err)
+	}
+
+	file, _ := sdbc.GetImageByName("abc@thumb.jpg")
+
+	if file.Id != before.Id || file.ImageSize != thumb.ImageSize || file.FileSize != 120 || file.Sha256 != "def" {
+		t.Fatalf("file = '%v', Should have the new size and digest", file)
+	}
+
+	if file.Crop != nil || file.Encoding != nil || file.Capped {
+		t.Fatalf("file = '%v', Should not have a crop, encoding or cap", file)
+	}
+
+	// Files that were changed since they were read aren't replaced
+	stale := thumb
+	stale.Sha256 = "ghi"
+
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        id,
+		SizeFormats:    []imageHandler.ImageSizeFormat{stale},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": before.Sha256},
+	})
+
+	if _, ok := err.(dbController.ConflictError); !ok {
+		t.Fatalf("err = '%v', Should be a ConflictError", err)
+	}
+
+	if file, _ := sdbc.GetImageByName("abc@thumb.jpg"); file.Sha256 != "def" {
+		t.Fatalf("file.Sha256 = '%v', Should be 'def'", file.Sha256)
+	}
+
+	source := imageHandler.ImageSource{
+		Sha256:    imageHandler.HashBytes([]byte("source")),
+		ImageType: imageHandler.Png,
+		Transform: imageHandler.Transform{Rotate: 45, Flip: imageHandler.FlipVertical, Background: color.NRGBA{0, 0, 0, 255}},
+	}
+
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        id,
+		SizeFormats:    []imageHandler.ImageSizeFormat{stale},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": "def"},
+		Source:         &source,
+	})
+
+	if err != nil {
+		t.Fatalf("ReplaceImageFiles returned error '%v'", err)
+	}
+
+	if img, _ := sdbc.GetImageDataById(id, true); img.Source == nil || *img.Source != source {
+		t.Fatalf("img.Source = '%v', Should be '%v'", img.Source, source)
+	}
+
+	if count, err := sdbc.CountImageSourcesWithSha256(source.Sha256); err != nil || count != 1 {
+		t.Fatalf("count = '%v' err = '%v', Should be '1'", count, err)
+	}
+
+	if sources, err := sdbc.GetImageSources(); err != nil || len(sources) != 1 || sources[0] != source {
+		t.Fatalf("sources = '%v' err = '%v', Should be '%v'", sources, err, source)
+	}
+
+	// Files of other images can't be replaced
+	otherId, _ := sdbc.AddImageData(makeAddImageDocument("xyz", "x.jpg", time.Now()))
+
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:     otherId,
+		SizeFormats: []imageHandler.ImageSizeFormat{thumb},
+	})
+
+	if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err = '%v', Should be an InvalidInputError for another image's file", err)
+	}
+
+	err = sdbc.ReplaceImageFiles(dbController.ReplaceImageFilesDocument{
+		ImageId:        otherId,
+		SizeFormats:    []imageHandler.ImageSizeFormat{thumb},
+		PreviousSha256: map[string]string{"abc@thumb.jpg": "ghi"},
+	})
+
+	if _, ok := err.(dbController.InvalidInputError); !ok {
+		t.Fatalf("err = '%v', Should be an InvalidInputError for another image's file", err)
+	}
+}
+
+func TestSetImagePlaceholders(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	doc := makeAddImageDocument("abc", "a.jpg", time.Now())
+	doc.BlurHash = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+	doc.Lqip = "data:image/jpeg;base64,abc"
+
+	id, err := sdbc.AddImageData(doc)
+	if err != nil {
+		t.Fatalf("AddImageData returned error '%v'", err)
+	}
+
+	img, _ := sdbc.GetImageDataById(id, true)
+	if img.BlurHash != doc.BlurHash || img.Lqip != doc.Lqip {
+		t.Fatalf("img = '%v', Should have the placeholders", img)
+	}
+
+	err = sdbc.SetImagePlaceholders(dbController.ImagePlaceholdersDocument{Id: id, BlurHash: "hash", Lqip: "data:image/jpeg;base64,def"})
+	if err != nil {
+		t.Fatalf("SetImagePlaceholders returned error '%v'", err)
+	}
+
+	images, _ := sdbc.GetImagesData(1, 10, dbController.MakeSortImageFilter(""))
+	if len(images) != 1 || images[0].BlurHash != "hash" || images[0].Lqip != "data:image/jpeg;base64,def" {
+		t.Fatalf("images = '%v', Should have the new placeholders", images)
+	}
+
+	err = sdbc.SetImagePlaceholders(dbController.ImagePlaceholdersDocument{Id: "00000000-0000-0000-0000-000000000000"})
+	if _, ok := err.(dbController.NoResultsError); !ok {
+		t.Fatalf("err = '%v', Should be a NoResultsError", err)
+	}
+}
+
+func TestGetImagesDataColorFilter(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	now := time.Now()
+
+	red := makeAddImageDocument("red", "red.jpg", now)
+	red.Palette = []imageHandler.PaletteColor{{Color: "#0000ff", Percentage: 60}, {Color: "#f01010", Percentage: 40}}
+	redId, _ := sdbc.AddImageData(red)
+
+	green := makeAddImageDocument("green", "green.jpg", now.Add(-1*time.Hour))
+	green.Palette = []imageHandler.PaletteColor{{Color: "#00ff00", Percentage: 100}}
+	sdbc.AddImageData(green)
+
+	// Images without a palette never match
+	sdbc.AddImageData(makeAddImageDocument("none", "none.jpg", now.Add(-2*time.Hour)))
+
+	img, _ := sdbc.GetImageDataById(redId, true)
+	if len(img.Palette) != 2 || img.Palette[1] != red.Palette[1] {
+		t.Fatalf("img.Palette = '%v', Should be '%v'", img.Palette, red.Palette)
+	}
+
+	redLab, _ := imageHandler.ParseLabColor("#ff0000")
+
+	filter := dbController.MakeSortImageFilter("")
+	filter.Color = &dbController.ColorFilter{Color: redLab, Distance: 10}
+
+	images, err := sdbc.GetImagesData(1, 10, filter)
+	if err != nil {
+		t.Fatalf("GetImagesData returned error '%v'", err)
+	}
+
+	if len(images) != 1 || images[0].Filename != "red.jpg" || len(images[0].Palette) != 2 {
+		t.Fatalf("images = '%v', Should only contain 'red.jpg' with its palette", images)
+	}
+
+	filter.Color.Distance = 1
+	images, _ = sdbc.GetImagesData(1, 10, filter)
+	if len(images) != 0 {
+		t.Fatalf("images = '%v', Should be empty", images)
+	}
+
+	if err := sdbc.DeleteImage(dbController.DeleteImageDocument{Id: redId}); err != nil {
+		t.Fatalf("DeleteImage returned error '%v'", err)
+	}
+
+	images, _ = sdbc.GetImagesData(1, 10, filter)
+	if len(images) != 0 {
+		t.Fatalf("images = '%v', Should be empty after deleting the red image", images)
+	}
+}
+
+func TestGetImagesDataSorting(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	now := time.Now()
+	sdbc.AddImageData(makeAddImageDocument("b", "B.jpg", now.Add(-2*time.Hour)))
+	sdbc.AddImageData(makeAddImageDocument("a", "a.jpg", now.Add(-1*time.Hour)))
+	sdbc.AddImageData(makeAddImageDocument("c", "c.jpg", now))
+
+	tests := []struct {
+		sortBy   string
+		expected []string
+	}{
+		{"name", []string{"a.jpg", "B.jpg", "c.jpg"}},
+		{"namereverse", []string{"c.jpg", "B.jpg", "a.jpg"}},
+		{"dateadded", []string{"c.jpg", "a.jpg", "B.jpg"}},
+		{"dateaddedreverse", []string{"B.jpg", "a.jpg", "c.jpg"}},
+	}
+
+	for _, test := range tests {
+		docs, err := sdbc.GetImagesData(1, 10, dbController.MakeSortImageFilter(test.sortBy))
+		if err != nil {
+			t.Fatalf("GetImagesData returned error '%v'", err)
+		}
+
+		for i, doc := range docs {
+			if doc.Filename != test.expected[i] {
+				t.Fatalf("%v: docs[%v].Filename = '%v', Should be '%v'", test.sortBy, i, doc.Filename, test.expected[i])
+			}
+
+			if len(doc.ImageFiles) != 1 {
+				t.Fatalf("%v: len(docs[%v].ImageFiles) = '%v', Should be '1'", test.sortBy, i, len(doc.ImageFiles))
+			}
+		}
+	}
+
+	page2, _ := sdbc.GetImagesData(2, 2, dbController.MakeSortImageFilter("name"))
+	if len(page2) != 1 || page2[0].Filename != "c.jpg" {
+		t.Fatalf("page 2 should only contain 'c.jpg'")
+	}
+}
+
+func TestEditImageData(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	id, _ := sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+
+	title := "new title"
+	tags := []string{"one", "two"}
+	if err := sdbc.EditImageData(dbController.EditImageDocument{Id: id, Title: &title, Tags: &tags}); err != nil {
+		t.Fatalf("EditImageData returned error '%v'", err)
+	}
+
+	img, _ := sdbc.GetImageDataById(id, true)
+	if img.Title != title || len(img.Tags) != 2 || img.Filename != "a.jpg" {
+		t.Fatalf("img = '%v' doesn't contain the edits", img)
+	}
+
+	file := img.ImageFiles[0]
+	result, err := sdbc.EditImageFileData(dbController.EditImageFileDocument{
+		Id:              file.Id,
+		ChangeObfuscate: true,
+		NewName:         "renamed.jpg",
+		ChangePrivate:   true,
+		Private:         !file.Private,
+	})
+	if err != nil {
+		t.Fatalf("EditImageFileData returned error '%v'", err)
+	}
+	if result.OldName != file.Filename || result.NewName != "renamed.jpg" {
+		t.Fatalf("result = '%v' doesn't contain the old and new names", result)
+	}
+
+	edited, _ := sdbc.GetImageFileById(file.Id)
+	if edited.Filename != "renamed.jpg" || edited.Private == file.Private {
+		t.Fatalf("edited = '%v' doesn't contain the edits", edited)
+	}
+}
+
+func TestDeleteImageFileCascade(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	id, _ := sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+	img, _ := sdbc.GetImageDataById(id, true)
+
+	sdbc.DeleteImageFile(dbController.DeleteImageFileDocument{Id: img.ImageFiles[0].Id})
+
+	if hasFiles, _ := sdbc.ImageHasFiles(id); !hasFiles {
+		t.Fatalf("image should still have one file")
+	}
+
+	deleted, err := sdbc.DeleteImageFile(dbController.DeleteImageFileDocument{Id: img.ImageFiles[1].Id})
+	if err != nil {
+		t.Fatalf("DeleteImageFile returned error '%v'", err)
+	}
+	if deleted.Filename != img.ImageFiles[1].Filename {
+		t.Fatalf("deleted.Filename = '%v', Should be '%v'", deleted.Filename, img.ImageFiles[1].Filename)
+	}
+
+	if _, err := sdbc.GetImageDataById(id, true); err == nil {
+		t.Fatalf("image should be deleted with its last image file")
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	id, _ := sdbc.AddImageData(makeAddImageDocument("abc", "a.jpg", time.Now()))
+
+	if err := sdbc.DeleteImage(dbController.DeleteImageDocument{Id: id}); err != nil {
+		t.Fatalf("DeleteImage returned error '%v'", err)
+	}
+
+	if _, err := sdbc.GetImageByName("abc@thumb.jpg"); err == nil {
+		t.Fatalf("image files should be deleted with the image")
+	}
+
+	if err := sdbc.DeleteImage(dbController.DeleteImageDocument{Id: id}); err == nil {
+		t.Fatalf("deleting a missing image should return an error")
+	}
+}
+
+func TestLogsAreCapped(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	for i := 0; i < MAX_LOGS+10; i++ {
+		sdbc.AddInfoLog(logging.InfoLogData{Timestamp: time.Now(), Type: "info", Message: "message"})
+	}
+
+	var count int
+	sdbc.db.QueryRow("SELECT COUNT(*) FROM " + LOGGING_TABLE).Scan(&count)
+
+	if count != MAX_LOGS {
+		t.Fatalf("count = '%v', Should be '%v'", count, MAX_LOGS)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	sdbc := makeTestController(t)
+
+	doc := dbController.AddAssetDocument{
+		Kind:      dbController.WatermarkAsset,
+		Name:      "logo",
+		Filename:  "logo.png",
+		Sha256:    "abc",
+		FileSize:  10,
+		AuthorId:  "author",
+		DateAdded: time.Now(),
+	}
+
+	id, err := sdbc.AddAsset(doc)
+	if err != nil {
+		t.Fatalf("AddAsset returned error '%v'", err)
+	}
+
+	if _, err := sdbc.AddAsset(doc); err == nil {
+		t.Fatalf("AddAsset with a duplicate name should return an error")
+	} else if _, ok := err.(dbController.DuplicateEntryError); !ok {
+		t.Fatalf("err is '%T', Should be 'DuplicateEntryError'", err)
+	}
+
+	asset, err := sdbc.GetAssetByName(dbController.WatermarkAsset, "logo")
+	if err != nil {
+		t.Fatalf("GetAssetByName returned error '%v'", err)
+	}
+	if asset.Id != id || asset.Filename != "logo.png" || asset.FileSize != 10 {
+		t.Fatalf("asset = '%v', Should match the added asset", asset)
+	}
+
+	if count, _ := sdbc.CountAssetsWithSha256("abc"); count != 1 {
+		t.Fatalf("count = '%v', Should be '1'", count)
+	}
+
+	if assets, _ := sdbc.GetAssets(dbController.WatermarkAsset); len(assets) != 1 {
+		t.Fatalf("len(assets) = '%v', Should be '1'", len(assets))
+	}
+
+	if _, err := sdbc.DeleteAsset(dbController.DeleteAssetDocument{Id: id}); err != nil {
+		t.Fatalf("DeleteAsset returned error '%v'", err)
+	}
+
+	if _, err := sdbc.GetAssetByName(dbController.WatermarkAsset, "logo"); err == nil {
+		t.Fatalf("the asset should be deleted")
+	}
+}
+
+func TestGetUserByUID(t *testing.T) {
+	sdbc := makeTestController(t)
+	sdbc.AddUser(dbController.UserDataDocument{UID: "author", Name: "Test Author"})
+
+	user, err := sdbc.GetUserByUID("author")
+	if err != nil {
+		t.Fatalf("GetUserByUID returned error '%v'", err)
+	}
+	if user.Name != "Test Author" {
+		t.Fatalf("user.Name = '%v', Should be 'Test Author'", user.Name)
+	}
+
+	if _, err := sdbc.GetUserByUID("missing"); err == nil {
+		t.Fatalf("GetUserByUID should return an error for an unknown user")
+	} else if _, ok := err.(dbController.NoResultsError); !ok {
+		t.Fatalf("err is '%T', Should be 'NoResultsError'", err)
+	}
+}
@@ -2,6 +2,7 @@ package imageServer
 
 import (
 	"os"
+	"time"
 
 	"methompson.com/image-microservice/imageServer/constants"
 	"methompson.com/image-microservice/imageServer/dbController"
@@ -64,6 +65,17 @@ func (doc *EditImageFileBody) GetEditImageFileDocument() dbController.EditImageF
 	return imgDoc
 }
 
+// Rotate is in clockwise degrees. Background is the color of the corners that
+// rotations by angles that aren't multiples of 90 degrees uncover. Flip is
+// "horizontal", "vertical" or "both".
+type TransformImageBody struct {
+	Id         string                           `json:"id" binding:"required"`
+	Rotate     float64                          `json:"rotate"`
+	Flip       string                           `json:"flip"`
+	Background string                           `json:"background"`
+	Operations []imageHandler.ConversionRequest `json:"operations"`
+}
+
 type DeleteImageBody struct {
 	Id string `json:"id" binding:"required"`
 }
@@ -84,6 +96,17 @@ func (dbb *DeleteImageFileBody) GetImageFileDocument() dbController.DeleteImageF
 	}
 }
 
+// The body of the requests that delete assets, like watermarks and fonts
+type DeleteAssetBody struct {
+	Id string `json:"id" binding:"required"`
+}
+
+func (dab *DeleteAssetBody) GetAssetDocument() dbController.DeleteAssetDocument {
+	return dbController.DeleteAssetDocument{
+		Id: dab.Id,
+	}
+}
+
 type AddImageFormData struct {
 	Title      string                           `json:"title"`
 	Tags       []string                         `json:"tags"`
@@ -97,3 +120,31 @@ func GetDefaultImageFormMetaData() AddImageFormData {
 		Operations: make([]imageHandler.ConversionRequest, 0),
 	}
 }
+
+type CheckConsistencyBody struct {
+	Action string `json:"action"`
+	MinAge *int   `json:"minAge"`
+}
+
+func (ccb *CheckConsistencyBody) GetConsistencyOptions() (ConsistencyOptions, error) {
+	action, err := ParseOrphanAction(ccb.Action)
+
+	if err != nil {
+		return ConsistencyOptions{}, err
+	}
+
+	opts := ConsistencyOptions{
+		Action: action,
+		MinAge: DEFAULT_ORPHAN_MIN_AGE,
+	}
+
+	if ccb.MinAge != nil {
+		if *ccb.MinAge < 0 {
+			return opts, dbController.NewInvalidInputError("minAge must not be negative")
+		}
+
+		opts.MinAge = time.Duration(*ccb.MinAge) * time.Second
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,39 @@
+package imageServer
+
+import (
+	"bytes"
+	"image/png"
+
+	"github.com/gin-gonic/gin"
+
+	"methompson.com/image-microservice/imageServer/dbController"
+)
+
+// Saves an uploaded watermark. The form's "name" value is the name that
+// conversion requests use and the "watermark" file must be a PNG file. The
+// file is stored under its digest, like image files.
+func (ic *ImageController) AddWatermark(ctx *gin.Context) (string, error) {
+	return ic.addUploadedAsset(ctx, dbController.WatermarkAsset, "watermark", func(fileBytes []byte) error {
+		if _, err := png.DecodeConfig(bytes.NewReader(fileBytes)); err != nil {
+			return dbController.NewInvalidInputError("watermarks must be PNG files")
+		}
+
+		return nil
+	})
+}
+
+func (ic *ImageController) GetWatermarks() ([]dbController.AssetDocument, error) {
+	return (*ic.DBController).GetAssets(dbController.WatermarkAsset)
+}
+
+// Images that were already watermarked keep the watermark until they are
+// transformed, see deleteAsset
+func (ic *ImageController) DeleteWatermark(delDoc dbController.DeleteAssetDocument) error {
+	return ic.deleteAsset(delDoc)
+}
+
+// Implements imageHandler.WatermarkSource for the watermarks that conversion
+// requests refer to by name
+func (ic *ImageController) GetWatermarkFile(name string) ([]byte, error) {
+	return ic.getAssetFile(dbController.WatermarkAsset, name)
+}
@@ -0,0 +1,89 @@
+package webpEncoder
+
+// boolEncoder is the boolean entropy encoder of VP8, specified in section 7
+// of RFC 6386. Each bit is coded with the probability, out of 256, that it's
+// false.
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{
+		rng:      255,
+		bitCount: 24,
+	}
+}
+
+// Propagates a carry into the bytes that were already written
+func (e *boolEncoder) addOne() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 0xff {
+		e.buf[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+func (e *boolEncoder) putBit(prob uint8, bit bool) {
+	split := 1 + (((e.rng - 1) * uint32(prob)) >> 8)
+
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+
+	for e.rng < 128 {
+		e.rng <<= 1
+
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+
+		e.bottom <<= 1
+		e.bitCount--
+
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= (1 << 24) - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// Writes the n lowest bits of value, most significant bit first
+func (e *boolEncoder) putLiteral(value uint32, n int) {
+	for n > 0 {
+		n--
+		e.putBit(128, value&(1<<n) != 0)
+	}
+}
+
+// Writes the remaining bits and returns the encoded bytes
+func (e *boolEncoder) finish() []byte {
+	c := e.bitCount
+	v := e.bottom
+
+	if v&(1<<(32-c)) != 0 {
+		e.addOne()
+	}
+
+	v <<= uint(c & 7)
+	c >>= 3
+	for c--; c >= 0; c-- {
+		v <<= 8
+	}
+
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+
+	return e.buf
+}
@@ -0,0 +1,292 @@
+package webpEncoder
+
+import (
+	"sort"
+)
+
+// bitWriter writes the least significant bit first, which is the bit order
+// of VP8L.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+// Writes the n lowest bits of value. n can't be larger than 32.
+func (w *bitWriter) write(value uint32, n uint) {
+	w.bits |= uint64(value) << w.nBits
+	w.nBits += n
+
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+// Returns the written bytes, padding the last byte with zeros
+func (w *bitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits = 0
+		w.nBits = 0
+	}
+
+	return w.buf
+}
+
+// huffmanCode is a canonical Huffman code for an alphabet
+type huffmanCode struct {
+	lengths []uint8
+
+	// The codes with their bits reversed, since the decoder reads the most
+	// significant bit of a code first
+	codes []uint32
+
+	// A code with one symbol takes no bits to write
+	single bool
+}
+
+func (h *huffmanCode) write(w *bitWriter, symbol int) {
+	if !h.single {
+		w.write(h.codes[symbol], uint(h.lengths[symbol]))
+	}
+}
+
+// Builds a Huffman code for the histogram, with no code longer than
+// maxLength. Every code that the decoder accepts is complete, so an alphabet
+// without symbols gets a code for symbol 0.
+func makeHuffmanCode(histogram []int, maxLength int) *huffmanCode {
+	h := &huffmanCode{
+		lengths: make([]uint8, len(histogram)),
+		codes:   make([]uint32, len(histogram)),
+	}
+
+	symbols := make([]int, 0)
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	if len(symbols) <= 1 {
+		symbol := 0
+		if len(symbols) == 1 {
+			symbol = symbols[0]
+		}
+		h.lengths[symbol] = 1
+		h.single = true
+		return h
+	}
+
+	// Rare symbols are made more common until the code is short enough
+	for minCount := 1; ; minCount *= 2 {
+		counts := make([]int, len(symbols))
+		for i, symbol := range symbols {
+			counts[i] = histogram[symbol]
+			if counts[i] < minCount {
+				counts[i] = minCount
+			}
+		}
+
+		depths := huffmanDepths(counts)
+
+		maxDepth := 0
+		for _, d := range depths {
+			if d > maxDepth {
+				maxDepth = d
+			}
+		}
+
+		if maxDepth <= maxLength {
+			for i, symbol := range symbols {
+				h.lengths[symbol] = uint8(depths[i])
+			}
+			break
+		}
+	}
+
+	h.assignCodes()
+
+	return h
+}
+
+// Returns the depth of each leaf of the Huffman tree for counts
+func huffmanDepths(counts []int) []int {
+	type node struct {
+		count  int
+		parent int
+	}
+
+	nodes := make([]node, len(counts), 2*len(counts)-1)
+	order := make([]int, len(counts))
+	for i, count := range counts {
+		nodes[i] = node{count, -1}
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return counts[order[a]] < counts[order[b]]
+	})
+
+	// The two queue method: the leaves in order of their counts, and the
+	// internal nodes in the order they were made, which is also the order of
+	// their counts.
+	leaves := order
+	internal := make([]int, 0, len(counts)-1)
+
+	takeSmallest := func() int {
+		if len(internal) == 0 || (len(leaves) > 0 && nodes[leaves[0]].count <= nodes[internal[0]].count) {
+			n := leaves[0]
+			leaves = leaves[1:]
+			return n
+		}
+		n := internal[0]
+		internal = internal[1:]
+		return n
+	}
+
+	for len(leaves)+len(internal) > 1 {
+		a := takeSmallest()
+		b := takeSmallest()
+
+		parent := len(nodes)
+		nodes = append(nodes, node{nodes[a].count + nodes[b].count, -1})
+		nodes[a].parent = parent
+		nodes[b].parent = parent
+		internal = append(internal, parent)
+	}
+
+	depths := make([]int, len(counts))
+	for i := range counts {
+		for n := i; nodes[n].parent >= 0; n = nodes[n].parent {
+			depths[i]++
+		}
+	}
+
+	return depths
+}
+
+// Assigns canonical codes to the code lengths, the same way the decoder does
+func (h *huffmanCode) assignCodes() {
+	var lengthCounts [16]uint32
+	for _, length := range h.lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+
+	var nextCodes [16]uint32
+	code := uint32(0)
+	for length := 1; length < 16; length++ {
+		code = (code + lengthCounts[length-1]) << 1
+		nextCodes[length] = code
+	}
+
+	for symbol, length := range h.lengths {
+		if length == 0 {
+			continue
+		}
+
+		code := nextCodes[length]
+		nextCodes[length]++
+
+		reversed := uint32(0)
+		for i := uint8(0); i < length; i++ {
+			reversed = reversed<<1 | (code>>i)&1
+		}
+		h.codes[symbol] = reversed
+	}
+}
+
+// The order that the code lengths of the code length code are written in
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// A code length, or a run of code lengths, of a Huffman code
+type codeLengthToken struct {
+	symbol    int
+	extraBits uint
+	extra     uint32
+}
+
+// Writes the code lengths of h. They are themselves Huffman coded, with
+// symbols 16 to 18 repeating the previous length or zeros.
+func (h *huffmanCode) writeCode(w *bitWriter) {
+	tokens := make([]codeLengthToken, 0)
+
+	for i := 0; i < len(h.lengths); {
+		length := h.lengths[i]
+		run := 1
+		for i+run < len(h.lengths) && h.lengths[i+run] == length {
+			run++
+		}
+		i += run
+
+		if length == 0 {
+			for run > 0 {
+				switch {
+				case run >= 11:
+					r := minInt(run, 138)
+					tokens = append(tokens, codeLengthToken{18, 7, uint32(r - 11)})
+					run -= r
+				case run >= 3:
+					tokens = append(tokens, codeLengthToken{17, 3, uint32(run - 3)})
+					run = 0
+				default:
+					tokens = append(tokens, codeLengthToken{0, 0, 0})
+					run--
+				}
+			}
+			continue
+		}
+
+		tokens = append(tokens, codeLengthToken{int(length), 0, 0})
+		run--
+
+		for run > 0 {
+			if run >= 3 {
+				r := minInt(run, 6)
+				tokens = append(tokens, codeLengthToken{16, 2, uint32(r - 3)})
+				run -= r
+			} else {
+				tokens = append(tokens, codeLengthToken{int(length), 0, 0})
+				run--
+			}
+		}
+	}
+
+	histogram := make([]int, 19)
+	for _, t := range tokens {
+		histogram[t.symbol]++
+	}
+
+	lengthCode := makeHuffmanCode(histogram, 7)
+
+	nCodes := 19
+	for nCodes > 4 && lengthCode.lengths[codeLengthCodeOrder[nCodes-1]] == 0 {
+		nCodes--
+	}
+
+	// Not a simple code
+	w.write(0, 1)
+	w.write(uint32(nCodes-4), 4)
+	for _, symbol := range codeLengthCodeOrder[:nCodes] {
+		w.write(uint32(lengthCode.lengths[symbol]), 3)
+	}
+
+	// Every code length is written
+	w.write(0, 1)
+
+	for _, t := range tokens {
+		lengthCode.write(w, t.symbol)
+		if t.extraBits > 0 {
+			w.write(t.extra, t.extraBits)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,493 @@
+package webpEncoder
+
+import (
+	"errors"
+	"image"
+)
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+)
+
+// The predictor transform picks a predictor for every tile of
+// 1<<predictorBits by 1<<predictorBits pixels.
+const predictorBits = 4
+
+// The predictors that we try for each tile. They only use pixels above and to
+// the left, which avoids the special case of the top right pixel on the right
+// edge of the image.
+var predictorModes = []int{1, 2, 4, 7, 11, 12, 13}
+
+const (
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	// Backward references can't be longer than this
+	maxMatchLength = 4096
+
+	// Or further away than this
+	maxMatchDistance = 1<<20 - 120
+
+	minMatchLength = 3
+
+	// How many earlier positions with the same hash we compare
+	maxChainLength = 32
+
+	hashBits = 16
+)
+
+// Encodes a VP8L image. The result is the payload of a "VP8L" chunk.
+func encodeLossless(img *image.NRGBA) ([]byte, error) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	if width > 16384 || height > 16384 {
+		return nil, errors.New("image is too large for a lossless WebP image")
+	}
+
+	hasAlpha := !img.Opaque()
+
+	w := &bitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	w.write(uint32(btoi(hasAlpha)), 1)
+	w.write(0, 3)
+
+	writeImageStream(w, toARGB(img), width, height, true)
+
+	return w.bytes(), nil
+}
+
+// Compresses the alpha channel of an image as the payload of an "ALPH" chunk
+// that uses lossless compression
+func encodeAlpha(img *image.NRGBA) []byte {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// The alpha values are saved in the green channel of an image without a
+	// header
+	pixels := make([]uint32, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := img.Pix[y*img.Stride+x*4+3]
+			pixels[y*width+x] = 0xff000000 | uint32(a)<<8
+		}
+	}
+
+	w := &bitWriter{}
+	writeImageStream(w, pixels, width, height, false)
+
+	// No preprocessing, no filtering and lossless compression
+	return append([]byte{0x01}, w.bytes()...)
+}
+
+// Writes the transforms and the pixels of an image. The subtract green
+// transform is only useful for images with color.
+func writeImageStream(w *bitWriter, pixels []uint32, width, height int, subtractGreen bool) {
+	if subtractGreen {
+		w.write(1, 1)
+		w.write(transformSubtractGreen, 2)
+
+		for i, argb := range pixels {
+			green := (argb >> 8) & 0xff
+			red := ((argb >> 16) - green) & 0xff
+			blue := (argb - green) & 0xff
+			pixels[i] = argb&0xff00ff00 | red<<16 | blue
+		}
+	}
+
+	modes, residuals := predict(pixels, width, height)
+
+	w.write(1, 1)
+	w.write(transformPredictor, 2)
+	w.write(predictorBits-2, 3)
+	writePixels(w, modes, tileCount(width), false)
+
+	w.write(0, 1)
+	writePixels(w, residuals, width, true)
+}
+
+func tileCount(size int) int {
+	return (size + 1<<predictorBits - 1) >> predictorBits
+}
+
+// Applies the predictor transform. Returns the image of the predictor of each
+// tile and the residuals.
+func predict(pixels []uint32, width, height int) ([]uint32, []uint32) {
+	tilesX := tileCount(width)
+	tilesY := tileCount(height)
+	modes := make([]uint32, tilesX*tilesY)
+	residuals := make([]uint32, len(pixels))
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0 := tx << predictorBits
+			y0 := ty << predictorBits
+			x1 := minInt(x0+1<<predictorBits, width)
+			y1 := minInt(y0+1<<predictorBits, height)
+
+			bestMode := predictorModes[0]
+			bestCost := -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(subPixels(pixels[y*width+x], predictPixel(pixels, width, x, y, mode)))
+					}
+				}
+
+				if bestCost < 0 || cost < bestCost {
+					bestMode = mode
+					bestCost = cost
+				}
+			}
+
+			// The predictor is saved in the green channel
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(bestMode)<<8
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := y*width + x
+					residuals[i] = subPixels(pixels[i], predictPixel(pixels, width, x, y, bestMode))
+				}
+			}
+		}
+	}
+
+	return modes, residuals
+}
+
+// Predicts a pixel from its neighbours. The first pixel and the first row and
+// column of the image always use the same predictors.
+func predictPixel(pixels []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+
+	if y == 0 {
+		if x == 0 {
+			return 0xff000000
+		}
+		return pixels[i-1]
+	}
+
+	if x == 0 {
+		return pixels[i-width]
+	}
+
+	left := pixels[i-1]
+	top := pixels[i-width]
+	topLeft := pixels[i-width-1]
+
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	case 4:
+		return topLeft
+	case 7:
+		return average2(left, top)
+	case 11:
+		return selectPixel(left, top, topLeft)
+	case 12:
+		return clampAddSubtractFull(left, top, topLeft)
+	case 13:
+		return clampAddSubtractHalf(average2(left, top), topLeft)
+	default:
+		return 0xff000000
+	}
+}
+
+// Applies a function to each channel of an ARGB pixel
+func perChannel(f func(shift uint) uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		out |= (f(shift) & 0xff) << shift
+	}
+	return out
+}
+
+func channel(argb uint32, shift uint) int32 {
+	return int32((argb >> shift) & 0xff)
+}
+
+func subPixels(a, b uint32) uint32 {
+	return perChannel(func(shift uint) uint32 {
+		return uint32(channel(a, shift) - channel(b, shift))
+	})
+}
+
+func average2(a, b uint32) uint32 {
+	return perChannel(func(shift uint) uint32 {
+		return uint32((channel(a, shift) + channel(b, shift)) / 2)
+	})
+}
+
+func selectPixel(left, top, topLeft uint32) uint32 {
+	var l, t int32
+	for shift := uint(0); shift < 32; shift += 8 {
+		l += absInt32(channel(topLeft, shift) - channel(top, shift))
+		t += absInt32(channel(topLeft, shift) - channel(left, shift))
+	}
+
+	if l < t {
+		return left
+	}
+	return top
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	return perChannel(func(shift uint) uint32 {
+		return uint32(clip8(channel(a, shift) + channel(b, shift) - channel(c, shift)))
+	})
+}
+
+func clampAddSubtractHalf(a, b uint32) uint32 {
+	return perChannel(func(shift uint) uint32 {
+		x := channel(a, shift)
+		return uint32(clip8(x + (x-channel(b, shift))/2))
+	})
+}
+
+func absInt32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// How expensive a residual is likely to be. Residuals close to zero are cheap.
+func residualCost(argb uint32) int {
+	cost := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		cost += int(absInt32(int32(int8(argb >> shift))))
+	}
+	return cost
+}
+
+// A literal pixel when length is 0, otherwise a backward reference of length
+// pixels with the distance code in value
+type pixelSymbol struct {
+	value  uint32
+	length uint32
+}
+
+// Writes the pixels with backward references and Huffman codes. The top
+// level image can use more than one set of Huffman codes, but we use one.
+func writePixels(w *bitWriter, pixels []uint32, width int, topLevel bool) {
+	symbols := findBackwardReferences(pixels, width)
+
+	var histograms [5][]int
+	histograms[0] = make([]int, nLiteralCodes+nLengthCodes)
+	histograms[1] = make([]int, nLiteralCodes)
+	histograms[2] = make([]int, nLiteralCodes)
+	histograms[3] = make([]int, nLiteralCodes)
+	histograms[4] = make([]int, nDistanceCodes)
+
+	for _, s := range symbols {
+		if s.length == 0 {
+			histograms[0][(s.value>>8)&0xff]++
+			histograms[1][(s.value>>16)&0xff]++
+			histograms[2][s.value&0xff]++
+			histograms[3][s.value>>24]++
+		} else {
+			lengthSymbol, _, _ := prefixEncode(s.length)
+			histograms[0][nLiteralCodes+lengthSymbol]++
+			distSymbol, _, _ := prefixEncode(s.value)
+			histograms[4][distSymbol]++
+		}
+	}
+
+	// No color cache
+	w.write(0, 1)
+
+	if topLevel {
+		// No meta Huffman codes
+		w.write(0, 1)
+	}
+
+	var codes [5]*huffmanCode
+	for i, histogram := range histograms {
+		codes[i] = makeHuffmanCode(histogram, 15)
+		codes[i].writeCode(w)
+	}
+
+	for _, s := range symbols {
+		if s.length == 0 {
+			codes[0].write(w, int((s.value>>8)&0xff))
+			codes[1].write(w, int((s.value>>16)&0xff))
+			codes[2].write(w, int(s.value&0xff))
+			codes[3].write(w, int(s.value>>24))
+			continue
+		}
+
+		symbol, extraBits, extra := prefixEncode(s.length)
+		codes[0].write(w, nLiteralCodes+symbol)
+		w.write(extra, extraBits)
+
+		symbol, extraBits, extra = prefixEncode(s.value)
+		codes[4].write(w, symbol)
+		w.write(extra, extraBits)
+	}
+}
+
+// Splits a length or distance code into a prefix symbol and extra bits
+func prefixEncode(value uint32) (int, uint, uint32) {
+	if value <= 4 {
+		return int(value - 1), 0, 0
+	}
+
+	n := value - 1
+	highest := uint(31)
+	for n&(1<<highest) == 0 {
+		highest--
+	}
+
+	second := (n >> (highest - 1)) & 1
+	extraBits := highest - 1
+
+	return int(2*highest + uint(second)), extraBits, n & (1<<extraBits - 1)
+}
+
+// The pixel offsets that have short distance codes, specified in section
+// 4.2.2. Each value is (yOffset << 4) | (8 - xOffset).
+var distanceMapTable = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// Maps the distances of nearby pixels to their short distance codes
+func makeDistanceCodes(width int) map[uint32]uint32 {
+	codes := make(map[uint32]uint32)
+
+	for i := len(distanceMapTable) - 1; i >= 0; i-- {
+		yOffset := int(distanceMapTable[i] >> 4)
+		xOffset := 8 - int(distanceMapTable[i]&0xf)
+		dist := yOffset*width + xOffset
+
+		if dist >= 1 {
+			codes[uint32(dist)] = uint32(i + 1)
+		}
+	}
+
+	return codes
+}
+
+// Finds repeated runs of pixels with a hash chain, and replaces them with
+// backward references
+func findBackwardReferences(pixels []uint32, width int) []pixelSymbol {
+	distanceCodes := makeDistanceCodes(width)
+
+	symbols := make([]pixelSymbol, 0, len(pixels)/2)
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(pixels))
+
+	hash := func(i int) uint32 {
+		h := pixels[i]*0x1e35a7bd ^ pixels[i+1]*0x9e3779b1
+		return h >> (32 - hashBits)
+	}
+
+	insert := func(i int) {
+		if i+1 < len(pixels) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	matchLength := func(i, j int) int {
+		length := 0
+		for i+length < len(pixels) && length < maxMatchLength && pixels[i+length] == pixels[j+length] {
+			length++
+		}
+		return length
+	}
+
+	for i := 0; i < len(pixels); {
+		bestLength := 0
+		bestDist := 0
+
+		// The previous pixel and the pixel above are the most likely
+		// matches, and have the cheapest distance codes
+		for _, dist := range []int{1, width} {
+			if dist <= i {
+				if length := matchLength(i, i-dist); length > bestLength {
+					bestLength = length
+					bestDist = dist
+				}
+			}
+		}
+
+		if i+1 < len(pixels) {
+			candidate := head[hash(i)]
+			for chain := 0; candidate >= 0 && chain < maxChainLength; chain++ {
+				dist := i - int(candidate)
+				if dist > maxMatchDistance {
+					break
+				}
+
+				if length := matchLength(i, int(candidate)); length > bestLength {
+					bestLength = length
+					bestDist = dist
+				}
+
+				candidate = prev[candidate]
+			}
+		}
+
+		if bestLength < minMatchLength {
+			symbols = append(symbols, pixelSymbol{value: pixels[i]})
+			insert(i)
+			i++
+			continue
+		}
+
+		distCode, ok := distanceCodes[uint32(bestDist)]
+		if !ok {
+			distCode = uint32(bestDist) + 120
+		}
+
+		symbols = append(symbols, pixelSymbol{value: distCode, length: uint32(bestLength)})
+
+		for end := i + bestLength; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	return symbols
+}
+
+// Converts an image to ARGB pixels, the pixel format of VP8L
+func toARGB(img *image.NRGBA) []uint32 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	pixels := make([]uint32, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			pixels[y*width+x] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		}
+	}
+
+	return pixels
+}
@@ -0,0 +1,787 @@
+package webpEncoder
+
+import (
+	"errors"
+	"image"
+)
+
+// The intra prediction modes that we use. Their values match the decoder's.
+// Every macroblock predicts its luma as one 16x16 block, so we never use the
+// 4x4 luma modes.
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nMacroblockModes
+)
+
+// The largest level that a coefficient can be quantized to
+const maxLevel = 2048
+
+// The quantizer step sizes of one frame, as {DC, AC} pairs
+type quantMatrix struct {
+	y1 [2]int32
+	y2 [2]int32
+	uv [2]int32
+}
+
+func makeQuantMatrix(qIndex int) quantMatrix {
+	uvIndex := qIndex
+	if uvIndex > 117 {
+		uvIndex = 117
+	}
+
+	y2AC := int32(dequantTableAC[qIndex]) * 155 / 100
+	if y2AC < 8 {
+		y2AC = 8
+	}
+
+	return quantMatrix{
+		y1: [2]int32{int32(dequantTableDC[qIndex]), int32(dequantTableAC[qIndex])},
+		y2: [2]int32{int32(dequantTableDC[qIndex]) * 2, y2AC},
+		uv: [2]int32{int32(dequantTableDC[uvIndex]), int32(dequantTableAC[qIndex])},
+	}
+}
+
+// Maps a quality of 1 to 100 to a quantizer index of 127 to 0
+func qualityToQIndex(quality int) int {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	return (100 - quality) * 127 / 99
+}
+
+// What we decided for a macroblock. The modes are written to the first
+// partition once every macroblock has been encoded.
+type macroblockInfo struct {
+	yMode  uint8
+	uvMode uint8
+	skip   bool
+}
+
+type lossyEncoder struct {
+	mbw int
+	mbh int
+
+	// The source planes, padded to whole macroblocks by repeating the edge
+	// pixels
+	y        []uint8
+	u        []uint8
+	v        []uint8
+	yStride  int
+	uvStride int
+
+	// The reconstructed planes. These hold what the decoder will decode, which
+	// is what later macroblocks are predicted from.
+	ry []uint8
+	ru []uint8
+	rv []uint8
+
+	qIndex int
+	quant  quantMatrix
+
+	// Whether the blocks above and left of the current macroblock had non-zero
+	// coefficients. The nz arrays hold 4 luma values followed by 2 values
+	// for each chroma plane.
+	upY16   []uint8
+	leftY16 uint8
+	upNz    [][8]uint8
+	leftNz  [8]uint8
+
+	partitions []*boolEncoder
+	info       []macroblockInfo
+}
+
+func newLossyEncoder(img *image.NRGBA, quality int) *lossyEncoder {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	e := &lossyEncoder{
+		mbw:    (width + 15) >> 4,
+		mbh:    (height + 15) >> 4,
+		qIndex: qualityToQIndex(quality),
+	}
+
+	e.quant = makeQuantMatrix(e.qIndex)
+	e.yStride = e.mbw * 16
+	e.uvStride = e.mbw * 8
+
+	e.y = make([]uint8, e.yStride*e.mbh*16)
+	e.u = make([]uint8, e.uvStride*e.mbh*8)
+	e.v = make([]uint8, e.uvStride*e.mbh*8)
+	e.ry = make([]uint8, len(e.y))
+	e.ru = make([]uint8, len(e.u))
+	e.rv = make([]uint8, len(e.v))
+
+	e.upY16 = make([]uint8, e.mbw)
+	e.upNz = make([][8]uint8, e.mbw)
+	e.info = make([]macroblockInfo, 0, e.mbw*e.mbh)
+
+	// Each macroblock row is written to partition mby % len(partitions).
+	// Partitions can't be larger than 16 MiB, so large images use more of
+	// them.
+	log2Partitions := 0
+	for log2Partitions < 3 && (e.mbw*e.mbh)>>(12+log2Partitions) > 0 {
+		log2Partitions++
+	}
+
+	e.partitions = make([]*boolEncoder, 1<<log2Partitions)
+	for i := range e.partitions {
+		e.partitions[i] = newBoolEncoder()
+	}
+
+	e.convertColors(img)
+
+	return e
+}
+
+// Converts the image to BT.601 YUV 4:2:0, which is what browsers expect
+// WebP images to be in.
+func (e *lossyEncoder) convertColors(img *image.NRGBA) {
+	bounds := img.Bounds()
+
+	pixel := func(x, y int) (int32, int32, int32) {
+		if x >= bounds.Dx() {
+			x = bounds.Dx() - 1
+		}
+		if y >= bounds.Dy() {
+			y = bounds.Dy() - 1
+		}
+		i := y*img.Stride + x*4
+		return int32(img.Pix[i]), int32(img.Pix[i+1]), int32(img.Pix[i+2])
+	}
+
+	for y := 0; y < e.mbh*16; y++ {
+		for x := 0; x < e.yStride; x++ {
+			r, g, b := pixel(x, y)
+			e.y[y*e.yStride+x] = clip8((16839*r + 33059*g + 6420*b + (16 << 16) + (1 << 15)) >> 16)
+		}
+	}
+
+	for y := 0; y < e.mbh*8; y++ {
+		for x := 0; x < e.uvStride; x++ {
+			var r, g, b int32
+			for j := 0; j < 2; j++ {
+				for i := 0; i < 2; i++ {
+					pr, pg, pb := pixel(2*x+i, 2*y+j)
+					r += pr
+					g += pg
+					b += pb
+				}
+			}
+			r = (r + 2) >> 2
+			g = (g + 2) >> 2
+			b = (b + 2) >> 2
+
+			e.u[y*e.uvStride+x] = clip8((-9719*r - 19081*g + 28800*b + (128 << 16) + (1 << 15)) >> 16)
+			e.v[y*e.uvStride+x] = clip8((28800*r - 24116*g - 4684*b + (128 << 16) + (1 << 15)) >> 16)
+		}
+	}
+}
+
+// Encodes a VP8 key frame. The result is the payload of a "VP8 " chunk.
+func encodeLossy(img *image.NRGBA, quality int) ([]byte, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() > 16383 || bounds.Dy() > 16383 {
+		return nil, errors.New("image is too large for a lossy WebP image")
+	}
+
+	e := newLossyEncoder(img, quality)
+
+	for mby := 0; mby < e.mbh; mby++ {
+		e.leftY16 = 0
+		e.leftNz = [8]uint8{}
+
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	firstPartition := e.writeFirstPartition()
+
+	if len(firstPartition) >= 1<<19 {
+		return nil, errors.New("image is too large for a lossy WebP image")
+	}
+
+	buf := make([]byte, 0, 10+len(firstPartition))
+
+	// The frame tag says that this is a key frame that is shown, followed by
+	// the length of the first partition.
+	tag := uint32(1<<4) | uint32(len(firstPartition))<<5
+	buf = append(buf, byte(tag), byte(tag>>8), byte(tag>>16))
+	buf = append(buf, 0x9d, 0x01, 0x2a)
+	buf = append(buf, byte(bounds.Dx()), byte(bounds.Dx()>>8), byte(bounds.Dy()), byte(bounds.Dy()>>8))
+	buf = append(buf, firstPartition...)
+
+	partitions := make([][]byte, len(e.partitions))
+	for i, p := range e.partitions {
+		partitions[i] = p.finish()
+	}
+
+	// The length of every partition but the last
+	for _, p := range partitions[:len(partitions)-1] {
+		buf = append(buf, byte(len(p)), byte(len(p)>>8), byte(len(p)>>16))
+	}
+
+	for _, p := range partitions {
+		buf = append(buf, p...)
+	}
+
+	return buf, nil
+}
+
+// Writes the frame header and the modes of every macroblock
+func (e *lossyEncoder) writeFirstPartition() []byte {
+	fp := newBoolEncoder()
+
+	// Color space and clamping type
+	fp.putBit(128, false)
+	fp.putBit(128, false)
+
+	// No segments
+	fp.putBit(128, false)
+
+	// A normal loop filter that gets stronger as the quantizer grows, with no
+	// sharpness and no adjustments
+	fp.putBit(128, false)
+	fp.putLiteral(uint32(e.qIndex/2), 6)
+	fp.putLiteral(0, 3)
+	fp.putBit(128, false)
+
+	log2Partitions := 0
+	for 1<<log2Partitions < len(e.partitions) {
+		log2Partitions++
+	}
+	fp.putLiteral(uint32(log2Partitions), 2)
+
+	// The quantizer index, with no deltas
+	fp.putLiteral(uint32(e.qIndex), 7)
+	for i := 0; i < 5; i++ {
+		fp.putBit(128, false)
+	}
+
+	// refresh_entropy_probs
+	fp.putBit(128, false)
+
+	// We don't update the token probabilities
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for l := range tokenProbUpdateProb[i][j][k] {
+					fp.putBit(tokenProbUpdateProb[i][j][k][l], false)
+				}
+			}
+		}
+	}
+
+	// Macroblocks without coefficients are marked as skipped
+	skipped := 0
+	for _, info := range e.info {
+		if info.skip {
+			skipped++
+		}
+	}
+
+	skipProb := uint8(0)
+	if skipped > 0 {
+		p := 255 * (len(e.info) - skipped) / len(e.info)
+		if p < 1 {
+			p = 1
+		} else if p > 254 {
+			p = 254
+		}
+		skipProb = uint8(p)
+
+		fp.putBit(128, true)
+		fp.putLiteral(uint32(skipProb), 8)
+	} else {
+		fp.putBit(128, false)
+	}
+
+	for _, info := range e.info {
+		if skipped > 0 {
+			fp.putBit(skipProb, info.skip)
+		}
+
+		// 16x16 luma prediction
+		fp.putBit(145, true)
+
+		switch info.yMode {
+		case predDC:
+			fp.putBit(156, false)
+			fp.putBit(163, false)
+		case predVE:
+			fp.putBit(156, false)
+			fp.putBit(163, true)
+		case predHE:
+			fp.putBit(156, true)
+			fp.putBit(128, false)
+		case predTM:
+			fp.putBit(156, true)
+			fp.putBit(128, true)
+		}
+
+		switch info.uvMode {
+		case predDC:
+			fp.putBit(142, false)
+		case predVE:
+			fp.putBit(142, true)
+			fp.putBit(114, false)
+		case predHE:
+			fp.putBit(142, true)
+			fp.putBit(114, true)
+			fp.putBit(183, false)
+		case predTM:
+			fp.putBit(142, true)
+			fp.putBit(114, true)
+			fp.putBit(183, true)
+		}
+	}
+
+	return fp.finish()
+}
+
+func (e *lossyEncoder) encodeMacroblock(mbx, mby int) {
+	var (
+		yLevels  [16][16]int32
+		y2Levels [16]int32
+		uvLevels [8][16]int32
+	)
+
+	info := macroblockInfo{}
+
+	// Luma
+	x0 := mbx * 16
+	y0 := mby * 16
+	pred := make([]int32, 256)
+	info.yMode = bestMode(e.y, e.ry, e.yStride, x0, y0, 16, mbx, mby, pred)
+	writePrediction(e.ry, e.yStride, x0, y0, 16, pred)
+
+	var dcs [16]int32
+	for n := 0; n < 16; n++ {
+		bx := x0 + (n%4)*4
+		by := y0 + (n/4)*4
+		coeffs := forwardDCT(residual(e.y, e.ry, e.yStride, bx, by))
+		dcs[n] = coeffs[0]
+
+		for i := 1; i < 16; i++ {
+			yLevels[n][i] = quantize(coeffs[i], e.quant.y1[1], false)
+		}
+	}
+
+	y2 := forwardWHT(dcs)
+	for i := 0; i < 16; i++ {
+		y2Levels[i] = quantize(y2[i], e.quant.y2[btoi(i > 0)], i == 0)
+	}
+
+	// Reconstruct the luma the way the decoder will
+	var dequantY2 [16]int32
+	for i := 0; i < 16; i++ {
+		dequantY2[i] = int32(int16(y2Levels[i] * e.quant.y2[btoi(i > 0)]))
+	}
+	dequantDCs := inverseWHT(dequantY2)
+
+	for n := 0; n < 16; n++ {
+		var coeffs [16]int32
+		coeffs[0] = dequantDCs[n]
+		for i := 1; i < 16; i++ {
+			coeffs[i] = int32(int16(yLevels[n][i] * e.quant.y1[1]))
+		}
+		inverseDCT(e.ry, e.yStride, x0+(n%4)*4, y0+(n/4)*4, &coeffs)
+	}
+
+	// Chroma. Both planes use the same mode.
+	x0 = mbx * 8
+	y0 = mby * 8
+	info.uvMode = bestChromaMode(e, x0, y0, mbx, mby)
+
+	for c, plane := range [2][2][]uint8{{e.u, e.ru}, {e.v, e.rv}} {
+		src, rec := plane[0], plane[1]
+		predictBlock(info.uvMode, rec, e.uvStride, x0, y0, 8, mbx, mby, pred[:64])
+		writePrediction(rec, e.uvStride, x0, y0, 8, pred[:64])
+
+		for n := 0; n < 4; n++ {
+			bx := x0 + (n%2)*4
+			by := y0 + (n/2)*4
+			coeffs := forwardDCT(residual(src, rec, e.uvStride, bx, by))
+			levels := &uvLevels[c*4+n]
+
+			var dequant [16]int32
+			for i := 0; i < 16; i++ {
+				levels[i] = quantize(coeffs[i], e.quant.uv[btoi(i > 0)], i == 0)
+				dequant[i] = int32(int16(levels[i] * e.quant.uv[btoi(i > 0)]))
+			}
+			inverseDCT(rec, e.uvStride, bx, by, &dequant)
+		}
+	}
+
+	info.skip = allZero(y2Levels[:])
+	for n := 0; n < 16 && info.skip; n++ {
+		info.skip = allZero(yLevels[n][:])
+	}
+	for n := 0; n < 8 && info.skip; n++ {
+		info.skip = allZero(uvLevels[n][:])
+	}
+
+	e.info = append(e.info, info)
+
+	if info.skip {
+		// The decoder resets the contexts of skipped macroblocks
+		e.leftY16 = 0
+		e.upY16[mbx] = 0
+		e.leftNz = [8]uint8{}
+		e.upNz[mbx] = [8]uint8{}
+		return
+	}
+
+	e.writeCoefficients(mbx, mby, &yLevels, &y2Levels, &uvLevels)
+}
+
+// Writes the coefficients of a macroblock in the order the decoder reads them
+func (e *lossyEncoder) writeCoefficients(mbx, mby int, yLevels *[16][16]int32, y2Levels *[16]int32, uvLevels *[8][16]int32) {
+	enc := e.partitions[mby%len(e.partitions)]
+	up := &e.upNz[mbx]
+	left := &e.leftNz
+
+	nz := putCoefficients(enc, planeY2, e.leftY16+e.upY16[mbx], y2Levels, 0)
+	e.leftY16 = nz
+	e.upY16[mbx] = nz
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			nz := putCoefficients(enc, planeY1WithY2, left[y]+up[x], &yLevels[y*4+x], 1)
+			left[y] = nz
+			up[x] = nz
+		}
+	}
+
+	for c := 0; c < 4; c += 2 {
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				nz := putCoefficients(enc, planeUV, left[4+y+c]+up[4+x+c], &uvLevels[c*2+y*2+x], 0)
+				left[4+y+c] = nz
+				up[4+x+c] = nz
+			}
+		}
+	}
+}
+
+// Writes the tokens of one 4x4 block, starting at the coefficient first.
+// Returns 1 if any coefficient was non-zero, which is the context of the
+// neighbouring blocks.
+func putCoefficients(enc *boolEncoder, plane int, context uint8, levels *[16]int32, first int) uint8 {
+	probs := &defaultTokenProb[plane]
+
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[zigzag[n]] != 0 {
+			last = n
+		}
+	}
+
+	p := probs[bands[first]][context]
+
+	if last < 0 {
+		enc.putBit(p[0], false)
+		return 0
+	}
+
+	enc.putBit(p[0], true)
+
+	for n := first; n < 16; {
+		v := levels[zigzag[n]]
+		n++
+
+		if v == 0 {
+			enc.putBit(p[1], false)
+			p = probs[bands[n]][0]
+			continue
+		}
+
+		enc.putBit(p[1], true)
+
+		abs := v
+		if abs < 0 {
+			abs = -abs
+		}
+
+		if abs == 1 {
+			enc.putBit(p[2], false)
+			p = probs[bands[n]][1]
+		} else {
+			enc.putBit(p[2], true)
+			putLargeValue(enc, &p, abs)
+			p = probs[bands[n]][2]
+		}
+
+		enc.putBit(128, v < 0)
+
+		if n == 16 {
+			break
+		}
+
+		// End of block
+		if n > last {
+			enc.putBit(p[0], false)
+			break
+		}
+
+		enc.putBit(p[0], true)
+	}
+
+	return 1
+}
+
+// Writes the token of a value larger than 1, and its extra bits
+func putLargeValue(enc *boolEncoder, p *[nProb]uint8, v int32) {
+	switch {
+	case v <= 4:
+		enc.putBit(p[3], false)
+		if v == 2 {
+			enc.putBit(p[4], false)
+		} else {
+			enc.putBit(p[4], true)
+			enc.putBit(p[5], v == 4)
+		}
+	case v <= 10:
+		enc.putBit(p[3], true)
+		enc.putBit(p[6], false)
+		if v <= 6 {
+			enc.putBit(p[7], false)
+			enc.putBit(159, v == 6)
+		} else {
+			enc.putBit(p[7], true)
+			enc.putBit(165, (v-7)&2 != 0)
+			enc.putBit(145, (v-7)&1 != 0)
+		}
+	default:
+		enc.putBit(p[3], true)
+		enc.putBit(p[6], true)
+
+		cat := 3
+		for cat > 0 && v < 3+(8<<cat) {
+			cat--
+		}
+
+		enc.putBit(p[8], cat >= 2)
+		enc.putBit(p[9+cat>>1], cat&1 != 0)
+
+		tab := &cat3456[cat]
+		nBits := 0
+		for tab[nBits] != 0 {
+			nBits++
+		}
+
+		extra := v - int32(3+(8<<cat))
+		for i := 0; i < nBits; i++ {
+			enc.putBit(tab[i], extra&(1<<(nBits-1-i)) != 0)
+		}
+	}
+}
+
+// Finds the prediction mode with the smallest squared error. The prediction of
+// that mode is left in pred.
+func bestMode(src, rec []uint8, stride, x0, y0, size, mbx, mby int, pred []int32) uint8 {
+	best := uint8(predDC)
+	bestScore := int64(-1)
+	candidate := make([]int32, len(pred))
+
+	for mode := uint8(0); mode < nMacroblockModes; mode++ {
+		predictBlock(mode, rec, stride, x0, y0, size, mbx, mby, candidate)
+		score := squaredError(src, stride, x0, y0, size, candidate)
+
+		if bestScore < 0 || score < bestScore {
+			best = mode
+			bestScore = score
+			copy(pred, candidate)
+		}
+	}
+
+	return best
+}
+
+func bestChromaMode(e *lossyEncoder, x0, y0, mbx, mby int) uint8 {
+	best := uint8(predDC)
+	bestScore := int64(-1)
+	candidate := make([]int32, 64)
+
+	for mode := uint8(0); mode < nMacroblockModes; mode++ {
+		predictBlock(mode, e.ru, e.uvStride, x0, y0, 8, mbx, mby, candidate)
+		score := squaredError(e.u, e.uvStride, x0, y0, 8, candidate)
+		predictBlock(mode, e.rv, e.uvStride, x0, y0, 8, mbx, mby, candidate)
+		score += squaredError(e.v, e.uvStride, x0, y0, 8, candidate)
+
+		if bestScore < 0 || score < bestScore {
+			best = mode
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+func squaredError(src []uint8, stride, x0, y0, size int, pred []int32) int64 {
+	var sum int64
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			d := int64(src[(y0+j)*stride+x0+i]) - int64(pred[j*size+i])
+			sum += d * d
+		}
+	}
+	return sum
+}
+
+// Predicts a block from the reconstructed pixels above and left of it. Blocks
+// on the top or left edge of the image use the same made up edges as the
+// decoder.
+func predictBlock(mode uint8, rec []uint8, stride, x0, y0, size, mbx, mby int, pred []int32) {
+	top := make([]int32, size)
+	left := make([]int32, size)
+	corner := int32(0x7f)
+
+	for i := 0; i < size; i++ {
+		if mby == 0 {
+			top[i] = 0x7f
+		} else {
+			top[i] = int32(rec[(y0-1)*stride+x0+i])
+		}
+
+		if mbx == 0 {
+			left[i] = 0x81
+		} else {
+			left[i] = int32(rec[(y0+i)*stride+x0-1])
+		}
+	}
+
+	if mby > 0 {
+		if mbx == 0 {
+			corner = 0x81
+		} else {
+			corner = int32(rec[(y0-1)*stride+x0-1])
+		}
+	}
+
+	shift := 3
+	if size == 16 {
+		shift = 4
+	}
+
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			var v int32
+
+			switch mode {
+			case predDC:
+				v = predictDC(top, left, size, shift, mbx, mby)
+			case predTM:
+				v = int32(clip8(left[j] + top[i] - corner))
+			case predVE:
+				v = top[i]
+			case predHE:
+				v = left[j]
+			}
+
+			pred[j*size+i] = v
+		}
+	}
+}
+
+func predictDC(top, left []int32, size, shift, mbx, mby int) int32 {
+	var sum int32
+
+	switch {
+	case mbx > 0 && mby > 0:
+		for i := 0; i < size; i++ {
+			sum += top[i] + left[i]
+		}
+		return (sum + int32(size)) >> (shift + 1)
+	case mby > 0:
+		for i := 0; i < size; i++ {
+			sum += top[i]
+		}
+		return (sum + int32(size/2)) >> shift
+	case mbx > 0:
+		for i := 0; i < size; i++ {
+			sum += left[i]
+		}
+		return (sum + int32(size/2)) >> shift
+	default:
+		return 0x80
+	}
+}
+
+func writePrediction(rec []uint8, stride, x0, y0, size int, pred []int32) {
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			rec[(y0+j)*stride+x0+i] = uint8(pred[j*size+i])
+		}
+	}
+}
+
+// Returns the difference between the source and the prediction of a 4x4
+// block. The prediction has already been written to rec.
+func residual(src, rec []uint8, stride, x0, y0 int) [16]int32 {
+	var r [16]int32
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			k := (y0+j)*stride + x0 + i
+			r[j*4+i] = int32(src[k]) - int32(rec[k])
+		}
+	}
+	return r
+}
+
+// Quantizes a coefficient. AC coefficients are rounded towards zero a little
+// more, which saves more bits than it costs in quality.
+func quantize(c int32, q int32, isDC bool) int32 {
+	bias := q / 2
+	if !isDC {
+		bias = q * 3 / 8
+	}
+
+	abs := c
+	if abs < 0 {
+		abs = -abs
+	}
+
+	level := (abs + bias) / q
+	if level > maxLevel {
+		level = maxLevel
+	}
+
+	if c < 0 {
+		return -level
+	}
+	return level
+}
+
+func allZero(levels []int32) bool {
+	for _, l := range levels {
+		if l != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func clip8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
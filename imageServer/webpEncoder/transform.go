@@ -0,0 +1,135 @@
+package webpEncoder
+
+// The forward transforms only need to be close to the inverse of the decoder's
+// transforms. The inverse transforms have to match the decoder exactly, since
+// later blocks are predicted from what they reconstruct.
+
+// Transforms the residual of a 4x4 block. The coefficients are in raster
+// order, with the vertical frequency in the rows.
+func forwardDCT(in [16]int32) [16]int32 {
+	var tmp, out [16]int32
+
+	for j := 0; j < 4; j++ {
+		a := (in[j*4+0] + in[j*4+3]) * 8
+		b := (in[j*4+1] + in[j*4+2]) * 8
+		c := (in[j*4+1] - in[j*4+2]) * 8
+		d := (in[j*4+0] - in[j*4+3]) * 8
+
+		tmp[j*4+0] = a + b
+		tmp[j*4+2] = a - b
+		tmp[j*4+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[j*4+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217+d*5352+12000)>>16 + int32(btoi(d != 0))
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+
+	return out
+}
+
+// Transforms the DC coefficients of the 16 luma blocks of a macroblock
+func forwardWHT(in [16]int32) [16]int32 {
+	var tmp, out [16]int32
+
+	for j := 0; j < 4; j++ {
+		a := (in[j*4+0] + in[j*4+2]) * 4
+		d := (in[j*4+1] + in[j*4+3]) * 4
+		c := (in[j*4+1] - in[j*4+3]) * 4
+		b := (in[j*4+0] - in[j*4+2]) * 4
+
+		tmp[j*4+0] = a + d + int32(btoi(a != 0))
+		tmp[j*4+1] = b + c
+		tmp[j*4+2] = b - c
+		tmp[j*4+3] = a - d
+	}
+
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[8+i]
+		d := tmp[4+i] + tmp[12+i]
+		c := tmp[4+i] - tmp[12+i]
+		b := tmp[i] - tmp[8+i]
+
+		values := [4]int32{a + d, b + c, b - c, a - d}
+		for k, v := range values {
+			if v < 0 {
+				v++
+			}
+			out[k*4+i] = (v + 3) >> 3
+		}
+	}
+
+	return out
+}
+
+// Returns the DC coefficients of the 16 luma blocks
+func inverseWHT(in [16]int32) [16]int32 {
+	var m, out [16]int32
+
+	for i := 0; i < 4; i++ {
+		a0 := in[0+i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[0+i] - in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[i*4+0] = int32(int16((a0 + a1) >> 3))
+		out[i*4+1] = int32(int16((a3 + a2) >> 3))
+		out[i*4+2] = int32(int16((a0 - a1) >> 3))
+		out[i*4+3] = int32(int16((a3 - a2) >> 3))
+	}
+
+	return out
+}
+
+// Adds the inverse transform of a 4x4 block to the prediction in rec
+func inverseDCT(rec []uint8, stride, x0, y0 int, coeffs *[16]int32) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := coeffs[i] + coeffs[8+i]
+		b := coeffs[i] - coeffs[8+i]
+		c := (coeffs[4+i]*c2)>>16 - (coeffs[12+i]*c1)>>16
+		d := (coeffs[4+i]*c1)>>16 + (coeffs[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+
+		k := (y0+j)*stride + x0
+		rec[k+0] = clip8(int32(rec[k+0]) + (a+d)>>3)
+		rec[k+1] = clip8(int32(rec[k+1]) + (b+c)>>3)
+		rec[k+2] = clip8(int32(rec[k+2]) + (b-c)>>3)
+		rec[k+3] = clip8(int32(rec[k+3]) + (a-d)>>3)
+	}
+}
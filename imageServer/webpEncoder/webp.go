@@ -0,0 +1,130 @@
+// Package webpEncoder encodes images as WebP files. golang.org/x/image/webp
+// only decodes WebP files, so we implement the encoder here. Lossy images are
+// VP8 key frames with 16x16 intra prediction and the default token
+// probabilities, and lossless images are VP8L images with the subtract green
+// and predictor transforms. Neither is as small as what libwebp makes, but
+// both are valid WebP files that browsers can display.
+//
+// The specifications are at https://developers.google.com/speed/webp/docs/riff_container
+// and https://datatracker.ietf.org/doc/html/rfc6386
+package webpEncoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+const DEFAULT_QUALITY = 75
+
+type Options struct {
+	// Lossless images keep every pixel exactly. Quality is ignored for them.
+	Lossless bool
+
+	// The quality of lossy images, from 1 to 100. Values outside of this range
+	// use DEFAULT_QUALITY.
+	Quality int
+}
+
+// Writes img to w as a WebP file
+func Encode(w io.Writer, img image.Image, opts *Options) error {
+	if opts == nil {
+		opts = &Options{Quality: DEFAULT_QUALITY}
+	}
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return errors.New("can't encode an empty image")
+	}
+
+	nrgba := toNRGBA(img)
+
+	var chunks []byte
+
+	if opts.Lossless {
+		data, err := encodeLossless(nrgba)
+		if err != nil {
+			return err
+		}
+
+		chunks = appendChunk(chunks, "VP8L", data)
+	} else {
+		quality := opts.Quality
+		if quality < 1 || quality > 100 {
+			quality = DEFAULT_QUALITY
+		}
+
+		data, err := encodeLossy(nrgba, quality)
+		if err != nil {
+			return err
+		}
+
+		// VP8 has no alpha channel, so transparent images save their alpha
+		// in a separate chunk, which needs the extended format
+		if !nrgba.Opaque() {
+			chunks = appendChunk(chunks, "VP8X", extendedHeader(bounds.Dx(), bounds.Dy()))
+			chunks = appendChunk(chunks, "ALPH", encodeAlpha(nrgba))
+		}
+
+		chunks = appendChunk(chunks, "VP8 ", data)
+	}
+
+	header := make([]byte, 12)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+len(chunks)))
+	copy(header[8:12], "WEBP")
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(chunks)
+
+	return err
+}
+
+// Chunks are padded to an even length
+func appendChunk(buf []byte, fourCC string, data []byte) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+
+	buf = append(buf, fourCC...)
+	buf = append(buf, size[:]...)
+	buf = append(buf, data...)
+
+	if len(data)%2 == 1 {
+		buf = append(buf, 0)
+	}
+
+	return buf
+}
+
+// The VP8X chunk of an image with an alpha channel
+func extendedHeader(width, height int) []byte {
+	const alphaFlag = 1 << 4
+
+	data := make([]byte, 10)
+	data[0] = alphaFlag
+	data[4] = byte(width - 1)
+	data[5] = byte((width - 1) >> 8)
+	data[6] = byte((width - 1) >> 16)
+	data[7] = byte(height - 1)
+	data[8] = byte((height - 1) >> 8)
+	data[9] = byte((height - 1) >> 16)
+
+	return data
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	return nrgba
+}
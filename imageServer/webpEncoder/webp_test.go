@@ -0,0 +1,142 @@
+package webpEncoder
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// Makes an image with gradients, some noise and a block of repeated pixels
+func makeTestImage(width, height int, transparent bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	seed := uint32(1)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			seed = seed*1103515245 + 12345
+			noise := uint8(seed>>24) % 8
+
+			c := color.NRGBA{
+				R: uint8(x*255/width) + noise,
+				G: uint8(y*255/height) + noise,
+				B: uint8((x+y)*255/(width+height)) + noise,
+				A: 255,
+			}
+
+			if x > width/2 && y > height/2 {
+				c = color.NRGBA{R: 200, G: 40, B: 90, A: 255}
+			}
+
+			if transparent {
+				c.A = uint8(x * 255 / width)
+			}
+
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func encodeAndDecode(t *testing.T, img image.Image, opts *Options) (image.Image, int) {
+	buffer := new(bytes.Buffer)
+
+	if err := Encode(buffer, img, opts); err != nil {
+		t.Fatalf("Encode returned error '%v'", err)
+	}
+
+	size := buffer.Len()
+
+	decoded, err := webp.Decode(buffer)
+	if err != nil {
+		t.Fatalf("webp.Decode returned error '%v'", err)
+	}
+
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("bounds = '%v', Should be '%v'", decoded.Bounds(), img.Bounds())
+	}
+
+	return decoded, size
+}
+
+func TestEncodeLossless(t *testing.T) {
+	for _, transparent := range []bool{false, true} {
+		img := makeTestImage(77, 45, transparent)
+		decoded, _ := encodeAndDecode(t, img, &Options{Lossless: true})
+
+		for y := 0; y < 45; y++ {
+			for x := 0; x < 77; x++ {
+				got := color.NRGBAModel.Convert(decoded.At(x, y))
+				if got != img.At(x, y) {
+					t.Fatalf("pixel (%v, %v) = '%v', Should be '%v'", x, y, got, img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// Compares the luma of the decoded image with the luma that was encoded
+func lumaPSNR(img *image.NRGBA, decoded *image.YCbCr) float64 {
+	e := newLossyEncoder(img, DEFAULT_QUALITY)
+	bounds := img.Bounds()
+
+	var sum float64
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			d := float64(e.y[y*e.yStride+x]) - float64(decoded.Y[decoded.YOffset(x, y)])
+			sum += d * d
+		}
+	}
+
+	mse := sum / float64(bounds.Dx()*bounds.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(255*255/mse)
+}
+
+func TestEncodeLossy(t *testing.T) {
+	img := makeTestImage(300, 200, false)
+
+	high, highSize := encodeAndDecode(t, img, &Options{Quality: 95})
+	low, lowSize := encodeAndDecode(t, img, &Options{Quality: 10})
+
+	highPSNR := lumaPSNR(img, high.(*image.YCbCr))
+	lowPSNR := lumaPSNR(img, low.(*image.YCbCr))
+
+	if highPSNR < 35 {
+		t.Fatalf("highPSNR = '%v', Should be at least '35'", highPSNR)
+	}
+
+	if lowPSNR < 22 || lowPSNR >= highPSNR {
+		t.Fatalf("lowPSNR = '%v', Should be between '22' and '%v'", lowPSNR, highPSNR)
+	}
+
+	if lowSize >= highSize {
+		t.Fatalf("lowSize = '%v', Should be less than '%v'", lowSize, highSize)
+	}
+}
+
+func TestEncodeLossyAlpha(t *testing.T) {
+	img := makeTestImage(40, 30, true)
+	decoded, _ := encodeAndDecode(t, img, &Options{Quality: 80})
+
+	nycbcra, ok := decoded.(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("decoded image should have an alpha channel")
+	}
+
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			alpha := nycbcra.A[nycbcra.AOffset(x, y)]
+			if alpha != img.NRGBAAt(x, y).A {
+				t.Fatalf("alpha (%v, %v) = '%v', Should be '%v'", x, y, alpha, img.NRGBAAt(x, y).A)
+			}
+		}
+	}
+}
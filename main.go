@@ -2,20 +2,24 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/joho/godotenv"
 
 	"methompson.com/image-microservice/imageServer"
-	"methompson.com/image-microservice/imageServer/imageHandler"
 )
 
 func main() {
 	godotenv.Load()
 
-	imgFolderErr := imageHandler.CheckOrCreateImageFolder(imageHandler.GetImageRootPath())
+	// Any arguments run a maintenance command, e.g. "migrate", instead of
+	// starting the server.
+	if len(os.Args) > 1 {
+		if err := imageServer.RunCommand(os.Args[1:]); err != nil {
+			log.Fatal(err.Error())
+		}
 
-	if imgFolderErr != nil {
-		log.Fatal(imgFolderErr.Error())
+		return
 	}
 
 	imageServer.MakeAndStartServer()